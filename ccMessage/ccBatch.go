@@ -0,0 +1,289 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"bytes"
+	"encoding/json"
+	"iter"
+	"math"
+	"sort"
+	"time"
+
+	lp2 "github.com/influxdata/line-protocol/v2/lineprotocol"
+)
+
+// Kind of a field value stored in a Batch
+type batchValueKind uint8
+
+const (
+	batchFloat batchValueKind = iota
+	batchInt
+	batchUint
+	batchBool
+	batchString
+)
+
+// Batch stores many messages in a compact, columnar layout. Names, tag keys
+// and values, meta data and string field values are interned, so each
+// distinct string is stored only once. Timestamps and field values are kept
+// in separate columns.
+//
+// The zero value is an empty batch ready to use. A Batch is not safe for
+// concurrent use.
+type Batch struct {
+	strings []string          // interned strings
+	lookup  map[string]uint32 // index of interned strings
+
+	// one entry per message
+	names    []uint32    // index of name in strings
+	times    []time.Time // timestamps
+	tagEnd   []int       // end of the message's tags in tags
+	metaEnd  []int       // end of the message's meta data in meta
+	fieldEnd []int       // end of the message's fields in the field columns
+
+	tags        []uint32 // pairs of key and value index in strings
+	meta        []uint32 // pairs of key and value index in strings
+	fieldKeys   []uint32 // index of field key in strings
+	fieldKinds  []batchValueKind
+	fieldValues []uint64 // value bits, index in strings for string values
+
+	msg     ccMessage // message reused by All
+	tagSort []int     // buffer for sorting tags
+}
+
+// NewBatch creates a batch with space for size messages
+func NewBatch(size int) *Batch {
+	return &Batch{
+		lookup:   make(map[string]uint32),
+		names:    make([]uint32, 0, size),
+		times:    make([]time.Time, 0, size),
+		tagEnd:   make([]int, 0, size),
+		metaEnd:  make([]int, 0, size),
+		fieldEnd: make([]int, 0, size),
+	}
+}
+
+// intern returns the index of s in the string table, adding it if required
+func (b *Batch) intern(s string) uint32 {
+	if idx, ok := b.lookup[s]; ok {
+		return idx
+	}
+	if b.lookup == nil {
+		b.lookup = make(map[string]uint32)
+	}
+	idx := uint32(len(b.strings))
+	b.strings = append(b.strings, s)
+	b.lookup[s] = idx
+	return idx
+}
+
+// Add appends a copy of the message to the batch. Fields with unsupported
+// value types are skipped.
+func (b *Batch) Add(m CCMessageView) {
+	b.names = append(b.names, b.intern(m.Name()))
+	b.times = append(b.times, m.Time())
+	for k, v := range m.AllTags() {
+		b.tags = append(b.tags, b.intern(k), b.intern(v))
+	}
+	b.tagEnd = append(b.tagEnd, len(b.tags))
+	for k, v := range m.AllMeta() {
+		b.meta = append(b.meta, b.intern(k), b.intern(v))
+	}
+	b.metaEnd = append(b.metaEnd, len(b.meta))
+	for k, v := range m.AllFields() {
+		var kind batchValueKind
+		var bits uint64
+		switch value := convertField(v).(type) {
+		case float64:
+			kind, bits = batchFloat, math.Float64bits(value)
+		case int64:
+			kind, bits = batchInt, uint64(value)
+		case uint64:
+			kind, bits = batchUint, value
+		case bool:
+			kind = batchBool
+			if value {
+				bits = 1
+			}
+		case string:
+			kind, bits = batchString, uint64(b.intern(value))
+		default:
+			continue
+		}
+		b.fieldKeys = append(b.fieldKeys, b.intern(k))
+		b.fieldKinds = append(b.fieldKinds, kind)
+		b.fieldValues = append(b.fieldValues, bits)
+	}
+	b.fieldEnd = append(b.fieldEnd, len(b.fieldKeys))
+}
+
+// Len returns the number of messages in the batch
+func (b *Batch) Len() int {
+	return len(b.names)
+}
+
+// Reset removes all messages from the batch but keeps the allocated memory
+// and the interned strings
+func (b *Batch) Reset() {
+	b.names = b.names[:0]
+	b.times = b.times[:0]
+	b.tagEnd = b.tagEnd[:0]
+	b.metaEnd = b.metaEnd[:0]
+	b.fieldEnd = b.fieldEnd[:0]
+	b.tags = b.tags[:0]
+	b.meta = b.meta[:0]
+	b.fieldKeys = b.fieldKeys[:0]
+	b.fieldKinds = b.fieldKinds[:0]
+	b.fieldValues = b.fieldValues[:0]
+	// Drop the string table if it grew large, e.g. due to changing tag values
+	if len(b.strings) > 4*cap(b.names)+1024 {
+		b.strings = b.strings[:0]
+		clear(b.lookup)
+	}
+}
+
+// span returns the start and end of message i in a column with end offsets
+func span(ends []int, i int) (int, int) {
+	if i == 0 {
+		return 0, ends[0]
+	}
+	return ends[i-1], ends[i]
+}
+
+// value returns the j-th field value
+func (b *Batch) value(j int) interface{} {
+	bits := b.fieldValues[j]
+	switch b.fieldKinds[j] {
+	case batchInt:
+		return int64(bits)
+	case batchUint:
+		return bits
+	case batchBool:
+		return bits != 0
+	case batchString:
+		return b.strings[bits]
+	}
+	return math.Float64frombits(bits)
+}
+
+// fill sets m to message i of the batch
+func (b *Batch) fill(m *ccMessage, i int) {
+	m.name = b.strings[b.names[i]]
+	m.tm = b.times[i]
+	start, end := span(b.tagEnd, i)
+	for j := start; j < end; j += 2 {
+		m.tags.m[b.strings[b.tags[j]]] = b.strings[b.tags[j+1]]
+	}
+	start, end = span(b.metaEnd, i)
+	for j := start; j < end; j += 2 {
+		m.meta.m[b.strings[b.meta[j]]] = b.strings[b.meta[j+1]]
+	}
+	start, end = span(b.fieldEnd, i)
+	for j := start; j < end; j++ {
+		m.fields.m[b.strings[b.fieldKeys[j]]] = b.value(j)
+	}
+}
+
+// Message returns a copy of message i of the batch
+func (b *Batch) Message(i int) CCMessage {
+	m := acquire()
+	b.fill(m, i)
+	return m
+}
+
+// All returns an iterator over the messages in the batch. The yielded
+// message is reused and only valid until the next iteration, use Mutable()
+// to keep a copy.
+func (b *Batch) All() iter.Seq2[int, CCMessageView] {
+	return func(yield func(int, CCMessageView) bool) {
+		for i := range b.names {
+			b.msg.Reset()
+			b.fill(&b.msg, i)
+			if !yield(i, readOnlyMessage{&b.msg}) {
+				return
+			}
+		}
+	}
+}
+
+// EncodeLineProtocol encodes all messages in the batch with the line
+// protocol encoder e. Like for the sinks, only tags are encoded, meta data
+// is skipped. Lines that cannot be encoded are skipped by the encoder and
+// the first error is returned.
+func (b *Batch) EncodeLineProtocol(e *lp2.Encoder) error {
+	for i := range b.names {
+		e.StartLine(b.strings[b.names[i]])
+
+		// Tags must be in lexical order
+		start, end := span(b.tagEnd, i)
+		b.tagSort = b.tagSort[:0]
+		for j := start; j < end; j += 2 {
+			b.tagSort = append(b.tagSort, j)
+		}
+		sort.Slice(b.tagSort, func(x, y int) bool {
+			return b.strings[b.tags[b.tagSort[x]]] < b.strings[b.tags[b.tagSort[y]]]
+		})
+		for _, j := range b.tagSort {
+			e.AddTag(b.strings[b.tags[j]], b.strings[b.tags[j+1]])
+		}
+
+		start, end = span(b.fieldEnd, i)
+		for j := start; j < end; j++ {
+			var value lp2.Value
+			ok := true
+			bits := b.fieldValues[j]
+			switch b.fieldKinds[j] {
+			case batchFloat:
+				value, ok = lp2.FloatValue(math.Float64frombits(bits))
+			case batchInt:
+				value = lp2.IntValue(int64(bits))
+			case batchUint:
+				value = lp2.UintValue(bits)
+			case batchBool:
+				value = lp2.BoolValue(bits != 0)
+			case batchString:
+				value, ok = lp2.StringValue(b.strings[bits])
+			}
+			if ok {
+				e.AddField(b.strings[b.fieldKeys[j]], value)
+			}
+		}
+		e.EndLine(b.times[i])
+	}
+	return e.Err()
+}
+
+// ToLineProtocol encodes all messages in the batch as line protocol with
+// nanosecond timestamps
+func (b *Batch) ToLineProtocol() ([]byte, error) {
+	var e lp2.Encoder
+	e.SetPrecision(lp2.Nanosecond)
+	err := b.EncodeLineProtocol(&e)
+	return e.Bytes(), err
+}
+
+// ToJSON encodes all messages in the batch as JSON array of the versioned
+// JSON envelope (see CCMessage.ToJSON)
+func (b *Batch) ToJSON() (json.RawMessage, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	m := acquire()
+	defer Release(m)
+	for i := range b.names {
+		m.Reset()
+		b.fill(m, i)
+		data, err := m.ToJSON(nil)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,471 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"math"
+	"time"
+)
+
+// Binary wire format for CCMessages
+//
+// Each message is encoded as MessagePack array
+//
+//	[version, name, tags, meta, fields, timestamp]
+//
+// with tags and meta as maps of strings, fields as map of typed values
+// and the timestamp as MessagePack timestamp extension. A batch of messages
+// is the concatenation of the encoded messages.
+//
+// Field types are kept: int64 values use the signed integer formats, uint64
+// values always use the unsigned integer formats, float64 values always use
+// the float64 format.
+
+// Version of the binary encoding written by ToBinary
+const CCMSG_BINARY_VERSION = 1
+
+const ccMessageBinaryElements = 6
+
+// MessagePack format bytes
+const (
+	mpNil      = 0xc0
+	mpFalse    = 0xc2
+	mpTrue     = 0xc3
+	mpBin8     = 0xc4
+	mpBin16    = 0xc5
+	mpBin32    = 0xc6
+	mpExt8     = 0xc7
+	mpFloat32  = 0xca
+	mpFloat64  = 0xcb
+	mpUint8    = 0xcc
+	mpUint16   = 0xcd
+	mpUint32   = 0xce
+	mpUint64   = 0xcf
+	mpInt8     = 0xd0
+	mpInt16    = 0xd1
+	mpInt32    = 0xd2
+	mpInt64    = 0xd3
+	mpFixExt4  = 0xd6
+	mpFixExt8  = 0xd7
+	mpStr8     = 0xd9
+	mpStr16    = 0xda
+	mpStr32    = 0xdb
+	mpArray16  = 0xdc
+	mpArray32  = 0xdd
+	mpMap16    = 0xde
+	mpMap32    = 0xdf
+	mpExtTime  = 0xff // extension type -1
+	mpFixMap   = 0x80
+	mpFixArray = 0x90
+	mpFixStr   = 0xa0
+)
+
+// AppendBinary appends the binary encoding of the message to dst
+func AppendBinary(dst []byte, m CCMessageView) ([]byte, error) {
+	dst = mpAppendArrayHeader(dst, ccMessageBinaryElements)
+	dst = mpAppendInt(dst, CCMSG_BINARY_VERSION)
+	dst = mpAppendString(dst, m.Name())
+
+	for _, list := range []iter.Seq2[string, string]{m.AllTags(), m.AllMeta()} {
+		dst = mpAppendMapHeader(dst, seqLen(list))
+		for k, v := range list {
+			dst = mpAppendString(dst, k)
+			dst = mpAppendString(dst, v)
+		}
+	}
+
+	fields := m.AllFields()
+	dst = mpAppendMapHeader(dst, seqLen(fields))
+	for k, v := range fields {
+		dst = mpAppendString(dst, k)
+		switch value := convertField(v).(type) {
+		case float64:
+			dst = append(dst, mpFloat64)
+			dst = binary.BigEndian.AppendUint64(dst, math.Float64bits(value))
+		case int64:
+			dst = mpAppendInt(dst, value)
+		case uint64:
+			dst = mpAppendUint(dst, value)
+		case string:
+			dst = mpAppendString(dst, value)
+		case bool:
+			if value {
+				dst = append(dst, mpTrue)
+			} else {
+				dst = append(dst, mpFalse)
+			}
+		default:
+			return nil, fmt.Errorf("CCMessage: Failed to encode field value for key %s", k)
+		}
+	}
+
+	return mpAppendTime(dst, m.Time()), nil
+}
+
+// seqLen returns the number of elements of a map iterator
+func seqLen[V any](seq iter.Seq2[string, V]) int {
+	n := 0
+	for range seq {
+		n++
+	}
+	return n
+}
+
+// ToBinary generates the binary encoding of the message
+func (m *ccMessage) ToBinary() ([]byte, error) {
+	return AppendBinary(nil, m)
+}
+
+// FromBinary decodes one or more binary encoded messages
+func FromBinary(data []byte) ([]CCMessage, error) {
+	out := make([]CCMessage, 0)
+	d := mpDecoder{buf: data}
+	for d.pos < len(d.buf) {
+		m, err := d.message()
+		if err != nil {
+			err = fmt.Errorf("ccmessage: Failed to decode binary message %d: %v", len(out), err.Error())
+			// Return the already decoded messages to the message pool
+			for _, m := range out {
+				Release(m)
+			}
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func mpAppendArrayHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, mpFixArray|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, mpArray16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, mpArray32), uint32(n))
+}
+
+func mpAppendMapHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, mpFixMap|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, mpMap16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, mpMap32), uint32(n))
+}
+
+func mpAppendString(dst []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		dst = append(dst, mpFixStr|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, mpStr8, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, mpStr16), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, mpStr32), uint32(n))
+	}
+	return append(dst, s...)
+}
+
+func mpAppendInt(dst []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= math.MaxInt8:
+		return append(dst, byte(v))
+	case v < 0 && v >= -32:
+		return append(dst, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return append(dst, mpInt8, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(dst, mpInt16), uint16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(dst, mpInt32), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, mpInt64), uint64(v))
+}
+
+func mpAppendUint(dst []byte, v uint64) []byte {
+	switch {
+	case v <= math.MaxUint8:
+		return append(dst, mpUint8, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, mpUint16), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, mpUint32), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, mpUint64), v)
+}
+
+// mpAppendTime appends t using the MessagePack timestamp extension
+func mpAppendTime(dst []byte, t time.Time) []byte {
+	sec := t.Unix()
+	nsec := uint32(t.Nanosecond())
+	if sec >= 0 && sec < 1<<34 {
+		// timestamp 64: 30 bit nanoseconds, 34 bit seconds
+		dst = append(dst, mpFixExt8, mpExtTime)
+		return binary.BigEndian.AppendUint64(dst, uint64(nsec)<<34|uint64(sec))
+	}
+	// timestamp 96: 32 bit nanoseconds, 64 bit seconds
+	dst = append(dst, mpExt8, 12, mpExtTime)
+	dst = binary.BigEndian.AppendUint32(dst, nsec)
+	return binary.BigEndian.AppendUint64(dst, uint64(sec))
+}
+
+var errBinaryShort = errors.New("unexpected end of data")
+
+type mpDecoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *mpDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errBinaryShort
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *mpDecoder) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *mpDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *mpDecoder) length(fix, fixMask byte, formats [3]byte) (int, error) {
+	c, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch {
+	case c&^fixMask == fix:
+		n = uint64(c & fixMask)
+	case c == formats[0] && formats[0] != 0:
+		n, err = d.uint(1)
+	case c == formats[1]:
+		n, err = d.uint(2)
+	case c == formats[2]:
+		n, err = d.uint(4)
+	default:
+		return 0, fmt.Errorf("unexpected format 0x%02x at offset %d", c, d.pos-1)
+	}
+	return int(n), err
+}
+
+func (d *mpDecoder) arrayHeader() (int, error) {
+	return d.length(mpFixArray, 0x0f, [3]byte{0, mpArray16, mpArray32})
+}
+
+func (d *mpDecoder) mapHeader() (int, error) {
+	return d.length(mpFixMap, 0x0f, [3]byte{0, mpMap16, mpMap32})
+}
+
+func (d *mpDecoder) string() (string, error) {
+	n, err := d.length(mpFixStr, 0x1f, [3]byte{mpStr8, mpStr16, mpStr32})
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *mpDecoder) stringMap(out map[string]string) error {
+	n, err := d.mapHeader()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		k, err := d.string()
+		if err != nil {
+			return err
+		}
+		v, err := d.string()
+		if err != nil {
+			return err
+		}
+		out[k] = v
+	}
+	return nil
+}
+
+func (d *mpDecoder) value() (interface{}, error) {
+	c, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&^0x1f == mpFixStr:
+		b, err := d.next(int(c & 0x1f))
+		return string(b), err
+	}
+	switch c {
+	case mpNil:
+		return nil, nil
+	case mpFalse:
+		return false, nil
+	case mpTrue:
+		return true, nil
+	case mpFloat32:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case mpFloat64:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case mpUint8, mpUint16, mpUint32, mpUint64:
+		return d.uint(1 << (c - mpUint8))
+	case mpInt8:
+		v, err := d.uint(1)
+		return int64(int8(v)), err
+	case mpInt16:
+		v, err := d.uint(2)
+		return int64(int16(v)), err
+	case mpInt32:
+		v, err := d.uint(4)
+		return int64(int32(v)), err
+	case mpInt64:
+		v, err := d.uint(8)
+		return int64(v), err
+	case mpStr8, mpStr16, mpStr32, mpBin8, mpBin16, mpBin32:
+		var n uint64
+		switch c {
+		case mpStr8, mpBin8:
+			n, err = d.uint(1)
+		case mpStr16, mpBin16:
+			n, err = d.uint(2)
+		default:
+			n, err = d.uint(4)
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		return string(b), err
+	}
+	return nil, fmt.Errorf("unsupported format 0x%02x at offset %d", c, d.pos-1)
+}
+
+func (d *mpDecoder) time() (time.Time, error) {
+	c, err := d.byte()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var size uint64
+	switch c {
+	case mpFixExt4:
+		size = 4
+	case mpFixExt8:
+		size = 8
+	case mpExt8:
+		if size, err = d.uint(1); err != nil {
+			return time.Time{}, err
+		}
+	default:
+		return time.Time{}, fmt.Errorf("unexpected format 0x%02x for timestamp at offset %d", c, d.pos-1)
+	}
+	if t, err := d.byte(); err != nil || t != mpExtTime {
+		return time.Time{}, errors.New("invalid timestamp extension")
+	}
+	switch size {
+	case 4:
+		sec, err := d.uint(4)
+		return time.Unix(int64(sec), 0), err
+	case 8:
+		v, err := d.uint(8)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), err
+	case 12:
+		nsec, err := d.uint(4)
+		if err != nil {
+			return time.Time{}, err
+		}
+		sec, err := d.uint(8)
+		return time.Unix(int64(sec), int64(nsec)), err
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp size %d", size)
+}
+
+func (d *mpDecoder) message() (CCMessage, error) {
+	n, err := d.arrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n != ccMessageBinaryElements {
+		return nil, fmt.Errorf("expected %d elements, got %d", ccMessageBinaryElements, n)
+	}
+	version, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := version.(int64); !ok || v != CCMSG_BINARY_VERSION {
+		return nil, fmt.Errorf("unsupported version %v", version)
+	}
+	m := acquire()
+	if err := d.messageBody(m); err != nil {
+		Release(m)
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *mpDecoder) messageBody(m *ccMessage) error {
+	var err error
+	if m.name, err = d.string(); err != nil {
+		return err
+	}
+	if err = d.stringMap(m.tags.m); err != nil {
+		return err
+	}
+	if err = d.stringMap(m.meta.m); err != nil {
+		return err
+	}
+	n, err := d.mapHeader()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		k, err := d.string()
+		if err != nil {
+			return err
+		}
+		v, err := d.value()
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			m.fields.m[k] = v
+		}
+	}
+	m.tm, err = d.time()
+	return err
+}
@@ -5,10 +5,45 @@
 package ccmessage
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"time"
 )
 
+// Tags and fields used by control messages
+const (
+	CCMSG_CONTROL_METHOD_TAG     = "method"     // Method of the control message
+	CCMSG_CONTROL_REQUEST_ID_TAG = "request_id" // Correlation ID of request and reply
+	CCMSG_CONTROL_STATUS_TAG     = "status"     // Status of a reply
+	CCMSG_CONTROL_ERROR_FIELD    = "error"      // Error message of a failed request
+)
+
+// Methods of control messages
+const (
+	CCMSG_CONTROL_GET   = "GET"
+	CCMSG_CONTROL_PUT   = "PUT"
+	CCMSG_CONTROL_REPLY = "REPLY"
+)
+
+// Status of control replies
+const (
+	CCMSG_CONTROL_STATUS_OK    = "ok"
+	CCMSG_CONTROL_STATUS_ERROR = "error"
+)
+
+// NewControlRequestID returns a random ID to correlate control requests and replies
+func NewControlRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// NewGetControl creates a GET control request with a new request ID, unless
+// the tags already contain one
 func NewGetControl(name string,
 	tags map[string]string,
 	meta map[string]string,
@@ -16,11 +51,16 @@ func NewGetControl(name string,
 ) (CCMessage, error) {
 	m, err := NewMessage(name, tags, meta, map[string]interface{}{"control": ""}, tm)
 	if err == nil {
-		m.AddTag("method", "GET")
+		m.AddTag(CCMSG_CONTROL_METHOD_TAG, CCMSG_CONTROL_GET)
+		if !m.HasTag(CCMSG_CONTROL_REQUEST_ID_TAG) {
+			m.AddTag(CCMSG_CONTROL_REQUEST_ID_TAG, NewControlRequestID())
+		}
 	}
 	return m, err
 }
 
+// NewPutControl creates a PUT control request with a new request ID, unless
+// the tags already contain one
 func NewPutControl(name string,
 	tags map[string]string,
 	meta map[string]string,
@@ -29,15 +69,41 @@ func NewPutControl(name string,
 ) (CCMessage, error) {
 	m, err := NewMessage(name, tags, meta, map[string]interface{}{"control": value}, tm)
 	if err == nil {
-		m.AddTag("method", "PUT")
+		m.AddTag(CCMSG_CONTROL_METHOD_TAG, CCMSG_CONTROL_PUT)
+		if !m.HasTag(CCMSG_CONTROL_REQUEST_ID_TAG) {
+			m.AddTag(CCMSG_CONTROL_REQUEST_ID_TAG, NewControlRequestID())
+		}
 	}
 	return m, err
 }
 
+// NewControlReply creates the reply to the control request req. The reply
+// has the name, tags and request ID of the request. If err is nil, the
+// status is "ok" and the control field contains value, otherwise the status
+// is "error" and the error message is stored in the error field.
+func NewControlReply(req CCMessageView, value string, err error) (CCMessage, error) {
+	method, _ := req.GetTag(CCMSG_CONTROL_METHOD_TAG)
+	if req.MessageType() != CCMSG_TYPE_CONTROL || method == CCMSG_CONTROL_REPLY {
+		return nil, fmt.Errorf("cannot reply to message %s: not a control request", req.Name())
+	}
+	m := FromMessage(req)
+	m.SetTime(time.Now())
+	m.AddTag(CCMSG_CONTROL_METHOD_TAG, CCMSG_CONTROL_REPLY)
+	if err != nil {
+		m.AddTag(CCMSG_CONTROL_STATUS_TAG, CCMSG_CONTROL_STATUS_ERROR)
+		m.AddField("control", "")
+		m.AddField(CCMSG_CONTROL_ERROR_FIELD, err.Error())
+	} else {
+		m.AddTag(CCMSG_CONTROL_STATUS_TAG, CCMSG_CONTROL_STATUS_OK)
+		m.AddField("control", value)
+	}
+	return m, nil
+}
+
 func (m *ccMessage) IsControl() bool {
 	if v, ok := m.GetField("control"); ok {
-		if me, ok := m.GetTag("method"); ok {
-			if reflect.TypeOf(v) == reflect.TypeOf("string") && (me == "PUT" || me == "GET") {
+		if me, ok := m.GetTag(CCMSG_CONTROL_METHOD_TAG); ok {
+			if reflect.TypeOf(v) == reflect.TypeOf("string") && (me == CCMSG_CONTROL_PUT || me == CCMSG_CONTROL_GET || me == CCMSG_CONTROL_REPLY) {
 				return true
 			}
 		}
@@ -60,9 +126,131 @@ func (m *ccMessage) GetControlValue() string {
 
 func (m *ccMessage) GetControlMethod() string {
 	if m.IsControl() {
-		if v, ok := m.GetTag("method"); ok {
+		if v, ok := m.GetTag(CCMSG_CONTROL_METHOD_TAG); ok {
 			return v
 		}
 	}
 	return ""
 }
+
+// IsControlReply checks whether the message is a reply to a control request
+func (m *ccMessage) IsControlReply() bool {
+	return m.GetControlMethod() == CCMSG_CONTROL_REPLY
+}
+
+// GetControlRequestID returns the request ID of a control message
+func (m *ccMessage) GetControlRequestID() string {
+	if m.IsControl() {
+		if v, ok := m.GetTag(CCMSG_CONTROL_REQUEST_ID_TAG); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// GetControlStatus returns the status of a control reply and the error
+// reported by the replying side for status "error"
+func (m *ccMessage) GetControlStatus() (string, error) {
+	if !m.IsControlReply() {
+		return "", nil
+	}
+	status, _ := m.GetTag(CCMSG_CONTROL_STATUS_TAG)
+	if status == CCMSG_CONTROL_STATUS_ERROR {
+		msg := "unknown error"
+		if v, ok := m.GetField(CCMSG_CONTROL_ERROR_FIELD); ok {
+			msg = fmt.Sprint(v)
+		}
+		return status, errors.New(msg)
+	}
+	return status, nil
+}
+
+// ErrControlTimeout is returned by ControlClient.Request if no reply
+// arrives in time
+var ErrControlTimeout = errors.New("timeout waiting for control reply")
+
+// ControlClient sends control requests into a message pipeline and matches
+// the replies by their request ID. The replies have to be passed to
+// HandleReply, e.g. by the receiver of the pipeline.
+type ControlClient struct {
+	output  chan CCMessage
+	lock    sync.Mutex
+	pending map[string]chan CCMessage
+}
+
+// NewControlClient creates a control client sending requests to output
+func NewControlClient(output chan CCMessage) *ControlClient {
+	return &ControlClient{
+		output:  output,
+		pending: make(map[string]chan CCMessage),
+	}
+}
+
+// Request sends the control request req and waits at most timeout for the
+// matching reply. A request ID is added to req if it has none. If the reply
+// reports an error, the reply and the error are returned.
+func (c *ControlClient) Request(req CCMessage, timeout time.Duration) (CCMessage, error) {
+	if req.MessageType() != CCMSG_TYPE_CONTROL {
+		return nil, fmt.Errorf("cannot send message %s: not a control request", req.Name())
+	}
+	id, ok := req.GetTag(CCMSG_CONTROL_REQUEST_ID_TAG)
+	if !ok {
+		id = NewControlRequestID()
+		req.AddTag(CCMSG_CONTROL_REQUEST_ID_TAG, id)
+	}
+
+	reply := make(chan CCMessage, 1)
+	c.lock.Lock()
+	if _, ok := c.pending[id]; ok {
+		c.lock.Unlock()
+		return nil, fmt.Errorf("control request %s already pending", id)
+	}
+	c.pending[id] = reply
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case c.output <- req:
+	case <-timer.C:
+		return nil, ErrControlTimeout
+	}
+
+	select {
+	case m := <-reply:
+		if _, err := m.GetControlStatus(); err != nil {
+			return m, err
+		}
+		return m, nil
+	case <-timer.C:
+		return nil, ErrControlTimeout
+	}
+}
+
+// HandleReply delivers m to the waiting Request call if it is the reply to
+// a pending request. It returns whether m was such a reply.
+func (c *ControlClient) HandleReply(m CCMessageView) bool {
+	if method, _ := m.GetTag(CCMSG_CONTROL_METHOD_TAG); method != CCMSG_CONTROL_REPLY {
+		return false
+	}
+	id, ok := m.GetTag(CCMSG_CONTROL_REQUEST_ID_TAG)
+	if !ok {
+		return false
+	}
+	c.lock.Lock()
+	reply, ok := c.pending[id]
+	if ok {
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+	if ok {
+		reply <- m.Mutable()
+	}
+	return ok
+}
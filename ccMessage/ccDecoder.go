@@ -0,0 +1,422 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	lp2 "github.com/influxdata/line-protocol/v2/lineprotocol"
+)
+
+// Precision of line protocol timestamps
+type Precision int
+
+const (
+	PRECISION_NANOSECOND Precision = iota
+	PRECISION_MICROSECOND
+	PRECISION_MILLISECOND
+	PRECISION_SECOND
+	PRECISION_AUTO // detect the precision from the number of digits
+)
+
+// ParsePrecision parses the precision names used by InfluxDB ("ns", "n",
+// "us", "u", "ms", "s") and "auto". An empty string selects nanoseconds.
+func ParsePrecision(precision string) (Precision, error) {
+	switch precision {
+	case "", "ns", "n":
+		return PRECISION_NANOSECOND, nil
+	case "us", "u", "µs":
+		return PRECISION_MICROSECOND, nil
+	case "ms":
+		return PRECISION_MILLISECOND, nil
+	case "s":
+		return PRECISION_SECOND, nil
+	case "auto":
+		return PRECISION_AUTO, nil
+	}
+	return PRECISION_NANOSECOND, fmt.Errorf("invalid precision '%s'", precision)
+}
+
+var lpPrecision = map[Precision]lp2.Precision{
+	PRECISION_NANOSECOND:  lp2.Nanosecond,
+	PRECISION_MICROSECOND: lp2.Microsecond,
+	PRECISION_MILLISECOND: lp2.Millisecond,
+	PRECISION_SECOND:      lp2.Second,
+}
+
+// detectPrecision guesses the precision of a timestamp from its number of
+// digits: up to 10 digits are seconds, up to 13 digits milliseconds, up to
+// 16 digits microseconds and everything longer nanoseconds
+func detectPrecision(timestamp []byte) lp2.Precision {
+	digits := len(timestamp)
+	if digits > 0 && timestamp[0] == '-' {
+		digits--
+	}
+	switch {
+	case digits <= 10:
+		return lp2.Second
+	case digits <= 13:
+		return lp2.Millisecond
+	case digits <= 16:
+		return lp2.Microsecond
+	}
+	return lp2.Nanosecond
+}
+
+// Maximal number of bad lines whose errors the Decoder keeps, see Errors
+const DECODER_MAX_ERRORS = 100
+
+// Maximal length in bytes of the offending line kept in a DecodeError
+const DECODER_MAX_ERROR_TEXT = 1024
+
+// DecodeError describes a line protocol line that could not be decoded
+type DecodeError struct {
+	Line   int64  // One-based number of the first input line
+	Column int    // One-based column (in bytes) of the error, 0 if unknown
+	Text   string // Offending line, truncated to DECODER_MAX_ERROR_TEXT bytes
+	Err    error  // Underlying error
+}
+
+// Error implements the error interface
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("line %d: %s: %q", e.Line, e.Err.Error(), e.Text)
+}
+
+// Unwrap returns the underlying error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Decoder decodes InfluxDB line protocol into CCMessages line by line.
+//
+// By default, lines that cannot be decoded are skipped and reported by
+// Errors() and ErrorCount(). In strict mode, decoding stops at the first bad line and the
+// error is returned by Err(). Empty lines and comments are ignored.
+//
+// Line protocol allows newlines in quoted string field values, like
+// multi-line logs. A line ends only at a newline outside of such a value,
+// so it may span several lines of the input.
+type Decoder struct {
+	reader  *bufio.Reader  // input if created with NewDecoder
+	data    []byte         // input if created with NewDecoderWithBytes
+	lineBuf []byte         // buffer for lines read from reader
+	line    int64          // number of the first input line of the current line
+	lines   int64          // number of input lines read so far
+	strict  bool           // stop at the first bad line
+	prec    Precision      // timestamp precision
+	msg     CCMessage      // last decoded message
+	err     error          // I/O error or first error in strict mode
+	errors  []*DecodeError // first DECODER_MAX_ERRORS bad lines
+	nerrors int64          // number of all bad lines
+}
+
+// NewDecoder returns a decoder reading line protocol from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// NewDecoderWithBytes returns a decoder for the line protocol in data
+func NewDecoderWithBytes(data []byte) *Decoder {
+	return &Decoder{
+		data: data,
+	}
+}
+
+// SetStrict selects whether decoding stops at the first bad line (strict)
+// or bad lines are skipped
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
+}
+
+// SetPrecision sets the precision of the timestamps (default nanoseconds)
+func (d *Decoder) SetPrecision(precision Precision) {
+	d.prec = precision
+}
+
+// Next decodes the next message and reports whether there is one available
+// through Message(). It returns false at the end of the input, on I/O errors
+// and in strict mode on the first bad line.
+func (d *Decoder) Next() bool {
+	d.msg = nil
+	if d.err != nil {
+		return false
+	}
+	for {
+		line, ok := d.readLine()
+		if !ok {
+			return false
+		}
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 || trimmed[0] == '#' {
+			continue
+		}
+		m, err := decodeLine(line, d.prec)
+		if err != nil {
+			d.nerrors++
+			if len(d.errors) >= DECODER_MAX_ERRORS {
+				continue
+			}
+			if len(line) > DECODER_MAX_ERROR_TEXT {
+				line = line[:DECODER_MAX_ERROR_TEXT]
+			}
+			e := &DecodeError{
+				Line: d.line,
+				Text: string(line),
+				Err:  err,
+			}
+			var lpErr *lp2.DecodeError
+			if errors.As(err, &lpErr) {
+				e.Column = lpErr.Column
+				e.Err = lpErr.Err
+			}
+			d.errors = append(d.errors, e)
+			if d.strict {
+				d.err = e
+				return false
+			}
+			continue
+		}
+		d.msg = m
+		return true
+	}
+}
+
+// Message returns the message decoded by the last call to Next()
+func (d *Decoder) Message() CCMessage {
+	return d.msg
+}
+
+// Err returns the I/O error or, in strict mode, the error of the first bad line
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Errors returns the errors of the first DECODER_MAX_ERRORS bad lines seen
+// so far. ErrorCount returns the number of all bad lines.
+func (d *Decoder) Errors() []*DecodeError {
+	return d.errors
+}
+
+// ErrorCount returns the number of all bad lines seen so far
+func (d *Decoder) ErrorCount() int64 {
+	return d.nerrors
+}
+
+// readLine returns the next line without line ending. Newlines in quoted
+// string field values do not end the line.
+func (d *Decoder) readLine() ([]byte, bool) {
+	var line []byte
+	var scanner lineScanner
+	if d.reader == nil {
+		if len(d.data) == 0 {
+			return nil, false
+		}
+		if i := scanner.scan(d.data); i >= 0 {
+			line, d.data = d.data[:i], d.data[i+1:]
+		} else {
+			line, d.data = d.data, nil
+		}
+	} else {
+		d.lineBuf = d.lineBuf[:0]
+		for {
+			chunk, err := d.reader.ReadSlice('\n')
+			d.lineBuf = append(d.lineBuf, chunk...)
+			if err == bufio.ErrBufferFull {
+				scanner.scan(chunk)
+				continue
+			}
+			if err != nil && err != io.EOF {
+				d.err = err
+				return nil, false
+			}
+			if err == io.EOF {
+				if len(d.lineBuf) == 0 {
+					return nil, false
+				}
+				break
+			}
+			// The chunk ends with a newline, which ends the line unless it
+			// is part of a quoted string
+			if scanner.scan(chunk) >= 0 {
+				break
+			}
+		}
+		line = bytes.TrimSuffix(d.lineBuf, []byte{'\n'})
+	}
+	d.line = d.lines + 1
+	d.lines += int64(bytes.Count(line, []byte{'\n'})) + 1
+	return bytes.TrimSuffix(line, []byte{'\r'}), true
+}
+
+// States of the lineScanner
+const (
+	scanStart      = iota // before the measurement
+	scanComment           // in a comment line
+	scanSeries            // in the measurement and tags
+	scanFieldKey          // in a field key
+	scanValueStart        // at the start of a field value
+	scanValue             // in a field value other than a string
+	scanString            // in a quoted string field value
+	scanTimestamp         // in the timestamp
+)
+
+// lineScanner finds the newline ending a line of line protocol. Newlines in
+// quoted string field values are part of the value. The scanner keeps its
+// state between calls, so a line can be scanned in chunks.
+type lineScanner struct {
+	state   int
+	escaped bool // the previous character was a backslash
+}
+
+// scan processes data and returns the index of the newline ending the line
+// or -1 if data does not contain it
+func (s *lineScanner) scan(data []byte) int {
+	for i, c := range data {
+		if s.state == scanString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case c == '\\':
+				s.escaped = true
+			case c == '"':
+				s.state = scanValue
+			}
+			continue
+		}
+		if c == '\n' {
+			return i
+		}
+		if s.escaped {
+			s.escaped = false
+			continue
+		}
+		switch s.state {
+		case scanStart:
+			switch c {
+			case ' ', '\t', '\r':
+			case '#':
+				s.state = scanComment
+			case '\\':
+				s.state = scanSeries
+				s.escaped = true
+			default:
+				s.state = scanSeries
+			}
+		case scanSeries:
+			switch c {
+			case '\\':
+				s.escaped = true
+			case ' ':
+				s.state = scanFieldKey
+			}
+		case scanFieldKey:
+			switch c {
+			case '\\':
+				s.escaped = true
+			case '=':
+				s.state = scanValueStart
+			}
+		case scanValueStart:
+			if c == '"' {
+				s.state = scanString
+				continue
+			}
+			s.state = scanValue
+			fallthrough
+		case scanValue:
+			switch c {
+			case ',':
+				s.state = scanFieldKey
+			case ' ':
+				s.state = scanTimestamp
+			}
+		}
+	}
+	return -1
+}
+
+// decodeLine decodes a single line of line protocol
+func decodeLine(line []byte, precision Precision) (CCMessage, error) {
+	decoder := lp2.NewDecoderWithBytes(line)
+	decoder.Next()
+
+	// Decode measurement name
+	measurement, err := decoder.Measurement()
+	if err != nil {
+		return nil, err
+	}
+	m := acquire()
+	m.name = string(measurement)
+	if err := decodeLineBody(decoder, m, precision); err != nil {
+		Release(m)
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodeLineBody decodes tags, fields and timestamp of a line into m
+func decodeLineBody(decoder *lp2.Decoder, m *ccMessage, precision Precision) error {
+	var err error
+
+	// Decode tags
+	for {
+		key, value, err := decoder.NextTag()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			break
+		}
+		m.tags.m[string(key)] = string(value)
+	}
+
+	// Decode fields
+	for {
+		key, value, err := decoder.NextField()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			break
+		}
+		m.fields.m[string(key)] = value.Interface()
+	}
+
+	// Decode time stamp
+	switch precision {
+	case PRECISION_AUTO:
+		timestamp, err := decoder.TimeBytes()
+		if err != nil {
+			return err
+		}
+		if timestamp == nil {
+			break
+		}
+		ts, err := strconv.ParseInt(string(timestamp), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q: %v", timestamp, err.Error())
+		}
+		scale := int64(detectPrecision(timestamp).Duration())
+		if ts > math.MaxInt64/scale || ts < math.MinInt64/scale {
+			return fmt.Errorf("timestamp %q out of range", timestamp)
+		}
+		m.tm = time.Unix(0, ts*scale)
+	default:
+		m.tm, err = decoder.Time(lpPrecision[precision], time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields of histogram messages
+const (
+	CCMSG_HISTOGRAM_COUNT_FIELD         = "hist_count"   // Total number of observations
+	CCMSG_HISTOGRAM_SUM_FIELD           = "hist_sum"     // Sum of all observations
+	CCMSG_HISTOGRAM_BUCKET_FIELD_PREFIX = "hist_bucket_" // Prefix of the bucket fields, followed by the upper bound
+)
+
+// Histogram is the distribution of observations carried by a histogram
+// message. Like in Prometheus, the bucket counts are cumulative: Counts[i]
+// is the number of observations less than or equal to Buckets[i]. The
+// bucket for +Inf is implicit, its count is Count.
+type Histogram struct {
+	Buckets []float64 // Upper bounds of the buckets in increasing order
+	Counts  []uint64  // Cumulative number of observations per bucket
+	Count   uint64    // Total number of observations
+	Sum     float64   // Sum of all observations
+}
+
+// Validate checks that buckets and counts match, the buckets are increasing
+// and the counts do not decrease
+func (h *Histogram) Validate() error {
+	if len(h.Buckets) != len(h.Counts) {
+		return fmt.Errorf("histogram has %d buckets but %d counts", len(h.Buckets), len(h.Counts))
+	}
+	for i, b := range h.Buckets {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("invalid histogram bucket bound %v", b)
+		}
+		if i > 0 && b <= h.Buckets[i-1] {
+			return fmt.Errorf("histogram buckets not in increasing order at %v", b)
+		}
+		if i > 0 && h.Counts[i] < h.Counts[i-1] {
+			return fmt.Errorf("histogram counts not cumulative at bucket %v", b)
+		}
+	}
+	if len(h.Counts) > 0 && h.Counts[len(h.Counts)-1] > h.Count {
+		return fmt.Errorf("histogram bucket count exceeds total count %d", h.Count)
+	}
+	return nil
+}
+
+// histogramBucketField returns the field name of the bucket with upper bound b
+func histogramBucketField(b float64) string {
+	return CCMSG_HISTOGRAM_BUCKET_FIELD_PREFIX + strconv.FormatFloat(b, 'g', -1, 64)
+}
+
+// NewHistogram creates a histogram message. Count and sum are stored in the
+// fields hist_count and hist_sum, the cumulative bucket counts in the fields
+// hist_bucket_<upper bound>.
+func NewHistogram(name string,
+	tags map[string]string,
+	meta map[string]string,
+	hist Histogram,
+	tm time.Time,
+) (CCMessage, error) {
+	if err := hist.Validate(); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{}, len(hist.Buckets)+2)
+	fields[CCMSG_HISTOGRAM_COUNT_FIELD] = hist.Count
+	fields[CCMSG_HISTOGRAM_SUM_FIELD] = hist.Sum
+	for i, b := range hist.Buckets {
+		fields[histogramBucketField(b)] = hist.Counts[i]
+	}
+	return NewMessage(name, tags, meta, fields, tm)
+}
+
+// IsHistogram checks whether the message is a histogram message
+func (m *ccMessage) IsHistogram() bool {
+	return m.MessageType() == CCMSG_TYPE_HISTOGRAM
+}
+
+// histogramCount converts the field value of counts, which may be decoded
+// as signed integer or float
+func histogramCount(key string, v interface{}) (uint64, error) {
+	switch x := v.(type) {
+	case uint64:
+		return x, nil
+	case int64:
+		if x >= 0 {
+			return uint64(x), nil
+		}
+	case float64:
+		if x >= 0 && x == math.Trunc(x) {
+			return uint64(x), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid histogram count %v in field %s", v, key)
+}
+
+// GetHistogram returns the histogram of a histogram message
+func (m *ccMessage) GetHistogram() (Histogram, error) {
+	var h Histogram
+	if !m.IsHistogram() {
+		return h, fmt.Errorf("message %s is no histogram", m.name)
+	}
+
+	type bucket struct {
+		bound float64
+		count uint64
+	}
+	buckets := make([]bucket, 0, len(m.fields.get()))
+	for k, v := range m.fields.get() {
+		var err error
+		switch {
+		case k == CCMSG_HISTOGRAM_COUNT_FIELD:
+			h.Count, err = histogramCount(k, v)
+		case k == CCMSG_HISTOGRAM_SUM_FIELD:
+			switch x := v.(type) {
+			case float64:
+				h.Sum = x
+			case int64:
+				h.Sum = float64(x)
+			case uint64:
+				h.Sum = float64(x)
+			default:
+				err = fmt.Errorf("invalid histogram sum %v", v)
+			}
+		case strings.HasPrefix(k, CCMSG_HISTOGRAM_BUCKET_FIELD_PREFIX):
+			var b bucket
+			b.bound, err = strconv.ParseFloat(strings.TrimPrefix(k, CCMSG_HISTOGRAM_BUCKET_FIELD_PREFIX), 64)
+			if err == nil {
+				b.count, err = histogramCount(k, v)
+			}
+			buckets = append(buckets, b)
+		}
+		if err != nil {
+			return Histogram{}, err
+		}
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+	h.Buckets = make([]float64, len(buckets))
+	h.Counts = make([]uint64, len(buckets))
+	for i, b := range buckets {
+		h.Buckets[i] = b.bound
+		h.Counts[i] = b.count
+	}
+	if err := h.Validate(); err != nil {
+		return Histogram{}, err
+	}
+	return h, nil
+}
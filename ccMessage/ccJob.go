@@ -5,54 +5,228 @@
 package ccmessage
 
 import (
+	"bytes"
 	"encoding/json"
-	"strings"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/ClusterCockpit/cc-lib/schema"
 )
 
-func NewJobStartEvent(job *schema.JobMeta) (CCMessage, error) {
+// Names of job events
+const (
+	CCMSG_JOB_START        = "start_job"        // Job started, payload is the job meta data
+	CCMSG_JOB_STOP         = "stop_job"         // Job stopped, payload is the job meta data
+	CCMSG_JOB_UPDATE_META  = "update_job_meta"  // Meta data of a job changed
+	CCMSG_JOB_ADD_TAG      = "add_job_tag"      // Tag added to a job
+	CCMSG_JOB_CHANGE_STATE = "change_job_state" // State of a job changed
+)
+
+// Properties of the job meta data required for the job events
+var (
+	jobStartRequired  = []string{"jobId", "user", "project", "cluster", "subCluster", "numNodes", "startTime", "jobState", "resources"}
+	jobStopRequired   = []string{"jobId", "user", "project", "cluster", "subCluster", "numNodes", "startTime", "jobState", "duration", "resources"}
+	jobUpdateRequired = []string{"jobId", "cluster", "startTime"}
+)
+
+// jobEventPayload is the event value of job events which change a job.
+// Start and stop events use the job meta data as event value.
+type jobEventPayload struct {
+	Job      *schema.JobMeta   `json:"job"`                // Job the event refers to
+	MetaData map[string]string `json:"metaData,omitempty"` // Changed meta data
+	Tag      *schema.Tag       `json:"tag,omitempty"`      // Added tag
+	State    schema.JobState   `json:"jobState,omitempty"` // New job state
+}
+
+// validateJob validates the job meta data against the job meta schema.
+// Properties that are not required and have their zero value are treated
+// as not set.
+func validateJob(job *schema.JobMeta, required []string) error {
+	if job == nil {
+		return fmt.Errorf("no job meta data")
+	}
 	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return err
+	}
+	for k, v := range values {
+		if slices.Contains(required, k) {
+			continue
+		}
+		switch x := v.(type) {
+		case nil:
+			delete(values, k)
+		case float64:
+			if x == 0 {
+				delete(values, k)
+			}
+		case string:
+			if len(x) == 0 {
+				delete(values, k)
+			}
+		}
+	}
+	payload, err = json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := schema.ValidateJobMeta(bytes.NewReader(payload), required); err != nil {
+		return fmt.Errorf("invalid job meta data: %v", err.Error())
+	}
+	return nil
+}
+
+// newJobEvent validates the job and creates the job event
+func newJobEvent(name string, job *schema.JobMeta, required []string, value interface{}, tm time.Time) (CCMessage, error) {
+	if err := validateJob(job, required); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(value)
 	if err != nil {
 		return nil, err
 	}
+	return NewEvent(name, nil, nil, string(payload), tm)
+}
 
-	return NewEvent("start_job", nil, nil, string(payload), time.Unix(job.StartTime, 0))
+// NewJobStartEvent creates a start_job event timestamped at the start time of the job
+func NewJobStartEvent(job *schema.JobMeta) (CCMessage, error) {
+	if job == nil {
+		return nil, fmt.Errorf("no job meta data")
+	}
+	return newJobEvent(CCMSG_JOB_START, job, jobStartRequired, job, time.Unix(job.StartTime, 0))
 }
 
+// NewJobStopEvent creates a stop_job event timestamped at the end of the job
+// (start time plus duration)
 func NewJobStopEvent(job *schema.JobMeta) (CCMessage, error) {
-	payload, err := json.Marshal(job)
-	if err != nil {
-		return nil, err
+	if job == nil {
+		return nil, fmt.Errorf("no job meta data")
 	}
+	return newJobEvent(CCMSG_JOB_STOP, job, jobStopRequired, job, time.Unix(job.StartTime+int64(job.Duration), 0))
+}
 
-	return NewEvent("stop_job", nil, nil, string(payload), time.Unix(job.StartTime, 0))
+// NewJobUpdateMetaEvent creates an update_job_meta event for changed meta
+// data of the job
+func NewJobUpdateMetaEvent(job *schema.JobMeta, metaData map[string]string) (CCMessage, error) {
+	if len(metaData) == 0 {
+		return nil, fmt.Errorf("no meta data to update")
+	}
+	return newJobEvent(CCMSG_JOB_UPDATE_META, job, jobUpdateRequired, jobEventPayload{Job: job, MetaData: metaData}, time.Now())
+}
+
+// NewJobTagEvent creates an add_job_tag event for a tag added to the job
+func NewJobTagEvent(job *schema.JobMeta, tag *schema.Tag) (CCMessage, error) {
+	if tag == nil || len(tag.Name) == 0 || len(tag.Type) == 0 {
+		return nil, fmt.Errorf("tag requires name and type")
+	}
+	return newJobEvent(CCMSG_JOB_ADD_TAG, job, jobUpdateRequired, jobEventPayload{Job: job, Tag: tag}, time.Now())
 }
 
+// NewJobStateChangeEvent creates a change_job_state event for the new state of the job
+func NewJobStateChangeEvent(job *schema.JobMeta, state schema.JobState) (CCMessage, error) {
+	if !state.Valid() {
+		return nil, fmt.Errorf("invalid job state '%s'", state)
+	}
+	return newJobEvent(CCMSG_JOB_CHANGE_STATE, job, jobUpdateRequired, jobEventPayload{Job: job, State: state}, time.Now())
+}
+
+// IsJobEvent returns the name of the job event and whether the message is a job event
 func (m *ccMessage) IsJobEvent() (string, bool) {
 	if !m.IsEvent() {
 		return "", false
 	}
 
-	name := m.name
-
-	if name == "start_job" || name == "stop_job" {
-		return name, true
+	switch m.name {
+	case CCMSG_JOB_START, CCMSG_JOB_STOP, CCMSG_JOB_UPDATE_META, CCMSG_JOB_ADD_TAG, CCMSG_JOB_CHANGE_STATE:
+		return m.name, true
 	}
 
 	return "", false
 }
 
+// jobEvent decodes and validates the payload of the job event
+func (m *ccMessage) jobEvent() (*jobEventPayload, error) {
+	name, ok := m.IsJobEvent()
+	if !ok {
+		return nil, fmt.Errorf("message %s is no job event", m.name)
+	}
+	value := []byte(m.GetEventValue())
+
+	p := &jobEventPayload{}
+	required := jobUpdateRequired
+	switch name {
+	case CCMSG_JOB_START, CCMSG_JOB_STOP:
+		p.Job = &schema.JobMeta{}
+		if err := json.Unmarshal(value, p.Job); err != nil {
+			return nil, err
+		}
+		required = jobStartRequired
+		if name == CCMSG_JOB_STOP {
+			required = jobStopRequired
+		}
+	default:
+		if err := json.Unmarshal(value, p); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateJob(p.Job, required); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetJob returns the job meta data of a job event
 func (m *ccMessage) GetJob() (job *schema.JobMeta, err error) {
-	value := m.GetEventValue()
-	d := json.NewDecoder(strings.NewReader(value))
-	d.DisallowUnknownFields()
-	job = &schema.JobMeta{}
-
-	if err = d.Decode(job); err == nil {
-		return job, nil
-	} else {
+	p, err := m.jobEvent()
+	if err != nil {
 		return nil, err
 	}
+	return p.Job, nil
+}
+
+// GetJobMetaUpdate returns the job and the changed meta data of an update_job_meta event
+func (m *ccMessage) GetJobMetaUpdate() (*schema.JobMeta, map[string]string, error) {
+	if m.name != CCMSG_JOB_UPDATE_META {
+		return nil, nil, fmt.Errorf("message %s is no %s event", m.name, CCMSG_JOB_UPDATE_META)
+	}
+	p, err := m.jobEvent()
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Job, p.MetaData, nil
+}
+
+// GetJobTag returns the job and the added tag of an add_job_tag event
+func (m *ccMessage) GetJobTag() (*schema.JobMeta, *schema.Tag, error) {
+	if m.name != CCMSG_JOB_ADD_TAG {
+		return nil, nil, fmt.Errorf("message %s is no %s event", m.name, CCMSG_JOB_ADD_TAG)
+	}
+	p, err := m.jobEvent()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Tag == nil {
+		return nil, nil, fmt.Errorf("%s event without tag", CCMSG_JOB_ADD_TAG)
+	}
+	return p.Job, p.Tag, nil
+}
+
+// GetJobStateChange returns the job and the new state of a change_job_state event
+func (m *ccMessage) GetJobStateChange() (*schema.JobMeta, schema.JobState, error) {
+	if m.name != CCMSG_JOB_CHANGE_STATE {
+		return nil, "", fmt.Errorf("message %s is no %s event", m.name, CCMSG_JOB_CHANGE_STATE)
+	}
+	p, err := m.jobEvent()
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.State.Valid() {
+		return nil, "", fmt.Errorf("invalid job state '%s'", p.State)
+	}
+	return p.Job, p.State, nil
 }
@@ -5,10 +5,84 @@
 package ccmessage
 
 import (
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Severity of log messages using the syslog levels (RFC 5424). The levels
+// match the "<N>" prefixes of the ccLogger output.
+type LogSeverity int
+
+const (
+	LOG_EMERGENCY LogSeverity = iota // System is unusable
+	LOG_ALERT                        // Action must be taken immediately
+	LOG_CRITICAL                     // Critical conditions
+	LOG_ERROR                        // Error conditions
+	LOG_WARNING                      // Warning conditions
+	LOG_NOTICE                       // Normal but significant condition
+	LOG_INFO                         // Informational messages
+	LOG_DEBUG                        // Debug-level messages
+)
+
+// Tags used by structured log messages
+const (
+	CCMSG_LOG_SEVERITY_TAG = "severity" // Name of the log severity
+	CCMSG_LOG_FACILITY_TAG = "facility" // Facility or component that created the log message
+)
+
+var logSeverityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// String returns the syslog name of the severity
+func (s LogSeverity) String() string {
+	if s >= LOG_EMERGENCY && s <= LOG_DEBUG {
+		return logSeverityNames[s]
+	}
+	return "invalid"
+}
+
+// ParseLogSeverity parses the syslog names of severities (e.g. "err",
+// "warning"), common aliases like "error", "warn" or "critical" and the
+// numeric levels with or without "<>"
+func ParseLogSeverity(severity string) (LogSeverity, error) {
+	s := strings.ToLower(strings.TrimSpace(severity))
+	switch s {
+	case "emergency", "panic":
+		return LOG_EMERGENCY, nil
+	case "critical", "fatal":
+		return LOG_CRITICAL, nil
+	case "error":
+		return LOG_ERROR, nil
+	case "warn":
+		return LOG_WARNING, nil
+	}
+	for i, name := range logSeverityNames {
+		if s == name {
+			return LogSeverity(i), nil
+		}
+	}
+	if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(s, "<"), ">")); err == nil && n >= int(LOG_EMERGENCY) && n <= int(LOG_DEBUG) {
+		return LogSeverity(n), nil
+	}
+	return LOG_INFO, fmt.Errorf("invalid log severity '%s'", severity)
+}
+
+// SplitLogSeverity splits a "<N>" severity prefix, as written by ccLogger,
+// from a log line. If the line has no valid prefix, ok is false and the
+// line is returned unchanged.
+func SplitLogSeverity(line string) (severity LogSeverity, rest string, ok bool) {
+	if len(line) < 3 || line[0] != '<' || line[2] != '>' || line[1] < '0' || line[1] > '7' {
+		return LOG_INFO, line, false
+	}
+	return LogSeverity(line[1] - '0'), line[3:], true
+}
+
+// reservedLogAttributes are field names that cannot be used as attributes
+// because they determine the message type
+var reservedLogAttributes = []string{"log", "value", "event", "control"}
+
 func NewLog(name string,
 	tags map[string]string,
 	meta map[string]string,
@@ -18,6 +92,40 @@ func NewLog(name string,
 	return NewMessage(name, tags, meta, map[string]interface{}{"log": log}, tm)
 }
 
+// NewStructuredLog creates a log message with severity and facility tags.
+// The attributes are stored as additional fields.
+func NewStructuredLog(name string,
+	tags map[string]string,
+	meta map[string]string,
+	severity LogSeverity,
+	facility string,
+	log string,
+	attributes map[string]interface{},
+	tm time.Time,
+) (CCMessage, error) {
+	if severity < LOG_EMERGENCY || severity > LOG_DEBUG {
+		return nil, fmt.Errorf("invalid log severity %d", severity)
+	}
+	fields := make(map[string]interface{}, len(attributes)+1)
+	for k, v := range attributes {
+		for _, r := range reservedLogAttributes {
+			if k == r {
+				return nil, fmt.Errorf("invalid log attribute name '%s'", k)
+			}
+		}
+		fields[k] = v
+	}
+	fields["log"] = log
+	m, err := NewMessage(name, tags, meta, fields, tm)
+	if err == nil {
+		m.AddTag(CCMSG_LOG_SEVERITY_TAG, severity.String())
+		if len(facility) > 0 {
+			m.AddTag(CCMSG_LOG_FACILITY_TAG, facility)
+		}
+	}
+	return m, err
+}
+
 func (m *ccMessage) IsLog() bool {
 	if v, ok := m.GetField("log"); ok {
 		if reflect.TypeOf(v) == reflect.TypeOf("string") {
@@ -35,3 +143,39 @@ func (m *ccMessage) GetLogValue() string {
 	}
 	return ""
 }
+
+// GetLogSeverity returns the severity of a log message. If the message has
+// no valid severity tag, ok is false.
+func (m *ccMessage) GetLogSeverity() (severity LogSeverity, ok bool) {
+	if m.IsLog() {
+		if v, ok := m.GetTag(CCMSG_LOG_SEVERITY_TAG); ok {
+			if s, err := ParseLogSeverity(v); err == nil {
+				return s, true
+			}
+		}
+	}
+	return LOG_INFO, false
+}
+
+// GetLogFacility returns the facility of a log message
+func (m *ccMessage) GetLogFacility() string {
+	if m.IsLog() {
+		if v, ok := m.GetTag(CCMSG_LOG_FACILITY_TAG); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// GetLogAttributes returns all fields of a log message except the log field
+func (m *ccMessage) GetLogAttributes() map[string]interface{} {
+	out := make(map[string]interface{})
+	if m.IsLog() {
+		for k, v := range m.fields.get() {
+			if k != "log" {
+				out[k] = v
+			}
+		}
+	}
+	return out
+}
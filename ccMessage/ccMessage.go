@@ -5,10 +5,13 @@
 package ccmessage
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -25,86 +28,103 @@ const (
 	CCMSG_TYPE_EVENT
 	CCMSG_TYPE_LOG
 	CCMSG_TYPE_CONTROL
+	CCMSG_TYPE_HISTOGRAM
 )
 
 const (
 	MIN_CCMSG_TYPE     = CCMSG_TYPE_METRIC
-	MAX_CCMSG_TYPE     = CCMSG_TYPE_CONTROL
+	MAX_CCMSG_TYPE     = CCMSG_TYPE_HISTOGRAM
 	CCMSG_TYPE_INVALID = MAX_CCMSG_TYPE + 1
 )
 
+var ccMessageTypeNames = map[CCMessageType]string{
+	CCMSG_TYPE_METRIC:    "metric",
+	CCMSG_TYPE_EVENT:     "event",
+	CCMSG_TYPE_LOG:       "log",
+	CCMSG_TYPE_CONTROL:   "control",
+	CCMSG_TYPE_HISTOGRAM: "histogram",
+}
+
+// String returns the name of the message type as used in the JSON envelope
+// and by the message processor ("metric", "event", "log", "control",
+// "histogram")
+func (t CCMessageType) String() string {
+	if n, ok := ccMessageTypeNames[t]; ok {
+		return n
+	}
+	return "invalid"
+}
+
+// Version of the JSON envelope written by ToJSON. JSON input without a
+// version is treated as the legacy format without meta information.
+const CCMSG_JSON_VERSION = 1
+
 // Most functions are derived from github.com/influxdata/line-protocol/metric.go
 // The metric type is extended with an extra meta information list re-using the Tag
 // type.
 //
 // See: https://docs.influxdata.com/influxdb/latest/reference/syntax/line-protocol/
+//
+// The maps are shared between copies of a message until one of the copies
+// modifies them (copy-on-write), so copying a message is cheap.
 type ccMessage struct {
-	name   string                 // Measurement name
-	meta   map[string]string      // map of meta data tags
-	tags   map[string]string      // map of of tags
-	fields map[string]interface{} // map of of fields
-	tm     time.Time              // timestamp
+	name   string               // Measurement name
+	meta   *cowMap[string]      // map of meta data tags
+	tags   *cowMap[string]      // map of of tags
+	fields *cowMap[interface{}] // map of of fields
+	tm     time.Time            // timestamp
 }
 
 type ccMessageJSON struct {
-	Name string `json:"name"` // Measurement name
-	// Meta   map[string]string      `json:"meta,omitempty"` // map of meta data tags
-	Tags   map[string]string      `json:"tags"`      // map of of tags
-	Fields map[string]interface{} `json:"fields"`    // map of of fields
-	Tm     time.Time              `json:"timestamp"` // timestamp
+	Version    int                    `json:"version,omitempty"`     // Envelope version
+	Type       string                 `json:"type,omitempty"`        // Message type
+	Name       string                 `json:"name"`                  // Measurement name
+	Tags       map[string]string      `json:"tags"`                  // map of of tags
+	Meta       map[string]string      `json:"meta,omitempty"`        // map of meta data tags
+	Fields     map[string]interface{} `json:"fields"`                // map of of fields
+	FieldTypes map[string]string      `json:"field_types,omitempty"` // type hints for fields JSON cannot represent exactly
+	Tm         time.Time              `json:"timestamp"`             // timestamp
 }
 
 // ccMessage access functions
 type CCMessage interface {
-	ToPoint(metaAsTags map[string]bool) *write.Point  // Generate influxDB point for data type ccMessage
-	ToLineProtocol(metaAsTags map[string]bool) string // Generate influxDB line protocol for data type ccMessage
-	ToJSON(metaAsTags map[string]bool) (json.RawMessage, error)
+	CCMessageView // Read access
 
-	Name() string        // Get metric name
 	SetName(name string) // Set metric name
-
-	Time() time.Time     // Get timestamp
 	SetTime(t time.Time) // Set timestamp
 
-	Tags() map[string]string                   // Map of tags
-	AddTag(key, value string)                  // Add a tag
-	GetTag(key string) (value string, ok bool) // Get a tag by its key
-	HasTag(key string) (ok bool)               // Check if a tag key is present
-	RemoveTag(key string)                      // Remove a tag by its key
-
-	Meta() map[string]string                    // Map of meta data tags
-	AddMeta(key, value string)                  // Add a meta data tag
-	GetMeta(key string) (value string, ok bool) // Get a meta data tab addressed by its key
-	HasMeta(key string) (ok bool)               // Check if a meta data key is present
-	RemoveMeta(key string)                      // Remove a meta data tag by its key
-
-	Fields() map[string]interface{}                   // Map of fields
-	AddField(key string, value interface{})           // Add a field
-	GetField(key string) (value interface{}, ok bool) // Get a field addressed by its key
-	HasField(key string) (ok bool)                    // Check if a field key is present
-	RemoveField(key string)                           // Remove a field addressed by its key
-	String() string                                   // Return line-protocol like string
-
-	MessageType() CCMessageType // Return message type
-	IsMetric() bool
-	GetMetricValue() interface{}
-	IsLog() bool
-	GetLogValue() string
-	IsEvent() bool
-	GetEventValue() string
+	Reset() // Clear the message for reuse
+
+	// Tags(), Meta() and Fields() return the maps of the message. Changing
+	// them changes only this message: maps shared with copies of the message
+	// are copied first, so the maps must not be kept after the message was
+	// copied again. For read access, use the iterators AllTags(), AllMeta()
+	// and AllFields(), which never copy.
+
+	Tags() map[string]string  // Map of tags
+	AddTag(key, value string) // Add a tag
+	RemoveTag(key string)     // Remove a tag by its key
+
+	Meta() map[string]string   // Map of meta data tags
+	AddMeta(key, value string) // Add a meta data tag
+	RemoveMeta(key string)     // Remove a meta data tag by its key
+
+	Fields() map[string]interface{}         // Map of fields
+	AddField(key string, value interface{}) // Add a field
+	RemoveField(key string)                 // Remove a field addressed by its key
 }
 
 // String implements the stringer interface for data type ccMessage
 func (m *ccMessage) String() string {
 	return fmt.Sprintf(
 		"Name: %s, Tags: %+v, Meta: %+v, fields: %+v, Timestamp: %d",
-		m.name, m.tags, m.meta, m.fields, m.tm.UnixNano(),
+		m.name, m.tags.get(), m.meta.get(), m.fields.get(), m.tm.UnixNano(),
 	)
 }
 
 // ToLineProtocol generates influxDB line protocol for data type ccMessage
 func (m *ccMessage) ToPoint(metaAsTags map[string]bool) (p *write.Point) {
-	p = influxdb2.NewPoint(m.name, m.tags, m.fields, m.tm)
+	p = influxdb2.NewPoint(m.name, m.tags.get(), m.fields.get(), m.tm)
 	for key, use_as_tag := range metaAsTags {
 		if use_as_tag {
 			if value, ok := m.GetMeta(key); ok {
@@ -123,27 +143,83 @@ func (m *ccMessage) ToLineProtocol(metaAsTags map[string]bool) string {
 	)
 }
 
+// ToJSON generates the versioned JSON envelope for data type ccMessage.
+// Meta data tags listed in metaAsTags are written as tags, all other meta
+// data tags are kept in the meta section.
 func (m *ccMessage) ToJSON(metaAsTags map[string]bool) (json.RawMessage, error) {
-	metalen := len(m.meta) - len(metaAsTags)
-	if metalen < 0 {
-		metalen = 0
-	}
 	mc := ccMessageJSON{
-		Name: m.name,
-		Tm:   m.tm,
-		Tags: maps.Clone(m.tags),
-		// Meta:   make(map[string]string, metalen),
-		Fields: maps.Clone(m.fields),
-	}
-	for k := range metaAsTags {
-		if v, ok := m.meta[k]; ok {
+		Version: CCMSG_JSON_VERSION,
+		Name:    m.name,
+		Tm:      m.tm,
+		Tags:    maps.Clone(m.tags.get()),
+		Meta:    make(map[string]string, len(m.meta.get())),
+		Fields:  make(map[string]interface{}, len(m.fields.get())),
+	}
+	if mc.Tags == nil {
+		mc.Tags = make(map[string]string)
+	}
+	if t := m.MessageType(); t != CCMSG_TYPE_INVALID {
+		mc.Type = t.String()
+	}
+	for k, v := range m.meta.get() {
+		if metaAsTags[k] {
 			mc.Tags[k] = v
+		} else {
+			mc.Meta[k] = v
+		}
+	}
+	for k, v := range m.fields.get() {
+		value, hint := jsonEncodeField(v)
+		mc.Fields[k] = value
+		if len(hint) > 0 {
+			if mc.FieldTypes == nil {
+				mc.FieldTypes = make(map[string]string)
+			}
+			mc.FieldTypes[k] = hint
 		}
 	}
 
 	return json.Marshal(mc)
 }
 
+// jsonEncodeField returns the JSON representation of a field value and a
+// type hint if decoding the plain JSON value would not restore the type
+func jsonEncodeField(v interface{}) (interface{}, string) {
+	switch v := v.(type) {
+	case int64:
+		return v, "int"
+	case uint64:
+		return v, "uint"
+	case float64:
+		// JSON has no representation for NaN and Inf
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64), "float"
+		}
+	}
+	return v, ""
+}
+
+// jsonDecodeField converts a field value decoded with json.Decoder.UseNumber
+// back to its original type using the type hint written by ToJSON
+func jsonDecodeField(v interface{}, hint string) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		switch hint {
+		case "int":
+			return v.Int64()
+		case "uint":
+			return strconv.ParseUint(v.String(), 10, 64)
+		default:
+			return v.Float64()
+		}
+	case string:
+		if hint == "float" {
+			return strconv.ParseFloat(v, 64)
+		}
+	}
+	return v, nil
+}
+
 // Name returns the measurement name
 func (m *ccMessage) Name() string {
 	return m.name
@@ -164,86 +240,111 @@ func (m *ccMessage) SetTime(t time.Time) {
 	m.tm = t
 }
 
-// Tags returns the the list of tags as key-value-mapping
+// Tags returns the list of tags as key-value-mapping. A map shared with
+// copies of the message is copied first.
 func (m *ccMessage) Tags() map[string]string {
-	return m.tags
+	// Only assign a copy, so concurrent reads of an unshared message do not race
+	if w := m.tags.writable(); w != m.tags {
+		m.tags = w
+	}
+	return m.tags.m
 }
 
 // AddTag adds a tag (consisting of key and value) to the map of tags
 func (m *ccMessage) AddTag(key, value string) {
-	m.tags[key] = value
+	m.tags = m.tags.writable()
+	m.tags.m[key] = value
 }
 
 // GetTag returns the tag with tag's key equal to <key>
 func (m *ccMessage) GetTag(key string) (string, bool) {
-	value, ok := m.tags[key]
+	value, ok := m.tags.get()[key]
 	return value, ok
 }
 
 // HasTag checks if a tag with key equal to <key> is present in the list of tags
 func (m *ccMessage) HasTag(key string) bool {
-	_, ok := m.tags[key]
+	_, ok := m.tags.get()[key]
 	return ok
 }
 
 // RemoveTag removes the tag with tag's key equal to <key>
 func (m *ccMessage) RemoveTag(key string) {
-	delete(m.tags, key)
+	if _, ok := m.tags.get()[key]; ok {
+		m.tags = m.tags.writable()
+		delete(m.tags.m, key)
+	}
 }
 
-// Meta returns the meta data tags as key-value mapping
+// Meta returns the meta data tags as key-value mapping. A map shared with
+// copies of the message is copied first.
 func (m *ccMessage) Meta() map[string]string {
-	return m.meta
+	if w := m.meta.writable(); w != m.meta {
+		m.meta = w
+	}
+	return m.meta.m
 }
 
 // AddMeta adds a meta data tag (consisting of key and value) to the map of meta data tags
 func (m *ccMessage) AddMeta(key, value string) {
-	m.meta[key] = value
+	m.meta = m.meta.writable()
+	m.meta.m[key] = value
 }
 
 // GetMeta returns the meta data tag with meta data's key equal to <key>
 func (m *ccMessage) GetMeta(key string) (string, bool) {
-	value, ok := m.meta[key]
+	value, ok := m.meta.get()[key]
 	return value, ok
 }
 
 // HasMeta checks if a meta data tag with meta data's key equal to <key> is present in the map of meta data tags
 func (m *ccMessage) HasMeta(key string) bool {
-	_, ok := m.meta[key]
+	_, ok := m.meta.get()[key]
 	return ok
 }
 
 // RemoveMeta removes the meta data tag with tag's key equal to <key>
 func (m *ccMessage) RemoveMeta(key string) {
-	delete(m.meta, key)
+	if _, ok := m.meta.get()[key]; ok {
+		m.meta = m.meta.writable()
+		delete(m.meta.m, key)
+	}
 }
 
-// Fields returns the list of fields as key-value-mapping
+// Fields returns the list of fields as key-value-mapping. A map shared with
+// copies of the message is copied first.
 func (m *ccMessage) Fields() map[string]interface{} {
-	return m.fields
+	if w := m.fields.writable(); w != m.fields {
+		m.fields = w
+	}
+	return m.fields.m
 }
 
 // AddField adds a field (consisting of key and value) to the map of fields
 func (m *ccMessage) AddField(key string, value interface{}) {
-	m.fields[key] = value
+	m.fields = m.fields.writable()
+	m.fields.m[key] = value
 }
 
 // GetField returns the field with field's key equal to <key>
 func (m *ccMessage) GetField(key string) (interface{}, bool) {
-	v, ok := m.fields[key]
+	v, ok := m.fields.get()[key]
 	return v, ok
 }
 
 // HasField checks if a field with field's key equal to <key> is present in the map of fields
 func (m *ccMessage) HasField(key string) bool {
-	_, ok := m.fields[key]
+	_, ok := m.fields.get()[key]
 	return ok
 }
 
 // RemoveField removes the field with field's key equal to <key>
 // from the map of fields
 func (m *ccMessage) RemoveField(key string) {
-	delete(m.fields, key)
+	if _, ok := m.fields.get()[key]; ok {
+		m.fields = m.fields.writable()
+		delete(m.fields.m, key)
+	}
 }
 
 // New creates a new measurement point
@@ -254,75 +355,126 @@ func NewMessage(
 	fields map[string]interface{},
 	tm time.Time,
 ) (CCMessage, error) {
-	m := &ccMessage{
-		name:   name,
-		tags:   maps.Clone(tags),
-		meta:   maps.Clone(meta),
-		fields: make(map[string]interface{}, len(fields)),
-		tm:     tm,
-	}
+	m := acquire()
+	m.name = name
+	m.tm = tm
 
-	// deep copy fields
+	// deep copy tags, meta and fields
+	for k, v := range tags {
+		m.tags.m[k] = v
+	}
+	for k, v := range meta {
+		m.meta.m[k] = v
+	}
 	for k, v := range fields {
 		v := convertField(v)
 		if v == nil {
 			continue
 		}
-		m.fields[k] = v
+		m.fields.m[k] = v
 	}
 
 	return m, nil
 }
 
-// FromMetric copies the metric <other>
-func FromMessage(other CCMessage) CCMessage {
-	return &ccMessage{
-		name:   other.Name(),
-		tags:   maps.Clone(other.Tags()),
-		meta:   maps.Clone(other.Meta()),
-		fields: maps.Clone(other.Fields()),
-		tm:     other.Time(),
+// FromMetric copies the metric <other>. Copies of a CCMessage share
+// tags, meta data and fields until one of the copies modifies them.
+func FromMessage(other CCMessageView) CCMessage {
+	if r, ok := other.(readOnlyMessage); ok {
+		other = r.CCMessageView
 	}
+	if o, ok := other.(*ccMessage); ok {
+		m := messagePool.Get().(*ccMessage)
+		m.name = o.name
+		m.tm = o.tm
+		m.tags = o.tags.share()
+		m.meta = o.meta.share()
+		m.fields = o.fields.share()
+		return m
+	}
+	m := acquire()
+	m.name = other.Name()
+	m.tm = other.Time()
+	for k, v := range other.AllTags() {
+		m.tags.m[k] = v
+	}
+	for k, v := range other.AllMeta() {
+		m.meta.m[k] = v
+	}
+	for k, v := range other.AllFields() {
+		m.fields.m[k] = v
+	}
+	return m
 }
 
 func EmptyMessage() CCMessage {
-	return &ccMessage{
-		name:   "",
-		tags:   make(map[string]string),
-		meta:   make(map[string]string),
-		fields: make(map[string]interface{}),
-		tm:     time.Time{},
-	}
+	return acquire()
 }
 
 // FromInfluxMetric copies the influxDB line protocol metric <other>
 func FromInfluxMetric(other lp1.Metric) CCMessage {
-	m := &ccMessage{
-		name:   other.Name(),
-		tags:   make(map[string]string),
-		meta:   make(map[string]string),
-		fields: make(map[string]interface{}),
-		tm:     other.Time(),
-	}
+	m := acquire()
+	m.name = other.Name()
+	m.tm = other.Time()
 
 	// deep copy tags and fields
 	for _, otherTag := range other.TagList() {
-		m.tags[otherTag.Key] = otherTag.Value
+		m.tags.m[otherTag.Key] = otherTag.Value
 	}
 	for _, otherField := range other.FieldList() {
-		m.fields[otherField.Key] = otherField.Value
+		m.fields.m[otherField.Key] = otherField.Value
 	}
 	return m
 }
 
-func FromJSON(input json.RawMessage) (CCMessage, error) {
+// decodeJSON parses the JSON envelope written by ToJSON. JSON input
+// without a version is the legacy format which only contains
+// name, tags, fields and timestamp.
+func decodeJSON(input []byte) (*ccMessage, error) {
 	var j ccMessageJSON
-	err := json.Unmarshal(input, &j)
-	if err != nil {
+	d := json.NewDecoder(bytes.NewReader(input))
+	d.UseNumber()
+	if err := d.Decode(&j); err != nil {
 		return nil, fmt.Errorf("failed to parse JSON to CCMessage: %v", err.Error())
 	}
+	if j.Version > CCMSG_JSON_VERSION {
+		return nil, fmt.Errorf("failed to parse JSON to CCMessage: unsupported version %d", j.Version)
+	}
 
-	return NewMessage(j.Name, j.Tags, make(map[string]string), j.Fields, j.Tm)
+	m := acquire()
+	m.name = j.Name
+	m.tm = j.Tm
+	for k, v := range j.Tags {
+		m.tags.m[k] = v
+	}
+	for k, v := range j.Meta {
+		m.meta.m[k] = v
+	}
+	for k, v := range j.Fields {
+		value, err := jsonDecodeField(v, j.FieldTypes[k])
+		if err != nil {
+			Release(m)
+			return nil, fmt.Errorf("failed to parse JSON to CCMessage: field %s: %v", k, err.Error())
+		}
+		if value = convertField(value); value != nil {
+			m.fields.m[k] = value
+		}
+	}
+	if len(j.Type) > 0 && m.MessageType().String() != j.Type {
+		Release(m)
+		return nil, fmt.Errorf("failed to parse JSON to CCMessage: message type %s does not match fields", j.Type)
+	}
+	return m, nil
+}
+
+// FromJSON creates a CCMessage out of the JSON envelope written by ToJSON
+// or the legacy JSON format without meta information
+func FromJSON(input json.RawMessage) (CCMessage, error) {
+	m, err := decodeJSON(input)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
 func (m *ccMessage) MarshalJSON() ([]byte, error) {
@@ -330,83 +482,26 @@ func (m *ccMessage) MarshalJSON() ([]byte, error) {
 }
 
 func (m *ccMessage) UnmarshalJSON(data []byte) error {
-	var j ccMessageJSON
-	err := json.Unmarshal(data, &j)
+	x, err := decodeJSON(data)
 	if err != nil {
-		return fmt.Errorf("failed to parse JSON to CCMessage: %v", err.Error())
-	}
-	m.name = j.Name
-	m.tm = j.Tm
-	m.meta = make(map[string]string)
-	m.tags = make(map[string]string)
-	for k, v := range j.Tags {
-		m.tags[k] = v
-	}
-	m.fields = make(map[string]interface{})
-	for k, v := range j.Fields {
-		m.fields[k] = v
+		return err
 	}
+	*m = *x
 	return nil
 }
 
+// FromBytes decodes all messages in the line protocol data. It fails on
+// the first line that cannot be decoded, use Decoder to skip bad lines.
 func FromBytes(data []byte) ([]CCMessage, error) {
 	out := make([]CCMessage, 0)
-	decoder := lp2.NewDecoderWithBytes(data)
+	decoder := NewDecoderWithBytes(data)
+	decoder.SetStrict(true)
 	for decoder.Next() {
-		// Decode measurement name
-		measurement, err := decoder.Measurement()
-		if err != nil {
-			msg := "ccmessage: Failed to decode measurement: " + err.Error()
-			return nil, errors.New(msg)
-		}
-
-		// Decode tags
-		tags := make(map[string]string)
-		for {
-			key, value, err := decoder.NextTag()
-			if err != nil {
-				msg := "ccmessage: Failed to decode tag: " + err.Error()
-				return nil, errors.New(msg)
-			}
-			if key == nil {
-				break
-			}
-			tags[string(key)] = string(value)
-		}
-
-		// Decode fields
-		fields := make(map[string]interface{})
-		for {
-			key, value, err := decoder.NextField()
-			if err != nil {
-				msg := "ccmessage: Failed to decode field: " + err.Error()
-				return nil, errors.New(msg)
-			}
-			if key == nil {
-				break
-			}
-			fields[string(key)] = value.Interface()
-		}
-
-		// Decode time stamp
-		t, err := decoder.Time(lp2.Nanosecond, time.Time{})
-		if err != nil {
-			msg := "ccmessage: Failed to decode time: " + err.Error()
-			return nil, errors.New(msg)
-		}
-
-		y, err := NewMessage(
-			string(measurement),
-			tags,
-			map[string]string{},
-			fields,
-			t,
-		)
-		if err != nil {
-			msg := "ccmessage: Failed to create CCMessage: " + err.Error()
-			return nil, errors.New(msg)
-		}
-		out = append(out, y)
+		out = append(out, decoder.Message())
+	}
+	if err := decoder.Err(); err != nil {
+		msg := "ccmessage: Failed to decode: " + err.Error()
+		return nil, errors.New(msg)
 	}
 	return out, nil
 }
@@ -416,7 +511,7 @@ func (m *ccMessage) Bytes() ([]byte, error) {
 	encoder.SetPrecision(lp2.Nanosecond)
 
 	sortedkeys := make([]string, 0)
-	for k := range m.Tags() {
+	for k := range m.tags.get() {
 		sortedkeys = append(sortedkeys, k)
 	}
 	sort.Strings(sortedkeys)
@@ -430,7 +525,7 @@ func (m *ccMessage) Bytes() ([]byte, error) {
 		}
 		encoder.AddTag(k, v)
 	}
-	for k, v := range m.Fields() {
+	for k, v := range m.fields.get() {
 		nv, ok := lp2.NewValue(v)
 		if !ok {
 			msg := fmt.Sprintf("CCMessage: Failed to get field value for key %s", k)
@@ -455,6 +550,8 @@ func (m *ccMessage) MessageType() CCMessageType {
 		return CCMSG_TYPE_LOG
 	} else if m.HasField("control") {
 		return CCMSG_TYPE_CONTROL
+	} else if m.HasField(CCMSG_HISTOGRAM_COUNT_FIELD) {
+		return CCMSG_TYPE_HISTOGRAM
 	}
 	return CCMSG_TYPE_INVALID
 }
@@ -5,16 +5,25 @@
 package ccmessage
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/ClusterCockpit/cc-lib/schema"
+	"golang.org/x/exp/maps"
 )
 
 func TestJSONEncode(t *testing.T) {
 	input := []CCMessage{
-		&ccMessage{name: "test1", tags: map[string]string{"type": "node"}, meta: map[string]string{"unit": "B"}, fields: map[string]interface{}{"value": 1.23}, tm: time.Now()},
-		&ccMessage{name: "test2", tags: map[string]string{"type": "socket", "type-id": "0"}, meta: map[string]string{"unit": "B"}, fields: map[string]interface{}{"value": 1.23}, tm: time.Now()},
+		&ccMessage{name: "test1", tags: cowOf(map[string]string{"type": "node"}), meta: cowOf(map[string]string{"unit": "B"}), fields: cowOf(map[string]interface{}{"value": 1.23}), tm: time.Now()},
+		&ccMessage{name: "test2", tags: cowOf(map[string]string{"type": "socket", "type-id": "0"}), meta: cowOf(map[string]string{"unit": "B"}), fields: cowOf(map[string]interface{}{"value": 1.23}), tm: time.Now()},
 	}
 
 	x, err := json.Marshal(input)
@@ -53,3 +62,879 @@ test2,type=socket,type-id=0 value=1.23 %d`, time.Now().UnixNano(), time.Now().Un
 		t.Log(m.Name())
 	}
 }
+
+func TestJSONRoundTrip(t *testing.T) {
+	input, err := NewMessage("test1",
+		map[string]string{"type": "socket", "type-id": "0"},
+		map[string]string{"unit": "B", "source": "test"},
+		map[string]interface{}{"value": int64(42), "count": uint64(7), "ratio": 1.0, "nan": math.NaN(), "ok": true},
+		time.Unix(1719057119, 495479906))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	x, err := input.ToJSON(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := FromJSON(x)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if output.Name() != input.Name() || !output.Time().Equal(input.Time()) {
+		t.Errorf("name or timestamp changed: %s", output.String())
+	}
+	if output.MessageType() != CCMSG_TYPE_METRIC {
+		t.Errorf("expected message type metric, got %s", output.MessageType())
+	}
+	if !maps.Equal(output.Tags(), input.Tags()) || !maps.Equal(output.Meta(), input.Meta()) {
+		t.Errorf("tags or meta changed: %s", output.String())
+	}
+	for k, v := range input.Fields() {
+		o, ok := output.GetField(k)
+		if !ok {
+			t.Errorf("missing field %s", k)
+			continue
+		}
+		if reflect.TypeOf(o) != reflect.TypeOf(v) {
+			t.Errorf("field %s changed type from %T to %T", k, v, o)
+		}
+	}
+	if v, _ := output.GetField("nan"); !math.IsNaN(v.(float64)) {
+		t.Errorf("expected NaN for field nan, got %v", v)
+	}
+
+	x, err = input.ToJSON(map[string]bool{"unit": true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err = FromJSON(x)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if u, ok := output.GetTag("unit"); !ok || u != "B" || output.HasMeta("unit") || !output.HasMeta("source") {
+		t.Errorf("expected meta 'unit' as tag and meta 'source' as meta: %s", output.String())
+	}
+}
+
+func TestJSONDecodeLegacy(t *testing.T) {
+	input := `{"name":"test1","tags":{"type":"node"},"fields":{"value":1.23},"timestamp":"2024-06-22T13:51:59.495479906+02:00"}`
+	m, err := FromJSON(json.RawMessage(input))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v := m.GetMetricValue(); v != 1.23 {
+		t.Errorf("expected value 1.23, got %v", v)
+	}
+	if len(m.Meta()) != 0 {
+		t.Errorf("expected no meta information, got %v", m.Meta())
+	}
+
+	input = `{"version":1,"type":"event","name":"test1","tags":{},"fields":{"value":1.23},"timestamp":"2024-06-22T13:51:59.495479906+02:00"}`
+	if _, err := FromJSON(json.RawMessage(input)); err == nil {
+		t.Error("expected error for message type not matching fields")
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	input := []CCMessage{
+		&ccMessage{name: "test1", tags: cowOf(map[string]string{"type": "node", "hostname": "myhost"}), meta: cowOf(map[string]string{"unit": "B"}), fields: cowOf(map[string]interface{}{"value": 1.23}), tm: time.Unix(1719057119, 495479906)},
+		&ccMessage{name: "test2", tags: cowOf(map[string]string{"type": "socket", "type-id": "0"}), meta: cowOf(map[string]string{}), fields: cowOf(map[string]interface{}{"value": int64(-100000), "other": uint64(1) << 40, "ok": false}), tm: time.Unix(1719057119, 0)},
+		&ccMessage{name: "test3", tags: cowOf(map[string]string{}), meta: cowOf(map[string]string{}), fields: cowOf(map[string]interface{}{"log": strings.Repeat("x", 300)}), tm: time.Unix(-1, 5)},
+	}
+
+	var data []byte
+	for _, m := range input {
+		var err error
+		if data, err = AppendBinary(data, m); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	output, err := FromBinary(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(output) != len(input) {
+		t.Fatalf("expected %d messages, got %d", len(input), len(output))
+	}
+	for i, m := range output {
+		if m.String() != input[i].String() {
+			t.Errorf("message %d changed:\n%s\n%s", i, input[i].String(), m.String())
+		}
+		for k, v := range input[i].Fields() {
+			if o, _ := m.GetField(k); o != v {
+				t.Errorf("message %d: field %s changed from %T(%v) to %T(%v)", i, k, v, v, o, o)
+			}
+		}
+	}
+
+	if _, err := FromBinary(data[:len(data)-1]); err == nil {
+		t.Error("expected error for truncated input")
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	input := `test1,type=node value=1.23 1719057119000000000
+# comment
+
+test2,type=socket,type-id=0 value=
+test3,type=node value=2i 1719057119000000000
+test4 bad line`
+
+	d := NewDecoder(strings.NewReader(input))
+	names := make([]string, 0)
+	for d.Next() {
+		names = append(names, d.Message().Name())
+	}
+	if d.Err() != nil {
+		t.Fatal(d.Err().Error())
+	}
+	if len(names) != 2 || names[0] != "test1" || names[1] != "test3" {
+		t.Errorf("expected messages test1 and test3, got %v", names)
+	}
+	errs := d.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %d", len(errs))
+	}
+	if errs[0].Line != 4 || errs[0].Text != "test2,type=socket,type-id=0 value=" {
+		t.Errorf("unexpected error line %d or text %q", errs[0].Line, errs[0].Text)
+	}
+	if errs[1].Line != 6 || errs[1].Text != "test4 bad line" {
+		t.Errorf("unexpected error line %d or text %q", errs[1].Line, errs[1].Text)
+	}
+
+	d = NewDecoderWithBytes([]byte(input))
+	d.SetStrict(true)
+	names = names[:0]
+	for d.Next() {
+		names = append(names, d.Message().Name())
+	}
+	var derr *DecodeError
+	if !errors.As(d.Err(), &derr) || derr.Line != 4 {
+		t.Errorf("expected decode error in line 4, got %v", d.Err())
+	}
+	if len(names) != 1 {
+		t.Errorf("expected a single message before the bad line, got %v", names)
+	}
+
+	if _, err := FromBytes([]byte(input)); err == nil {
+		t.Error("expected FromBytes to fail on bad line")
+	}
+}
+
+func TestDecoderMultiLineString(t *testing.T) {
+	// Newlines in string fields, like stack traces in logs, do not end the
+	// line. Quotes and spaces before the fields do not start a string.
+	const text = "line1\nline 2 \"quoted\",\n\\\nline3"
+	m, err := NewLog("test", map[string]string{"type": "node", "tag": `a"b`}, nil, text, time.Unix(1719057119, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	line := m.ToLineProtocol(nil)
+	input := line + "test2,type=node value=1 1719057119000000000\n"
+
+	out, err := FromBytes([]byte(input))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(out) != 2 || out[0].(*ccMessage).GetLogValue() != text || out[1].Name() != "test2" {
+		t.Fatalf("unexpected messages %v", out)
+	}
+	if v, _ := out[0].GetTag("tag"); v != `a"b` {
+		t.Errorf("unexpected tag value %q", v)
+	}
+
+	// The reader is read in small chunks
+	d := NewDecoder(bufio.NewReaderSize(strings.NewReader(input+"bad line\n"), 16))
+	n := 0
+	for d.Next() {
+		if n == 0 && d.Message().(*ccMessage).GetLogValue() != text {
+			t.Errorf("unexpected log %q", d.Message().(*ccMessage).GetLogValue())
+		}
+		n++
+	}
+	if n != 2 || d.Err() != nil {
+		t.Fatalf("expected 2 messages, got %d and error %v", n, d.Err())
+	}
+	// Line numbers count the lines of the input
+	if errs := d.Errors(); len(errs) != 1 || errs[0].Line != int64(strings.Count(line, "\n")+2) {
+		t.Errorf("expected error in line %d, got %v", strings.Count(line, "\n")+2, errs)
+	}
+}
+
+func TestDecoderErrorLimit(t *testing.T) {
+	// Only the first bad lines are kept, with a truncated text
+	const numLines = 2 * DECODER_MAX_ERRORS
+	var input strings.Builder
+	input.WriteString("bad" + strings.Repeat("x", 2*DECODER_MAX_ERROR_TEXT) + "\n")
+	for i := 1; i < numLines; i++ {
+		input.WriteString("bad line\n")
+	}
+	input.WriteString("test,type=node value=1 1719057119000000000\n")
+
+	d := NewDecoder(strings.NewReader(input.String()))
+	n := 0
+	for d.Next() {
+		n++
+	}
+	if n != 1 || d.Err() != nil {
+		t.Fatalf("expected the good line after the bad lines, got %d messages and error %v", n, d.Err())
+	}
+	if len(d.Errors()) != DECODER_MAX_ERRORS || d.ErrorCount() != numLines {
+		t.Errorf("expected %d kept of %d errors, got %d of %d", DECODER_MAX_ERRORS, numLines, len(d.Errors()), d.ErrorCount())
+	}
+	if len(d.Errors()[0].Text) != DECODER_MAX_ERROR_TEXT {
+		t.Errorf("expected text truncated to %d bytes, got %d", DECODER_MAX_ERROR_TEXT, len(d.Errors()[0].Text))
+	}
+}
+
+func TestDecoderPrecision(t *testing.T) {
+	ts := time.Unix(1719057119, 0)
+	input := map[Precision]string{
+		PRECISION_SECOND:      "test,type=node value=1 1719057119",
+		PRECISION_MILLISECOND: "test,type=node value=1 1719057119000",
+		PRECISION_MICROSECOND: "test,type=node value=1 1719057119000000",
+		PRECISION_NANOSECOND:  "test,type=node value=1 1719057119000000000",
+	}
+	for p, line := range input {
+		for _, prec := range []Precision{p, PRECISION_AUTO} {
+			d := NewDecoderWithBytes([]byte(line))
+			d.SetPrecision(prec)
+			if !d.Next() {
+				t.Fatalf("failed to decode %q: %v", line, d.Errors())
+			}
+			if !d.Message().Time().Equal(ts) {
+				t.Errorf("precision %d: expected %v for %q, got %v", prec, ts, line, d.Message().Time())
+			}
+		}
+	}
+	if _, err := ParsePrecision("h"); err == nil {
+		t.Error("expected error for unsupported precision")
+	}
+}
+
+func cowOf[V any](m map[string]V) *cowMap[V] {
+	c := newCowMap[V](len(m))
+	for k, v := range m {
+		c.m[k] = v
+	}
+	return c
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	orig, err := NewMessage("test", map[string]string{"type": "node"}, map[string]string{"unit": "B"}, map[string]interface{}{"value": 1.0}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := FromMessage(orig)
+	c.AddTag("hostname", "myhost")
+	c.RemoveMeta("unit")
+	c.AddField("value", 2.0)
+
+	if orig.HasTag("hostname") || !orig.HasMeta("unit") {
+		t.Errorf("modifying the copy changed the original: %s", orig.String())
+	}
+	if v, _ := orig.GetField("value"); v != 1.0 {
+		t.Errorf("modifying the copy changed field of the original to %v", v)
+	}
+	if !c.HasTag("type") || c.HasMeta("unit") {
+		t.Errorf("unexpected copy: %s", c.String())
+	}
+
+	// Changes through the maps returned by Tags(), Meta() and Fields()
+	// change only the message itself
+	d := FromMessage(c)
+	d.Tags()["cluster"] = "testcluster"
+	d.Meta()["unit"] = "B"
+	d.Fields()["value"] = 3.0
+	if !d.HasTag("cluster") || !d.HasMeta("unit") {
+		t.Errorf("modifying the returned maps did not change the message: %s", d.String())
+	}
+	if v, _ := d.GetField("value"); v != 3.0 {
+		t.Errorf("expected field value 3 after modifying the returned fields, got %v", v)
+	}
+	if c.HasTag("cluster") || c.HasMeta("unit") {
+		t.Errorf("modifying the returned maps changed the copied message: %s", c.String())
+	}
+	if v, _ := c.GetField("value"); v != 2.0 {
+		t.Errorf("modifying the returned fields changed field of the copied message to %v", v)
+	}
+	Release(d)
+
+	// Releasing the original must not affect the copy
+	Release(orig)
+	if v, _ := c.GetTag("type"); v != "node" {
+		t.Errorf("releasing the original changed the copy: %s", c.String())
+	}
+
+	c.Reset()
+	if len(c.Name()) > 0 || len(c.Tags()) > 0 || len(c.Meta()) > 0 || len(c.Fields()) > 0 || !c.Time().IsZero() {
+		t.Errorf("expected empty message after Reset, got %s", c.String())
+	}
+	Release(c)
+}
+
+func TestConcurrentMapReads(t *testing.T) {
+	// Reading the maps of an unshared message concurrently does not modify
+	// it (run with -race)
+	m, _ := NewMessage("test", map[string]string{"type": "node"}, map[string]string{"unit": "B"}, map[string]interface{}{"value": 1.0}, time.Now())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if len(m.Tags()) != 1 || len(m.Meta()) != 1 || len(m.Fields()) != 1 {
+				t.Errorf("unexpected maps of %s", m.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkFromMessage(b *testing.B) {
+	m, _ := NewMessage("test", map[string]string{"type": "node", "hostname": "myhost"}, map[string]string{"unit": "B", "source": "test"}, map[string]interface{}{"value": 1.0}, time.Now())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := FromMessage(m)
+		Release(c)
+	}
+}
+
+func BenchmarkFromMessageModified(b *testing.B) {
+	m, _ := NewMessage("test", map[string]string{"type": "node", "hostname": "myhost"}, map[string]string{"unit": "B", "source": "test"}, map[string]interface{}{"value": 1.0}, time.Now())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := FromMessage(m)
+		c.AddTag("cluster", "testcluster")
+		Release(c)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	m, err := NewMessage("test", map[string]string{"type": "node"}, map[string]string{"unit": "B"}, map[string]interface{}{"value": 1.0}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	view := ReadOnly(m)
+	if _, ok := view.(CCMessage); ok {
+		t.Fatal("read-only view can be converted to CCMessage")
+	}
+	tags := make(map[string]string)
+	for k, v := range view.AllTags() {
+		tags[k] = v
+	}
+	if !reflect.DeepEqual(tags, m.Tags()) {
+		t.Errorf("expected tags %v, got %v", m.Tags(), tags)
+	}
+	if rt, rm, rf, ok := ReadMaps(view); !ok || !reflect.DeepEqual(rt, m.Tags()) || !reflect.DeepEqual(rm, m.Meta()) || !reflect.DeepEqual(rf, m.Fields()) {
+		t.Errorf("ReadMaps of view returned %v, %v, %v, %v", rt, rm, rf, ok)
+	}
+
+	c := view.Mutable()
+	c.AddTag("hostname", "myhost")
+	if view.HasTag("hostname") || m.HasTag("hostname") {
+		t.Errorf("modifying the mutable copy changed the original: %s", m.String())
+	}
+	if c.String() == view.String() {
+		t.Errorf("expected modified copy, got %s", c.String())
+	}
+	if FromMessage(view).String() != m.String() {
+		t.Errorf("FromMessage of view differs from original")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	input := []CCMessage{
+		&ccMessage{name: "test1", tags: cowOf(map[string]string{"type": "node", "hostname": "myhost"}), meta: cowOf(map[string]string{"unit": "B"}), fields: cowOf(map[string]interface{}{"value": 1.23}), tm: time.Unix(1719057119, 495479906)},
+		&ccMessage{name: "test2", tags: cowOf(map[string]string{"type": "socket", "type-id": "0", "hostname": "myhost"}), meta: cowOf(map[string]string{}), fields: cowOf(map[string]interface{}{"value": int64(-100000), "other": uint64(1) << 40, "ok": false}), tm: time.Unix(1719057119, 0)},
+		&ccMessage{name: "test3", tags: cowOf(map[string]string{"hostname": "myhost"}), meta: cowOf(map[string]string{}), fields: cowOf(map[string]interface{}{"log": "some text"}), tm: time.Unix(1719057120, 5)},
+	}
+
+	var b Batch
+	for _, m := range input {
+		b.Add(m)
+	}
+	if b.Len() != len(input) {
+		t.Fatalf("expected %d messages, got %d", len(input), b.Len())
+	}
+	n := 0
+	for i, m := range b.All() {
+		if m.String() != input[i].String() {
+			t.Errorf("message %d changed:\n%s\n%s", i, input[i].String(), m.String())
+		}
+		n++
+	}
+	if n != len(input) {
+		t.Errorf("iterated over %d messages, expected %d", n, len(input))
+	}
+	if m := b.Message(1); m.String() != input[1].String() {
+		t.Errorf("message 1 changed:\n%s\n%s", input[1].String(), m.String())
+	}
+
+	data, err := b.ToLineProtocol()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := FromBytes(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, m := range output {
+		if m.Name() != input[i].Name() || !reflect.DeepEqual(m.Tags(), input[i].Tags()) || !reflect.DeepEqual(m.Fields(), input[i].Fields()) || !m.Time().Equal(input[i].Time()) {
+			t.Errorf("line protocol of message %d differs:\n%s\n%s", i, input[i].String(), m.String())
+		}
+	}
+
+	data, err = b.ToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var decoded []*ccMessage
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, m := range decoded {
+		if m.String() != input[i].String() {
+			t.Errorf("JSON of message %d differs:\n%s\n%s", i, input[i].String(), m.String())
+		}
+	}
+
+	b.Reset()
+	if b.Len() != 0 {
+		t.Errorf("expected empty batch after Reset, got %d messages", b.Len())
+	}
+}
+
+func TestControlReply(t *testing.T) {
+	req, err := NewGetControl("freq", map[string]string{"type": "hwthread", "type-id": "0"}, map[string]string{}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	id := req.GetControlRequestID()
+	if len(id) == 0 {
+		t.Fatal("control request without request ID")
+	}
+
+	reply, err := NewControlReply(req, "2400000", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The accessors are part of the read-only view
+	r := ReadOnly(reply)
+	if !r.IsControl() || !r.IsControlReply() || r.GetControlRequestID() != id || r.GetControlValue() != "2400000" {
+		t.Errorf("unexpected reply %s", reply.String())
+	}
+	if status, err := r.GetControlStatus(); status != CCMSG_CONTROL_STATUS_OK || err != nil {
+		t.Errorf("expected status ok, got %s (%v)", status, err)
+	}
+	if req.IsControlReply() {
+		t.Error("request changed by creating reply")
+	}
+
+	reply, _ = NewControlReply(req, "", errors.New("permission denied"))
+	if status, err := reply.GetControlStatus(); status != CCMSG_CONTROL_STATUS_ERROR || err == nil || err.Error() != "permission denied" {
+		t.Errorf("expected status error, got %s (%v)", status, err)
+	}
+	if _, err := NewControlReply(reply, "", nil); err == nil {
+		t.Error("expected error when replying to a reply")
+	}
+}
+
+func TestControlClient(t *testing.T) {
+	pipeline := make(chan CCMessage)
+	client := NewControlClient(pipeline)
+
+	// Answer all requests, PUT requests fail
+	go func() {
+		for req := range pipeline {
+			var reply CCMessage
+			if req.(*ccMessage).GetControlMethod() == CCMSG_CONTROL_PUT {
+				reply, _ = NewControlReply(req, "", errors.New("read only"))
+			} else {
+				reply, _ = NewControlReply(req, "42", nil)
+			}
+			if !client.HandleReply(reply) {
+				t.Errorf("reply %s not matched", reply.String())
+			}
+		}
+	}()
+
+	req, _ := NewGetControl("test", map[string]string{"type": "node"}, map[string]string{}, time.Now())
+	reply, err := client.Request(req, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply.(*ccMessage).GetControlValue() != "42" {
+		t.Errorf("unexpected reply %s", reply.String())
+	}
+
+	req, _ = NewPutControl("test", map[string]string{"type": "node"}, map[string]string{}, "1", time.Now())
+	if _, err := client.Request(req, time.Second); err == nil || err.Error() != "read only" {
+		t.Errorf("expected error 'read only', got %v", err)
+	}
+	close(pipeline)
+
+	// Nobody reads the requests
+	client = NewControlClient(make(chan CCMessage))
+	req, _ = NewGetControl("test", map[string]string{"type": "node"}, map[string]string{}, time.Now())
+	if _, err := client.Request(req, 10*time.Millisecond); !errors.Is(err, ErrControlTimeout) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if client.HandleReply(reply) {
+		t.Error("reply matched without pending request")
+	}
+}
+
+func TestJobEvents(t *testing.T) {
+	job := &schema.JobMeta{
+		BaseJob: schema.BaseJob{
+			JobID:      123,
+			User:       "user1",
+			Project:    "project1",
+			Cluster:    "testcluster",
+			SubCluster: "main",
+			NumNodes:   1,
+			Exclusive:  1,
+			State:      schema.JobStateRunning,
+			Resources:  []*schema.Resource{{Hostname: "node1"}},
+		},
+		StartTime: 1719057119,
+	}
+
+	start, err := NewJobStartEvent(job)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The accessors are part of the read-only view
+	if name, ok := ReadOnly(start).IsJobEvent(); !ok || name != CCMSG_JOB_START {
+		t.Errorf("expected %s event, got %s", CCMSG_JOB_START, name)
+	}
+	if j, err := ReadOnly(start).GetJob(); err != nil || j.JobID != job.JobID {
+		t.Errorf("failed to get job from start event: %v", err)
+	}
+
+	// Unknown fields are ignored
+	x := start.(*ccMessage)
+	x.AddField("event", strings.Replace(x.GetEventValue(), "{", `{"unknownField":1,`, 1))
+	if _, err := x.GetJob(); err != nil {
+		t.Errorf("failed to get job with unknown field: %v", err)
+	}
+
+	if _, err := NewJobStopEvent(job); err == nil {
+		t.Error("expected error for stop event without duration")
+	}
+	job.Duration = 3600
+	job.State = schema.JobStateCompleted
+	stop, err := NewJobStopEvent(job)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stop.Time().Unix() != job.StartTime+3600 {
+		t.Errorf("expected stop event at %d, got %d", job.StartTime+3600, stop.Time().Unix())
+	}
+
+	ref := &schema.JobMeta{BaseJob: schema.BaseJob{JobID: 123, Cluster: "testcluster"}, StartTime: 1719057119}
+	update, err := NewJobUpdateMetaEvent(ref, map[string]string{"jobName": "test"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if j, meta, err := update.GetJobMetaUpdate(); err != nil || j.JobID != 123 || meta["jobName"] != "test" {
+		t.Errorf("unexpected update_job_meta event: %v %v %v", j, meta, err)
+	}
+
+	tag, err := NewJobTagEvent(ref, &schema.Tag{Type: "Debug", Name: "Testjob"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, tg, err := tag.GetJobTag(); err != nil || tg.Name != "Testjob" {
+		t.Errorf("unexpected add_job_tag event: %v %v", tg, err)
+	}
+	if _, _, err := tag.GetJobMetaUpdate(); err == nil {
+		t.Error("expected error for wrong accessor")
+	}
+
+	state, err := NewJobStateChangeEvent(ref, schema.JobStateFailed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, s, err := state.GetJobStateChange(); err != nil || s != schema.JobStateFailed {
+		t.Errorf("unexpected change_job_state event: %v %v", s, err)
+	}
+	if _, err := NewJobStateChangeEvent(ref, "unknown"); err == nil {
+		t.Error("expected error for invalid job state")
+	}
+	if _, err := NewJobUpdateMetaEvent(&schema.JobMeta{}, map[string]string{"jobName": "test"}); err == nil {
+		t.Error("expected error for job without cluster")
+	}
+}
+
+func TestStructuredLog(t *testing.T) {
+	m, err := NewStructuredLog("syslog", map[string]string{"hostname": "myhost"}, map[string]string{}, LOG_WARNING, "kernel", "disk almost full", map[string]interface{}{"pid": 123, "device": "sda"}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The accessors are part of the read-only view
+	x := ReadOnly(m)
+	if !x.IsLog() || x.GetLogValue() != "disk almost full" {
+		t.Errorf("unexpected log message %s", m.String())
+	}
+	if s, ok := x.GetLogSeverity(); !ok || s != LOG_WARNING {
+		t.Errorf("expected severity %s, got %s", LOG_WARNING, s)
+	}
+	if f := x.GetLogFacility(); f != "kernel" {
+		t.Errorf("expected facility kernel, got %s", f)
+	}
+	attr := x.GetLogAttributes()
+	if !reflect.DeepEqual(attr, map[string]interface{}{"pid": int64(123), "device": "sda"}) {
+		t.Errorf("unexpected attributes %v", attr)
+	}
+
+	if _, err := NewStructuredLog("syslog", nil, nil, LOG_INFO, "", "text", map[string]interface{}{"value": 1}, time.Now()); err == nil {
+		t.Error("expected error for reserved attribute name")
+	}
+
+	for input, expected := range map[string]LogSeverity{"err": LOG_ERROR, "Error": LOG_ERROR, "warn": LOG_WARNING, "<7>": LOG_DEBUG, "2": LOG_CRITICAL} {
+		if s, err := ParseLogSeverity(input); err != nil || s != expected {
+			t.Errorf("ParseLogSeverity(%q): expected %s, got %s (%v)", input, expected, s, err)
+		}
+	}
+	if s, rest, ok := SplitLogSeverity("<4>[WARNING]  something"); !ok || s != LOG_WARNING || rest != "[WARNING]  something" {
+		t.Errorf("unexpected result of SplitLogSeverity: %s %q %v", s, rest, ok)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	hist := Histogram{
+		Buckets: []float64{0.1, 1, 10},
+		Counts:  []uint64{3, 7, 8},
+		Count:   9,
+		Sum:     5.25,
+	}
+	m, err := NewHistogram("latency", map[string]string{"hostname": "myhost", "type": "node"}, map[string]string{"unit": "s"}, hist, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !m.IsHistogram() || m.MessageType() != CCMSG_TYPE_HISTOGRAM || m.IsMetric() {
+		t.Fatalf("unexpected message type %s", m.MessageType())
+	}
+	if h, err := m.GetHistogram(); err != nil || !reflect.DeepEqual(h, hist) {
+		t.Errorf("expected histogram %v, got %v (%v)", hist, h, err)
+	}
+
+	lines, err := FromBytes([]byte(m.ToLineProtocol(nil)))
+	if err != nil || len(lines) != 1 {
+		t.Fatalf("decoding line protocol failed: %v", err)
+	}
+	data, err := m.ToJSON(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fromJSON, err := FromJSON(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	binary, err := AppendBinary(nil, m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fromBinary, err := FromBinary(binary)
+	if err != nil || len(fromBinary) != 1 {
+		t.Fatalf("decoding binary failed: %v", err)
+	}
+	for enc, x := range map[string]CCMessage{"line protocol": lines[0], "JSON": fromJSON, "binary": fromBinary[0]} {
+		if h, err := x.GetHistogram(); err != nil || !reflect.DeepEqual(h, hist) {
+			t.Errorf("%s: expected histogram %v, got %v (%v)", enc, hist, h, err)
+		}
+	}
+
+	for _, h := range []Histogram{
+		{Buckets: []float64{1, 2}, Counts: []uint64{1}, Count: 1},
+		{Buckets: []float64{2, 1}, Counts: []uint64{1, 2}, Count: 2},
+		{Buckets: []float64{1, 2}, Counts: []uint64{2, 1}, Count: 2},
+		{Buckets: []float64{1, 2}, Counts: []uint64{1, 3}, Count: 2},
+		{Buckets: []float64{math.NaN()}, Counts: []uint64{1}, Count: 1},
+	} {
+		if _, err := NewHistogram("latency", nil, nil, h, time.Now()); err == nil {
+			t.Errorf("expected error for invalid histogram %v", h)
+		}
+	}
+	if m, err := NewMetric("latency", nil, nil, 1.0, time.Now()); err != nil || m.IsHistogram() {
+		t.Error("metric detected as histogram")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tags := map[string]string{"hostname": "myhost", "type": "socket", "type-id": "0"}
+	valid := []CCMessage{}
+	if m, err := NewMetric("mem_bw", tags, nil, 12.5, time.Now()); err == nil {
+		valid = append(valid, m)
+	}
+	if m, err := NewEvent("start_job", map[string]string{"hostname": "myhost", "type": "node"}, nil, "{}", time.Now()); err == nil {
+		valid = append(valid, m)
+	}
+	if len(valid) != 2 {
+		t.Fatal("failed to create messages")
+	}
+	for _, m := range valid {
+		if err := Validate(m, ValidationOptions{}); err != nil {
+			t.Errorf("unexpected validation error for %s: %v", m.String(), err)
+		}
+	}
+
+	m, err := NewMessage("", map[string]string{"type": "socket", "bad\nkey": "x"}, nil, map[string]interface{}{"value": "high", "other": math.Inf(1)}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = Validate(m, ValidationOptions{})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, problem := range []string{"empty name", "missing required tag hostname", "missing required tag type-id", "illegal character", "non-finite", "not numeric"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected problem %q in %q", problem, err.Error())
+		}
+	}
+	if err := Validate(m, ValidationOptions{RequiredTags: []string{}, AllowNonFinite: true}); err == nil || strings.Contains(err.Error(), "required tag") || strings.Contains(err.Error(), "non-finite") {
+		t.Errorf("unexpected validation result with options: %v", err)
+	}
+
+	v := &Validator{Reject: true}
+	v.Check(valid[0])
+	v.Check(m)
+	if v.Invalid() != 1 {
+		t.Errorf("expected 1 invalid message, got %d", v.Invalid())
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	m1, err := NewMetric("cpu_load", map[string]string{"type": "node", "hostname": "myhost", "cluster": "a,b"}, map[string]string{"unit": "load", "group": "cpu"}, 1.0, time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	m2, err := NewMetric("cpu_load", map[string]string{"cluster": "a,b", "hostname": "myhost", "type": "node"}, nil, 2.0, time.Unix(2, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := `cpu_load,cluster=a\,b,hostname=myhost,type=node`
+	if k := m1.SeriesKey(); k != expected {
+		t.Errorf("expected series key %s, got %s", expected, k)
+	}
+	if m1.SeriesKey() != m2.SeriesKey() || m1.SeriesHash() != m2.SeriesHash() {
+		t.Error("messages of the same series have different keys")
+	}
+	// The hash must not change between processes and versions
+	if h := m1.SeriesHash(); h != 0x2fcac769c17db7f3 {
+		t.Errorf("unexpected series hash %#x", h)
+	}
+
+	if k := m1.SeriesKey("unit", "missing", "unit"); k != expected+";unit=load" {
+		t.Errorf("unexpected series key with meta data %s", k)
+	}
+	if m1.SeriesHash("unit") == m2.SeriesHash("unit") {
+		t.Error("meta data not included in series hash")
+	}
+
+	// Separators in values must not produce the same key as separate tags
+	m3, _ := NewMetric("cpu_load", map[string]string{"cluster": "a", "b,hostname": "myhost,type=node"}, nil, 1.0, time.Now())
+	if m3.SeriesKey() == m1.SeriesKey() {
+		t.Error("escaping of series keys failed")
+	}
+}
+
+func TestOTLPRoundTrip(t *testing.T) {
+	tm := time.Unix(1700000000, 123456789)
+	host := map[string]string{"hostname": "myhost", "cluster": "testcluster", "type": "node"}
+	socket := map[string]string{"hostname": "myhost", "cluster": "testcluster", "type": "socket", "type-id": "1"}
+	msgs := make([]CCMessage, 0)
+	add := func(m CCMessage, err error) {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		msgs = append(msgs, m)
+	}
+	add(NewMetric("cpu_load", host, map[string]string{"unit": "load", "group": "CPU"}, 1.5, tm))
+	add(NewMetric("mem_bw", socket, map[string]string{"unit": "GB/s"}, 12.25, tm))
+	add(NewMetric("mem_bw", map[string]string{"hostname": "otherhost", "type": "socket", "type-id": "0"}, map[string]string{"unit": "GB/s"}, 10.0, tm))
+	add(NewMetric("ib_recv", map[string]string{"hostname": "myhost", "cluster": "testcluster", "type": "node", "device": "mlx5_0"}, map[string]string{"metric_type": "counter"}, int64(4711), tm))
+	add(NewHistogram("latency", host, map[string]string{"unit": "s"}, Histogram{Buckets: []float64{0.1, 1}, Counts: []uint64{2, 5}, Count: 6, Sum: 3.5}, tm))
+	add(NewStructuredLog("syslog", host, nil, LOG_WARNING, "kernel", "disk almost full", map[string]interface{}{"pid": int64(123)}, tm))
+	add(NewEvent("start_job", host, nil, `{"jobId": 1}`, tm))
+
+	views := make([]CCMessageView, 0, len(msgs))
+	for _, m := range msgs {
+		views = append(views, m)
+	}
+	data, err := ToOTLP(views...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(data.Metrics.ResourceMetrics) != 2 || len(data.Logs.ResourceLogs) != 1 {
+		t.Fatalf("expected 2 metric and 1 log resources, got %d and %d", len(data.Metrics.ResourceMetrics), len(data.Logs.ResourceLogs))
+	}
+	for _, om := range data.Metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		switch om.Name {
+		case "mem_bw":
+			if om.Gauge == nil || len(om.Gauge.DataPoints) != 1 || om.Gauge.DataPoints[0].Attributes[0].Key != "socket" {
+				t.Errorf("unexpected OTLP metric %+v", om)
+			}
+		case "ib_recv":
+			if om.Sum == nil || !om.Sum.IsMonotonic || om.Sum.DataPoints[0].AsInt == nil {
+				t.Errorf("expected monotonic sum for counter, got %+v", om)
+			}
+		case "latency":
+			if om.Histogram == nil || !reflect.DeepEqual(om.Histogram.DataPoints[0].BucketCounts, []OTLPUint64{2, 3, 1}) {
+				t.Errorf("unexpected OTLP histogram %+v", om)
+			}
+		}
+	}
+
+	// Round trip through the OTLP/JSON encoding
+	metrics, err := json.Marshal(data.Metrics)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	logs, err := json.Marshal(data.Logs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(metrics), `"timeUnixNano":"1700000000123456789"`) {
+		t.Errorf("timestamp not encoded as string: %s", string(metrics))
+	}
+	var decoded OTLPData
+	if err := json.Unmarshal(metrics, &decoded.Metrics); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := json.Unmarshal(logs, &decoded.Logs); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := FromOTLP(&decoded)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(out) != len(msgs) {
+		t.Fatalf("expected %d messages, got %d", len(msgs), len(out))
+	}
+	for _, m := range msgs {
+		found := false
+		for _, o := range out {
+			if o.SeriesKey() != m.SeriesKey() {
+				continue
+			}
+			found = true
+			if !o.Time().Equal(m.Time()) || !reflect.DeepEqual(o.Meta(), m.Meta()) || !reflect.DeepEqual(o.Fields(), m.Fields()) {
+				t.Errorf("expected %s, got %s", m.String(), o.String())
+			}
+		}
+		if !found {
+			t.Errorf("message %s missing after round trip", m.String())
+		}
+	}
+
+	c, _ := NewGetControl("freq", host, nil, tm)
+	if _, err := ToOTLP(c); err == nil {
+		t.Error("expected error for control message")
+	}
+}
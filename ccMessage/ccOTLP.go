@@ -0,0 +1,656 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file contains the OpenTelemetry data model in the OTLP/JSON encoding
+// (see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding),
+// limited to the parts used by ClusterCockpit, and the conversion of
+// CCMessages to and from it.
+
+// OTLPUint64 is a 64 bit unsigned integer, encoded as JSON string like
+// fixed64 values in OTLP/JSON. Decoding also accepts JSON numbers.
+type OTLPUint64 uint64
+
+func (u OTLPUint64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(u), 10))
+}
+
+func (u *OTLPUint64) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid OTLP uint64 %s: %v", string(data), err.Error())
+	}
+	*u = OTLPUint64(v)
+	return nil
+}
+
+// OTLPInt64 is a 64 bit signed integer, encoded as JSON string like int64
+// values in OTLP/JSON. Decoding also accepts JSON numbers.
+type OTLPInt64 int64
+
+func (i OTLPInt64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *OTLPInt64) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid OTLP int64 %s: %v", string(data), err.Error())
+	}
+	*i = OTLPInt64(v)
+	return nil
+}
+
+// OTLPAnyValue is an attribute value or log body. Exactly one of the values is set.
+type OTLPAnyValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	BoolValue   *bool      `json:"boolValue,omitempty"`
+	IntValue    *OTLPInt64 `json:"intValue,omitempty"`
+	DoubleValue *float64   `json:"doubleValue,omitempty"`
+}
+
+type OTLPKeyValue struct {
+	Key   string       `json:"key"`
+	Value OTLPAnyValue `json:"value"`
+}
+
+type OTLPResource struct {
+	Attributes []OTLPKeyValue `json:"attributes,omitempty"`
+}
+
+type OTLPScope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Aggregation temporality of sums and histograms
+const (
+	OTLP_TEMPORALITY_DELTA      = 1
+	OTLP_TEMPORALITY_CUMULATIVE = 2
+)
+
+type OTLPNumberDataPoint struct {
+	Attributes        []OTLPKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano OTLPUint64     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      OTLPUint64     `json:"timeUnixNano"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+	AsInt             *OTLPInt64     `json:"asInt,omitempty"`
+}
+
+// OTLPHistogramDataPoint is a histogram with explicit bounds. Unlike the
+// CCMessage histogram, the bucket counts are not cumulative and there is one
+// more bucket count than bounds for the +Inf bucket.
+type OTLPHistogramDataPoint struct {
+	Attributes        []OTLPKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano OTLPUint64     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      OTLPUint64     `json:"timeUnixNano"`
+	Count             OTLPUint64     `json:"count"`
+	Sum               *float64       `json:"sum,omitempty"`
+	BucketCounts      []OTLPUint64   `json:"bucketCounts,omitempty"`
+	ExplicitBounds    []float64      `json:"explicitBounds,omitempty"`
+}
+
+type OTLPGauge struct {
+	DataPoints []OTLPNumberDataPoint `json:"dataPoints"`
+}
+
+type OTLPSum struct {
+	DataPoints             []OTLPNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic,omitempty"`
+}
+
+type OTLPHistogram struct {
+	DataPoints             []OTLPHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+// OTLPMetric is a metric with the data points of one of gauge, sum or histogram
+type OTLPMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *OTLPGauge     `json:"gauge,omitempty"`
+	Sum         *OTLPSum       `json:"sum,omitempty"`
+	Histogram   *OTLPHistogram `json:"histogram,omitempty"`
+}
+
+type OTLPScopeMetrics struct {
+	Scope   OTLPScope    `json:"scope"`
+	Metrics []OTLPMetric `json:"metrics"`
+}
+
+type OTLPResourceMetrics struct {
+	Resource     OTLPResource       `json:"resource"`
+	ScopeMetrics []OTLPScopeMetrics `json:"scopeMetrics"`
+}
+
+// OTLPMetricsData is the payload of OTLP metrics exports (/v1/metrics)
+type OTLPMetricsData struct {
+	ResourceMetrics []OTLPResourceMetrics `json:"resourceMetrics"`
+}
+
+type OTLPLogRecord struct {
+	TimeUnixNano         OTLPUint64     `json:"timeUnixNano,omitempty"`
+	ObservedTimeUnixNano OTLPUint64     `json:"observedTimeUnixNano,omitempty"`
+	SeverityNumber       int            `json:"severityNumber,omitempty"`
+	SeverityText         string         `json:"severityText,omitempty"`
+	Body                 OTLPAnyValue   `json:"body"`
+	Attributes           []OTLPKeyValue `json:"attributes,omitempty"`
+}
+
+type OTLPScopeLogs struct {
+	Scope      OTLPScope       `json:"scope"`
+	LogRecords []OTLPLogRecord `json:"logRecords"`
+}
+
+type OTLPResourceLogs struct {
+	Resource  OTLPResource    `json:"resource"`
+	ScopeLogs []OTLPScopeLogs `json:"scopeLogs"`
+}
+
+// OTLPLogsData is the payload of OTLP log exports (/v1/logs)
+type OTLPLogsData struct {
+	ResourceLogs []OTLPResourceLogs `json:"resourceLogs"`
+}
+
+// OTLPData contains the metrics and logs converted by ToOTLP. They have to
+// be sent separately to the metrics and logs endpoints.
+type OTLPData struct {
+	Metrics OTLPMetricsData
+	Logs    OTLPLogsData
+}
+
+// Attribute names and meta data used by the OTLP conversion
+const (
+	OTLP_SCOPE_NAME             = "cc-lib"
+	OTLP_HOSTNAME_ATTRIBUTE     = "host.name"   // Resource attribute of the hostname tag
+	OTLP_CLUSTER_ATTRIBUTE      = "cluster"     // Resource attribute of the cluster tag
+	OTLP_EVENT_NAME_ATTRIBUTE   = "event.name"  // Log record attribute with the name of event messages
+	OTLP_LOG_NAME_ATTRIBUTE     = "log.name"    // Log record attribute with the name of log messages
+	OTLP_META_PREFIX            = "meta."       // Prefix of attributes for meta data
+	OTLP_FIELD_PREFIX           = "field."      // Prefix of log record attributes for additional log fields
+	CCMSG_OTLP_METRIC_TYPE_META = "metric_type" // Meta data selecting the OTLP metric type
+)
+
+// Values of the meta data metric_type
+const (
+	OTLP_METRIC_TYPE_GAUGE   = "gauge"   // Gauge (default)
+	OTLP_METRIC_TYPE_COUNTER = "counter" // Monotonic cumulative sum
+	OTLP_METRIC_TYPE_SUM     = "sum"     // Non-monotonic cumulative sum
+	OTLP_METRIC_TYPE_DELTA   = "delta"   // Non-monotonic delta sum
+)
+
+// otlpTypes are the ClusterCockpit types which are mapped to a data point
+// attribute named after the type with the type-id as value, like the
+// labels of the Prometheus sink
+var otlpTypes = []string{"hwthread", "core", "llc", "memoryDomain", "die", "socket", "accelerator"}
+
+// otlpSeverity maps syslog severities to OTLP severity numbers
+var otlpSeverity = map[LogSeverity]int{
+	LOG_EMERGENCY: 24, // FATAL4
+	LOG_ALERT:     23, // FATAL3
+	LOG_CRITICAL:  21, // FATAL
+	LOG_ERROR:     17, // ERROR
+	LOG_WARNING:   13, // WARN
+	LOG_NOTICE:    10, // INFO2
+	LOG_INFO:      9,  // INFO
+	LOG_DEBUG:     5,  // DEBUG
+}
+
+// severityFromOTLP maps OTLP severity numbers to syslog severities
+func severityFromOTLP(n int) (LogSeverity, bool) {
+	switch {
+	case n <= 0 || n > 24:
+		return LOG_INFO, false
+	case n <= 8:
+		return LOG_DEBUG, true
+	case n == 9:
+		return LOG_INFO, true
+	case n <= 12:
+		return LOG_NOTICE, true
+	case n <= 16:
+		return LOG_WARNING, true
+	case n <= 20:
+		return LOG_ERROR, true
+	case n <= 22:
+		return LOG_CRITICAL, true
+	case n == 23:
+		return LOG_ALERT, true
+	}
+	return LOG_EMERGENCY, true
+}
+
+func otlpString(s string) OTLPAnyValue {
+	return OTLPAnyValue{StringValue: &s}
+}
+
+// otlpValue converts a field value to an OTLP value
+func otlpValue(v interface{}) (OTLPAnyValue, bool) {
+	switch x := convertField(v).(type) {
+	case float64:
+		return OTLPAnyValue{DoubleValue: &x}, true
+	case int64:
+		i := OTLPInt64(x)
+		return OTLPAnyValue{IntValue: &i}, true
+	case uint64:
+		f := float64(x)
+		return OTLPAnyValue{DoubleValue: &f}, true
+	case bool:
+		return OTLPAnyValue{BoolValue: &x}, true
+	case string:
+		return otlpString(x), true
+	}
+	return OTLPAnyValue{}, false
+}
+
+// Value returns the value as field value
+func (v OTLPAnyValue) Value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	}
+	return nil
+}
+
+// String returns the value as string, e.g. for tags
+func (v OTLPAnyValue) String() string {
+	switch x := v.Value().(type) {
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	return ""
+}
+
+// sortedAttributes sorts the attributes by their keys
+func sortedAttributes(attrs []OTLPKeyValue) []OTLPKeyValue {
+	slices.SortFunc(attrs, func(a, b OTLPKeyValue) int { return strings.Compare(a.Key, b.Key) })
+	return attrs
+}
+
+// otlpAttributes returns the resource and data point attributes of the
+// message. Hostname and cluster become resource attributes, type and
+// type-id become an attribute named after the type, all other tags are
+// attributes with the same name and meta data are attributes with the
+// prefix "meta.". The meta data unit and metric_type and the tags in skip
+// are left out.
+func otlpAttributes(m CCMessageView, skip ...string) (resource, attrs []OTLPKeyValue) {
+	t, hasType := m.GetTag("type")
+	tid, hasTypeID := m.GetTag("type-id")
+	typeAttr := hasType && hasTypeID && slices.Contains(otlpTypes, t)
+	for k, v := range m.AllTags() {
+		switch {
+		case k == "hostname":
+			resource = append(resource, OTLPKeyValue{OTLP_HOSTNAME_ATTRIBUTE, otlpString(v)})
+		case k == "cluster":
+			resource = append(resource, OTLPKeyValue{OTLP_CLUSTER_ATTRIBUTE, otlpString(v)})
+		case k == "type" && (typeAttr || v == "node"):
+		case k == "type-id" && typeAttr:
+		case slices.Contains(skip, k):
+		default:
+			attrs = append(attrs, OTLPKeyValue{k, otlpString(v)})
+		}
+	}
+	if typeAttr {
+		attrs = append(attrs, OTLPKeyValue{t, otlpString(tid)})
+	}
+	for k, v := range m.AllMeta() {
+		if k != "unit" && k != CCMSG_OTLP_METRIC_TYPE_META {
+			attrs = append(attrs, OTLPKeyValue{OTLP_META_PREFIX + k, otlpString(v)})
+		}
+	}
+	return sortedAttributes(resource), sortedAttributes(attrs)
+}
+
+// resourceKey identifies equal resources
+func resourceKey(attrs []OTLPKeyValue) string {
+	var b strings.Builder
+	for _, a := range attrs {
+		b.WriteString(a.Key)
+		b.WriteByte('=')
+		b.WriteString(a.Value.String())
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// ToOTLP converts the messages to OTLP metrics and logs:
+//
+//   - Metrics become gauges or, depending on the meta data metric_type, sums.
+//     The meta data unit is the unit of the metric.
+//   - Histograms become OTLP histograms with explicit bounds.
+//   - Log messages become log records with the log as body and the name in
+//     the attribute log.name. The severity is mapped to the OTLP severity
+//     number, additional fields are attributes with the prefix "field.".
+//   - Events become log records with the event as body and the name in the
+//     attribute event.name.
+//
+// The tags hostname and cluster are resource attributes (host.name and
+// cluster), the tags type and type-id are mapped like the labels of the
+// Prometheus sink to an attribute named after the type with the type-id as
+// value (e.g. socket="0"), the type node is left out. All other tags are
+// data point attributes, meta data are data point attributes with the
+// prefix "meta.". Control messages cannot be converted.
+func ToOTLP(msgs ...CCMessageView) (*OTLPData, error) {
+	data := &OTLPData{
+		Metrics: OTLPMetricsData{ResourceMetrics: []OTLPResourceMetrics{}},
+		Logs:    OTLPLogsData{ResourceLogs: []OTLPResourceLogs{}},
+	}
+	scope := OTLPScope{Name: OTLP_SCOPE_NAME}
+	metricResources := make(map[string]int)
+	logResources := make(map[string]int)
+	metricIndex := make(map[string]int)
+
+	// scopeMetrics returns the metrics of the resource
+	scopeMetrics := func(resource []OTLPKeyValue) *OTLPScopeMetrics {
+		key := resourceKey(resource)
+		idx, ok := metricResources[key]
+		if !ok {
+			idx = len(data.Metrics.ResourceMetrics)
+			metricResources[key] = idx
+			data.Metrics.ResourceMetrics = append(data.Metrics.ResourceMetrics, OTLPResourceMetrics{
+				Resource:     OTLPResource{Attributes: resource},
+				ScopeMetrics: []OTLPScopeMetrics{{Scope: scope, Metrics: []OTLPMetric{}}},
+			})
+		}
+		return &data.Metrics.ResourceMetrics[idx].ScopeMetrics[0]
+	}
+	// metric returns the metric of the resource with the given name, type and unit
+	metric := func(resource []OTLPKeyValue, name, metricType, unit string) *OTLPMetric {
+		sm := scopeMetrics(resource)
+		key := strings.Join([]string{resourceKey(resource), name, metricType, unit}, "\x00")
+		idx, ok := metricIndex[key]
+		if !ok {
+			idx = len(sm.Metrics)
+			metricIndex[key] = idx
+			m := OTLPMetric{Name: name, Unit: unit}
+			switch metricType {
+			case OTLP_METRIC_TYPE_COUNTER:
+				m.Sum = &OTLPSum{AggregationTemporality: OTLP_TEMPORALITY_CUMULATIVE, IsMonotonic: true}
+			case OTLP_METRIC_TYPE_SUM:
+				m.Sum = &OTLPSum{AggregationTemporality: OTLP_TEMPORALITY_CUMULATIVE}
+			case OTLP_METRIC_TYPE_DELTA:
+				m.Sum = &OTLPSum{AggregationTemporality: OTLP_TEMPORALITY_DELTA}
+			case "histogram":
+				m.Histogram = &OTLPHistogram{AggregationTemporality: OTLP_TEMPORALITY_CUMULATIVE}
+			default:
+				m.Gauge = &OTLPGauge{}
+			}
+			sm.Metrics = append(sm.Metrics, m)
+		}
+		return &sm.Metrics[idx]
+	}
+	// addLogRecord appends the log record to the logs of the resource
+	addLogRecord := func(resource []OTLPKeyValue, record OTLPLogRecord) {
+		key := resourceKey(resource)
+		idx, ok := logResources[key]
+		if !ok {
+			idx = len(data.Logs.ResourceLogs)
+			logResources[key] = idx
+			data.Logs.ResourceLogs = append(data.Logs.ResourceLogs, OTLPResourceLogs{
+				Resource:  OTLPResource{Attributes: resource},
+				ScopeLogs: []OTLPScopeLogs{{Scope: scope, LogRecords: []OTLPLogRecord{}}},
+			})
+		}
+		sl := &data.Logs.ResourceLogs[idx].ScopeLogs[0]
+		sl.LogRecords = append(sl.LogRecords, record)
+	}
+
+	for _, m := range msgs {
+		tm := OTLPUint64(m.Time().UnixNano())
+		unit, _ := m.GetMeta("unit")
+		switch m.MessageType() {
+		case CCMSG_TYPE_METRIC:
+			resource, attrs := otlpAttributes(m)
+			v, _ := otlpValue(m.GetMetricValue())
+			dp := OTLPNumberDataPoint{Attributes: attrs, TimeUnixNano: tm, AsDouble: v.DoubleValue, AsInt: v.IntValue}
+			if dp.AsDouble == nil && dp.AsInt == nil {
+				return nil, fmt.Errorf("metric %s has no numeric value", m.Name())
+			}
+			metricType, _ := m.GetMeta(CCMSG_OTLP_METRIC_TYPE_META)
+			om := metric(resource, m.Name(), metricType, unit)
+			if om.Sum != nil {
+				om.Sum.DataPoints = append(om.Sum.DataPoints, dp)
+			} else {
+				om.Gauge.DataPoints = append(om.Gauge.DataPoints, dp)
+			}
+		case CCMSG_TYPE_HISTOGRAM:
+			hist, err := m.GetHistogram()
+			if err != nil {
+				return nil, err
+			}
+			resource, attrs := otlpAttributes(m)
+			dp := OTLPHistogramDataPoint{
+				Attributes:     attrs,
+				TimeUnixNano:   tm,
+				Count:          OTLPUint64(hist.Count),
+				Sum:            &hist.Sum,
+				BucketCounts:   make([]OTLPUint64, len(hist.Counts)+1),
+				ExplicitBounds: hist.Buckets,
+			}
+			var last uint64
+			for i, c := range hist.Counts {
+				dp.BucketCounts[i] = OTLPUint64(c - last)
+				last = c
+			}
+			dp.BucketCounts[len(hist.Counts)] = OTLPUint64(hist.Count - last)
+			om := metric(resource, m.Name(), "histogram", unit)
+			om.Histogram.DataPoints = append(om.Histogram.DataPoints, dp)
+		case CCMSG_TYPE_LOG:
+			resource, attrs := otlpAttributes(m, CCMSG_LOG_SEVERITY_TAG)
+			attrs = append(attrs, OTLPKeyValue{OTLP_LOG_NAME_ATTRIBUTE, otlpString(m.Name())})
+			for k, v := range m.AllFields() {
+				if k == "log" {
+					continue
+				}
+				if value, ok := otlpValue(v); ok {
+					attrs = append(attrs, OTLPKeyValue{OTLP_FIELD_PREFIX + k, value})
+				}
+			}
+			record := OTLPLogRecord{TimeUnixNano: tm, Body: otlpString(m.GetLogValue()), Attributes: sortedAttributes(attrs)}
+			if s, ok := m.GetTag(CCMSG_LOG_SEVERITY_TAG); ok {
+				if severity, err := ParseLogSeverity(s); err == nil {
+					record.SeverityNumber = otlpSeverity[severity]
+					record.SeverityText = severity.String()
+				}
+			}
+			addLogRecord(resource, record)
+		case CCMSG_TYPE_EVENT:
+			resource, attrs := otlpAttributes(m)
+			attrs = append(attrs, OTLPKeyValue{OTLP_EVENT_NAME_ATTRIBUTE, otlpString(m.Name())})
+			addLogRecord(resource, OTLPLogRecord{TimeUnixNano: tm, Body: otlpString(m.GetEventValue()), Attributes: sortedAttributes(attrs)})
+		default:
+			return nil, fmt.Errorf("cannot convert %s message %s to OTLP", m.MessageType(), m.Name())
+		}
+	}
+	return data, nil
+}
+
+// fromOTLPAttributes adds the attributes as tags and meta data, reverting
+// the mapping of ToOTLP
+func fromOTLPAttributes(attrs []OTLPKeyValue, tags, meta map[string]string) {
+	for _, a := range attrs {
+		v := a.Value.String()
+		switch {
+		case a.Key == OTLP_HOSTNAME_ATTRIBUTE:
+			tags["hostname"] = v
+		case strings.HasPrefix(a.Key, OTLP_META_PREFIX):
+			meta[strings.TrimPrefix(a.Key, OTLP_META_PREFIX)] = v
+		case slices.Contains(otlpTypes, a.Key):
+			tags["type"] = a.Key
+			tags["type-id"] = v
+		default:
+			tags[a.Key] = v
+		}
+	}
+}
+
+// fromOTLPTags returns the tags and meta data of a data point or log record
+func fromOTLPTags(resource, attrs []OTLPKeyValue) (map[string]string, map[string]string) {
+	tags := make(map[string]string, len(resource)+len(attrs))
+	meta := make(map[string]string)
+	fromOTLPAttributes(resource, tags, meta)
+	fromOTLPAttributes(attrs, tags, meta)
+	return tags, meta
+}
+
+// FromOTLP converts OTLP metrics and logs to messages, reverting the
+// mapping of ToOTLP. Data points without a ClusterCockpit type attribute get
+// the type node. Sums get the meta data metric_type (counter, sum or delta),
+// histograms with explicit bounds become histogram messages, log records
+// with the attribute event.name become events and all other log records
+// become log messages.
+func FromOTLP(data *OTLPData) ([]CCMessage, error) {
+	out := make([]CCMessage, 0)
+	add := func(m CCMessage, err error) error {
+		if err != nil {
+			return err
+		}
+		if !m.HasTag("type") {
+			m.AddTag("type", "node")
+		}
+		out = append(out, m)
+		return nil
+	}
+
+	for _, rm := range data.Metrics.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, om := range sm.Metrics {
+				var points []OTLPNumberDataPoint
+				metricType := ""
+				switch {
+				case om.Gauge != nil:
+					points = om.Gauge.DataPoints
+				case om.Sum != nil:
+					points = om.Sum.DataPoints
+					switch {
+					case om.Sum.AggregationTemporality == OTLP_TEMPORALITY_DELTA:
+						metricType = OTLP_METRIC_TYPE_DELTA
+					case om.Sum.IsMonotonic:
+						metricType = OTLP_METRIC_TYPE_COUNTER
+					default:
+						metricType = OTLP_METRIC_TYPE_SUM
+					}
+				case om.Histogram != nil:
+					for _, dp := range om.Histogram.DataPoints {
+						if len(dp.BucketCounts) > 0 && len(dp.BucketCounts) != len(dp.ExplicitBounds)+1 {
+							return nil, fmt.Errorf("histogram %s: %d bucket counts for %d bounds", om.Name, len(dp.BucketCounts), len(dp.ExplicitBounds))
+						}
+						hist := Histogram{
+							Buckets: dp.ExplicitBounds,
+							Counts:  make([]uint64, len(dp.ExplicitBounds)),
+							Count:   uint64(dp.Count),
+						}
+						if dp.Sum != nil {
+							hist.Sum = *dp.Sum
+						}
+						var sum uint64
+						for i := range dp.ExplicitBounds {
+							if i < len(dp.BucketCounts) {
+								sum += uint64(dp.BucketCounts[i])
+							}
+							hist.Counts[i] = sum
+						}
+						tags, meta := fromOTLPTags(rm.Resource.Attributes, dp.Attributes)
+						if len(om.Unit) > 0 {
+							meta["unit"] = om.Unit
+						}
+						err := add(NewHistogram(om.Name, tags, meta, hist, time.Unix(0, int64(dp.TimeUnixNano))))
+						if err != nil {
+							return nil, fmt.Errorf("histogram %s: %v", om.Name, err.Error())
+						}
+					}
+					continue
+				default:
+					return nil, fmt.Errorf("metric %s has unsupported OTLP type", om.Name)
+				}
+				for _, dp := range points {
+					var value interface{}
+					switch {
+					case dp.AsDouble != nil:
+						value = *dp.AsDouble
+					case dp.AsInt != nil:
+						value = int64(*dp.AsInt)
+					default:
+						return nil, fmt.Errorf("metric %s: data point without value", om.Name)
+					}
+					tags, meta := fromOTLPTags(rm.Resource.Attributes, dp.Attributes)
+					if len(om.Unit) > 0 {
+						meta["unit"] = om.Unit
+					}
+					if len(metricType) > 0 {
+						meta[CCMSG_OTLP_METRIC_TYPE_META] = metricType
+					}
+					if err := add(NewMetric(om.Name, tags, meta, value, time.Unix(0, int64(dp.TimeUnixNano)))); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	for _, rl := range data.Logs.ResourceLogs {
+		for _, sl := range rl.ScopeLogs {
+			for _, r := range sl.LogRecords {
+				tm := time.Unix(0, int64(r.TimeUnixNano))
+				if r.TimeUnixNano == 0 {
+					tm = time.Unix(0, int64(r.ObservedTimeUnixNano))
+				}
+				name := "log"
+				isEvent := false
+				attrs := make([]OTLPKeyValue, 0, len(r.Attributes))
+				fields := make(map[string]interface{})
+				for _, a := range r.Attributes {
+					switch {
+					case a.Key == OTLP_EVENT_NAME_ATTRIBUTE:
+						name, isEvent = a.Value.String(), true
+					case a.Key == OTLP_LOG_NAME_ATTRIBUTE:
+						name = a.Value.String()
+					case strings.HasPrefix(a.Key, OTLP_FIELD_PREFIX):
+						fields[strings.TrimPrefix(a.Key, OTLP_FIELD_PREFIX)] = a.Value.Value()
+					default:
+						attrs = append(attrs, a)
+					}
+				}
+				tags, meta := fromOTLPTags(rl.Resource.Attributes, attrs)
+				if isEvent {
+					if err := add(NewEvent(name, tags, meta, r.Body.String(), tm)); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if severity, ok := severityFromOTLP(r.SeverityNumber); ok {
+					tags[CCMSG_LOG_SEVERITY_TAG] = severity.String()
+				}
+				fields["log"] = r.Body.String()
+				if err := add(NewMessage(name, tags, meta, fields, tm)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return out, nil
+}
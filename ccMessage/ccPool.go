@@ -0,0 +1,127 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cowMap is a reference counted map that is shared between copies of a
+// message until one of them modifies it (copy-on-write). All methods
+// accept a nil *cowMap, which behaves like an empty map.
+type cowMap[V any] struct {
+	refs atomic.Int32 // number of messages using the map
+	m    map[string]V
+}
+
+func newCowMap[V any](size int) *cowMap[V] {
+	c := &cowMap[V]{m: make(map[string]V, size)}
+	c.refs.Store(1)
+	return c
+}
+
+// get returns the map for reading
+func (c *cowMap[V]) get() map[string]V {
+	if c == nil {
+		return nil
+	}
+	return c.m
+}
+
+// share adds a reference for another message
+func (c *cowMap[V]) share() *cowMap[V] {
+	if c != nil {
+		c.refs.Add(1)
+	}
+	return c
+}
+
+// writable returns a map exclusively owned by the caller, either c itself
+// or a copy of it
+func (c *cowMap[V]) writable() *cowMap[V] {
+	if c == nil {
+		return newCowMap[V](0)
+	}
+	if c.refs.Load() == 1 {
+		return c
+	}
+	n := newCowMap[V](len(c.m))
+	for k, v := range c.m {
+		n.m[k] = v
+	}
+	c.refs.Add(-1)
+	return n
+}
+
+// release drops a reference. If it was the last one, the cleared map is
+// returned for reuse, otherwise nil.
+func (c *cowMap[V]) release() *cowMap[V] {
+	if c == nil || c.refs.Add(-1) != 0 {
+		return nil
+	}
+	clear(c.m)
+	c.refs.Store(1)
+	return c
+}
+
+// reset returns an empty map exclusively owned by the caller, reusing c if possible
+func (c *cowMap[V]) reset() *cowMap[V] {
+	if r := c.release(); r != nil {
+		return r
+	}
+	return newCowMap[V](0)
+}
+
+var messagePool = sync.Pool{
+	New: func() any {
+		return new(ccMessage)
+	},
+}
+
+// acquire returns an empty message with exclusively owned maps from the pool
+func acquire() *ccMessage {
+	m := messagePool.Get().(*ccMessage)
+	if m.tags == nil {
+		m.tags = newCowMap[string](0)
+	}
+	if m.meta == nil {
+		m.meta = newCowMap[string](0)
+	}
+	if m.fields == nil {
+		m.fields = newCowMap[interface{}](0)
+	}
+	return m
+}
+
+// Acquire returns an empty message from the message pool. Pass it to
+// Release when it is not used anymore.
+func Acquire() CCMessage {
+	return acquire()
+}
+
+// Release returns a message to the message pool. The message must not be
+// used afterwards. Copies of it are not affected.
+func Release(m CCMessage) {
+	if x, ok := m.(*ccMessage); ok && x != nil {
+		x.name = ""
+		x.tm = time.Time{}
+		x.tags = x.tags.release()
+		x.meta = x.meta.release()
+		x.fields = x.fields.release()
+		messagePool.Put(x)
+	}
+}
+
+// Reset clears name, tags, meta data, fields and timestamp of the message.
+// Copies of the message are not affected.
+func (m *ccMessage) Reset() {
+	m.name = ""
+	m.tm = time.Time{}
+	m.tags = m.tags.reset()
+	m.meta = m.meta.reset()
+	m.fields = m.fields.reset()
+}
@@ -0,0 +1,80 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"hash/fnv"
+	"slices"
+)
+
+// appendSeriesEscaped appends s with the separators of the series key
+// escaped by a backslash
+func appendSeriesEscaped(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\', ',', '=', ';':
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, s[i])
+	}
+	return dst
+}
+
+// appendSeriesKey appends the series key of the message to dst
+func (m *ccMessage) appendSeriesKey(dst []byte, metaKeys []string) []byte {
+	dst = appendSeriesEscaped(dst, m.name)
+
+	tags := m.tags.get()
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		dst = append(dst, ',')
+		dst = appendSeriesEscaped(dst, k)
+		dst = append(dst, '=')
+		dst = appendSeriesEscaped(dst, tags[k])
+	}
+
+	if len(metaKeys) > 0 {
+		meta := m.meta.get()
+		keys = append(keys[:0], metaKeys...)
+		slices.Sort(keys)
+		keys = slices.Compact(keys)
+		for _, k := range keys {
+			if v, ok := meta[k]; ok {
+				dst = append(dst, ';')
+				dst = appendSeriesEscaped(dst, k)
+				dst = append(dst, '=')
+				dst = appendSeriesEscaped(dst, v)
+			}
+		}
+	}
+	return dst
+}
+
+// SeriesKey returns the canonical identity of the time series the message
+// belongs to: the name followed by the tags sorted by key and the given meta
+// data keys, if present:
+//
+//	name,tag1=value1,tag2=value2;meta1=value1
+//
+// Backslashes, commas, equal signs and semicolons in names, keys and values
+// are escaped with a backslash. Fields and the timestamp are not part of the
+// key.
+func (m *ccMessage) SeriesKey(metaKeys ...string) string {
+	return string(m.appendSeriesKey(nil, metaKeys))
+}
+
+// SeriesHash returns the 64 bit FNV-1a hash of the series key. The hash only
+// depends on the series key, so it is stable across processes and can be
+// used for sharding and consistent hashing.
+func (m *ccMessage) SeriesHash(metaKeys ...string) uint64 {
+	var buf [256]byte
+	h := fnv.New64a()
+	h.Write(m.appendSeriesKey(buf[:0], metaKeys))
+	return h.Sum64()
+}
@@ -0,0 +1,156 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tags required by the ClusterCockpit specification. The tag type-id is only
+// required if the type is not "node".
+var DefaultRequiredTags = []string{"hostname", "type", "type-id"}
+
+// ValidationOptions configure the checks of Validate
+type ValidationOptions struct {
+	// Tags every message must have. If nil, DefaultRequiredTags are used
+	RequiredTags []string `json:"required_tags,omitempty"`
+	// Accept NaN and Inf as field values
+	AllowNonFinite bool `json:"allow_non_finite,omitempty"`
+}
+
+// checkString checks that s is not empty, valid UTF-8 and contains no
+// control characters, which cannot be encoded in the line protocol
+func checkString(what, s string) error {
+	if len(s) == 0 {
+		return fmt.Errorf("empty %s", what)
+	}
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("%s %q is no valid UTF-8", what, s)
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%s %q contains illegal character %U", what, s, r)
+		}
+	}
+	return nil
+}
+
+// Validate checks the message against the line protocol and the ClusterCockpit
+// conventions: name, tag keys and values and field keys must be non-empty
+// strings without control characters, field values must be of supported types
+// and finite, the value, event, log and control fields must have the type of
+// their message type, and the required tags must be present. All problems are
+// returned at once, joined with errors.Join.
+func Validate(m CCMessageView, opts ValidationOptions) error {
+	var errs []error
+	if err := checkString("name", m.Name()); err != nil {
+		errs = append(errs, err)
+	}
+
+	required := opts.RequiredTags
+	if required == nil {
+		required = DefaultRequiredTags
+	}
+	for _, key := range required {
+		if key == "type-id" {
+			if t, ok := m.GetTag("type"); !ok || t == "node" {
+				continue
+			}
+		}
+		if !m.HasTag(key) {
+			errs = append(errs, fmt.Errorf("missing required tag %s", key))
+		}
+	}
+	for k, v := range m.AllTags() {
+		if err := checkString("tag key", k); err != nil {
+			errs = append(errs, err)
+		}
+		if err := checkString(fmt.Sprintf("value of tag %s", k), v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	numFields := 0
+	for k, v := range m.AllFields() {
+		numFields++
+		if err := checkString("field key", k); err != nil {
+			errs = append(errs, err)
+		}
+		switch x := convertField(v).(type) {
+		case nil:
+			errs = append(errs, fmt.Errorf("field %s has unsupported type %T", k, v))
+		case float64:
+			if !opts.AllowNonFinite && (math.IsNaN(x) || math.IsInf(x, 0)) {
+				errs = append(errs, fmt.Errorf("field %s has non-finite value %v", k, x))
+			}
+		}
+	}
+	if numFields == 0 {
+		errs = append(errs, errors.New("message has no fields"))
+	}
+
+	// Type of the fields defining the message type
+	switch m.MessageType() {
+	case CCMSG_TYPE_METRIC:
+		v, _ := m.GetField("value")
+		switch convertField(v).(type) {
+		case float64, int64, uint64:
+		default:
+			errs = append(errs, fmt.Errorf("metric value %v is not numeric (%T)", v, v))
+		}
+	case CCMSG_TYPE_EVENT, CCMSG_TYPE_LOG, CCMSG_TYPE_CONTROL:
+		key := m.MessageType().String()
+		if v, _ := m.GetField(key); convertField(v) != nil {
+			if _, ok := v.(string); !ok {
+				errs = append(errs, fmt.Errorf("%s field is no string (%T)", key, v))
+			}
+		}
+	case CCMSG_TYPE_HISTOGRAM:
+		if _, err := m.GetHistogram(); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		if numFields > 0 {
+			errs = append(errs, errors.New("message has no value, event, log, control or histogram field"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validator validates messages with fixed options, e.g. as configured for a
+// receiver, and counts the invalid messages. It can be used concurrently.
+type Validator struct {
+	ValidationOptions
+	// Drop invalid messages instead of only counting them
+	Reject bool `json:"reject,omitempty"`
+
+	invalid atomic.Uint64
+}
+
+// Check validates the message and counts it if it is invalid. A nil
+// Validator accepts all messages.
+func (v *Validator) Check(m CCMessageView) error {
+	if v == nil {
+		return nil
+	}
+	err := Validate(m, v.ValidationOptions)
+	if err != nil {
+		v.invalid.Add(1)
+	}
+	return err
+}
+
+// Invalid returns the number of invalid messages seen by Check
+func (v *Validator) Invalid() uint64 {
+	if v == nil {
+		return 0
+	}
+	return v.invalid.Load()
+}
@@ -0,0 +1,121 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package ccmessage
+
+import (
+	"encoding/json"
+	"iter"
+	"maps"
+	"time"
+
+	"github.com/ClusterCockpit/cc-lib/schema"
+	write "github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// CCMessageView provides read-only access to a CCMessage. It is used to hand
+// out the same message to multiple consumers (e.g. sinks), which must not
+// modify it. Consumers that need to change the message use Mutable() to get
+// their own copy.
+type CCMessageView interface {
+	ToPoint(metaAsTags map[string]bool) *write.Point  // Generate influxDB point for data type ccMessage
+	ToLineProtocol(metaAsTags map[string]bool) string // Generate influxDB line protocol for data type ccMessage
+	ToJSON(metaAsTags map[string]bool) (json.RawMessage, error)
+
+	Name() string    // Get metric name
+	Time() time.Time // Get timestamp
+
+	AllTags() iter.Seq2[string, string]        // Iterate over all tags
+	GetTag(key string) (value string, ok bool) // Get a tag by its key
+	HasTag(key string) (ok bool)               // Check if a tag key is present
+
+	AllMeta() iter.Seq2[string, string]         // Iterate over all meta data tags
+	GetMeta(key string) (value string, ok bool) // Get a meta data tab addressed by its key
+	HasMeta(key string) (ok bool)               // Check if a meta data key is present
+
+	AllFields() iter.Seq2[string, interface{}]        // Iterate over all fields
+	GetField(key string) (value interface{}, ok bool) // Get a field addressed by its key
+	HasField(key string) (ok bool)                    // Check if a field key is present
+	String() string                                   // Return line-protocol like string
+
+	SeriesKey(metaKeys ...string) string  // Canonical key of the time series (name, tags and selected meta data)
+	SeriesHash(metaKeys ...string) uint64 // Stable FNV-1a hash of the series key
+
+	MessageType() CCMessageType // Return message type
+	IsMetric() bool
+	GetMetricValue() interface{}
+	IsLog() bool
+	GetLogValue() string
+	GetLogSeverity() (severity LogSeverity, ok bool) // Get the severity of a log message
+	GetLogFacility() string                          // Get the facility of a log message
+	GetLogAttributes() map[string]interface{}        // Get the fields of a log message except the log field
+	IsEvent() bool
+	GetEventValue() string
+	IsJobEvent() (string, bool)                                    // Get the name of the job event
+	GetJob() (*schema.JobMeta, error)                              // Get the job of a job event
+	GetJobMetaUpdate() (*schema.JobMeta, map[string]string, error) // Get the job and the changed meta data of an update_job_meta event
+	GetJobTag() (*schema.JobMeta, *schema.Tag, error)              // Get the job and the added tag of an add_job_tag event
+	GetJobStateChange() (*schema.JobMeta, schema.JobState, error)  // Get the job and the new state of a change_job_state event
+	IsControl() bool
+	GetControlValue() string
+	GetControlMethod() string
+	IsControlReply() bool              // Check if the message is a reply to a control request
+	GetControlRequestID() string       // Get the request ID of a control message
+	GetControlStatus() (string, error) // Get the status of a control reply and the reported error
+	IsHistogram() bool
+	GetHistogram() (Histogram, error)
+
+	Mutable() CCMessage // Get a copy of the message that can be modified
+}
+
+// readOnlyMessage hides the modifying functions of a CCMessage
+type readOnlyMessage struct {
+	CCMessageView
+}
+
+// ReadOnly returns a read-only view of the message. The view does not copy
+// the message, so m must not be modified while the view is in use.
+func ReadOnly(m CCMessage) CCMessageView {
+	if m == nil {
+		return nil
+	}
+	return readOnlyMessage{m}
+}
+
+// AllTags returns an iterator over all tags
+func (m *ccMessage) AllTags() iter.Seq2[string, string] {
+	return maps.All(m.tags.get())
+}
+
+// AllMeta returns an iterator over all meta data tags
+func (m *ccMessage) AllMeta() iter.Seq2[string, string] {
+	return maps.All(m.meta.get())
+}
+
+// AllFields returns an iterator over all fields
+func (m *ccMessage) AllFields() iter.Seq2[string, interface{}] {
+	return maps.All(m.fields.get())
+}
+
+// ReadMaps returns the tags, meta data and fields of the message for reading
+// without copying them. Unlike the iterators, it does not allocate, which
+// matters in hot paths like the message processor. The maps may be shared with
+// copies of the message and must not be modified. ok is false for
+// implementations of CCMessageView outside of this package.
+func ReadMaps(m CCMessageView) (tags, meta map[string]string, fields map[string]interface{}, ok bool) {
+	if v, isView := m.(readOnlyMessage); isView {
+		m = v.CCMessageView
+	}
+	c, ok := m.(*ccMessage)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	return c.tags.get(), c.meta.get(), c.fields.get(), true
+}
+
+// Mutable returns a copy of the message. Tags, meta data and fields are
+// copied on the first modification.
+func (m *ccMessage) Mutable() CCMessage {
+	return FromMessage(m)
+}
@@ -5,10 +5,18 @@
 package messageprocessor
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
@@ -24,59 +32,276 @@ type messageProcessorTagConfig struct {
 	Condition string `json:"if"`              // Condition for adding or removing corresponding tag
 }
 
+// Message processor set field/tag/meta configuration
+type messageProcessorSetConfig struct {
+	Key        string `json:"key"`        // Name of the field, tag or meta information
+	Expression string `json:"expression"` // Expression computing the new value
+	Condition  string `json:"if"`         // Condition for setting the value
+}
+
+// Message processor regular expression rewrite configuration
+type messageProcessorRegexConfig struct {
+	Key         string `json:"key"`         // Name of the tag, meta information or field
+	Regex       string `json:"regex"`       // Regular expression the value has to match
+	Replacement string `json:"replacement"` // Replacement of the matches with $1 etc. for capture groups
+	Condition   string `json:"if"`          // Condition for rewriting the value
+}
+
+// regexRule is a rename or rewrite rule with its compiled regular expression
+type regexRule struct {
+	key         string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// setRule is a set rule with its pre-processed expression
+type setRule struct {
+	key        string
+	expression string // Expression as configured
+	program    *vm.Program
+}
+
 type messageProcessorConfig struct {
-	StageOrder       []string                    `json:"stage_order,omitempty"`        // List of stages to execute them in the specified order and to skip unrequired ones
-	DropMessages     []string                    `json:"drop_messages,omitempty"`      // List of metric names to drop. For fine-grained dropping use drop_messages_if
-	DropMessagesIf   []string                    `json:"drop_messages_if,omitempty"`   // List of evaluatable terms to drop messages
-	RenameMessages   map[string]string           `json:"rename_messages,omitempty"`    // Map of metric names to rename
-	RenameMessagesIf map[string]string           `json:"rename_messages_if,omitempty"` // Map to rename metric name based on a condition
-	NormalizeUnits   bool                        `json:"normalize_units,omitempty"`    // Check unit meta flag and normalize it using cc-units
-	ChangeUnitPrefix map[string]string           `json:"change_unit_prefix,omitempty"` // Add prefix that should be applied to the messages
-	AddTagsIf        []messageProcessorTagConfig `json:"add_tags_if"`                  // List of tags that are added when the condition is met
-	DelTagsIf        []messageProcessorTagConfig `json:"delete_tags_if"`               // List of tags that are removed when the condition is met
-	AddMetaIf        []messageProcessorTagConfig `json:"add_meta_if"`                  // List of meta infos that are added when the condition is met
-	DelMetaIf        []messageProcessorTagConfig `json:"delete_meta_if"`               // List of meta infos that are removed when the condition is met
-	AddFieldIf       []messageProcessorTagConfig `json:"add_field_if"`                 // List of fields that are added when the condition is met
-	DelFieldIf       []messageProcessorTagConfig `json:"delete_field_if"`              // List of fields that are removed when the condition is met
-	DropByType       []string                    `json:"drop_by_message_type"`         // List of message types that should be dropped
-	MoveTagToMeta    []messageProcessorTagConfig `json:"move_tag_to_meta_if"`
-	MoveTagToField   []messageProcessorTagConfig `json:"move_tag_to_field_if"`
-	MoveMetaToTag    []messageProcessorTagConfig `json:"move_meta_to_tag_if"`
-	MoveMetaToField  []messageProcessorTagConfig `json:"move_meta_to_field_if"`
-	MoveFieldToTag   []messageProcessorTagConfig `json:"move_field_to_tag_if"`
-	MoveFieldToMeta  []messageProcessorTagConfig `json:"move_field_to_meta_if"`
-	AddBaseEnv       map[string]interface{}      `json:"add_base_env"`
+	StageOrder       []string                      `json:"stage_order,omitempty"`           // List of stages to execute them in the specified order and to skip unrequired ones
+	DropMessages     []string                      `json:"drop_messages,omitempty"`         // List of metric names to drop. For fine-grained dropping use drop_messages_if
+	DropMessagesIf   []string                      `json:"drop_messages_if,omitempty"`      // List of evaluatable terms to drop messages
+	RenameMessages   map[string]string             `json:"rename_messages,omitempty"`       // Map of metric names to rename
+	RenameMessagesIf orderedConfigMap              `json:"rename_messages_if,omitempty"`    // Map to rename metric name based on a condition
+	RenameMessagesRe orderedConfigMap              `json:"rename_messages_regex,omitempty"` // Map of regular expressions to rename matching metric names with capture groups
+	NormalizeUnits   bool                          `json:"normalize_units,omitempty"`       // Check unit meta flag and normalize it using cc-units
+	ChangeUnitPrefix orderedConfigMap              `json:"change_unit_prefix,omitempty"`    // Add prefix that should be applied to the messages
+	AddTagsIf        []messageProcessorTagConfig   `json:"add_tags_if,omitempty"`           // List of tags that are added when the condition is met
+	DelTagsIf        []messageProcessorTagConfig   `json:"delete_tags_if,omitempty"`        // List of tags that are removed when the condition is met
+	AddMetaIf        []messageProcessorTagConfig   `json:"add_meta_if,omitempty"`           // List of meta infos that are added when the condition is met
+	DelMetaIf        []messageProcessorTagConfig   `json:"delete_meta_if,omitempty"`        // List of meta infos that are removed when the condition is met
+	AddFieldIf       []messageProcessorTagConfig   `json:"add_field_if,omitempty"`          // List of fields that are added when the condition is met
+	DelFieldIf       []messageProcessorTagConfig   `json:"delete_field_if,omitempty"`       // List of fields that are removed when the condition is met
+	DropByType       []string                      `json:"drop_by_message_type,omitempty"`  // List of message types that should be dropped
+	MoveTagToMeta    []messageProcessorTagConfig   `json:"move_tag_to_meta_if,omitempty"`
+	MoveTagToField   []messageProcessorTagConfig   `json:"move_tag_to_field_if,omitempty"`
+	MoveMetaToTag    []messageProcessorTagConfig   `json:"move_meta_to_tag_if,omitempty"`
+	MoveMetaToField  []messageProcessorTagConfig   `json:"move_meta_to_field_if,omitempty"`
+	MoveFieldToTag   []messageProcessorTagConfig   `json:"move_field_to_tag_if,omitempty"`
+	MoveFieldToMeta  []messageProcessorTagConfig   `json:"move_field_to_meta_if,omitempty"`
+	SetFieldIf       []messageProcessorSetConfig   `json:"set_field_if,omitempty"`     // List of fields that are set to the result of an expression when the condition is met
+	SetTagIf         []messageProcessorSetConfig   `json:"set_tag_if,omitempty"`       // List of tags that are set to the result of an expression when the condition is met
+	SetMetaIf        []messageProcessorSetConfig   `json:"set_meta_if,omitempty"`      // List of meta infos that are set to the result of an expression when the condition is met
+	RewriteTagsIf    []messageProcessorRegexConfig `json:"rewrite_tags_if,omitempty"`  // List of tag values that are rewritten with a regular expression when the condition is met
+	RewriteMetaIf    []messageProcessorRegexConfig `json:"rewrite_meta_if,omitempty"`  // List of meta info values that are rewritten with a regular expression when the condition is met
+	RewriteFieldIf   []messageProcessorRegexConfig `json:"rewrite_field_if,omitempty"` // List of field values that are rewritten with a regular expression when the condition is met
+	AddBaseEnv       map[string]interface{}        `json:"add_base_env,omitempty"`
+	FirstMatch       []string                      `json:"stop_after_first_match,omitempty"` // List of stages whose rules stop after the first matching rule
+	AllMatches       []string                      `json:"apply_all_matches,omitempty"`      // List of stages stopping after the first matching rule by default whose matching rules are all applied
+	Aggregate        []AggregationConfig           `json:"aggregate,omitempty"`              // List of aggregations over time windows and scopes
+	Rate             []RateConfig                  `json:"rate,omitempty"`                   // List of counters to convert to rates
+	DerivedMetrics   []DerivedMetricConfig         `json:"derived_metrics,omitempty"`        // List of metrics computed from several input metrics
+	SplitFields      []SplitConfig                 `json:"split_fields,omitempty"`           // List of multi-field messages to split into one metric per field
+	MergeFields      []MergeConfig                 `json:"merge_fields,omitempty"`           // List of metrics to merge into multi-field messages
+	TraceIf          string                        `json:"trace_if,omitempty"`               // Log how messages matching the condition are processed
+	StatsInterval    string                        `json:"stats_interval,omitempty"`         // Interval to emit the statistics as metrics
+}
+
+// orderedConfigMap is a JSON object with string values that keeps the
+// order of its keys, so rules configured as JSON object are applied in the
+// configured order
+type orderedConfigMap []orderedConfigEntry
+
+type orderedConfigEntry struct {
+	Key   string
+	Value string
+}
+
+func (m *orderedConfigMap) UnmarshalJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		*m = nil
+		return nil
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected JSON object, got %v", t)
+	}
+	out := make(orderedConfigMap, 0)
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		var value string
+		if err := d.Decode(&value); err != nil {
+			return err
+		}
+		out = append(out, orderedConfigEntry{Key: t.(string), Value: value})
+	}
+	if _, err := d.Token(); err != nil {
+		return err
+	}
+	*m = out
+	return nil
+}
+
+func (m orderedConfigMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, e := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// messageProcessorRule is a rule with its pre-processed condition
+type messageProcessorRule[T any] struct {
+	condition string        // Condition as configured
+	program   *vm.Program   // Pre-processed condition
+	config    T             // What to do if the condition matches
+	stats     *statCounters // Statistics of the rule
+}
+
+// messageProcessorRules is a list of rules, which are evaluated in the order
+// they were added. If firstMatch is set, the evaluation stops after the
+// first rule whose condition matches.
+type messageProcessorRules[T any] struct {
+	rules      []messageProcessorRule[T]
+	firstMatch bool
+	stats      *statCounters // Statistics of the stage
+}
+
+// eval evaluates the conditions of the rules in order and calls apply for
+// each matching rule. The evaluated rules are recorded by the tracer and in
+// the statistics. It returns the statistics of the last matching rule.
+func (r *messageProcessorRules[T]) eval(params map[string]interface{}, t *tracer, apply func(config T) error) (*statCounters, error) {
+	var last *statCounters
+	start := time.Now()
+	for _, rule := range r.rules {
+		rule.stats.evaluated.Add(1)
+		value, err := expr.Run(rule.program, params)
+		if err != nil {
+			t.end(rule.condition, false)
+			rule.stats.fail(start)
+			return last, fmt.Errorf("failed to evaluate: %v", err.Error())
+		}
+		if !value.(bool) {
+			t.end(rule.condition, false)
+			start = rule.stats.since(start)
+			continue
+		}
+		rule.stats.match()
+		last = rule.stats
+		t.begin()
+		err = apply(rule.config)
+		t.end(rule.condition, true)
+		if err != nil {
+			rule.stats.fail(start)
+			return last, err
+		}
+		start = rule.stats.since(start)
+		if r.firstMatch {
+			break
+		}
+	}
+	if last != nil {
+		r.stats.match()
+	}
+	return last, nil
+}
+
+// addRule compiles the condition and appends the rule to the rule list
+func addRule[T any](mp *messageProcessor, rules *messageProcessorRules[T], condition string, config T) error {
+	program, err := expr.Compile(sanitizeExprString(condition), expr.Env(baseenv), expr.AsBool())
+	if err != nil {
+		return fmt.Errorf("failed to create condition evaluable of '%s': %v", condition, err.Error())
+	}
+	appendRule(mp, rules, condition, program, config)
+	return nil
+}
+
+// appendRule appends a rule with a compiled condition to the rule list. The
+// key identifies the rule in traces, statistics and when removing it.
+func appendRule[T any](mp *messageProcessor, rules *messageProcessorRules[T], key string, program *vm.Program, config T) {
+	mp.mutex.Lock()
+	rules.rules = append(rules.rules, messageProcessorRule[T]{
+		condition: key,
+		program:   program,
+		config:    config,
+		stats:     new(statCounters),
+	})
+	mp.mutex.Unlock()
+}
+
+// removeRules removes all rules with the condition from the rule list
+func removeRules[T any](mp *messageProcessor, rules *messageProcessorRules[T], condition string) {
+	mp.mutex.Lock()
+	rules.rules = slices.DeleteFunc(rules.rules, func(r messageProcessorRule[T]) bool {
+		return r.condition == condition
+	})
+	mp.mutex.Unlock()
 }
 
 type messageProcessor struct {
 	// For thread-safety
 	mutex sync.RWMutex
 
-	// mapping contains all evalables as strings to gval.Evaluable
-	// because it is not possible to get the original string out of
-	// a gval.Evaluable
-	mapping map[string]*vm.Program
-
-	stages           []string                 // order of stage execution
-	dropMessages     map[string]struct{}      // internal lookup map
-	dropTypes        map[string]struct{}      // internal lookup map
-	dropMessagesIf   map[*vm.Program]struct{} // pre-processed dropMessagesIf
-	renameMessages   map[string]string        // internal lookup map
-	renameMessagesIf map[*vm.Program]string   // pre-processed RenameMessagesIf
-	changeUnitPrefix map[*vm.Program]string   // pre-processed ChangeUnitPrefix
+	stages           []string                        // order of stage execution
+	dropMessages     map[string]struct{}             // internal lookup map
+	dropTypes        map[string]struct{}             // internal lookup map
+	dropMessagesIf   messageProcessorRules[struct{}] // pre-processed dropMessagesIf
+	renameMessages   map[string]string               // internal lookup map
+	renameMessagesIf messageProcessorRules[string]   // pre-processed RenameMessagesIf
+	changeUnitPrefix messageProcessorRules[string]   // pre-processed ChangeUnitPrefix
 	normalizeUnits   bool
-	addTagsIf        map[*vm.Program]messageProcessorTagConfig // pre-processed AddTagsIf
-	deleteTagsIf     map[*vm.Program]messageProcessorTagConfig // pre-processed DelTagsIf
-	addMetaIf        map[*vm.Program]messageProcessorTagConfig // pre-processed AddMetaIf
-	deleteMetaIf     map[*vm.Program]messageProcessorTagConfig // pre-processed DelMetaIf
-	addFieldIf       map[*vm.Program]messageProcessorTagConfig // pre-processed AddFieldIf
-	deleteFieldIf    map[*vm.Program]messageProcessorTagConfig // pre-processed DelFieldIf
-	moveTagToMeta    map[*vm.Program]messageProcessorTagConfig // pre-processed MoveTagToMeta
-	moveTagToField   map[*vm.Program]messageProcessorTagConfig // pre-processed MoveTagToField
-	moveMetaToTag    map[*vm.Program]messageProcessorTagConfig // pre-processed MoveMetaToTag
-	moveMetaToField  map[*vm.Program]messageProcessorTagConfig // pre-processed MoveMetaToField
-	moveFieldToTag   map[*vm.Program]messageProcessorTagConfig // pre-processed MoveFieldToTag
-	moveFieldToMeta  map[*vm.Program]messageProcessorTagConfig // pre-processed MoveFieldToMeta
+	addTagsIf        messageProcessorRules[messageProcessorTagConfig] // pre-processed AddTagsIf
+	deleteTagsIf     messageProcessorRules[messageProcessorTagConfig] // pre-processed DelTagsIf
+	addMetaIf        messageProcessorRules[messageProcessorTagConfig] // pre-processed AddMetaIf
+	deleteMetaIf     messageProcessorRules[messageProcessorTagConfig] // pre-processed DelMetaIf
+	addFieldIf       messageProcessorRules[messageProcessorTagConfig] // pre-processed AddFieldIf
+	deleteFieldIf    messageProcessorRules[messageProcessorTagConfig] // pre-processed DelFieldIf
+	moveTagToMeta    messageProcessorRules[messageProcessorTagConfig] // pre-processed MoveTagToMeta
+	moveTagToField   messageProcessorRules[messageProcessorTagConfig] // pre-processed MoveTagToField
+	moveMetaToTag    messageProcessorRules[messageProcessorTagConfig] // pre-processed MoveMetaToTag
+	moveMetaToField  messageProcessorRules[messageProcessorTagConfig] // pre-processed MoveMetaToField
+	moveFieldToTag   messageProcessorRules[messageProcessorTagConfig] // pre-processed MoveFieldToTag
+	moveFieldToMeta  messageProcessorRules[messageProcessorTagConfig] // pre-processed MoveFieldToMeta
+	setFieldIf       messageProcessorRules[setRule]                   // pre-processed SetFieldIf
+	setTagIf         messageProcessorRules[setRule]                   // pre-processed SetTagIf
+	setMetaIf        messageProcessorRules[setRule]                   // pre-processed SetMetaIf
+	rewriteTagsIf    messageProcessorRules[regexRule]                 // pre-processed RewriteTagsIf
+	rewriteMetaIf    messageProcessorRules[regexRule]                 // pre-processed RewriteMetaIf
+	rewriteFieldIf   messageProcessorRules[regexRule]                 // pre-processed RewriteFieldIf
+	renameRegex      messageProcessorRules[regexRule]                 // pre-processed RenameMessagesRe
+	aggregate        messageProcessorRules[*aggregation]              // aggregations with their state
+	rate             messageProcessorRules[*rate]                     // counters to convert with their last samples
+	derive           messageProcessorRules[*derivedMetric]            // derived metrics with their incomplete input sets
+	splitFields      messageProcessorRules[SplitConfig]               // pre-processed SplitFields
+	mergeFields      messageProcessorRules[*merge]                    // merge rules with their incomplete merged messages
+
+	// Messages generated by stateful stages
+	pending pendingMessages
+	// Hook for traces of selected messages
+	traceHook *traceHook
+
+	// Statistics of the stages
+	stageStats    map[string]*statCounters
+	statsInterval time.Duration // Interval to emit the statistics as metrics
+	statsLock     sync.Mutex
+	lastStats     time.Time // Time the statistics were emitted last
+	hostname      string    // Hostname of the statistics metrics
 }
 
 type MessageProcessor interface {
@@ -94,6 +319,8 @@ type MessageProcessor interface {
 	RemoveRenameMetricByCondition(condition string)
 	AddRenameMetricByName(from, to string) error
 	RemoveRenameMetricByName(from string)
+	AddRenameMetricByRegex(regex, replacement string) error
+	RemoveRenameMetricByRegex(regex string)
 	SetNormalizeUnits(settings bool)
 	AddChangeUnitPrefix(condition string, prefix string) error
 	RemoveChangeUnitPrefix(condition string)
@@ -117,10 +344,54 @@ type MessageProcessor interface {
 	RemoveMoveFieldToTags(condition string)
 	AddMoveFieldToMeta(condition, key, value string) error
 	RemoveMoveFieldToMeta(condition string)
+	AddSetFieldByCondition(condition, key, expression string) error
+	RemoveSetFieldByCondition(condition string)
+	AddSetTagByCondition(condition, key, expression string) error
+	RemoveSetTagByCondition(condition string)
+	AddSetMetaByCondition(condition, key, expression string) error
+	RemoveSetMetaByCondition(condition string)
+	AddRewriteTagsByCondition(condition, key, regex, replacement string) error
+	RemoveRewriteTagsByCondition(condition string)
+	AddRewriteMetaByCondition(condition, key, regex, replacement string) error
+	RemoveRewriteMetaByCondition(condition string)
+	AddRewriteFieldByCondition(condition, key, regex, replacement string) error
+	RemoveRewriteFieldByCondition(condition string)
+	AddAggregation(config AggregationConfig) error
+	RemoveAggregation(condition string)
+	AddRate(config RateConfig) error
+	RemoveRate(condition string)
+	AddDerivedMetric(config DerivedMetricConfig) error
+	RemoveDerivedMetric(name string)
+	AddSplitFields(config SplitConfig) error
+	RemoveSplitFields(condition string)
+	AddMergeFields(config MergeConfig) error
+	RemoveMergeFields(condition string)
+	// Stop evaluating the rules of a stage after the first matching rule
+	SetStopAfterFirstMatch(stage string, setting bool) error
 	// Read in a JSON configuration
 	FromConfigJSON(config json.RawMessage) error
+	// Export the current configuration as JSON
+	ToConfigJSON() (json.RawMessage, error)
+	// Differences between the configuration of the message processor and another one
+	Diff(other MessageProcessor) ([]ConfigChange, error)
 	// Processing functions for legacy CCMetric and current CCMessage
-	ProcessMessage(m lp.CCMessage) (lp.CCMessage, error)
+	ProcessMessage(m lp.CCMessageView) (lp.CCMessage, error)
+	// Process a batch of messages, dropped messages are not returned
+	ProcessMessages(in []lp.CCMessage) ([]lp.CCMessage, error)
+	// Process the messages of a channel concurrently keeping the order of each series
+	ProcessChannel(in <-chan lp.CCMessage, out chan<- lp.CCMessage, workers int)
+	// Processing function which additionally returns how each stage and rule processed the message
+	ProcessMessageTrace(m lp.CCMessageView) (lp.CCMessage, *Trace, error)
+	// Trace messages matching the selector and pass the traces to the hook (nil: log them)
+	SetTraceHook(selector string, hook func(trace *Trace)) error
+	// Messages generated by stateful stages like aggregate since the last call
+	PendingMessages() []lp.CCMessage
+	// Close the time windows and expire the state of stateful stages
+	Tick(now time.Time)
+	// Statistics of the stages and rules
+	Stats() []StageStats
+	// Emit the statistics as metrics in the interval (0: disabled)
+	SetStatsInterval(interval time.Duration)
 	// EvalToBool(condition string, parameters map[string]interface{}) (bool, error)
 	// EvalToFloat64(condition string, parameters map[string]interface{}) (float64, error)
 	// EvalToString(condition string, parameters map[string]interface{}) (string, error)
@@ -130,6 +401,7 @@ const (
 	STAGENAME_DROP_BY_NAME       string = "drop_by_name"
 	STAGENAME_DROP_BY_TYPE       string = "drop_by_type"
 	STAGENAME_DROP_IF            string = "drop_if"
+	STAGENAME_SPLIT_FIELDS       string = "split_fields"
 	STAGENAME_ADD_TAG            string = "add_tag"
 	STAGENAME_DELETE_TAG         string = "delete_tag"
 	STAGENAME_MOVE_TAG_META      string = "move_tag_to_meta"
@@ -142,16 +414,28 @@ const (
 	STAGENAME_DELETE_FIELD       string = "delete_field"
 	STAGENAME_MOVE_FIELD_TAG     string = "move_field_to_tags"
 	STAGENAME_MOVE_FIELD_META    string = "move_field_to_meta"
+	STAGENAME_SET_FIELD          string = "set_field"
+	STAGENAME_SET_TAG            string = "set_tag"
+	STAGENAME_SET_META           string = "set_meta"
+	STAGENAME_REWRITE_TAG        string = "rewrite_tag"
+	STAGENAME_REWRITE_META       string = "rewrite_meta"
+	STAGENAME_REWRITE_FIELD      string = "rewrite_field"
 	STAGENAME_RENAME_BY_NAME     string = "rename"
 	STAGENAME_RENAME_IF          string = "rename_if"
+	STAGENAME_RENAME_REGEX       string = "rename_regex"
 	STAGENAME_CHANGE_UNIT_PREFIX string = "change_unit_prefix"
 	STAGENAME_NORMALIZE_UNIT     string = "normalize_unit"
+	STAGENAME_RATE               string = "rate"
+	STAGENAME_DERIVE             string = "derive"
+	STAGENAME_AGGREGATE          string = "aggregate"
+	STAGENAME_MERGE_FIELDS       string = "merge_fields"
 )
 
 var StageNames = []string{
 	STAGENAME_DROP_BY_NAME,
 	STAGENAME_DROP_BY_TYPE,
 	STAGENAME_DROP_IF,
+	STAGENAME_SPLIT_FIELDS,
 	STAGENAME_ADD_TAG,
 	STAGENAME_DELETE_TAG,
 	STAGENAME_MOVE_TAG_META,
@@ -164,10 +448,21 @@ var StageNames = []string{
 	STAGENAME_DELETE_FIELD,
 	STAGENAME_MOVE_FIELD_TAG,
 	STAGENAME_MOVE_FIELD_META,
+	STAGENAME_SET_FIELD,
+	STAGENAME_SET_TAG,
+	STAGENAME_SET_META,
+	STAGENAME_REWRITE_TAG,
+	STAGENAME_REWRITE_META,
+	STAGENAME_REWRITE_FIELD,
 	STAGENAME_RENAME_BY_NAME,
 	STAGENAME_RENAME_IF,
+	STAGENAME_RENAME_REGEX,
 	STAGENAME_CHANGE_UNIT_PREFIX,
 	STAGENAME_NORMALIZE_UNIT,
+	STAGENAME_RATE,
+	STAGENAME_DERIVE,
+	STAGENAME_AGGREGATE,
+	STAGENAME_MERGE_FIELDS,
 }
 
 var paramMapPool = sync.Pool{
@@ -180,50 +475,104 @@ func sanitizeExprString(key string) string {
 	return strings.ReplaceAll(key, "type-id", "typeid")
 }
 
-func getParamMap(point lp.CCMessage) map[string]interface{} {
+// newParamMap returns an empty evaluation environment from the pool. It has
+// to be returned with putParamMap.
+func newParamMap() map[string]interface{} {
 	params := paramMapPool.Get().(map[string]interface{})
+	clear(params)
+	for _, key := range []string{"fields", "tags", "meta"} {
+		m := paramMapPool.Get().(map[string]interface{})
+		clear(m)
+		params[key] = m
+	}
+	return params
+}
+
+// putParamMap returns the evaluation environment to the pool
+func putParamMap(params map[string]interface{}) {
+	params["field"] = nil
+	params["tag"] = nil
+	paramMapPool.Put(params["fields"])
+	paramMapPool.Put(params["tags"])
+	paramMapPool.Put(params["meta"])
+	paramMapPool.Put(params)
+}
+
+// Names of the message types in the evaluation environment, stored as
+// interface values, so setting them does not allocate
+var messageTypeNames = func() map[lp.CCMessageType]interface{} {
+	names := make(map[lp.CCMessageType]interface{})
+	for t := lp.CCMessageType(lp.MIN_CCMSG_TYPE); t <= lp.MAX_CCMSG_TYPE; t++ {
+		names[t] = t.String()
+	}
+	return names
+}()
+
+// setParamMap sets the evaluation environment to the values of the message.
+// The maps of the fields, tags and meta information are reused.
+func setParamMap(params map[string]interface{}, point lp.CCMessage) {
+	fields := params["fields"].(map[string]interface{})
+	tags := params["tags"].(map[string]interface{})
+	meta := params["meta"].(map[string]interface{})
+	clear(params)
+	clear(fields)
+	clear(tags)
+	clear(meta)
+
 	params["message"] = point
 	params["msg"] = point
 	params["name"] = point.Name()
 	params["timestamp"] = point.Time().Unix()
 	params["time"] = params["timestamp"]
 
-	fields := paramMapPool.Get().(map[string]interface{})
-	for key, value := range point.Fields() {
+	// Read the maps directly, the iterators allocate for each message
+	tagMap, metaMap, fieldMap, ok := lp.ReadMaps(point)
+	if !ok {
+		tagMap, metaMap, fieldMap = maps.Collect(point.AllTags()), maps.Collect(point.AllMeta()), maps.Collect(point.AllFields())
+	}
+	for key, value := range fieldMap {
 		fields[key] = value
 		switch key {
 		case "value":
-			params["messagetype"] = "metric"
 			params["value"] = value
 			params["metric"] = value
 		case "event":
-			params["messagetype"] = "event"
 			params["event"] = value
 		case "control":
-			params["messagetype"] = "control"
 			params["control"] = value
 		case "log":
-			params["messagetype"] = "log"
 			params["log"] = value
-		default:
-			params["messagetype"] = "unknown"
 		}
 	}
+	// The message type does not depend on additional fields
+	if t, ok := messageTypeNames[point.MessageType()]; ok {
+		params["messagetype"] = t
+	} else {
+		params["messagetype"] = "unknown"
+	}
 	params["msgtype"] = params["messagetype"]
+	// Severity as syslog level, -1 if the message has no severity
+	params["severity"] = -1
+	params["facility"] = ""
+	if params["messagetype"] == "log" {
+		if v, ok := point.GetTag(lp.CCMSG_LOG_SEVERITY_TAG); ok {
+			if s, err := lp.ParseLogSeverity(v); err == nil {
+				params["severity"] = int(s)
+			}
+		}
+		params["facility"], _ = point.GetTag(lp.CCMSG_LOG_FACILITY_TAG)
+	}
 	params["fields"] = fields
 	params["field"] = fields
-	tags := paramMapPool.Get().(map[string]interface{})
-	for key, value := range point.Tags() {
+	for key, value := range tagMap {
 		tags[sanitizeExprString(key)] = value
 	}
 	params["tags"] = tags
 	params["tag"] = tags
-	meta := paramMapPool.Get().(map[string]interface{})
-	for key, value := range point.Meta() {
+	for key, value := range metaMap {
 		meta[sanitizeExprString(key)] = value
 	}
 	params["meta"] = meta
-	return params
 }
 
 var baseenv = map[string]interface{}{
@@ -262,7 +611,15 @@ var baseenv = map[string]interface{}{
 		"control": "",
 		"log":     "",
 	},
+	"value":     0,
+	"metric":    0,
+	"event":     "",
+	"control":   "",
+	"log":       "",
 	"timestamp": 1234567890,
+	"time":      1234567890,
+	"severity":  -1,
+	"facility":  "",
 	"msg":       lp.EmptyMessage(),
 	"message":   lp.EmptyMessage(),
 }
@@ -298,26 +655,23 @@ func (mp *messageProcessor) AddBaseEnv(env map[string]interface{}) error {
 
 func (mp *messageProcessor) init() error {
 	mp.stages = make([]string, 0)
-	mp.mapping = make(map[string]*vm.Program)
 	mp.dropMessages = make(map[string]struct{})
 	mp.dropTypes = make(map[string]struct{})
-	mp.dropMessagesIf = make(map[*vm.Program]struct{})
+	// A message can only be dropped once
+	mp.dropMessagesIf.firstMatch = true
+	// A counter can only be converted once, a message only split or merged
+	// once
+	settings := mp.firstMatchSettings()
+	for _, s := range firstMatchStages {
+		*settings[s] = true
+	}
 	mp.renameMessages = make(map[string]string)
-	mp.renameMessagesIf = make(map[*vm.Program]string)
-	mp.changeUnitPrefix = make(map[*vm.Program]string)
-	mp.addTagsIf = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.addMetaIf = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.addFieldIf = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.deleteTagsIf = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.deleteMetaIf = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.deleteFieldIf = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.moveFieldToMeta = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.moveFieldToTag = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.moveMetaToField = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.moveMetaToTag = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.moveTagToField = make(map[*vm.Program]messageProcessorTagConfig)
-	mp.moveTagToMeta = make(map[*vm.Program]messageProcessorTagConfig)
 	mp.normalizeUnits = false
+	mp.stageStats = newStageStats()
+	mp.hostname = statsHostname()
+	for s, l := range mp.ruleLists() {
+		l.setStats(mp.stageStats[s])
+	}
 	return nil
 }
 
@@ -337,7 +691,7 @@ func (mp *messageProcessor) RemoveDropMessagesByName(name string) {
 }
 
 func (mp *messageProcessor) AddDropMessagesByType(typestring string) error {
-	valid := []string{"metric", "event", "control", "log"}
+	valid := []string{"metric", "event", "control", "log", "histogram"}
 	isValid := false
 	for _, t := range valid {
 		if t == typestring {
@@ -364,32 +718,16 @@ func (mp *messageProcessor) RemoveDropMessagesByType(typestring string) {
 	mp.mutex.Unlock()
 }
 
-func (mp *messageProcessor) addTagConfig(condition, key, value string, config *map[*vm.Program]messageProcessorTagConfig) error {
-	var err error
-	evaluable, err := expr.Compile(sanitizeExprString(condition), expr.Env(baseenv), expr.AsBool())
-	if err != nil {
-		return fmt.Errorf("failed to create condition evaluable of '%s': %v", condition, err.Error())
-	}
-	mp.mutex.Lock()
-	if _, ok := (*config)[evaluable]; !ok {
-		mp.mapping[condition] = evaluable
-		(*config)[evaluable] = messageProcessorTagConfig{
-			Condition: condition,
-			Key:       key,
-			Value:     value,
-		}
-	}
-	mp.mutex.Unlock()
-	return nil
+func (mp *messageProcessor) addTagConfig(condition, key, value string, config *messageProcessorRules[messageProcessorTagConfig]) error {
+	return addRule(mp, config, condition, messageProcessorTagConfig{
+		Condition: condition,
+		Key:       key,
+		Value:     value,
+	})
 }
 
-func (mp *messageProcessor) removeTagConfig(condition string, config *map[*vm.Program]messageProcessorTagConfig) {
-	mp.mutex.Lock()
-	if e, ok := mp.mapping[condition]; ok {
-		delete(mp.mapping, condition)
-		delete(*config, e)
-	}
-	mp.mutex.Unlock()
+func (mp *messageProcessor) removeTagConfig(condition string, config *messageProcessorRules[messageProcessorTagConfig]) {
+	removeRules(mp, config, condition)
 }
 
 func (mp *messageProcessor) AddAddTagsByCondition(condition, key, value string) error {
@@ -441,53 +779,19 @@ func (mp *messageProcessor) RemoveDeleteFieldByCondition(condition string) {
 }
 
 func (mp *messageProcessor) AddDropMessagesByCondition(condition string) error {
-	var err error
-	evaluable, err := expr.Compile(sanitizeExprString(condition), expr.Env(baseenv), expr.AsBool())
-	if err != nil {
-		return fmt.Errorf("failed to create condition evaluable of '%s': %v", condition, err.Error())
-	}
-	mp.mutex.Lock()
-	if _, ok := mp.dropMessagesIf[evaluable]; !ok {
-		mp.mapping[condition] = evaluable
-		mp.dropMessagesIf[evaluable] = struct{}{}
-	}
-	mp.mutex.Unlock()
-	return nil
+	return addRule(mp, &mp.dropMessagesIf, condition, struct{}{})
 }
 
 func (mp *messageProcessor) RemoveDropMessagesByCondition(condition string) {
-	mp.mutex.Lock()
-	if e, ok := mp.mapping[condition]; ok {
-		delete(mp.mapping, condition)
-		delete(mp.dropMessagesIf, e)
-	}
-	mp.mutex.Unlock()
+	removeRules(mp, &mp.dropMessagesIf, condition)
 }
 
 func (mp *messageProcessor) AddRenameMetricByCondition(condition string, name string) error {
-	var err error
-	evaluable, err := expr.Compile(sanitizeExprString(condition), expr.Env(baseenv), expr.AsBool())
-	if err != nil {
-		return fmt.Errorf("failed to create condition evaluable of '%s': %v", condition, err.Error())
-	}
-	mp.mutex.Lock()
-	if _, ok := mp.renameMessagesIf[evaluable]; !ok {
-		mp.mapping[condition] = evaluable
-		mp.renameMessagesIf[evaluable] = name
-	} else {
-		mp.renameMessagesIf[evaluable] = name
-	}
-	mp.mutex.Unlock()
-	return nil
+	return addRule(mp, &mp.renameMessagesIf, condition, name)
 }
 
 func (mp *messageProcessor) RemoveRenameMetricByCondition(condition string) {
-	mp.mutex.Lock()
-	if e, ok := mp.mapping[condition]; ok {
-		delete(mp.mapping, condition)
-		delete(mp.renameMessagesIf, e)
-	}
-	mp.mutex.Unlock()
+	removeRules(mp, &mp.renameMessagesIf, condition)
 }
 
 func (mp *messageProcessor) SetNormalizeUnits(setting bool) {
@@ -495,29 +799,11 @@ func (mp *messageProcessor) SetNormalizeUnits(setting bool) {
 }
 
 func (mp *messageProcessor) AddChangeUnitPrefix(condition string, prefix string) error {
-	var err error
-	evaluable, err := expr.Compile(sanitizeExprString(condition), expr.Env(baseenv), expr.AsBool())
-	if err != nil {
-		return fmt.Errorf("failed to create condition evaluable of '%s': %v", condition, err.Error())
-	}
-	mp.mutex.Lock()
-	if _, ok := mp.changeUnitPrefix[evaluable]; !ok {
-		mp.mapping[condition] = evaluable
-		mp.changeUnitPrefix[evaluable] = prefix
-	} else {
-		mp.changeUnitPrefix[evaluable] = prefix
-	}
-	mp.mutex.Unlock()
-	return nil
+	return addRule(mp, &mp.changeUnitPrefix, condition, prefix)
 }
 
 func (mp *messageProcessor) RemoveChangeUnitPrefix(condition string) {
-	mp.mutex.Lock()
-	if e, ok := mp.mapping[condition]; ok {
-		delete(mp.mapping, condition)
-		delete(mp.changeUnitPrefix, e)
-	}
-	mp.mutex.Unlock()
+	removeRules(mp, &mp.changeUnitPrefix, condition)
 }
 
 func (mp *messageProcessor) AddRenameMetricByName(from, to string) error {
@@ -583,6 +869,308 @@ func (mp *messageProcessor) RemoveMoveFieldToMeta(condition string) {
 	mp.removeTagConfig(condition, &mp.moveFieldToMeta)
 }
 
+// compileSetExpression compiles the expression of a set rule and checks
+// whether its result can be stored at the location. Tags and meta
+// information require strings, fields numbers, strings or booleans. The
+// value field of metrics must be numeric and the event, log and control
+// fields must be strings.
+func compileSetExpression(key, expression string, location MessageLocation) (*vm.Program, error) {
+	options := []expr.Option{expr.Env(baseenv)}
+	if location != MESSAGE_LOCATION_FIELDS {
+		options = append(options, expr.AsKind(reflect.String))
+	}
+	program, err := expr.Compile(sanitizeExprString(expression), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create expression evaluable of '%s': %v", expression, err.Error())
+	}
+	if location == MESSAGE_LOCATION_FIELDS {
+		if t := program.Node().Type(); t != nil && t.Kind() != reflect.Interface {
+			if _, err := fieldValue(key, reflect.Zero(t).Interface()); err != nil {
+				return nil, fmt.Errorf("expression '%s' cannot be used for field %s: %v", expression, key, err.Error())
+			}
+		}
+	}
+	return program, nil
+}
+
+func (mp *messageProcessor) addSetConfig(condition, key, expression string, location MessageLocation, config *messageProcessorRules[setRule]) error {
+	program, err := compileSetExpression(key, expression, location)
+	if err != nil {
+		return err
+	}
+	return addRule(mp, config, condition, setRule{key: key, expression: expression, program: program})
+}
+
+// AddSetFieldByCondition sets the field key to the result of the expression
+// when the condition is met
+func (mp *messageProcessor) AddSetFieldByCondition(condition, key, expression string) error {
+	return mp.addSetConfig(condition, key, expression, MESSAGE_LOCATION_FIELDS, &mp.setFieldIf)
+}
+
+func (mp *messageProcessor) RemoveSetFieldByCondition(condition string) {
+	removeRules(mp, &mp.setFieldIf, condition)
+}
+
+// AddSetTagByCondition sets the tag key to the result of the expression when
+// the condition is met
+func (mp *messageProcessor) AddSetTagByCondition(condition, key, expression string) error {
+	return mp.addSetConfig(condition, key, expression, MESSAGE_LOCATION_TAGS, &mp.setTagIf)
+}
+
+func (mp *messageProcessor) RemoveSetTagByCondition(condition string) {
+	removeRules(mp, &mp.setTagIf, condition)
+}
+
+// AddSetMetaByCondition sets the meta information key to the result of the
+// expression when the condition is met
+func (mp *messageProcessor) AddSetMetaByCondition(condition, key, expression string) error {
+	return mp.addSetConfig(condition, key, expression, MESSAGE_LOCATION_META, &mp.setMetaIf)
+}
+
+func (mp *messageProcessor) RemoveSetMetaByCondition(condition string) {
+	removeRules(mp, &mp.setMetaIf, condition)
+}
+
+// compileRegex compiles the regular expression of a rename or rewrite rule
+func compileRegex(regex string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regular expression '%s': %v", regex, err.Error())
+	}
+	return re, nil
+}
+
+// AddRenameMetricByRegex renames messages whose name matches the regular
+// expression to the replacement, which can contain capture groups like $1.
+// The condition of the rule is the match of the name, the rule is identified
+// by the regular expression.
+func (mp *messageProcessor) AddRenameMetricByRegex(regex, replacement string) error {
+	re, err := compileRegex(regex)
+	if err != nil {
+		return err
+	}
+	program, err := expr.Compile("name matches "+strconv.Quote(regex), expr.Env(baseenv), expr.AsBool())
+	if err != nil {
+		return fmt.Errorf("failed to create condition evaluable of '%s': %v", regex, err.Error())
+	}
+	appendRule(mp, &mp.renameRegex, regex, program, regexRule{regex: re, replacement: replacement})
+	return nil
+}
+
+// RemoveRenameMetricByRegex removes all renames with the regular expression
+func (mp *messageProcessor) RemoveRenameMetricByRegex(regex string) {
+	removeRules(mp, &mp.renameRegex, regex)
+}
+
+func (mp *messageProcessor) addRegexConfig(condition, key, regex, replacement string, config *messageProcessorRules[regexRule]) error {
+	re, err := compileRegex(regex)
+	if err != nil {
+		return err
+	}
+	return addRule(mp, config, condition, regexRule{key: key, regex: re, replacement: replacement})
+}
+
+// AddRewriteTagsByCondition rewrites the value of the tag key with the
+// regular expression when the condition is met
+func (mp *messageProcessor) AddRewriteTagsByCondition(condition, key, regex, replacement string) error {
+	return mp.addRegexConfig(condition, key, regex, replacement, &mp.rewriteTagsIf)
+}
+
+func (mp *messageProcessor) RemoveRewriteTagsByCondition(condition string) {
+	removeRules(mp, &mp.rewriteTagsIf, condition)
+}
+
+// AddRewriteMetaByCondition rewrites the value of the meta information key
+// with the regular expression when the condition is met
+func (mp *messageProcessor) AddRewriteMetaByCondition(condition, key, regex, replacement string) error {
+	return mp.addRegexConfig(condition, key, regex, replacement, &mp.rewriteMetaIf)
+}
+
+func (mp *messageProcessor) RemoveRewriteMetaByCondition(condition string) {
+	removeRules(mp, &mp.rewriteMetaIf, condition)
+}
+
+// AddRewriteFieldByCondition rewrites the string value of the field key with
+// the regular expression when the condition is met
+func (mp *messageProcessor) AddRewriteFieldByCondition(condition, key, regex, replacement string) error {
+	return mp.addRegexConfig(condition, key, regex, replacement, &mp.rewriteFieldIf)
+}
+
+func (mp *messageProcessor) RemoveRewriteFieldByCondition(condition string) {
+	removeRules(mp, &mp.rewriteFieldIf, condition)
+}
+
+// AddAggregation adds an aggregation to the aggregate stage. The aggregated
+// messages are returned by PendingMessages.
+func (mp *messageProcessor) AddAggregation(config AggregationConfig) error {
+	a, err := newAggregation(config)
+	if err != nil {
+		return err
+	}
+	return addRule(mp, &mp.aggregate, config.Condition, a)
+}
+
+// RemoveAggregation removes all aggregations with the condition. The state
+// of their current time windows is discarded.
+func (mp *messageProcessor) RemoveAggregation(condition string) {
+	removeRules(mp, &mp.aggregate, condition)
+}
+
+// AddRate adds a counter to the rate stage, which replaces the value of the
+// counter by its per-second rate
+func (mp *messageProcessor) AddRate(config RateConfig) error {
+	r, err := newRate(config)
+	if err != nil {
+		return err
+	}
+	return addRule(mp, &mp.rate, config.Condition, r)
+}
+
+// RemoveRate removes all rate rules with the condition including the stored
+// samples
+func (mp *messageProcessor) RemoveRate(condition string) {
+	removeRules(mp, &mp.rate, condition)
+}
+
+// AddDerivedMetric adds a metric computed from several input metrics with
+// the same tags and close timestamps. The derived metrics are returned by
+// PendingMessages.
+func (mp *messageProcessor) AddDerivedMetric(config DerivedMetricConfig) error {
+	d, err := newDerivedMetric(config)
+	if err != nil {
+		return err
+	}
+	return addRule(mp, &mp.derive, d.config.Condition, d)
+}
+
+// RemoveDerivedMetric removes all derived metrics with the name including
+// their incomplete input sets
+func (mp *messageProcessor) RemoveDerivedMetric(name string) {
+	mp.mutex.Lock()
+	mp.derive.rules = slices.DeleteFunc(mp.derive.rules, func(r messageProcessorRule[*derivedMetric]) bool {
+		return r.config.config.Name == name
+	})
+	mp.mutex.Unlock()
+}
+
+// AddSplitFields adds a rule to the split_fields stage, which replaces a
+// multi-field message by one metric per numeric field. The metrics are
+// processed by the stages after split_fields and returned by PendingMessages.
+func (mp *messageProcessor) AddSplitFields(config SplitConfig) error {
+	c, err := newSplitConfig(config)
+	if err != nil {
+		return err
+	}
+	return addRule(mp, &mp.splitFields, c.Condition, c)
+}
+
+// RemoveSplitFields removes all split rules with the condition
+func (mp *messageProcessor) RemoveSplitFields(condition string) {
+	removeRules(mp, &mp.splitFields, condition)
+}
+
+// AddMergeFields adds a rule to the merge_fields stage, which merges metrics
+// with the same tags and timestamp into one multi-field message. The merged
+// messages are returned by PendingMessages.
+func (mp *messageProcessor) AddMergeFields(config MergeConfig) error {
+	m, err := newMerge(config)
+	if err != nil {
+		return err
+	}
+	return addRule(mp, &mp.mergeFields, config.Condition, m)
+}
+
+// RemoveMergeFields removes all merge rules with the condition. Their
+// incomplete merged messages are discarded.
+func (mp *messageProcessor) RemoveMergeFields(condition string) {
+	removeRules(mp, &mp.mergeFields, condition)
+}
+
+// PendingMessages returns the messages generated by stateful stages since
+// the last call. The caller takes ownership of the messages.
+func (mp *messageProcessor) PendingMessages() []lp.CCMessage {
+	return mp.pending.take()
+}
+
+// Tick closes the time windows of the aggregations which ended at least their
+// delay before now, removes the samples of idle counters, discards the incomplete input
+// sets of derived metrics and emits the incomplete merged messages which timed
+// out. Without it, a time window is only closed when a message of the same
+// group for a later window arrives.
+func (mp *messageProcessor) Tick(now time.Time) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	for _, r := range mp.aggregate.rules {
+		r.config.flush(now, mp.pending.add)
+	}
+	for _, r := range mp.rate.rules {
+		r.config.flush(now)
+	}
+	for _, r := range mp.derive.rules {
+		r.config.flush(now)
+	}
+	for _, r := range mp.mergeFields.rules {
+		r.config.flush(now, mp.pending.add)
+	}
+	if mp.statsInterval > 0 {
+		mp.emitStats(now)
+	}
+}
+
+// Stages whose rules stop after the first matching rule by default
+var firstMatchStages = []string{
+	STAGENAME_RATE,
+	STAGENAME_SPLIT_FIELDS,
+	STAGENAME_MERGE_FIELDS,
+}
+
+// SetStopAfterFirstMatch sets whether the evaluation of the rules of the
+// stage stops after the first rule whose condition matches. By default, all
+// matching rules are applied in the order they were added.
+func (mp *messageProcessor) SetStopAfterFirstMatch(stage string, setting bool) error {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	firstMatch, ok := mp.firstMatchSettings()[stage]
+	if !ok {
+		return fmt.Errorf("stage %s has no rule list", stage)
+	}
+	*firstMatch = setting
+	return nil
+}
+
+// firstMatchSettings returns the stop after first match setting of the
+// stages with configurable rule lists
+func (mp *messageProcessor) firstMatchSettings() map[string]*bool {
+	return map[string]*bool{
+		STAGENAME_RENAME_IF:          &mp.renameMessagesIf.firstMatch,
+		STAGENAME_RENAME_REGEX:       &mp.renameRegex.firstMatch,
+		STAGENAME_CHANGE_UNIT_PREFIX: &mp.changeUnitPrefix.firstMatch,
+		STAGENAME_ADD_TAG:            &mp.addTagsIf.firstMatch,
+		STAGENAME_DELETE_TAG:         &mp.deleteTagsIf.firstMatch,
+		STAGENAME_ADD_META:           &mp.addMetaIf.firstMatch,
+		STAGENAME_DELETE_META:        &mp.deleteMetaIf.firstMatch,
+		STAGENAME_ADD_FIELD:          &mp.addFieldIf.firstMatch,
+		STAGENAME_DELETE_FIELD:       &mp.deleteFieldIf.firstMatch,
+		STAGENAME_MOVE_TAG_META:      &mp.moveTagToMeta.firstMatch,
+		STAGENAME_MOVE_TAG_FIELD:     &mp.moveTagToField.firstMatch,
+		STAGENAME_MOVE_META_TAG:      &mp.moveMetaToTag.firstMatch,
+		STAGENAME_MOVE_META_FIELD:    &mp.moveMetaToField.firstMatch,
+		STAGENAME_MOVE_FIELD_TAG:     &mp.moveFieldToTag.firstMatch,
+		STAGENAME_MOVE_FIELD_META:    &mp.moveFieldToMeta.firstMatch,
+		STAGENAME_SET_FIELD:          &mp.setFieldIf.firstMatch,
+		STAGENAME_SET_TAG:            &mp.setTagIf.firstMatch,
+		STAGENAME_SET_META:           &mp.setMetaIf.firstMatch,
+		STAGENAME_REWRITE_TAG:        &mp.rewriteTagsIf.firstMatch,
+		STAGENAME_REWRITE_META:       &mp.rewriteMetaIf.firstMatch,
+		STAGENAME_REWRITE_FIELD:      &mp.rewriteFieldIf.firstMatch,
+		STAGENAME_RATE:               &mp.rate.firstMatch,
+		STAGENAME_DERIVE:             &mp.derive.firstMatch,
+		STAGENAME_AGGREGATE:          &mp.aggregate.firstMatch,
+		STAGENAME_SPLIT_FIELDS:       &mp.splitFields.firstMatch,
+		STAGENAME_MERGE_FIELDS:       &mp.mergeFields.firstMatch,
+	}
+}
+
 func (mp *messageProcessor) SetStages(stages []string) error {
 	newstages := make([]string, 0)
 	if len(stages) == 0 {
@@ -652,8 +1240,14 @@ func (mp *messageProcessor) FromConfigJSON(config json.RawMessage) error {
 			return fmt.Errorf("failed to process config JSON: %v", err.Error())
 		}
 	}
-	for k, v := range c.RenameMessagesIf {
-		err = mp.AddRenameMetricByCondition(k, v)
+	for _, e := range c.RenameMessagesIf {
+		err = mp.AddRenameMetricByCondition(e.Key, e.Value)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, e := range c.RenameMessagesRe {
+		err = mp.AddRenameMetricByRegex(e.Key, e.Value)
 		if err != nil {
 			return fmt.Errorf("failed to process config JSON: %v", err.Error())
 		}
@@ -664,8 +1258,8 @@ func (mp *messageProcessor) FromConfigJSON(config json.RawMessage) error {
 			return fmt.Errorf("failed to process config JSON: %v", err.Error())
 		}
 	}
-	for k, v := range c.ChangeUnitPrefix {
-		err = mp.AddChangeUnitPrefix(k, v)
+	for _, e := range c.ChangeUnitPrefix {
+		err = mp.AddChangeUnitPrefix(e.Key, e.Value)
 		if err != nil {
 			return fmt.Errorf("failed to process config JSON: %v", err.Error())
 		}
@@ -742,195 +1336,508 @@ func (mp *messageProcessor) FromConfigJSON(config json.RawMessage) error {
 			return fmt.Errorf("failed to process config JSON: %v", err.Error())
 		}
 	}
+	for _, c := range c.SetFieldIf {
+		err = mp.AddSetFieldByCondition(c.Condition, c.Key, c.Expression)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, c := range c.SetTagIf {
+		err = mp.AddSetTagByCondition(c.Condition, c.Key, c.Expression)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, c := range c.SetMetaIf {
+		err = mp.AddSetMetaByCondition(c.Condition, c.Key, c.Expression)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, c := range c.RewriteTagsIf {
+		err = mp.AddRewriteTagsByCondition(c.Condition, c.Key, c.Regex, c.Replacement)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, c := range c.RewriteMetaIf {
+		err = mp.AddRewriteMetaByCondition(c.Condition, c.Key, c.Regex, c.Replacement)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, c := range c.RewriteFieldIf {
+		err = mp.AddRewriteFieldByCondition(c.Condition, c.Key, c.Regex, c.Replacement)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
 	for _, m := range c.DropByType {
 		err = mp.AddDropMessagesByType(m)
 		if err != nil {
 			return fmt.Errorf("failed to process config JSON: %v", err.Error())
 		}
 	}
+	for _, r := range c.Rate {
+		err = mp.AddRate(r)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, d := range c.DerivedMetrics {
+		err = mp.AddDerivedMetric(d)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, a := range c.Aggregate {
+		err = mp.AddAggregation(a)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, c := range c.SplitFields {
+		err = mp.AddSplitFields(c)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, c := range c.MergeFields {
+		err = mp.AddMergeFields(c)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
 	if len(c.AddBaseEnv) > 0 {
 		err = mp.AddBaseEnv(c.AddBaseEnv)
 		if err != nil {
 			return fmt.Errorf("failed to process config JSON: %v", err.Error())
 		}
 	}
+	for _, s := range c.FirstMatch {
+		err = mp.SetStopAfterFirstMatch(s, true)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	for _, s := range c.AllMatches {
+		err = mp.SetStopAfterFirstMatch(s, false)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	if len(c.TraceIf) > 0 {
+		err = mp.SetTraceHook(c.TraceIf, nil)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+	if len(c.StatsInterval) > 0 {
+		interval, err := time.ParseDuration(c.StatsInterval)
+		if err != nil {
+			return fmt.Errorf("failed to process config JSON: invalid stats interval '%s': %v", c.StatsInterval, err.Error())
+		}
+		mp.SetStatsInterval(interval)
+	}
 	mp.SetNormalizeUnits(c.NormalizeUnits)
 	return nil
 }
 
-func (mp *messageProcessor) ProcessMessage(m lp.CCMessage) (lp.CCMessage, error) {
-	var err error = nil
-	out := lp.FromMessage(m)
+// ProcessMessage applies the configured stages to a copy of m. The input
+// message is not modified. If the message is dropped, nil is returned.
+func (mp *messageProcessor) ProcessMessage(m lp.CCMessageView) (lp.CCMessage, error) {
+	return mp.process(m, nil)
+}
 
-	name := out.Name()
+// ProcessMessages applies the configured stages to copies of the messages
+// like ProcessMessage, but locks the message processor and sets up the
+// evaluation environment only once for all messages. Dropped messages are not
+// returned. Messages which failed to process are skipped and the errors are
+// returned joined.
+func (mp *messageProcessor) ProcessMessages(in []lp.CCMessage) ([]lp.CCMessage, error) {
+	out := make([]lp.CCMessage, 0, len(in))
+	var errs []error
 
-	if len(mp.stages) == 0 {
-		mp.SetStages(mp.DefaultStages())
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	params := newParamMap()
+	defer putParamMap(params)
+
+	for _, m := range in {
+		y, err := mp.processLocked(m, params, nil)
+		if err != nil {
+			errs = append(errs, err)
+			lp.Release(y)
+			continue
+		}
+		if y != nil {
+			out = append(out, y)
+		}
 	}
+	return out, errors.Join(errs...)
+}
 
+// process applies the configured stages to a copy of m and records the
+// processing with the tracer, if it is not nil
+func (mp *messageProcessor) process(m lp.CCMessageView, t *tracer) (lp.CCMessage, error) {
 	mp.mutex.RLock()
 	defer mp.mutex.RUnlock()
+	params := newParamMap()
+	defer putParamMap(params)
+	return mp.processLocked(m, params, t)
+}
 
-	params := getParamMap(out)
+// processLocked applies the configured stages to a copy of m using the
+// evaluation environment params. The processing is recorded with the tracer,
+// if it is not nil or the message matches the selector of the trace hook. The
+// caller has to hold the read lock.
+func (mp *messageProcessor) processLocked(m lp.CCMessageView, params map[string]interface{}, t *tracer) (lp.CCMessage, error) {
+	return mp.processStages(m, params, mp.stageOrder(), &mp.pending, t)
+}
 
+// stageOrder returns the configured stage order or the default one. The
+// caller has to hold the read lock.
+func (mp *messageProcessor) stageOrder() []string {
+	if len(mp.stages) == 0 {
+		return mp.DefaultStages()
+	}
+	return mp.stages
+}
+
+// processSplit applies the stages following split_fields to a metric created
+// by it and adds the result to the pending messages. The caller has to hold
+// the read lock.
+func (mp *messageProcessor) processSplit(m lp.CCMessage, stages []string, pending *pendingMessages) {
+	params := newParamMap()
+	defer putParamMap(params)
+	out, err := mp.processStages(m, params, stages, pending, nil)
+	lp.Release(m)
+	if err != nil {
+		cclog.ComponentError("MessageProcessor", "failed to process split message:", err.Error())
+		lp.Release(out)
+		return
+	}
+	if out != nil {
+		pending.add(out)
+	}
+}
+
+// processStages applies the stages to a copy of m like processLocked
+func (mp *messageProcessor) processStages(m lp.CCMessageView, params map[string]interface{}, stages []string, pending *pendingMessages, t *tracer) (lp.CCMessage, error) {
+	out, t, hook := mp.startProcessing(m, params, t)
+	out, err := mp.runStages(out, params, stages, pending, t)
+	t.finish(out, err, hook)
+	return out, err
+}
+
+// startProcessing creates the copy of m the stages are applied to and fills
+// the evaluation environment params with it. If t is nil and the message
+// matches the selector of the trace hook, it returns a new tracer with the
+// hook to call when the processing is finished.
+func (mp *messageProcessor) startProcessing(m lp.CCMessageView, params map[string]interface{}, t *tracer) (lp.CCMessage, *tracer, func(trace *Trace)) {
+	out := lp.FromMessage(m)
+
+	setParamMap(params, out)
+
+	// Trace messages matching the selector of the trace hook
+	var hook func(trace *Trace)
+	if t == nil && mp.traceHook != nil {
+		if value, err := expr.Run(mp.traceHook.program, params); err == nil && value.(bool) {
+			t = new(tracer)
+			hook = mp.traceHook.hook
+		}
+	}
+	if t != nil {
+		t.message = out
+		t.trace.Input = m.String()
+	}
+	return out, t, hook
+}
+
+// runStages applies the stages to the message created by startProcessing.
+// params has to contain the current state of the message. The messages
+// generated by stateful stages are added to pending.
+func (mp *messageProcessor) runStages(msg lp.CCMessage, params map[string]interface{}, stages []string, pending *pendingMessages, t *tracer) (out lp.CCMessage, err error) {
+	out = msg
+
+	name := out.Name()
+
+	// Statistics of the stages. Dropping or failing ends the processing in
+	// the current stage.
+	var st stageTimer
 	defer func() {
-		params["field"] = nil
-		params["tag"] = nil
-		paramMapPool.Put(params["fields"])
-		paramMapPool.Put(params["tags"])
-		paramMapPool.Put(params["meta"])
-		paramMapPool.Put(params)
+		st.end(out == nil, err)
 	}()
 
-	for _, s := range mp.stages {
+	for i, s := range stages {
+		if t != nil {
+			t.stage = s
+		}
 		switch s {
 		case STAGENAME_DROP_BY_NAME:
 			if len(mp.dropMessages) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Dropping by message name ", name)
-				if _, ok := mp.dropMessages[name]; ok {
+				_, ok := mp.dropMessages[name]
+				t.end(name, ok)
+				if ok {
+					st.stage.match()
 					// cclog.ComponentDebug("MessageProcessor", "Drop")
+					t.drop()
+					lp.Release(out)
 					return nil, nil
 				}
 			}
 		case STAGENAME_DROP_BY_TYPE:
 			if len(mp.dropTypes) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Dropping by message type")
-				if _, ok := mp.dropTypes[params["messagetype"].(string)]; ok {
+				_, ok := mp.dropTypes[params["messagetype"].(string)]
+				t.end(params["messagetype"].(string), ok)
+				if ok {
+					st.stage.match()
 					// cclog.ComponentDebug("MessageProcessor", "Drop")
+					t.drop()
+					lp.Release(out)
 					return nil, nil
 				}
 			}
 		case STAGENAME_DROP_IF:
-			if len(mp.dropMessagesIf) > 0 {
+			if len(mp.dropMessagesIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Dropping by condition")
-				drop, err := dropMessagesIf(&params, &mp.dropMessagesIf)
+				drop, err := dropMessagesIf(&params, &mp.dropMessagesIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 				if drop {
 					// cclog.ComponentDebug("MessageProcessor", "Drop")
+					t.drop()
+					lp.Release(out)
+					return nil, nil
+				}
+			}
+		case STAGENAME_SPLIT_FIELDS:
+			if len(mp.splitFields.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Split fields")
+				drop, err := splitMessage(out, &params, &mp.splitFields, func(y lp.CCMessage) {
+					mp.processSplit(y, stages[i+1:], pending)
+				}, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+				if drop {
+					t.drop()
+					lp.Release(out)
 					return nil, nil
 				}
 			}
 		case STAGENAME_RENAME_BY_NAME:
 			if len(mp.renameMessages) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Renaming by name match")
-				if newname, ok := mp.renameMessages[name]; ok {
+				t.begin()
+				newname, ok := mp.renameMessages[name]
+				if ok {
+					st.stage.match()
 					// cclog.ComponentDebug("MessageProcessor", "Rename to", newname)
 					out.SetName(newname)
+					params["name"] = newname
 					// cclog.ComponentDebug("MessageProcessor", "Add old name as 'oldname' to meta", name)
 					out.AddMeta("oldname", name)
 				}
+				t.end(name, ok)
 			}
 		case STAGENAME_RENAME_IF:
-			if len(mp.renameMessagesIf) > 0 {
+			if len(mp.renameMessagesIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Renaming by condition")
-				_, err := renameMessagesIf(out, &params, &mp.renameMessagesIf)
+				_, err := renameMessagesIf(out, &params, &mp.renameMessagesIf, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+			}
+		case STAGENAME_RENAME_REGEX:
+			if len(mp.renameRegex.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Renaming by regular expression")
+				_, err := renameMessagesRegex(out, &params, &mp.renameRegex, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_ADD_TAG:
-			if len(mp.addTagsIf) > 0 {
+			if len(mp.addTagsIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Adding tags")
-				_, err = addTagIf(out, &params, &mp.addTagsIf)
+				_, err = addTagIf(out, &params, &mp.addTagsIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_DELETE_TAG:
-			if len(mp.deleteTagsIf) > 0 {
+			if len(mp.deleteTagsIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Delete tags")
-				_, err = deleteTagIf(out, &params, &mp.deleteTagsIf)
+				_, err = deleteTagIf(out, &params, &mp.deleteTagsIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_ADD_META:
-			if len(mp.addMetaIf) > 0 {
+			if len(mp.addMetaIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Adding meta information")
-				_, err = addMetaIf(out, &params, &mp.addMetaIf)
+				_, err = addMetaIf(out, &params, &mp.addMetaIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_DELETE_META:
-			if len(mp.deleteMetaIf) > 0 {
+			if len(mp.deleteMetaIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Delete meta information")
-				_, err = deleteMetaIf(out, &params, &mp.deleteMetaIf)
+				_, err = deleteMetaIf(out, &params, &mp.deleteMetaIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_ADD_FIELD:
-			if len(mp.addFieldIf) > 0 {
+			if len(mp.addFieldIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Adding fields")
-				_, err = addFieldIf(out, &params, &mp.addFieldIf)
+				_, err = addFieldIf(out, &params, &mp.addFieldIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_DELETE_FIELD:
-			if len(mp.deleteFieldIf) > 0 {
+			if len(mp.deleteFieldIf.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Delete fields")
-				_, err = deleteFieldIf(out, &params, &mp.deleteFieldIf)
+				_, err = deleteFieldIf(out, &params, &mp.deleteFieldIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_MOVE_TAG_META:
-			if len(mp.moveTagToMeta) > 0 {
+			if len(mp.moveTagToMeta.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Move tag to meta")
-				_, err := moveTagToMeta(out, &params, &mp.moveTagToMeta)
+				_, err := moveTagToMeta(out, &params, &mp.moveTagToMeta, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_MOVE_TAG_FIELD:
-			if len(mp.moveTagToField) > 0 {
+			if len(mp.moveTagToField.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Move tag to fields")
-				_, err := moveTagToField(out, &params, &mp.moveTagToField)
+				_, err := moveTagToField(out, &params, &mp.moveTagToField, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_MOVE_META_TAG:
-			if len(mp.moveMetaToTag) > 0 {
+			if len(mp.moveMetaToTag.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Move meta to tags")
-				_, err := moveMetaToTag(out, &params, &mp.moveMetaToTag)
+				_, err := moveMetaToTag(out, &params, &mp.moveMetaToTag, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_MOVE_META_FIELD:
-			if len(mp.moveMetaToField) > 0 {
+			if len(mp.moveMetaToField.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Move meta to fields")
-				_, err := moveMetaToField(out, &params, &mp.moveMetaToField)
+				_, err := moveMetaToField(out, &params, &mp.moveMetaToField, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_MOVE_FIELD_META:
-			if len(mp.moveFieldToMeta) > 0 {
+			if len(mp.moveFieldToMeta.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Move field to meta")
-				_, err := moveFieldToMeta(out, &params, &mp.moveFieldToMeta)
+				_, err := moveFieldToMeta(out, &params, &mp.moveFieldToMeta, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_MOVE_FIELD_TAG:
-			if len(mp.moveFieldToTag) > 0 {
+			if len(mp.moveFieldToTag.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Move field to tags")
-				_, err := moveFieldToTag(out, &params, &mp.moveFieldToTag)
+				_, err := moveFieldToTag(out, &params, &mp.moveFieldToTag, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+			}
+		case STAGENAME_SET_FIELD:
+			if len(mp.setFieldIf.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Set fields")
+				_, err := setFieldIf(out, &params, &mp.setFieldIf, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+			}
+		case STAGENAME_SET_TAG:
+			if len(mp.setTagIf.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Set tags")
+				_, err := setTagIf(out, &params, &mp.setTagIf, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+			}
+		case STAGENAME_SET_META:
+			if len(mp.setMetaIf.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Set meta information")
+				_, err := setMetaIf(out, &params, &mp.setMetaIf, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+			}
+		case STAGENAME_REWRITE_TAG:
+			if len(mp.rewriteTagsIf.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Rewrite tags")
+				_, err := rewriteTagIf(out, &params, &mp.rewriteTagsIf, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+			}
+		case STAGENAME_REWRITE_META:
+			if len(mp.rewriteMetaIf.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Rewrite meta")
+				_, err := rewriteMetaIf(out, &params, &mp.rewriteMetaIf, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+			}
+		case STAGENAME_REWRITE_FIELD:
+			if len(mp.rewriteFieldIf.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Rewrite fields")
+				_, err := rewriteFieldIf(out, &params, &mp.rewriteFieldIf, t)
 				if err != nil {
 					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 				}
 			}
 		case STAGENAME_NORMALIZE_UNIT:
 			if mp.normalizeUnits {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Normalize units")
 				if out.IsMetric() {
+					st.stage.match()
+					t.begin()
 					_, err := normalizeUnits(out)
+					t.end("", true)
 					if err != nil {
 						return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 					}
@@ -940,10 +1847,11 @@ func (mp *messageProcessor) ProcessMessage(m lp.CCMessage) (lp.CCMessage, error)
 			}
 
 		case STAGENAME_CHANGE_UNIT_PREFIX:
-			if len(mp.changeUnitPrefix) > 0 {
+			if len(mp.changeUnitPrefix.rules) > 0 {
+				st.next(mp.stageStats[s])
 				// cclog.ComponentDebug("MessageProcessor", "Change unit prefix")
 				if out.IsMetric() {
-					_, err := changeUnitPrefix(out, &params, &mp.changeUnitPrefix)
+					_, err := changeUnitPrefix(out, &params, &mp.changeUnitPrefix, t)
 					if err != nil {
 						return out, fmt.Errorf("failed to evaluate: %v", err.Error())
 					}
@@ -951,6 +1859,62 @@ func (mp *messageProcessor) ProcessMessage(m lp.CCMessage) (lp.CCMessage, error)
 					cclog.ComponentDebug("MessageProcessor", "skipped, no metric")
 				}
 			}
+		case STAGENAME_RATE:
+			if len(mp.rate.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Rate")
+				drop, err := rateMessage(out, &params, &mp.rate, pending.add, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+				if drop {
+					t.drop()
+					lp.Release(out)
+					return nil, nil
+				}
+			}
+		case STAGENAME_DERIVE:
+			if len(mp.derive.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Derive metrics")
+				drop, err := deriveMessage(out, &params, &mp.derive, pending.add, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+				if drop {
+					t.drop()
+					lp.Release(out)
+					return nil, nil
+				}
+			}
+		case STAGENAME_AGGREGATE:
+			if len(mp.aggregate.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Aggregate")
+				drop, err := aggregateMessage(out, &params, &mp.aggregate, pending.add, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+				if drop {
+					t.drop()
+					lp.Release(out)
+					return nil, nil
+				}
+			}
+		case STAGENAME_MERGE_FIELDS:
+			if len(mp.mergeFields.rules) > 0 {
+				st.next(mp.stageStats[s])
+				// cclog.ComponentDebug("MessageProcessor", "Merge fields")
+				drop, err := mergeMessage(out, &params, &mp.mergeFields, pending.add, t)
+				if err != nil {
+					return out, fmt.Errorf("failed to evaluate: %v", err.Error())
+				}
+				if drop {
+					t.drop()
+					lp.Release(out)
+					return nil, nil
+				}
+			}
 		}
 	}
 
@@ -0,0 +1,475 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+	"github.com/ClusterCockpit/cc-lib/schema"
+)
+
+// Aggregation functions of the aggregate stage
+const (
+	AGGREGATE_SUM   = "sum"
+	AGGREGATE_AVG   = "avg"
+	AGGREGATE_MIN   = "min"
+	AGGREGATE_MAX   = "max"
+	AGGREGATE_COUNT = "count"
+)
+
+// Scopes the aggregate stage can map the type and type-id tags to
+const (
+	AGGREGATE_SCOPE_NODE          = "node"
+	AGGREGATE_SCOPE_SOCKET        = "socket"
+	AGGREGATE_SCOPE_MEMORY_DOMAIN = "memoryDomain"
+	AGGREGATE_SCOPE_CORE          = "core"
+)
+
+// Default name template of the messages created by the aggregate stage
+const AGGREGATE_DEFAULT_NAME = "{name}_{function}"
+
+// Default time after the end of a time window until Tick closes it, so
+// inputs arriving shortly after a tick are still aggregated
+const AGGREGATE_DEFAULT_DELAY = 10 * time.Second
+
+// Default time after the end of the last closed time window of a group until
+// it is forgotten, so groups which stopped reporting do not keep state
+const AGGREGATE_DEFAULT_TTL = 10 * time.Minute
+
+// AggregationConfig configures a rule of the aggregate stage
+type AggregationConfig struct {
+	Condition string           `json:"if"`                   // Condition selecting the metrics to aggregate
+	GroupBy   []string         `json:"group_by,omitempty"`   // Tags identifying a group together with the name. Default: all tags
+	Scope     string           `json:"scope,omitempty"`      // Map the type and type-id tags to this scope before grouping
+	Topology  *schema.Topology `json:"topology,omitempty"`   // Topology of the node to map hwthreads and cores to the scope
+	Window    string           `json:"window,omitempty"`     // Length of the time window. Without window, metrics with the same timestamp are aggregated
+	Delay     string           `json:"delay,omitempty"`      // Time after the end of the window until Tick closes it. Default: 10s
+	TTL       string           `json:"ttl,omitempty"`        // Time after the end of the last closed window until Tick forgets an idle group. Default: 10m
+	Functions []string         `json:"functions"`            // Aggregation functions: sum, avg, min, max, count
+	Name      string           `json:"name,omitempty"`       // Name template of the created messages with {name} and {function}
+	DropInput bool             `json:"drop_input,omitempty"` // Drop the aggregated input metrics
+}
+
+// aggregationGroup is the state of a group in the current time window
+type aggregationGroup struct {
+	name  string
+	tags  map[string]string
+	meta  map[string]string
+	start time.Time
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// aggregation is a configured aggregation with the state of its groups
+type aggregation struct {
+	config AggregationConfig
+	window time.Duration
+	delay  time.Duration
+	ttl    time.Duration
+	scope  map[int]int // hwthread to ID in the scope
+
+	lock      sync.Mutex
+	groups    map[string]*aggregationGroup
+	closed    map[string]time.Time // start of the last window closed by Tick of groups without open window
+	lastSweep time.Time            // time of the last removal of expired closed windows
+}
+
+// newAggregation checks the configuration and creates the lookup table for
+// the scope
+func newAggregation(config AggregationConfig) (*aggregation, error) {
+	a := &aggregation{
+		config: config,
+		delay:  AGGREGATE_DEFAULT_DELAY,
+		ttl:    AGGREGATE_DEFAULT_TTL,
+		groups: make(map[string]*aggregationGroup),
+		closed: make(map[string]time.Time),
+	}
+	if len(config.Functions) == 0 {
+		return nil, fmt.Errorf("aggregation '%s' has no functions", config.Condition)
+	}
+	for _, f := range config.Functions {
+		switch f {
+		case AGGREGATE_SUM, AGGREGATE_AVG, AGGREGATE_MIN, AGGREGATE_MAX, AGGREGATE_COUNT:
+		default:
+			return nil, fmt.Errorf("invalid aggregation function %s", f)
+		}
+	}
+	if len(a.config.Name) == 0 {
+		a.config.Name = AGGREGATE_DEFAULT_NAME
+	}
+	if len(config.Functions) > 1 && !strings.Contains(a.config.Name, "{function}") {
+		return nil, fmt.Errorf("name template '%s' requires {function} for multiple functions", a.config.Name)
+	}
+	if len(config.Window) > 0 {
+		w, err := time.ParseDuration(config.Window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation window '%s': %v", config.Window, err.Error())
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("invalid aggregation window '%s'", config.Window)
+		}
+		a.window = w
+	}
+	if len(config.Delay) > 0 {
+		d, err := time.ParseDuration(config.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation delay '%s': %v", config.Delay, err.Error())
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid aggregation delay '%s'", config.Delay)
+		}
+		a.delay = d
+	}
+	if len(config.TTL) > 0 {
+		ttl, err := time.ParseDuration(config.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation TTL '%s': %v", config.TTL, err.Error())
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("invalid aggregation TTL '%s'", config.TTL)
+		}
+		a.ttl = ttl
+	}
+
+	var ids [][]int
+	switch config.Scope {
+	case "", AGGREGATE_SCOPE_NODE:
+		return a, nil
+	case AGGREGATE_SCOPE_SOCKET:
+		if config.Topology != nil {
+			ids = config.Topology.Socket
+		}
+	case AGGREGATE_SCOPE_MEMORY_DOMAIN:
+		if config.Topology != nil {
+			ids = config.Topology.MemoryDomain
+		}
+	case AGGREGATE_SCOPE_CORE:
+		if config.Topology != nil {
+			ids = config.Topology.Core
+		}
+	default:
+		return nil, fmt.Errorf("invalid aggregation scope %s", config.Scope)
+	}
+	if config.Topology == nil {
+		return nil, fmt.Errorf("aggregation scope %s requires a topology", config.Scope)
+	}
+	a.scope = make(map[int]int)
+	for id, hwthreads := range ids {
+		for _, h := range hwthreads {
+			a.scope[h] = id
+		}
+	}
+	return a, nil
+}
+
+// scopeTags maps the type and type-id tags of the message to the configured
+// scope. It returns false if the type cannot be mapped.
+func (a *aggregation) scopeTags(m lp.CCMessage) (string, string, bool) {
+	t, _ := m.GetTag("type")
+	if len(a.config.Scope) == 0 {
+		id, _ := m.GetTag("type-id")
+		return t, id, true
+	}
+	if a.config.Scope == AGGREGATE_SCOPE_NODE {
+		return AGGREGATE_SCOPE_NODE, "", true
+	}
+	id, ok := m.GetTag("type-id")
+	if !ok {
+		return "", "", false
+	}
+	if t == a.config.Scope {
+		return t, id, true
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return "", "", false
+	}
+	switch t {
+	case "hwthread":
+	case "core":
+		// A core belongs to the same scope as its hwthreads
+		if n < 0 || n >= len(a.config.Topology.Core) || len(a.config.Topology.Core[n]) == 0 {
+			return "", "", false
+		}
+		n = a.config.Topology.Core[n][0]
+	default:
+		return "", "", false
+	}
+	s, ok := a.scope[n]
+	if !ok {
+		return "", "", false
+	}
+	return a.config.Scope, strconv.Itoa(s), true
+}
+
+// groupTags returns the tags of the group the message belongs to
+func (a *aggregation) groupTags(m lp.CCMessage) (map[string]string, bool) {
+	t, id, ok := a.scopeTags(m)
+	if !ok {
+		return nil, false
+	}
+	tags := make(map[string]string)
+	if len(a.config.GroupBy) == 0 {
+		for k, v := range m.AllTags() {
+			tags[k] = v
+		}
+		if len(a.config.Scope) > 0 {
+			// The sub-type refers to the original type
+			delete(tags, "stype")
+			delete(tags, "stype-id")
+		}
+	} else {
+		for _, k := range a.config.GroupBy {
+			if v, ok := m.GetTag(k); ok {
+				tags[k] = v
+			}
+		}
+	}
+	delete(tags, "type")
+	delete(tags, "type-id")
+	if len(t) > 0 {
+		tags["type"] = t
+	}
+	if len(id) > 0 && t != AGGREGATE_SCOPE_NODE {
+		tags["type-id"] = id
+	}
+	return tags, true
+}
+
+// groupKey returns the key of the group with name and tags
+func groupKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+// numericValue returns the value field of a metric as float64
+func numericValue(m lp.CCMessage) (float64, bool) {
+	v, ok := m.GetField("value")
+	if !ok {
+		return 0, false
+	}
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case float32:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// add adds the metric to its group. If the metric starts a new time window
+// of its group, the messages of the previous window are passed to emit. It
+// returns false if the metric cannot be aggregated.
+func (a *aggregation) add(m lp.CCMessage, emit func(lp.CCMessage)) bool {
+	value, ok := numericValue(m)
+	if !ok || math.IsNaN(value) {
+		return false
+	}
+	tags, ok := a.groupTags(m)
+	if !ok {
+		cclog.ComponentDebug("MessageProcessor", "cannot map", m.Name(), "to scope", a.config.Scope)
+		return false
+	}
+	start := m.Time()
+	if a.window > 0 {
+		start = start.Truncate(a.window)
+	}
+	key := groupKey(m.Name(), tags)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	g, ok := a.groups[key]
+	if ok && start.Before(g.start) {
+		cclog.ComponentDebug("MessageProcessor", "skipping late metric", m.Name(), "for aggregation")
+		return true
+	}
+	// A window closed by Tick is not opened again
+	if closed, found := a.closed[key]; !ok && found {
+		if !start.After(closed) {
+			cclog.ComponentDebug("MessageProcessor", "skipping late metric", m.Name(), "for aggregation")
+			return true
+		}
+		delete(a.closed, key)
+	}
+	if ok && start.After(g.start) {
+		a.emit(g, emit)
+		ok = false
+	}
+	if !ok {
+		g = &aggregationGroup{
+			name:  m.Name(),
+			tags:  tags,
+			meta:  make(map[string]string),
+			start: start,
+			min:   value,
+			max:   value,
+		}
+		for k, v := range m.AllMeta() {
+			g.meta[k] = v
+		}
+		a.groups[key] = g
+	}
+	g.count++
+	g.sum += value
+	g.min = math.Min(g.min, value)
+	g.max = math.Max(g.max, value)
+	return true
+}
+
+// flush emits and removes all groups whose time window ended at least the
+// delay before now and forgets the closed windows which ended more than the
+// TTL before now
+func (a *aggregation) flush(now time.Time, emit func(lp.CCMessage)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for key, g := range a.groups {
+		if !g.start.Add(a.window + a.delay).After(now) {
+			a.emit(g, emit)
+			delete(a.groups, key)
+			a.closed[key] = g.start
+		}
+	}
+	if now.Sub(a.lastSweep) > a.ttl {
+		a.expire(now)
+	}
+}
+
+// expire removes all closed windows which ended more than the TTL before
+// now. Metrics for these windows are aggregated again if they still arrive.
+// The caller has to hold the lock.
+func (a *aggregation) expire(now time.Time) {
+	for key, start := range a.closed {
+		if now.Sub(start.Add(a.window)) > a.ttl {
+			delete(a.closed, key)
+		}
+	}
+	a.lastSweep = now
+}
+
+// emit creates a message for each aggregation function of the group
+func (a *aggregation) emit(g *aggregationGroup, emit func(lp.CCMessage)) {
+	for _, f := range a.config.Functions {
+		var value interface{}
+		meta := g.meta
+		switch f {
+		case AGGREGATE_SUM:
+			value = g.sum
+		case AGGREGATE_AVG:
+			value = g.sum / float64(g.count)
+		case AGGREGATE_MIN:
+			value = g.min
+		case AGGREGATE_MAX:
+			value = g.max
+		case AGGREGATE_COUNT:
+			value = g.count
+			// The count has no unit
+			if _, ok := meta["unit"]; ok {
+				meta = make(map[string]string, len(g.meta))
+				for k, v := range g.meta {
+					if k != "unit" {
+						meta[k] = v
+					}
+				}
+			}
+		}
+		name := strings.ReplaceAll(a.config.Name, "{name}", g.name)
+		name = strings.ReplaceAll(name, "{function}", f)
+		y, err := lp.NewMetric(name, g.tags, meta, value, g.start)
+		if err != nil {
+			cclog.ComponentError("MessageProcessor", "failed to create aggregated metric", name, ":", err.Error())
+			continue
+		}
+		emit(y)
+	}
+}
+
+// aggregateMessage adds the metric to all matching aggregations. It returns
+// whether the metric should be dropped.
+func aggregateMessage(message lp.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[*aggregation], emit func(lp.CCMessage), t *tracer) (bool, error) {
+	if !message.IsMetric() {
+		return false, nil
+	}
+	drop := false
+	last, err := checks.eval(*params, t, func(a *aggregation) error {
+		if a.add(message, emit) && a.config.DropInput {
+			drop = true
+		}
+		return nil
+	})
+	if drop {
+		last.drop()
+	}
+	return drop, err
+}
+
+// Maximal number of generated messages waiting to be fetched with PendingMessages
+const maxPendingMessages = 100000
+
+// pendingMessages is the queue of messages generated by stateful stages
+type pendingMessages struct {
+	lock     sync.Mutex
+	messages []lp.CCMessage
+	full     bool
+}
+
+// add appends the message to the queue. If the queue is full, the message is
+// dropped.
+func (p *pendingMessages) add(m lp.CCMessage) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.messages) >= maxPendingMessages {
+		if !p.full {
+			cclog.ComponentError("MessageProcessor", "too many pending messages, dropping generated messages")
+			p.full = true
+		}
+		lp.Release(m)
+		return
+	}
+	p.messages = append(p.messages, m)
+}
+
+// take returns all messages of the queue and empties it
+func (p *pendingMessages) take() []lp.CCMessage {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	out := p.messages
+	p.messages = nil
+	p.full = false
+	return out
+}
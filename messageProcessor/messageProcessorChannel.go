@@ -0,0 +1,270 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"runtime"
+	"sync"
+
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+)
+
+// Maximal number of messages a worker of ProcessChannel processes at once
+const maxBatchSize = 64
+
+// channelMessage is a message received by ProcessChannel with its position
+// in the input
+type channelMessage struct {
+	seq     uint64
+	message lp.CCMessage
+}
+
+// channelResult is a message processed by a worker of ProcessChannel
+type channelResult struct {
+	seq    uint64
+	out    lp.CCMessage // nil if the message was dropped
+	err    error
+	stages []string // Remaining stages, which are applied in input order
+	t      *tracer
+	hook   func(trace *Trace)
+}
+
+// ProcessChannel processes the messages received from in with the given
+// number of workers (default: GOMAXPROCS) and sends the processed messages
+// and the messages generated by stateful stages to out. Messages with the
+// same name and tags at the input are processed by the same worker, so the
+// rate stage sees each series in order. If a stage before rate may change the
+// name or tags, the stages starting with rate are applied to all messages in
+// one pass in the order they were received. The aggregate, derive and
+// merge_fields stages combine messages of different series, so the stages
+// starting with the first of them (or split_fields before it) are applied the
+// same way. The processed messages are sent in input order. The messages
+// generated while processing are sent to out instead of being added to
+// PendingMessages, so other callers of the message processor, like Tick, may
+// run concurrently. ProcessChannel takes ownership of the received messages
+// and releases them after processing. It returns when in is closed and all
+// messages are sent, out is not closed.
+func (mp *messageProcessor) ProcessChannel(in <-chan lp.CCMessage, out chan<- lp.CCMessage, workers int) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	// Messages generated by the stages for this call
+	pending := new(pendingMessages)
+	results := make(chan channelResult, workers*maxBatchSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mp.collectResults(results, out, pending)
+	}()
+
+	queues := make([]chan channelMessage, workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan channelMessage, maxBatchSize)
+		wg.Add(1)
+		go func(queue <-chan channelMessage) {
+			defer wg.Done()
+			mp.processQueue(queue, results, pending)
+		}(queues[i])
+	}
+	var seq uint64
+	for m := range in {
+		queues[m.SeriesHash()%uint64(workers)] <- channelMessage{seq: seq, message: m}
+		seq++
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	close(results)
+	<-done
+}
+
+// processQueue processes the messages of a worker in batches of the messages
+// available without waiting
+func (mp *messageProcessor) processQueue(queue <-chan channelMessage, results chan<- channelResult, pending *pendingMessages) {
+	batch := make([]channelMessage, 0, maxBatchSize)
+	processed := make([]channelResult, 0, maxBatchSize)
+	for m := range queue {
+		batch = append(batch[:0], m)
+	fill:
+		for len(batch) < maxBatchSize {
+			select {
+			case m, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, m)
+			default:
+				break fill
+			}
+		}
+		processed = mp.processBatch(batch, processed[:0], pending)
+		for _, m := range batch {
+			lp.Release(m.message)
+		}
+		// Sending may block until the collector takes the read lock, so it
+		// happens after releasing it
+		for _, r := range processed {
+			results <- r
+		}
+	}
+}
+
+// processBatch applies the stages before the first stage requiring the input
+// order to the messages and appends the results to processed. The generated
+// messages are added to pending.
+func (mp *messageProcessor) processBatch(batch []channelMessage, processed []channelResult, pending *pendingMessages) []channelResult {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	params := newParamMap()
+	defer putParamMap(params)
+
+	stages := mp.stageOrder()
+	serial := mp.serialStage(stages)
+	for _, m := range batch {
+		r := channelResult{seq: m.seq, stages: stages[serial:]}
+		var y lp.CCMessage
+		y, r.t, r.hook = mp.startProcessing(m.message, params, nil)
+		r.out, r.err = mp.runStages(y, params, stages[:serial], pending, r.t)
+		processed = append(processed, r)
+	}
+	return processed
+}
+
+// serialStage returns the index of the first stage, which has to see the
+// messages of all series in input order. These are the active aggregate,
+// derive and merge_fields stages and an active split_fields stage before
+// them, as the metrics it creates pass the following stages. The workers get
+// the messages by their series at the input, so an active rate stage is
+// also applied in input order if a stage before it may change the name or
+// tags. It returns len(stages) if no such stage is active. The caller has to
+// hold the read lock.
+func (mp *messageProcessor) serialStage(stages []string) int {
+	active := func(s string) bool {
+		switch s {
+		case STAGENAME_AGGREGATE:
+			return len(mp.aggregate.rules) > 0
+		case STAGENAME_DERIVE:
+			return len(mp.derive.rules) > 0
+		case STAGENAME_MERGE_FIELDS:
+			return len(mp.mergeFields.rules) > 0
+		}
+		return false
+	}
+	// changesSeries checks whether an active stage may change the name or
+	// tags of a message
+	changesSeries := func(s string) bool {
+		switch s {
+		case STAGENAME_RENAME_BY_NAME:
+			return len(mp.renameMessages) > 0
+		case STAGENAME_RENAME_IF:
+			return len(mp.renameMessagesIf.rules) > 0
+		case STAGENAME_RENAME_REGEX:
+			return len(mp.renameRegex.rules) > 0
+		case STAGENAME_ADD_TAG:
+			return len(mp.addTagsIf.rules) > 0
+		case STAGENAME_DELETE_TAG:
+			return len(mp.deleteTagsIf.rules) > 0
+		case STAGENAME_MOVE_TAG_META:
+			return len(mp.moveTagToMeta.rules) > 0
+		case STAGENAME_MOVE_TAG_FIELD:
+			return len(mp.moveTagToField.rules) > 0
+		case STAGENAME_MOVE_META_TAG:
+			return len(mp.moveMetaToTag.rules) > 0
+		case STAGENAME_MOVE_FIELD_TAG:
+			return len(mp.moveFieldToTag.rules) > 0
+		case STAGENAME_SET_TAG:
+			return len(mp.setTagIf.rules) > 0
+		case STAGENAME_REWRITE_TAG:
+			return len(mp.rewriteTagsIf.rules) > 0
+		case STAGENAME_CHANGE_UNIT_PREFIX:
+			// The unit may be a tag
+			return len(mp.changeUnitPrefix.rules) > 0
+		case STAGENAME_NORMALIZE_UNIT:
+			return mp.normalizeUnits
+		}
+		return false
+	}
+	changed := false
+	for i, s := range stages {
+		if active(s) {
+			return i
+		}
+		if s == STAGENAME_RATE && len(mp.rate.rules) > 0 && changed {
+			return i
+		}
+		if s == STAGENAME_SPLIT_FIELDS && len(mp.splitFields.rules) > 0 {
+			for _, x := range stages[i+1:] {
+				if active(x) {
+					return i
+				}
+			}
+		}
+		changed = changed || changesSeries(s)
+	}
+	return len(stages)
+}
+
+// collectResults applies the remaining stages to the results of the workers
+// in input order and sends the processed and the generated messages to out
+func (mp *messageProcessor) collectResults(results <-chan channelResult, out chan<- lp.CCMessage, pending *pendingMessages) {
+	waiting := make(map[uint64]channelResult)
+	ready := make([]channelResult, 0, maxBatchSize)
+	var next uint64
+	for r := range results {
+		waiting[r.seq] = r
+		ready = ready[:0]
+		for {
+			r, ok := waiting[next]
+			if !ok {
+				break
+			}
+			delete(waiting, next)
+			ready = append(ready, r)
+			next++
+		}
+		if len(ready) == 0 {
+			continue
+		}
+		for _, m := range mp.finishResults(ready, pending) {
+			out <- m
+		}
+		for _, m := range pending.take() {
+			out <- m
+		}
+	}
+}
+
+// finishResults applies the remaining stages to the results and returns the
+// messages which were not dropped. The generated messages are added to
+// pending.
+func (mp *messageProcessor) finishResults(results []channelResult, pending *pendingMessages) []lp.CCMessage {
+	processed := make([]lp.CCMessage, 0, len(results))
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	params := newParamMap()
+	defer putParamMap(params)
+
+	for _, r := range results {
+		y, err := r.out, r.err
+		if err == nil && y != nil && len(r.stages) > 0 {
+			setParamMap(params, y)
+			y, err = mp.runStages(y, params, r.stages, pending, r.t)
+		}
+		r.t.finish(y, err, r.hook)
+		if err != nil {
+			cclog.ComponentError("MessageProcessor", "failed to process message:", err.Error())
+			lp.Release(y)
+			continue
+		}
+		if y != nil {
+			processed = append(processed, y)
+		}
+	}
+	return processed
+}
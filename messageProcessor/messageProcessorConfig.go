@@ -0,0 +1,307 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// ConfigChange is a difference between the configurations of two message
+// processors. Before is nil for added rules and settings, After is nil for
+// removed ones.
+type ConfigChange struct {
+	Option string      `json:"option"`           // Configuration option as in the JSON configuration, e.g. add_tags_if
+	Key    string      `json:"key,omitempty"`    // Key of options configured as JSON object, e.g. the condition of rename_messages_if
+	Before interface{} `json:"before,omitempty"` // Rule or setting of the message processor
+	After  interface{} `json:"after,omitempty"`  // Rule or setting of the other message processor
+}
+
+// ruleConfigs returns the configurations of the rules in order
+func ruleConfigs[T, C any](rules *messageProcessorRules[T], config func(rule messageProcessorRule[T]) C) []C {
+	if len(rules.rules) == 0 {
+		return nil
+	}
+	out := make([]C, 0, len(rules.rules))
+	for _, r := range rules.rules {
+		out = append(out, config(r))
+	}
+	return out
+}
+
+// tagConfigs returns the configurations of tag, meta and field rules
+func tagConfigs(rules *messageProcessorRules[messageProcessorTagConfig]) []messageProcessorTagConfig {
+	return ruleConfigs(rules, func(r messageProcessorRule[messageProcessorTagConfig]) messageProcessorTagConfig {
+		return r.config
+	})
+}
+
+// setConfigs returns the configurations of set rules
+func setConfigs(rules *messageProcessorRules[setRule]) []messageProcessorSetConfig {
+	return ruleConfigs(rules, func(r messageProcessorRule[setRule]) messageProcessorSetConfig {
+		return messageProcessorSetConfig{Key: r.config.key, Expression: r.config.expression, Condition: r.condition}
+	})
+}
+
+// regexConfigs returns the configurations of rewrite rules
+func regexConfigs(rules *messageProcessorRules[regexRule]) []messageProcessorRegexConfig {
+	return ruleConfigs(rules, func(r messageProcessorRule[regexRule]) messageProcessorRegexConfig {
+		return messageProcessorRegexConfig{Key: r.config.key, Regex: r.config.regex.String(), Replacement: r.config.replacement, Condition: r.condition}
+	})
+}
+
+// orderedConfigs returns the configurations of rules configured as JSON object
+func orderedConfigs(rules *messageProcessorRules[string]) orderedConfigMap {
+	return ruleConfigs(rules, func(r messageProcessorRule[string]) orderedConfigEntry {
+		return orderedConfigEntry{Key: r.condition, Value: r.config}
+	})
+}
+
+// config returns the current configuration of the message processor
+func (mp *messageProcessor) config() messageProcessorConfig {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var c messageProcessorConfig
+	if len(mp.stages) > 0 && !slices.Equal(mp.stages, mp.DefaultStages()) {
+		c.StageOrder = slices.Clone(mp.stages)
+	}
+	if len(mp.dropMessages) > 0 {
+		c.DropMessages = slices.Sorted(maps.Keys(mp.dropMessages))
+	}
+	if len(mp.dropTypes) > 0 {
+		c.DropByType = slices.Sorted(maps.Keys(mp.dropTypes))
+	}
+	c.DropMessagesIf = ruleConfigs(&mp.dropMessagesIf, func(r messageProcessorRule[struct{}]) string {
+		return r.condition
+	})
+	if len(mp.renameMessages) > 0 {
+		c.RenameMessages = maps.Clone(mp.renameMessages)
+	}
+	c.RenameMessagesIf = orderedConfigs(&mp.renameMessagesIf)
+	c.RenameMessagesRe = ruleConfigs(&mp.renameRegex, func(r messageProcessorRule[regexRule]) orderedConfigEntry {
+		return orderedConfigEntry{Key: r.condition, Value: r.config.replacement}
+	})
+	c.NormalizeUnits = mp.normalizeUnits
+	c.ChangeUnitPrefix = orderedConfigs(&mp.changeUnitPrefix)
+	c.AddTagsIf = tagConfigs(&mp.addTagsIf)
+	c.DelTagsIf = tagConfigs(&mp.deleteTagsIf)
+	c.AddMetaIf = tagConfigs(&mp.addMetaIf)
+	c.DelMetaIf = tagConfigs(&mp.deleteMetaIf)
+	c.AddFieldIf = tagConfigs(&mp.addFieldIf)
+	c.DelFieldIf = tagConfigs(&mp.deleteFieldIf)
+	c.MoveTagToMeta = tagConfigs(&mp.moveTagToMeta)
+	c.MoveTagToField = tagConfigs(&mp.moveTagToField)
+	c.MoveMetaToTag = tagConfigs(&mp.moveMetaToTag)
+	c.MoveMetaToField = tagConfigs(&mp.moveMetaToField)
+	c.MoveFieldToTag = tagConfigs(&mp.moveFieldToTag)
+	c.MoveFieldToMeta = tagConfigs(&mp.moveFieldToMeta)
+	c.SetFieldIf = setConfigs(&mp.setFieldIf)
+	c.SetTagIf = setConfigs(&mp.setTagIf)
+	c.SetMetaIf = setConfigs(&mp.setMetaIf)
+	c.RewriteTagsIf = regexConfigs(&mp.rewriteTagsIf)
+	c.RewriteMetaIf = regexConfigs(&mp.rewriteMetaIf)
+	c.RewriteFieldIf = regexConfigs(&mp.rewriteFieldIf)
+	c.Aggregate = ruleConfigs(&mp.aggregate, func(r messageProcessorRule[*aggregation]) AggregationConfig {
+		return r.config.config
+	})
+	c.Rate = ruleConfigs(&mp.rate, func(r messageProcessorRule[*rate]) RateConfig {
+		return r.config.config
+	})
+	c.DerivedMetrics = ruleConfigs(&mp.derive, func(r messageProcessorRule[*derivedMetric]) DerivedMetricConfig {
+		return r.config.config
+	})
+	c.SplitFields = ruleConfigs(&mp.splitFields, func(r messageProcessorRule[SplitConfig]) SplitConfig {
+		return r.config
+	})
+	c.MergeFields = ruleConfigs(&mp.mergeFields, func(r messageProcessorRule[*merge]) MergeConfig {
+		return r.config.config
+	})
+	// Only settings differing from the default of the stage are exported
+	settings := mp.firstMatchSettings()
+	for _, s := range StageNames {
+		firstMatch, ok := settings[s]
+		if !ok {
+			continue
+		}
+		byDefault := slices.Contains(firstMatchStages, s)
+		if *firstMatch && !byDefault {
+			c.FirstMatch = append(c.FirstMatch, s)
+		} else if !*firstMatch && byDefault {
+			c.AllMatches = append(c.AllMatches, s)
+		}
+	}
+	if mp.traceHook != nil && mp.traceHook.logged {
+		c.TraceIf = mp.traceHook.selector
+	}
+	if mp.statsInterval > 0 {
+		c.StatsInterval = mp.statsInterval.String()
+	}
+	return c
+}
+
+// ToConfigJSON returns the current configuration in the format read by
+// FromConfigJSON, including the rules added at runtime. Variables added with
+// AddBaseEnv and trace hooks other than logging are not exported.
+func (mp *messageProcessor) ToConfigJSON() (json.RawMessage, error) {
+	out, err := json.Marshal(mp.config())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config JSON: %v", err.Error())
+	}
+	return out, nil
+}
+
+// diffList appends the rules removed from before and added in after. If only
+// the order of the rules changed, the whole lists are compared.
+func diffList[T any](changes []ConfigChange, option string, before, after []T) []ConfigChange {
+	if reflect.DeepEqual(before, after) {
+		return changes
+	}
+	// Match each rule of before with an equal rule of after, which is not
+	// matched yet
+	matched := make([]bool, len(after))
+	n := len(changes)
+	for _, b := range before {
+		found := false
+		for i, a := range after {
+			if !matched[i] && reflect.DeepEqual(a, b) {
+				matched[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			changes = append(changes, ConfigChange{Option: option, Before: b})
+		}
+	}
+	for i, a := range after {
+		if !matched[i] {
+			changes = append(changes, ConfigChange{Option: option, After: a})
+		}
+	}
+	if len(changes) == n && len(before)+len(after) > 0 {
+		changes = append(changes, ConfigChange{Option: option, Before: before, After: after})
+	}
+	return changes
+}
+
+// diffMap appends the keys removed from before, added in after or with
+// changed values
+func diffMap(changes []ConfigChange, option string, before, after map[string]string) []ConfigChange {
+	keys := slices.Sorted(maps.Keys(before))
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		if inBefore && inAfter && a == b {
+			continue
+		}
+		c := ConfigChange{Option: option, Key: k}
+		if inBefore {
+			c.Before = b
+		}
+		if inAfter {
+			c.After = a
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// diffOrderedMap appends the changes of rules configured as JSON object.
+// Like diffMap, but also reports if only the order of the rules changed.
+func diffOrderedMap(changes []ConfigChange, option string, before, after orderedConfigMap) []ConfigChange {
+	if slices.Equal(before, after) {
+		return changes
+	}
+	toMap := func(m orderedConfigMap) map[string]string {
+		out := make(map[string]string, len(m))
+		for _, e := range m {
+			out[e.Key] = e.Value
+		}
+		return out
+	}
+	n := len(changes)
+	changes = diffMap(changes, option, toMap(before), toMap(after))
+	if len(changes) == n {
+		changes = append(changes, ConfigChange{Option: option, Before: before, After: after})
+	}
+	return changes
+}
+
+// diffValue appends a change of a setting
+func diffValue[T comparable](changes []ConfigChange, option string, before, after T) []ConfigChange {
+	if before != after {
+		changes = append(changes, ConfigChange{Option: option, Before: before, After: after})
+	}
+	return changes
+}
+
+// Diff returns the differences between the configuration of the message
+// processor and the other one, like the rules added or removed in the other
+// message processor. Changes of the order of the rules or stages are reported
+// with the whole lists. Variables added with AddBaseEnv are not compared.
+func (mp *messageProcessor) Diff(other MessageProcessor) ([]ConfigChange, error) {
+	before := mp.config()
+	var after messageProcessorConfig
+	if o, ok := other.(*messageProcessor); ok {
+		after = o.config()
+	} else {
+		config, err := other.ToConfigJSON()
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(config, &after); err != nil {
+			return nil, fmt.Errorf("failed to process config JSON: %v", err.Error())
+		}
+	}
+
+	var changes []ConfigChange
+	changes = diffList(changes, "stage_order", before.StageOrder, after.StageOrder)
+	changes = diffList(changes, "drop_messages", before.DropMessages, after.DropMessages)
+	changes = diffList(changes, "drop_by_message_type", before.DropByType, after.DropByType)
+	changes = diffList(changes, "drop_messages_if", before.DropMessagesIf, after.DropMessagesIf)
+	changes = diffMap(changes, "rename_messages", before.RenameMessages, after.RenameMessages)
+	changes = diffOrderedMap(changes, "rename_messages_if", before.RenameMessagesIf, after.RenameMessagesIf)
+	changes = diffOrderedMap(changes, "rename_messages_regex", before.RenameMessagesRe, after.RenameMessagesRe)
+	changes = diffValue(changes, "normalize_units", before.NormalizeUnits, after.NormalizeUnits)
+	changes = diffOrderedMap(changes, "change_unit_prefix", before.ChangeUnitPrefix, after.ChangeUnitPrefix)
+	changes = diffList(changes, "add_tags_if", before.AddTagsIf, after.AddTagsIf)
+	changes = diffList(changes, "delete_tags_if", before.DelTagsIf, after.DelTagsIf)
+	changes = diffList(changes, "add_meta_if", before.AddMetaIf, after.AddMetaIf)
+	changes = diffList(changes, "delete_meta_if", before.DelMetaIf, after.DelMetaIf)
+	changes = diffList(changes, "add_field_if", before.AddFieldIf, after.AddFieldIf)
+	changes = diffList(changes, "delete_field_if", before.DelFieldIf, after.DelFieldIf)
+	changes = diffList(changes, "move_tag_to_meta_if", before.MoveTagToMeta, after.MoveTagToMeta)
+	changes = diffList(changes, "move_tag_to_field_if", before.MoveTagToField, after.MoveTagToField)
+	changes = diffList(changes, "move_meta_to_tag_if", before.MoveMetaToTag, after.MoveMetaToTag)
+	changes = diffList(changes, "move_meta_to_field_if", before.MoveMetaToField, after.MoveMetaToField)
+	changes = diffList(changes, "move_field_to_tag_if", before.MoveFieldToTag, after.MoveFieldToTag)
+	changes = diffList(changes, "move_field_to_meta_if", before.MoveFieldToMeta, after.MoveFieldToMeta)
+	changes = diffList(changes, "set_field_if", before.SetFieldIf, after.SetFieldIf)
+	changes = diffList(changes, "set_tag_if", before.SetTagIf, after.SetTagIf)
+	changes = diffList(changes, "set_meta_if", before.SetMetaIf, after.SetMetaIf)
+	changes = diffList(changes, "rewrite_tags_if", before.RewriteTagsIf, after.RewriteTagsIf)
+	changes = diffList(changes, "rewrite_meta_if", before.RewriteMetaIf, after.RewriteMetaIf)
+	changes = diffList(changes, "rewrite_field_if", before.RewriteFieldIf, after.RewriteFieldIf)
+	changes = diffList(changes, "rate", before.Rate, after.Rate)
+	changes = diffList(changes, "derived_metrics", before.DerivedMetrics, after.DerivedMetrics)
+	changes = diffList(changes, "aggregate", before.Aggregate, after.Aggregate)
+	changes = diffList(changes, "split_fields", before.SplitFields, after.SplitFields)
+	changes = diffList(changes, "merge_fields", before.MergeFields, after.MergeFields)
+	changes = diffList(changes, "stop_after_first_match", before.FirstMatch, after.FirstMatch)
+	changes = diffList(changes, "apply_all_matches", before.AllMatches, after.AllMatches)
+	changes = diffValue(changes, "trace_if", before.TraceIf, after.TraceIf)
+	changes = diffValue(changes, "stats_interval", before.StatsInterval, after.StatsInterval)
+	return changes, nil
+}
@@ -0,0 +1,226 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Default time after which incomplete input sets of derived metrics are discarded
+const DERIVE_DEFAULT_TIMEOUT = time.Minute
+
+// DerivedMetricConfig configures a metric computed from several input metrics
+type DerivedMetricConfig struct {
+	Name       string   `json:"name"`                 // Name of the derived metric
+	Condition  string   `json:"if,omitempty"`         // Condition the input metrics have to match. Default: true
+	Inputs     []string `json:"inputs"`               // Names of the input metrics
+	Expression string   `json:"expression"`           // Expression over the input names computing the value
+	Unit       string   `json:"unit,omitempty"`       // Unit meta information of the derived metric
+	Tolerance  string   `json:"tolerance,omitempty"`  // Maximal time difference of the inputs. Default: same timestamp
+	Timeout    string   `json:"timeout,omitempty"`    // Time after which incomplete input sets are discarded. Default: 1m
+	DropInput  bool     `json:"drop_input,omitempty"` // Drop the input metrics
+}
+
+// deriveSet collects the inputs with the same tags and close timestamps
+type deriveSet struct {
+	tm     time.Time
+	tags   map[string]string
+	meta   map[string]string
+	values map[string]interface{}
+}
+
+// derivedMetric is a configured derived metric with its incomplete input sets
+type derivedMetric struct {
+	config    DerivedMetricConfig
+	program   *vm.Program
+	tolerance time.Duration
+	timeout   time.Duration
+
+	lock      sync.Mutex
+	sets      map[string][]*deriveSet // incomplete input sets by tags
+	lastSweep time.Time               // time of the last search for timed out input sets
+}
+
+// newDerivedMetric checks the configuration and compiles the expression
+func newDerivedMetric(config DerivedMetricConfig) (*derivedMetric, error) {
+	d := &derivedMetric{
+		config:  config,
+		timeout: DERIVE_DEFAULT_TIMEOUT,
+		sets:    make(map[string][]*deriveSet),
+	}
+	if len(config.Name) == 0 {
+		return nil, fmt.Errorf("derived metric has no name")
+	}
+	if len(config.Inputs) == 0 {
+		return nil, fmt.Errorf("derived metric %s has no inputs", config.Name)
+	}
+	if len(d.config.Condition) == 0 {
+		d.config.Condition = "true"
+	}
+	if len(config.Tolerance) > 0 {
+		t, err := time.ParseDuration(config.Tolerance)
+		if err != nil || t < 0 {
+			return nil, fmt.Errorf("invalid tolerance '%s' of derived metric %s", config.Tolerance, config.Name)
+		}
+		d.tolerance = t
+	}
+	if len(config.Timeout) > 0 {
+		t, err := time.ParseDuration(config.Timeout)
+		if err != nil || t <= 0 {
+			return nil, fmt.Errorf("invalid timeout '%s' of derived metric %s", config.Timeout, config.Name)
+		}
+		d.timeout = t
+	}
+
+	env := make(map[string]interface{}, len(config.Inputs))
+	for _, in := range config.Inputs {
+		env[in] = 0.0
+	}
+	program, err := expr.Compile(config.Expression, expr.Env(env), expr.AsFloat64())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile expression of derived metric %s: %v", config.Name, err.Error())
+	}
+	d.program = program
+	return d, nil
+}
+
+// add adds the input metric to an input set with the same tags and a close
+// timestamp. Complete sets are evaluated and the derived metric is passed to
+// emit. It returns false if the metric is no input.
+func (d *derivedMetric) add(m lp.CCMessage, emit func(lp.CCMessage)) bool {
+	name := m.Name()
+	if !slices.Contains(d.config.Inputs, name) {
+		return false
+	}
+	value, ok := numericValue(m)
+	if !ok {
+		return false
+	}
+	tm := m.Time()
+	tags := maps.Collect(m.AllTags())
+	key := groupKey("", tags)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// Search for timed out input sets at most once per timeout, flush
+	// discards the remaining ones
+	if tm.Sub(d.lastSweep) > d.timeout {
+		d.expire(tm)
+	}
+
+	sets := d.sets[key]
+	var set *deriveSet
+	for _, s := range sets {
+		if _, ok := s.values[name]; ok {
+			continue
+		}
+		if diff := tm.Sub(s.tm); diff <= d.tolerance && diff >= -d.tolerance {
+			set = s
+			break
+		}
+	}
+	if set == nil {
+		set = &deriveSet{
+			tm:     tm,
+			tags:   tags,
+			meta:   make(map[string]string),
+			values: make(map[string]interface{}, len(d.config.Inputs)),
+		}
+		for k, v := range m.AllMeta() {
+			if k != "unit" {
+				set.meta[k] = v
+			}
+		}
+		sets = append(sets, set)
+	}
+	set.values[name] = value
+
+	if len(set.values) < len(d.config.Inputs) {
+		d.sets[key] = sets
+		return true
+	}
+	sets = slices.DeleteFunc(sets, func(s *deriveSet) bool { return s == set })
+	if len(sets) == 0 {
+		delete(d.sets, key)
+	} else {
+		d.sets[key] = sets
+	}
+	d.emit(set, emit)
+	return true
+}
+
+// emit evaluates the expression for the complete input set
+func (d *derivedMetric) emit(set *deriveSet, emit func(lp.CCMessage)) {
+	value, err := expr.Run(d.program, set.values)
+	if err != nil {
+		cclog.ComponentError("MessageProcessor", "failed to evaluate derived metric", d.config.Name, ":", err.Error())
+		return
+	}
+	if len(d.config.Unit) > 0 {
+		set.meta["unit"] = d.config.Unit
+	}
+	y, err := lp.NewMetric(d.config.Name, set.tags, set.meta, value, set.tm)
+	if err != nil {
+		cclog.ComponentError("MessageProcessor", "failed to create derived metric", d.config.Name, ":", err.Error())
+		return
+	}
+	emit(y)
+}
+
+// expire discards the incomplete input sets older than the timeout before
+// now. The caller has to hold the lock.
+func (d *derivedMetric) expire(now time.Time) {
+	for key, sets := range d.sets {
+		sets = slices.DeleteFunc(sets, func(s *deriveSet) bool {
+			if now.Sub(s.tm) > d.timeout {
+				cclog.ComponentDebug("MessageProcessor", "incomplete inputs of derived metric", d.config.Name, "timed out")
+				return true
+			}
+			return false
+		})
+		if len(sets) == 0 {
+			delete(d.sets, key)
+		} else {
+			d.sets[key] = sets
+		}
+	}
+	d.lastSweep = now
+}
+
+// flush discards the incomplete input sets which timed out
+func (d *derivedMetric) flush(now time.Time) {
+	d.lock.Lock()
+	d.expire(now)
+	d.lock.Unlock()
+}
+
+// deriveMessage adds the metric to all derived metrics it is an input of. It
+// returns whether the metric should be dropped.
+func deriveMessage(message lp.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[*derivedMetric], emit func(lp.CCMessage), t *tracer) (bool, error) {
+	if !message.IsMetric() {
+		return false, nil
+	}
+	drop := false
+	last, err := checks.eval(*params, t, func(d *derivedMetric) error {
+		if d.add(message, emit) && d.config.DropInput {
+			drop = true
+		}
+		return nil
+	})
+	if drop {
+		last.drop()
+	}
+	return drop, err
+}
@@ -11,7 +11,6 @@ import (
 	lp2 "github.com/ClusterCockpit/cc-lib/ccMessage"
 	units "github.com/ClusterCockpit/cc-units"
 	"github.com/expr-lang/expr"
-	"github.com/expr-lang/expr/vm"
 )
 
 type MessageLocation int
@@ -23,169 +22,300 @@ const (
 )
 
 // Abstract function to move entries from one location to another
-func moveInMessage(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig, from, to MessageLocation) (bool, error) {
-	for d, data := range *checks {
-		value, err := expr.Run(d, *params)
-		if err != nil {
-			return false, fmt.Errorf("failed to evaluate: %v", err.Error())
+func moveInMessage(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], from, to MessageLocation, t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(data messageProcessorTagConfig) error {
+		var v string
+		ok := false
+		switch from {
+		case MESSAGE_LOCATION_TAGS:
+			// cclog.ComponentDebug("MessageProcessor", "Getting tag key", data.Key)
+			v, ok = message.GetTag(data.Key)
+		case MESSAGE_LOCATION_META:
+			// cclog.ComponentDebug("MessageProcessor", "Getting meta key", data.Key)
+			// cclog.ComponentDebug("MessageProcessor", message.Meta())
+			v, ok = message.GetMeta(data.Key)
+		case MESSAGE_LOCATION_FIELDS:
+			var x interface{}
+			// cclog.ComponentDebug("MessageProcessor", "Getting field key", data.Key)
+			x, ok = message.GetField(data.Key)
+			v = fmt.Sprintf("%v", x)
 		}
-		// cclog.ComponentDebug("MessageProcessor", "Move from", from, "to", to)
-		if value.(bool) {
-			var v string
-			ok := false
-			switch from {
-			case MESSAGE_LOCATION_TAGS:
-				// cclog.ComponentDebug("MessageProcessor", "Getting tag key", data.Key)
-				v, ok = message.GetTag(data.Key)
-			case MESSAGE_LOCATION_META:
-				// cclog.ComponentDebug("MessageProcessor", "Getting meta key", data.Key)
-				// cclog.ComponentDebug("MessageProcessor", message.Meta())
-				v, ok = message.GetMeta(data.Key)
-			case MESSAGE_LOCATION_FIELDS:
-				var x interface{}
-				// cclog.ComponentDebug("MessageProcessor", "Getting field key", data.Key)
-				x, ok = message.GetField(data.Key)
-				v = fmt.Sprintf("%v", x)
-			}
-			if ok {
-				switch from {
-				case MESSAGE_LOCATION_TAGS:
-					// cclog.ComponentDebug("MessageProcessor", "Removing tag key", data.Key)
-					message.RemoveTag(data.Key)
-				case MESSAGE_LOCATION_META:
-					// cclog.ComponentDebug("MessageProcessor", "Removing meta key", data.Key)
-					message.RemoveMeta(data.Key)
-				case MESSAGE_LOCATION_FIELDS:
-					// cclog.ComponentDebug("MessageProcessor", "Removing field key", data.Key)
-					message.RemoveField(data.Key)
-				}
-				switch to {
-				case MESSAGE_LOCATION_TAGS:
-					// cclog.ComponentDebug("MessageProcessor", "Adding tag", data.Value, "->", v)
-					message.AddTag(data.Value, v)
-				case MESSAGE_LOCATION_META:
-					// cclog.ComponentDebug("MessageProcessor", "Adding meta", data.Value, "->", v)
-					message.AddMeta(data.Value, v)
-				case MESSAGE_LOCATION_FIELDS:
-					// cclog.ComponentDebug("MessageProcessor", "Adding field", data.Value, "->", v)
-					message.AddField(data.Value, v)
-				}
-			}
+		if ok {
+			// cclog.ComponentDebug("MessageProcessor", "Moving key", data.Key, "->", data.Value)
+			removeValue(message, params, from, data.Key)
+			putValue(message, params, to, data.Value, v)
 		}
-	}
-	return false, nil
+		return nil
+	})
+	return false, err
 }
 
-func deleteIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig, location MessageLocation) (bool, error) {
-	for d, data := range *checks {
-		value, err := expr.Run(d, *params)
-		if err != nil {
-			return true, fmt.Errorf("failed to evaluate: %v", err.Error())
-		}
-		if value.(bool) {
-			switch location {
-			case MESSAGE_LOCATION_FIELDS:
-				switch data.Key {
-				case "value", "event", "log", "control":
-					return false, errors.New("cannot delete protected fields")
-				default:
-					// cclog.ComponentDebug("MessageProcessor", "Removing field for", data.Key)
-					message.RemoveField(data.Key)
-				}
-			case MESSAGE_LOCATION_TAGS:
-				// cclog.ComponentDebug("MessageProcessor", "Removing tag for", data.Key)
-				message.RemoveTag(data.Key)
-			case MESSAGE_LOCATION_META:
-				// cclog.ComponentDebug("MessageProcessor", "Removing meta for", data.Key)
-				message.RemoveMeta(data.Key)
+func deleteIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], location MessageLocation, t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(data messageProcessorTagConfig) error {
+		switch location {
+		case MESSAGE_LOCATION_FIELDS:
+			switch data.Key {
+			case "value", "event", "log", "control":
+				return errors.New("cannot delete protected fields")
+			default:
+				// cclog.ComponentDebug("MessageProcessor", "Removing field for", data.Key)
+				removeValue(message, params, location, data.Key)
 			}
+		case MESSAGE_LOCATION_TAGS, MESSAGE_LOCATION_META:
+			// cclog.ComponentDebug("MessageProcessor", "Removing tag or meta for", data.Key)
+			removeValue(message, params, location, data.Key)
 		}
-	}
-	return false, nil
+		return nil
+	})
+	return false, err
 }
 
-func addIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig, location MessageLocation) (bool, error) {
-	for d, data := range *checks {
-		value, err := expr.Run(d, *params)
-		if err != nil {
-			return true, fmt.Errorf("failed to evaluate: %v", err.Error())
-		}
-		if value.(bool) {
-			switch location {
-			case MESSAGE_LOCATION_FIELDS:
-				// cclog.ComponentDebug("MessageProcessor", "Adding field", data.Value, "->", data.Value)
-				message.AddField(data.Key, data.Value)
-			case MESSAGE_LOCATION_TAGS:
-				// cclog.ComponentDebug("MessageProcessor", "Adding tag", data.Value, "->", data.Value)
-				message.AddTag(data.Key, data.Value)
-			case MESSAGE_LOCATION_META:
-				// cclog.ComponentDebug("MessageProcessor", "Adding meta", data.Value, "->", data.Value)
-				message.AddMeta(data.Key, data.Value)
-			}
-		}
-	}
-	return false, nil
+func addIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], location MessageLocation, t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(data messageProcessorTagConfig) error {
+		// cclog.ComponentDebug("MessageProcessor", "Adding", data.Key, "->", data.Value)
+		putValue(message, params, location, data.Key, data.Value)
+		return nil
+	})
+	return false, err
 }
 
-func deleteTagIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return deleteIf(message, params, checks, MESSAGE_LOCATION_TAGS)
+func deleteTagIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return deleteIf(message, params, checks, MESSAGE_LOCATION_TAGS, t)
 }
 
-func addTagIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return addIf(message, params, checks, MESSAGE_LOCATION_TAGS)
+func addTagIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return addIf(message, params, checks, MESSAGE_LOCATION_TAGS, t)
 }
 
-func moveTagToMeta(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return moveInMessage(message, params, checks, MESSAGE_LOCATION_TAGS, MESSAGE_LOCATION_META)
+func moveTagToMeta(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return moveInMessage(message, params, checks, MESSAGE_LOCATION_TAGS, MESSAGE_LOCATION_META, t)
 }
 
-func moveTagToField(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return moveInMessage(message, params, checks, MESSAGE_LOCATION_TAGS, MESSAGE_LOCATION_FIELDS)
+func moveTagToField(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return moveInMessage(message, params, checks, MESSAGE_LOCATION_TAGS, MESSAGE_LOCATION_FIELDS, t)
 }
 
-func deleteMetaIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return deleteIf(message, params, checks, MESSAGE_LOCATION_META)
+func deleteMetaIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return deleteIf(message, params, checks, MESSAGE_LOCATION_META, t)
 }
 
-func addMetaIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return addIf(message, params, checks, MESSAGE_LOCATION_META)
+func addMetaIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return addIf(message, params, checks, MESSAGE_LOCATION_META, t)
 }
 
-func moveMetaToTag(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return moveInMessage(message, params, checks, MESSAGE_LOCATION_META, MESSAGE_LOCATION_TAGS)
+func moveMetaToTag(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return moveInMessage(message, params, checks, MESSAGE_LOCATION_META, MESSAGE_LOCATION_TAGS, t)
 }
 
-func moveMetaToField(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return moveInMessage(message, params, checks, MESSAGE_LOCATION_META, MESSAGE_LOCATION_FIELDS)
+func moveMetaToField(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return moveInMessage(message, params, checks, MESSAGE_LOCATION_META, MESSAGE_LOCATION_FIELDS, t)
 }
 
-func deleteFieldIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return deleteIf(message, params, checks, MESSAGE_LOCATION_FIELDS)
+func deleteFieldIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return deleteIf(message, params, checks, MESSAGE_LOCATION_FIELDS, t)
 }
 
-func addFieldIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return addIf(message, params, checks, MESSAGE_LOCATION_FIELDS)
+func addFieldIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return addIf(message, params, checks, MESSAGE_LOCATION_FIELDS, t)
 }
 
-func moveFieldToTag(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return moveInMessage(message, params, checks, MESSAGE_LOCATION_FIELDS, MESSAGE_LOCATION_TAGS)
+func moveFieldToTag(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return moveInMessage(message, params, checks, MESSAGE_LOCATION_FIELDS, MESSAGE_LOCATION_TAGS, t)
 }
 
-func moveFieldToMeta(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]messageProcessorTagConfig) (bool, error) {
-	return moveInMessage(message, params, checks, MESSAGE_LOCATION_FIELDS, MESSAGE_LOCATION_META)
+func moveFieldToMeta(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[messageProcessorTagConfig], t *tracer) (bool, error) {
+	return moveInMessage(message, params, checks, MESSAGE_LOCATION_FIELDS, MESSAGE_LOCATION_META, t)
 }
 
-func dropMessagesIf(params *map[string]interface{}, checks *map[*vm.Program]struct{}) (bool, error) {
-	for d := range *checks {
-		value, err := expr.Run(d, *params)
+func dropMessagesIf(params *map[string]interface{}, checks *messageProcessorRules[struct{}], t *tracer) (bool, error) {
+	drop := false
+	last, err := checks.eval(*params, t, func(struct{}) error {
+		drop = true
+		return nil
+	})
+	if drop {
+		last.drop()
+	}
+	return drop, err
+}
+
+// fieldValue converts the result of an expression to a field value. The value
+// field must be numeric, the event, log and control fields must be strings.
+func fieldValue(key string, v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case int:
+		v = int64(x)
+	case int32:
+		v = int64(x)
+	case uint:
+		v = uint64(x)
+	case uint32:
+		v = uint64(x)
+	case float32:
+		v = float64(x)
+	case int64, uint64, float64, string, bool:
+	default:
+		return nil, fmt.Errorf("unsupported field type %T", v)
+	}
+	switch key {
+	case "value":
+		switch v.(type) {
+		case string, bool:
+			return nil, fmt.Errorf("value field requires a number, got %T", v)
+		}
+	case "event", "log", "control":
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("%s field requires a string, got %T", key, v)
+		}
+	}
+	return v, nil
+}
+
+// storeValue sets the tag, meta information or field to the value and
+// updates the evaluation environment, so following rules see the new value
+func storeValue(message lp2.CCMessage, params *map[string]interface{}, location MessageLocation, key string, value interface{}) error {
+	switch location {
+	case MESSAGE_LOCATION_FIELDS:
+		v, err := fieldValue(key, value)
 		if err != nil {
-			return false, fmt.Errorf("failed to evaluate: %v", err.Error())
+			return err
 		}
-		if value.(bool) {
-			return true, nil
+		// cclog.ComponentDebug("MessageProcessor", "Setting field", key, "->", v)
+		putValue(message, params, location, key, v)
+	case MESSAGE_LOCATION_TAGS, MESSAGE_LOCATION_META:
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expression for %s returned %T instead of string", key, value)
 		}
+		// cclog.ComponentDebug("MessageProcessor", "Setting tag or meta", key, "->", v)
+		putValue(message, params, location, key, v)
+	}
+	return nil
+}
+
+// putValue adds the entry to the message and to the evaluation environment
+// params, so following rules see it. Tags and meta information require
+// strings.
+func putValue(message lp2.CCMessage, params *map[string]interface{}, location MessageLocation, key string, value interface{}) {
+	switch location {
+	case MESSAGE_LOCATION_FIELDS:
+		message.AddField(key, value)
+		(*params)["fields"].(map[string]interface{})[key] = value
+		switch key {
+		case "value":
+			(*params)["value"] = value
+			(*params)["metric"] = value
+		case "event", "log", "control":
+			(*params)[key] = value
+		}
+	case MESSAGE_LOCATION_TAGS:
+		message.AddTag(key, value.(string))
+		(*params)["tags"].(map[string]interface{})[sanitizeExprString(key)] = value
+	case MESSAGE_LOCATION_META:
+		message.AddMeta(key, value.(string))
+		(*params)["meta"].(map[string]interface{})[sanitizeExprString(key)] = value
+	}
+}
+
+// removeValue removes the entry from the message and from the evaluation
+// environment params, so following rules do not see it anymore
+func removeValue(message lp2.CCMessage, params *map[string]interface{}, location MessageLocation, key string) {
+	switch location {
+	case MESSAGE_LOCATION_FIELDS:
+		message.RemoveField(key)
+		delete((*params)["fields"].(map[string]interface{}), key)
+		switch key {
+		case "value":
+			delete(*params, "value")
+			delete(*params, "metric")
+		case "event", "log", "control":
+			delete(*params, key)
+		}
+	case MESSAGE_LOCATION_TAGS:
+		message.RemoveTag(key)
+		delete((*params)["tags"].(map[string]interface{}), sanitizeExprString(key))
+	case MESSAGE_LOCATION_META:
+		message.RemoveMeta(key)
+		delete((*params)["meta"].(map[string]interface{}), sanitizeExprString(key))
 	}
-	return false, nil
+}
+
+// Abstract function to set entries to the result of an expression
+func setIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[setRule], location MessageLocation, t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(data setRule) error {
+		value, err := expr.Run(data.program, *params)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate expression for %s: %v", data.key, err.Error())
+		}
+		return storeValue(message, params, location, data.key, value)
+	})
+	return false, err
+}
+
+func setFieldIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[setRule], t *tracer) (bool, error) {
+	return setIf(message, params, checks, MESSAGE_LOCATION_FIELDS, t)
+}
+
+func setTagIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[setRule], t *tracer) (bool, error) {
+	return setIf(message, params, checks, MESSAGE_LOCATION_TAGS, t)
+}
+
+func setMetaIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[setRule], t *tracer) (bool, error) {
+	return setIf(message, params, checks, MESSAGE_LOCATION_META, t)
+}
+
+// Abstract function to rewrite string values of entries matching a regular
+// expression. Entries which do not exist or are not strings are skipped.
+func rewriteIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[regexRule], location MessageLocation, t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(data regexRule) error {
+		var value string
+		var ok bool
+		switch location {
+		case MESSAGE_LOCATION_TAGS:
+			value, ok = message.GetTag(data.key)
+		case MESSAGE_LOCATION_META:
+			value, ok = message.GetMeta(data.key)
+		case MESSAGE_LOCATION_FIELDS:
+			var v interface{}
+			if v, ok = message.GetField(data.key); ok {
+				value, ok = v.(string)
+			}
+		}
+		if !ok || !data.regex.MatchString(value) {
+			return nil
+		}
+		return storeValue(message, params, location, data.key, data.regex.ReplaceAllString(value, data.replacement))
+	})
+	return false, err
+}
+
+func rewriteTagIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[regexRule], t *tracer) (bool, error) {
+	return rewriteIf(message, params, checks, MESSAGE_LOCATION_TAGS, t)
+}
+
+func rewriteMetaIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[regexRule], t *tracer) (bool, error) {
+	return rewriteIf(message, params, checks, MESSAGE_LOCATION_META, t)
+}
+
+func rewriteFieldIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[regexRule], t *tracer) (bool, error) {
+	return rewriteIf(message, params, checks, MESSAGE_LOCATION_FIELDS, t)
+}
+
+// renameMessagesRegex renames the message with all matching regular
+// expressions in order
+func renameMessagesRegex(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[regexRule], t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(r regexRule) error {
+		old := message.Name()
+		n := r.regex.ReplaceAllString(old, r.replacement)
+		// cclog.ComponentDebug("MessageProcessor", "Rename to", n)
+		message.SetName(n)
+		// Following rules see the new name
+		(*params)["name"] = n
+		// cclog.ComponentDebug("MessageProcessor", "Add old name as 'oldname' to meta", old)
+		message.AddMeta("oldname", old)
+		return nil
+	})
+	return false, err
 }
 
 func normalizeUnits(message lp2.CCMessage) (bool, error) {
@@ -205,62 +335,54 @@ func normalizeUnits(message lp2.CCMessage) (bool, error) {
 	return false, nil
 }
 
-func changeUnitPrefix(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]string) (bool, error) {
-	for r, n := range *checks {
-		value, err := expr.Run(r, *params)
-		if err != nil {
-			return false, fmt.Errorf("failed to evaluate: %v", err.Error())
-		}
-		if value.(bool) {
-			newPrefix := units.NewPrefix(n)
-			// cclog.ComponentDebug("MessageProcessor", "Condition matches, change to prefix", newPrefix.String())
-			if in_unit, ok := message.GetMeta("unit"); ok && newPrefix != units.InvalidPrefix {
-				u := units.NewUnit(in_unit)
-				if u.Valid() {
-					// cclog.ComponentDebug("MessageProcessor", "Input unit", u.Short())
-					conv, out_unit := units.GetUnitPrefixFactor(u, newPrefix)
-					if conv != nil && out_unit.Valid() {
-						if val, ok := message.GetField("value"); ok {
-							// cclog.ComponentDebug("MessageProcessor", "Update unit with", out_unit.Short())
-							message.AddField("value", conv(val))
-							message.AddMeta("unit", out_unit.Short())
-						}
+func changeUnitPrefix(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[string], t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(n string) error {
+		newPrefix := units.NewPrefix(n)
+		// cclog.ComponentDebug("MessageProcessor", "Condition matches, change to prefix", newPrefix.String())
+		if in_unit, ok := message.GetMeta("unit"); ok && newPrefix != units.InvalidPrefix {
+			u := units.NewUnit(in_unit)
+			if u.Valid() {
+				// cclog.ComponentDebug("MessageProcessor", "Input unit", u.Short())
+				conv, out_unit := units.GetUnitPrefixFactor(u, newPrefix)
+				if conv != nil && out_unit.Valid() {
+					if val, ok := message.GetField("value"); ok {
+						// cclog.ComponentDebug("MessageProcessor", "Update unit with", out_unit.Short())
+						message.AddField("value", conv(val))
+						message.AddMeta("unit", out_unit.Short())
 					}
 				}
+			}
 
-			} else if in_unit, ok := message.GetTag("unit"); ok && newPrefix != units.InvalidPrefix {
-				u := units.NewUnit(in_unit)
-				if u.Valid() {
-					// cclog.ComponentDebug("MessageProcessor", "Input unit", u.Short())
-					conv, out_unit := units.GetUnitPrefixFactor(u, newPrefix)
-					if conv != nil && out_unit.Valid() {
-						if val, ok := message.GetField("value"); ok {
-							// cclog.ComponentDebug("MessageProcessor", "Update unit with", out_unit.Short())
-							message.AddField("value", conv(val))
-							message.AddTag("unit", out_unit.Short())
-						}
+		} else if in_unit, ok := message.GetTag("unit"); ok && newPrefix != units.InvalidPrefix {
+			u := units.NewUnit(in_unit)
+			if u.Valid() {
+				// cclog.ComponentDebug("MessageProcessor", "Input unit", u.Short())
+				conv, out_unit := units.GetUnitPrefixFactor(u, newPrefix)
+				if conv != nil && out_unit.Valid() {
+					if val, ok := message.GetField("value"); ok {
+						// cclog.ComponentDebug("MessageProcessor", "Update unit with", out_unit.Short())
+						message.AddField("value", conv(val))
+						message.AddTag("unit", out_unit.Short())
 					}
 				}
-
 			}
+
 		}
-	}
-	return false, nil
+		return nil
+	})
+	return false, err
 }
 
-func renameMessagesIf(message lp2.CCMessage, params *map[string]interface{}, checks *map[*vm.Program]string) (bool, error) {
-	for d, n := range *checks {
-		value, err := expr.Run(d, *params)
-		if err != nil {
-			return true, fmt.Errorf("failed to evaluate: %v", err.Error())
-		}
-		if value.(bool) {
-			old := message.Name()
-			// cclog.ComponentDebug("MessageProcessor", "Rename to", n)
-			message.SetName(n)
-			// cclog.ComponentDebug("MessageProcessor", "Add old name as 'oldname' to meta", old)
-			message.AddMeta("oldname", old)
-		}
-	}
-	return false, nil
+func renameMessagesIf(message lp2.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[string], t *tracer) (bool, error) {
+	_, err := checks.eval(*params, t, func(n string) error {
+		old := message.Name()
+		// cclog.ComponentDebug("MessageProcessor", "Rename to", n)
+		message.SetName(n)
+		// Following rules see the new name
+		(*params)["name"] = n
+		// cclog.ComponentDebug("MessageProcessor", "Add old name as 'oldname' to meta", old)
+		message.AddMeta("oldname", old)
+		return nil
+	})
+	return false, err
 }
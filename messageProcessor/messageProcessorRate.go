@@ -0,0 +1,257 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+)
+
+// Defaults of the rate stage
+const (
+	RATE_DEFAULT_NAME = "{name}_rate"
+	RATE_DEFAULT_TTL  = 10 * time.Minute
+)
+
+// RateConfig configures a rule of the rate stage
+type RateConfig struct {
+	Condition   string `json:"if"`                     // Condition selecting the counters
+	Name        string `json:"name,omitempty"`         // Name template of the rate with {name}. Default: {name}_rate
+	Unit        string `json:"unit,omitempty"`         // Unit of the rate. Default: unit of the counter with /s
+	CounterBits int    `json:"counter_bits,omitempty"` // Width of the counter (32 or 64) to detect wraparounds. Default: every decrease is a reset
+	TTL         string `json:"ttl,omitempty"`          // Time after which the state of idle series is removed. Default: 10m
+	KeepInput   bool   `json:"keep_input,omitempty"`   // Keep the counter and emit the rate as additional message
+}
+
+// rateSeries is the last sample of a counter
+type rateSeries struct {
+	tm    time.Time
+	value float64
+	int   uint64 // Value of integer counters, which may exceed the precision of float64
+	isInt bool
+}
+
+// rate is a configured rate rule with the last sample of each series
+type rate struct {
+	config RateConfig
+	ttl    time.Duration
+
+	lock      sync.Mutex
+	series    map[string]rateSeries
+	lastSweep time.Time
+}
+
+// newRate checks the configuration of the rate rule
+func newRate(config RateConfig) (*rate, error) {
+	r := &rate{
+		config: config,
+		ttl:    RATE_DEFAULT_TTL,
+		series: make(map[string]rateSeries),
+	}
+	if len(r.config.Name) == 0 {
+		r.config.Name = RATE_DEFAULT_NAME
+	}
+	switch config.CounterBits {
+	case 0, 32, 64:
+	default:
+		return nil, fmt.Errorf("invalid counter width %d, only 32 and 64 bits are supported", config.CounterBits)
+	}
+	if len(config.TTL) > 0 {
+		ttl, err := time.ParseDuration(config.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL '%s': %v", config.TTL, err.Error())
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("invalid TTL '%s'", config.TTL)
+		}
+		r.ttl = ttl
+	}
+	return r, nil
+}
+
+// counterSample returns the value field of the counter
+func counterSample(m lp.CCMessage) (rateSeries, bool) {
+	s := rateSeries{tm: m.Time()}
+	v, ok := m.GetField("value")
+	if !ok {
+		return s, false
+	}
+	switch x := v.(type) {
+	case uint64:
+		s.int, s.isInt = x, true
+	case int64:
+		if x < 0 {
+			return s, false
+		}
+		s.int, s.isInt = uint64(x), true
+	case int:
+		if x < 0 {
+			return s, false
+		}
+		s.int, s.isInt = uint64(x), true
+	case uint32:
+		s.int, s.isInt = uint64(x), true
+	case int32:
+		if x < 0 {
+			return s, false
+		}
+		s.int, s.isInt = uint64(x), true
+	case float64:
+		s.value = x
+	case float32:
+		s.value = float64(x)
+	default:
+		return s, false
+	}
+	if s.isInt {
+		s.value = float64(s.int)
+	}
+	return s, !math.IsNaN(s.value) && !math.IsInf(s.value, 0)
+}
+
+// wrapped checks whether the decrease from prev to cur is a wraparound of
+// the counter and not a reset: the counter was in the upper quarter of its
+// range and is now in the lower quarter.
+func (r *rate) wrapped(prev, cur float64) bool {
+	if r.config.CounterBits == 0 {
+		return false
+	}
+	max := math.Ldexp(1, r.config.CounterBits)
+	return prev >= 0.75*max && cur < 0.25*max
+}
+
+// delta returns the increase of the counter from prev to cur and false if
+// the counter was reset
+func (r *rate) delta(prev, cur rateSeries) (float64, bool) {
+	if prev.isInt && cur.isInt {
+		if cur.int >= prev.int {
+			return float64(cur.int - prev.int), true
+		}
+		if !r.wrapped(prev.value, cur.value) {
+			return 0, false
+		}
+		d := cur.int - prev.int
+		if r.config.CounterBits == 32 {
+			d &= math.MaxUint32
+		}
+		return float64(d), true
+	}
+	if cur.value >= prev.value {
+		return cur.value - prev.value, true
+	}
+	if !r.wrapped(prev.value, cur.value) {
+		return 0, false
+	}
+	return cur.value + math.Ldexp(1, r.config.CounterBits) - prev.value, true
+}
+
+// add stores the sample of the counter and returns the per-second rate since
+// the previous sample. It returns false if there is no previous sample, the
+// counter was reset or the sample is not newer than the previous one.
+func (r *rate) add(m lp.CCMessage) (float64, bool) {
+	cur, ok := counterSample(m)
+	if !ok {
+		return 0, false
+	}
+	key := m.SeriesKey()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if cur.tm.Sub(r.lastSweep) > r.ttl {
+		r.expire(cur.tm)
+	}
+	prev, ok := r.series[key]
+	if ok && !cur.tm.After(prev.tm) {
+		cclog.ComponentDebug("MessageProcessor", "skipping old sample of counter", m.Name())
+		return 0, false
+	}
+	r.series[key] = cur
+	if !ok || cur.tm.Sub(prev.tm) > r.ttl {
+		return 0, false
+	}
+	d, ok := r.delta(prev, cur)
+	if !ok {
+		cclog.ComponentDebug("MessageProcessor", "counter", m.Name(), "was reset")
+		return 0, false
+	}
+	return d / cur.tm.Sub(prev.tm).Seconds(), true
+}
+
+// expire removes the state of all series without sample in the last TTL
+// before now. The caller has to hold the lock.
+func (r *rate) expire(now time.Time) {
+	for key, s := range r.series {
+		if now.Sub(s.tm) > r.ttl {
+			delete(r.series, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+// flush removes the state of idle series
+func (r *rate) flush(now time.Time) {
+	r.lock.Lock()
+	r.expire(now)
+	r.lock.Unlock()
+}
+
+// setRate turns the message into the rate message
+func (r *rate) setRate(message lp.CCMessage, value float64) {
+	message.SetName(strings.ReplaceAll(r.config.Name, "{name}", message.Name()))
+	message.AddField("value", value)
+	if len(r.config.Unit) > 0 {
+		message.AddMeta("unit", r.config.Unit)
+	} else if u, ok := message.GetMeta("unit"); ok {
+		message.AddMeta("unit", u+"/s")
+	}
+}
+
+// rateMessage replaces the value of matching counters by their rate. With
+// keep_input, the rate is emitted as additional message instead. It returns
+// whether the message should be dropped because no rate can be computed.
+func rateMessage(message lp.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[*rate], emit func(lp.CCMessage), t *tracer) (bool, error) {
+	if !message.IsMetric() {
+		return false, nil
+	}
+	drop := false
+	last, err := checks.eval(*params, t, func(r *rate) error {
+		value, ok := r.add(message)
+		switch {
+		case r.config.KeepInput:
+			if ok {
+				y := lp.FromMessage(message)
+				r.setRate(y, value)
+				emit(y)
+			}
+		case ok:
+			r.setRate(message, value)
+			// Following stages see the rate
+			(*params)["name"] = message.Name()
+			(*params)["value"] = value
+			(*params)["metric"] = value
+			if fields, ok := (*params)["fields"].(map[string]interface{}); ok {
+				fields["value"] = value
+			}
+			if meta, ok := (*params)["meta"].(map[string]interface{}); ok {
+				if u, ok := message.GetMeta("unit"); ok {
+					meta["unit"] = u
+				}
+			}
+		default:
+			drop = true
+		}
+		return nil
+	})
+	if drop {
+		last.drop()
+	}
+	return drop, err
+}
@@ -0,0 +1,286 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+)
+
+// Defaults of the split_fields and merge_fields stages
+const (
+	SPLIT_DEFAULT_NAME    = "{name}_{field}"
+	MERGE_DEFAULT_TIMEOUT = 10 * time.Second
+)
+
+// Maximal number of incomplete merged messages of a merge rule
+const maxMergeGroups = 100000
+
+// SplitConfig configures a rule of the split_fields stage
+type SplitConfig struct {
+	Condition string   `json:"if"`                   // Condition selecting the messages to split
+	Fields    []string `json:"fields,omitempty"`     // Fields to split. Default: all numeric fields
+	Name      string   `json:"name,omitempty"`       // Name template of the created metrics with {name} and {field}. Default: {name}_{field}
+	KeepInput bool     `json:"keep_input,omitempty"` // Keep the multi-field message and emit the metrics as additional messages
+}
+
+// MergeConfig configures a rule of the merge_fields stage
+type MergeConfig struct {
+	Condition string   `json:"if"`                   // Condition selecting the metrics to merge
+	Template  string   `json:"template,omitempty"`   // Template of the input names with {name} and {field}. Default: {name}_{field}
+	Name      string   `json:"name,omitempty"`       // Name of the merged message. Default: {name} part of the input names
+	Fields    []string `json:"fields,omitempty"`     // Expected fields. The merged message is emitted once all are present
+	Timeout   string   `json:"timeout,omitempty"`    // Time after which incomplete merged messages are emitted. Default: 10s
+	KeepInput bool     `json:"keep_input,omitempty"` // Keep the input metrics
+}
+
+// newSplitConfig checks the configuration of the split rule
+func newSplitConfig(config SplitConfig) (SplitConfig, error) {
+	if len(config.Name) == 0 {
+		config.Name = SPLIT_DEFAULT_NAME
+	}
+	if !strings.Contains(config.Name, "{field}") {
+		return config, fmt.Errorf("name template '%s' does not contain {field}", config.Name)
+	}
+	return config, nil
+}
+
+// splitMessage creates a metric for each numeric field of the message and
+// passes it to emit. It returns whether the message should be dropped.
+func splitMessage(message lp.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[SplitConfig], emit func(lp.CCMessage), t *tracer) (bool, error) {
+	drop := false
+	last, err := checks.eval(*params, t, func(c SplitConfig) error {
+		keys := make([]string, 0)
+		values := make(map[string]interface{})
+		for key, field := range message.AllFields() {
+			if len(c.Fields) > 0 && !slices.Contains(c.Fields, key) {
+				continue
+			}
+			if value, err := fieldValue("value", field); err == nil {
+				keys = append(keys, key)
+				values[key] = value
+			}
+		}
+		// A message whose only numeric field is value, like a metric, is
+		// only split if value is listed in fields
+		if len(keys) == 1 && keys[0] == "value" && !slices.Contains(c.Fields, "value") {
+			return nil
+		}
+		slices.Sort(keys)
+		created := 0
+		for _, key := range keys {
+			value := values[key]
+			name := strings.NewReplacer("{name}", message.Name(), "{field}", key).Replace(c.Name)
+			y, err := lp.NewMetric(name, nil, nil, value, message.Time())
+			if err != nil {
+				return fmt.Errorf("failed to split field %s: %v", key, err.Error())
+			}
+			for k, v := range message.AllTags() {
+				y.AddTag(k, v)
+			}
+			for k, v := range message.AllMeta() {
+				y.AddMeta(k, v)
+			}
+			emit(y)
+			created++
+		}
+		if created > 0 && !c.KeepInput {
+			drop = true
+		}
+		return nil
+	})
+	if drop {
+		last.drop()
+	}
+	return drop, err
+}
+
+// mergeGroup collects the fields of the inputs with the same name, tags and
+// timestamp
+type mergeGroup struct {
+	name   string
+	tm     time.Time
+	tags   map[string]string
+	meta   map[string]string
+	fields map[string]interface{}
+}
+
+// merge is a configured merge rule with the incomplete merged messages
+type merge struct {
+	config  MergeConfig
+	regex   *regexp.Regexp // Matches the input names with the name and field as submatches
+	timeout time.Duration
+
+	lock   sync.Mutex
+	groups map[string]*mergeGroup // incomplete merged messages by name and tags
+}
+
+// newMerge checks the configuration of the merge rule and compiles the
+// template of the input names
+func newMerge(config MergeConfig) (*merge, error) {
+	m := &merge{
+		config:  config,
+		timeout: MERGE_DEFAULT_TIMEOUT,
+		groups:  make(map[string]*mergeGroup),
+	}
+	if len(m.config.Template) == 0 {
+		m.config.Template = SPLIT_DEFAULT_NAME
+	}
+	template := m.config.Template
+	if strings.Count(template, "{field}") != 1 || strings.Count(template, "{name}") > 1 {
+		return nil, fmt.Errorf("template '%s' requires exactly one {field} and at most one {name}", template)
+	}
+	if !strings.Contains(template, "{name}") && len(config.Name) == 0 {
+		return nil, fmt.Errorf("template '%s' without {name} requires a name", template)
+	}
+	if len(config.Timeout) > 0 {
+		t, err := time.ParseDuration(config.Timeout)
+		if err != nil || t <= 0 {
+			return nil, fmt.Errorf("invalid timeout '%s' of merge rule", config.Timeout)
+		}
+		m.timeout = t
+	}
+
+	// The name matches as few characters as possible, so '{name}_{field}'
+	// splits the input names at the first underscore
+	name := `(?P<name>.+?)`
+	if len(config.Name) > 0 {
+		name = regexp.QuoteMeta(config.Name)
+	}
+	var b strings.Builder
+	b.WriteByte('^')
+	for i, part := range strings.Split(template, "{field}") {
+		if i > 0 {
+			b.WriteString(`(?P<field>.+)`)
+		}
+		for j, p := range strings.Split(part, "{name}") {
+			if j > 0 {
+				b.WriteString(name)
+			}
+			b.WriteString(regexp.QuoteMeta(p))
+		}
+	}
+	b.WriteByte('$')
+	regex, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile template '%s': %v", template, err.Error())
+	}
+	m.regex = regex
+	return m, nil
+}
+
+// add adds the value of the metric as field to the merged message with the
+// same name, tags and timestamp. A merged message is passed to emit when all
+// expected fields are present or a metric with another timestamp arrives. It
+// returns false if the metric name does not match the template.
+func (m *merge) add(message lp.CCMessage, emit func(lp.CCMessage)) bool {
+	match := m.regex.FindStringSubmatch(message.Name())
+	if match == nil {
+		return false
+	}
+	name := m.config.Name
+	if len(name) == 0 {
+		name = match[m.regex.SubexpIndex("name")]
+	}
+	field := match[m.regex.SubexpIndex("field")]
+	if len(m.config.Fields) > 0 && !slices.Contains(m.config.Fields, field) {
+		return false
+	}
+	value, ok := message.GetField("value")
+	if !ok {
+		return false
+	}
+	tm := message.Time()
+	tags := maps.Collect(message.AllTags())
+	key := groupKey(name, tags)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	g := m.groups[key]
+	if g != nil && !g.tm.Equal(tm) {
+		m.emit(g, emit)
+		g = nil
+	}
+	if g == nil && len(m.groups) >= maxMergeGroups {
+		cclog.ComponentError("MessageProcessor", "too many incomplete merged messages, emitting them early")
+		for k, g := range m.groups {
+			delete(m.groups, k)
+			m.emit(g, emit)
+		}
+	}
+	if g == nil {
+		g = &mergeGroup{
+			name:   name,
+			tm:     tm,
+			tags:   tags,
+			meta:   make(map[string]string),
+			fields: make(map[string]interface{}),
+		}
+		// The units of the fields may differ
+		for k, v := range message.AllMeta() {
+			if k != "unit" {
+				g.meta[k] = v
+			}
+		}
+	}
+	g.fields[field] = value
+
+	if len(m.config.Fields) > 0 && len(g.fields) == len(m.config.Fields) {
+		delete(m.groups, key)
+		m.emit(g, emit)
+		return true
+	}
+	m.groups[key] = g
+	return true
+}
+
+// emit creates the merged message
+func (m *merge) emit(g *mergeGroup, emit func(lp.CCMessage)) {
+	y, err := lp.NewMessage(g.name, g.tags, g.meta, g.fields, g.tm)
+	if err != nil {
+		cclog.ComponentError("MessageProcessor", "failed to create merged message", g.name, ":", err.Error())
+		return
+	}
+	emit(y)
+}
+
+// flush emits the incomplete merged messages which timed out
+func (m *merge) flush(now time.Time, emit func(lp.CCMessage)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, g := range m.groups {
+		if now.Sub(g.tm) >= m.timeout {
+			delete(m.groups, key)
+			m.emit(g, emit)
+		}
+	}
+}
+
+// mergeMessage adds the metric to the merged messages of the matching rules.
+// It returns whether the metric should be dropped.
+func mergeMessage(message lp.CCMessage, params *map[string]interface{}, checks *messageProcessorRules[*merge], emit func(lp.CCMessage), t *tracer) (bool, error) {
+	if !message.IsMetric() {
+		return false, nil
+	}
+	drop := false
+	last, err := checks.eval(*params, t, func(m *merge) error {
+		if m.add(message, emit) && !m.config.KeepInput {
+			drop = true
+		}
+		return nil
+	})
+	if drop {
+		last.drop()
+	}
+	return drop, err
+}
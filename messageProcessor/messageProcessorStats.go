@@ -0,0 +1,285 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+)
+
+// Prefix of the names of the metrics with the statistics of the message processor
+const STATS_METRIC_PREFIX = "messageprocessor_"
+
+// StatCounters are the statistics of a stage or a rule since the message
+// processor was created
+type StatCounters struct {
+	Evaluated int64         `json:"evaluated"` // Messages processed by the stage or for which the condition of the rule was evaluated
+	Matched   int64         `json:"matched"`   // Messages for which a rule of the stage or the condition of the rule matched
+	Dropped   int64         `json:"dropped"`   // Messages dropped by the stage or after the rule matched
+	Errors    int64         `json:"errors"`    // Messages which failed to process
+	Time      time.Duration `json:"time"`      // Total processing time
+}
+
+// RuleStats are the statistics of a rule
+type RuleStats struct {
+	Rule string `json:"rule"` // Condition of the rule
+	StatCounters
+}
+
+// StageStats are the statistics of a stage and its rules
+type StageStats struct {
+	Stage string `json:"stage"` // Name of the stage
+	StatCounters
+	Rules []RuleStats `json:"rules,omitempty"` // Statistics of the rules in evaluation order
+}
+
+// statCounters are the counters of a stage or rule, which are updated
+// concurrently. All methods accept a nil pointer.
+type statCounters struct {
+	evaluated atomic.Int64
+	matched   atomic.Int64
+	dropped   atomic.Int64
+	errors    atomic.Int64
+	time      atomic.Int64
+}
+
+// get returns the current values of the counters
+func (c *statCounters) get() StatCounters {
+	if c == nil {
+		return StatCounters{}
+	}
+	return StatCounters{
+		Evaluated: c.evaluated.Load(),
+		Matched:   c.matched.Load(),
+		Dropped:   c.dropped.Load(),
+		Errors:    c.errors.Load(),
+		Time:      time.Duration(c.time.Load()),
+	}
+}
+
+// match counts a match
+func (c *statCounters) match() {
+	if c != nil {
+		c.matched.Add(1)
+	}
+}
+
+// since adds the time since start and returns the current time
+func (c *statCounters) since(start time.Time) time.Time {
+	now := time.Now()
+	if c != nil {
+		c.time.Add(int64(now.Sub(start)))
+	}
+	return now
+}
+
+// fail counts a failed evaluation and the time since start
+func (c *statCounters) fail(start time.Time) {
+	if c != nil {
+		c.errors.Add(1)
+	}
+	c.since(start)
+}
+
+// drop counts a dropped message
+func (c *statCounters) drop() {
+	if c != nil {
+		c.dropped.Add(1)
+	}
+}
+
+// newStageStats creates the counters of all stages
+func newStageStats() map[string]*statCounters {
+	stats := make(map[string]*statCounters, len(StageNames))
+	for _, s := range StageNames {
+		stats[s] = new(statCounters)
+	}
+	return stats
+}
+
+// stageTimer measures the processing of a message by the stages
+type stageTimer struct {
+	stage *statCounters // Counters of the current stage
+	start time.Time     // Start of the current stage
+}
+
+// next ends the current stage and starts the next one
+func (s *stageTimer) next(stage *statCounters) {
+	now := time.Now()
+	if s.stage != nil {
+		s.stage.time.Add(int64(now.Sub(s.start)))
+	}
+	stage.evaluated.Add(1)
+	s.stage = stage
+	s.start = now
+}
+
+// end ends the current stage, which dropped the message or failed
+func (s *stageTimer) end(dropped bool, err error) {
+	if s.stage == nil {
+		return
+	}
+	s.stage.time.Add(int64(time.Since(s.start)))
+	if err != nil {
+		s.stage.errors.Add(1)
+	} else if dropped {
+		s.stage.dropped.Add(1)
+	}
+	s.stage = nil
+}
+
+// ruleList is the part of a rule list independent of the type of the rules
+type ruleList interface {
+	setStats(stats *statCounters)
+	ruleStats() []RuleStats
+}
+
+func (r *messageProcessorRules[T]) setStats(stats *statCounters) {
+	r.stats = stats
+}
+
+func (r *messageProcessorRules[T]) ruleStats() []RuleStats {
+	if len(r.rules) == 0 {
+		return nil
+	}
+	out := make([]RuleStats, 0, len(r.rules))
+	for _, rule := range r.rules {
+		out = append(out, RuleStats{Rule: rule.condition, StatCounters: rule.stats.get()})
+	}
+	return out
+}
+
+// ruleLists returns the rule lists of the stages with rules
+func (mp *messageProcessor) ruleLists() map[string]ruleList {
+	return map[string]ruleList{
+		STAGENAME_DROP_IF:            &mp.dropMessagesIf,
+		STAGENAME_RENAME_IF:          &mp.renameMessagesIf,
+		STAGENAME_RENAME_REGEX:       &mp.renameRegex,
+		STAGENAME_CHANGE_UNIT_PREFIX: &mp.changeUnitPrefix,
+		STAGENAME_ADD_TAG:            &mp.addTagsIf,
+		STAGENAME_DELETE_TAG:         &mp.deleteTagsIf,
+		STAGENAME_ADD_META:           &mp.addMetaIf,
+		STAGENAME_DELETE_META:        &mp.deleteMetaIf,
+		STAGENAME_ADD_FIELD:          &mp.addFieldIf,
+		STAGENAME_DELETE_FIELD:       &mp.deleteFieldIf,
+		STAGENAME_MOVE_TAG_META:      &mp.moveTagToMeta,
+		STAGENAME_MOVE_TAG_FIELD:     &mp.moveTagToField,
+		STAGENAME_MOVE_META_TAG:      &mp.moveMetaToTag,
+		STAGENAME_MOVE_META_FIELD:    &mp.moveMetaToField,
+		STAGENAME_MOVE_FIELD_TAG:     &mp.moveFieldToTag,
+		STAGENAME_MOVE_FIELD_META:    &mp.moveFieldToMeta,
+		STAGENAME_SET_FIELD:          &mp.setFieldIf,
+		STAGENAME_SET_TAG:            &mp.setTagIf,
+		STAGENAME_SET_META:           &mp.setMetaIf,
+		STAGENAME_REWRITE_TAG:        &mp.rewriteTagsIf,
+		STAGENAME_REWRITE_META:       &mp.rewriteMetaIf,
+		STAGENAME_REWRITE_FIELD:      &mp.rewriteFieldIf,
+		STAGENAME_RATE:               &mp.rate,
+		STAGENAME_DERIVE:             &mp.derive,
+		STAGENAME_AGGREGATE:          &mp.aggregate,
+		STAGENAME_SPLIT_FIELDS:       &mp.splitFields,
+		STAGENAME_MERGE_FIELDS:       &mp.mergeFields,
+	}
+}
+
+// stats returns the statistics of all stages. The caller has to hold the
+// read lock.
+func (mp *messageProcessor) stats() []StageStats {
+	lists := mp.ruleLists()
+	out := make([]StageStats, 0, len(StageNames))
+	for _, s := range StageNames {
+		stats := StageStats{Stage: s, StatCounters: mp.stageStats[s].get()}
+		if l, ok := lists[s]; ok {
+			stats.Rules = l.ruleStats()
+		}
+		out = append(out, stats)
+	}
+	return out
+}
+
+// Stats returns the statistics of all stages in default order with the
+// statistics of their rules. Stages listed multiple times in the stage order
+// are counted together.
+func (mp *messageProcessor) Stats() []StageStats {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	return mp.stats()
+}
+
+// SetStatsInterval sets the interval in which Tick emits the statistics as
+// metrics, which are returned by PendingMessages. The caller has to call Tick
+// periodically, like the receivers do. An interval of 0 disables the metrics.
+func (mp *messageProcessor) SetStatsInterval(interval time.Duration) {
+	mp.mutex.Lock()
+	mp.statsInterval = interval
+	mp.mutex.Unlock()
+}
+
+// statsHostname returns the hostname used as tag of the statistics metrics
+func statsHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// emitStats creates the metrics of the statistics if the interval passed
+// since they were emitted last. The caller has to hold the read lock.
+func (mp *messageProcessor) emitStats(now time.Time) {
+	mp.statsLock.Lock()
+	if now.Sub(mp.lastStats) < mp.statsInterval {
+		mp.statsLock.Unlock()
+		return
+	}
+	mp.lastStats = now
+	mp.statsLock.Unlock()
+
+	hostname := mp.hostname
+	emit := func(tags map[string]string, rule string, c StatCounters) {
+		for _, v := range []struct {
+			name  string
+			unit  string
+			value interface{}
+		}{
+			{"evaluated", "", c.Evaluated},
+			{"matched", "", c.Matched},
+			{"dropped", "", c.Dropped},
+			{"errors", "", c.Errors},
+			{"time", "s", c.Time.Seconds()},
+		} {
+			meta := map[string]string{"source": "messageprocessor"}
+			if len(v.unit) > 0 {
+				meta["unit"] = v.unit
+			}
+			if len(rule) > 0 {
+				meta["rule"] = rule
+			}
+			y, err := lp.NewMetric(STATS_METRIC_PREFIX+v.name, tags, meta, v.value, now)
+			if err != nil {
+				cclog.ComponentError("MessageProcessor", "failed to create statistics metric:", err.Error())
+				return
+			}
+			mp.pending.add(y)
+		}
+	}
+	for _, s := range mp.stats() {
+		// Only stages that processed messages
+		if s.Evaluated == 0 {
+			continue
+		}
+		emit(map[string]string{"type": "node", "hostname": hostname, "stage": s.Stage}, "", s.StatCounters)
+		// Conditions are no stable tag values, the rules are identified by
+		// their position in the stage
+		for i, r := range s.Rules {
+			emit(map[string]string{"type": "node", "hostname": hostname, "stage": s.Stage, "rule": strconv.Itoa(i)}, r.Rule, r.StatCounters)
+		}
+	}
+}
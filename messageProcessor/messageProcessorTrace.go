@@ -0,0 +1,250 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package messageprocessor
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Locations of changes in a trace
+const (
+	TRACE_LOCATION_NAME  = "name"
+	TRACE_LOCATION_TAG   = "tag"
+	TRACE_LOCATION_META  = "meta"
+	TRACE_LOCATION_FIELD = "field"
+)
+
+// TraceChange is a change of the message by a rule. Before or after is nil if
+// the tag, meta information or field did not exist before or after the rule.
+type TraceChange struct {
+	Location string      `json:"location"`         // name, tag, meta or field
+	Key      string      `json:"key,omitempty"`    // Key of the tag, meta information or field
+	Before   interface{} `json:"before,omitempty"` // Value before the rule
+	After    interface{} `json:"after,omitempty"`  // Value after the rule
+}
+
+// TraceStep is the evaluation of a rule of a stage
+type TraceStep struct {
+	Stage   string        `json:"stage"`             // Name of the stage
+	Rule    string        `json:"rule,omitempty"`    // Condition of the rule or the name or type for the stages without conditions
+	Matched bool          `json:"matched"`           // Whether the condition matched
+	Changes []TraceChange `json:"changes,omitempty"` // Changes of the message by the rule
+	Dropped bool          `json:"dropped,omitempty"` // Whether the rule dropped the message
+}
+
+// Trace describes how the message processor processed a message
+type Trace struct {
+	Input   string      `json:"input"`            // Input message
+	Output  string      `json:"output,omitempty"` // Output message, empty if the message was dropped
+	Steps   []TraceStep `json:"steps"`            // Evaluated rules in processing order
+	Dropped bool        `json:"dropped"`          // Whether the message was dropped
+	Error   string      `json:"error,omitempty"`  // Processing error
+}
+
+// String formats the trace with one line per rule
+func (t *Trace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "trace of %s", t.Input)
+	for _, s := range t.Steps {
+		fmt.Fprintf(&b, "\n  %s", s.Stage)
+		if len(s.Rule) > 0 {
+			fmt.Fprintf(&b, " [%s]", s.Rule)
+		}
+		if !s.Matched {
+			b.WriteString(": no match")
+			continue
+		}
+		b.WriteString(": match")
+		for _, c := range s.Changes {
+			b.WriteString(", ")
+			b.WriteString(c.Location)
+			if len(c.Key) > 0 {
+				b.WriteString(" " + c.Key)
+			}
+			fmt.Fprintf(&b, " %s -> %s", traceValue(c.Before), traceValue(c.After))
+		}
+		if s.Dropped {
+			b.WriteString(", dropped")
+		}
+	}
+	switch {
+	case len(t.Error) > 0:
+		fmt.Fprintf(&b, "\n  error: %s", t.Error)
+	case t.Dropped:
+		b.WriteString("\n  dropped")
+	default:
+		fmt.Fprintf(&b, "\n  output: %s", t.Output)
+	}
+	return b.String()
+}
+
+// traceValue formats a value of a change
+func traceValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "<none>"
+	case string:
+		return fmt.Sprintf("%q", x)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// diffMaps appends the changes between the entries before and after
+func diffMaps[V any](changes []TraceChange, location string, beforeEntries, afterEntries iter.Seq2[string, V]) []TraceChange {
+	before, after := maps.Collect(beforeEntries), maps.Collect(afterEntries)
+	keys := make([]string, 0, len(before)+len(after))
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		if inBefore && inAfter && reflect.DeepEqual(b, a) {
+			continue
+		}
+		c := TraceChange{Location: location, Key: k}
+		if inBefore {
+			c.Before = b
+		}
+		if inAfter {
+			c.After = a
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// diffMessages returns the changes from before to after
+func diffMessages(before, after lp.CCMessage) []TraceChange {
+	var changes []TraceChange
+	if before.Name() != after.Name() {
+		changes = append(changes, TraceChange{Location: TRACE_LOCATION_NAME, Before: before.Name(), After: after.Name()})
+	}
+	changes = diffMaps(changes, TRACE_LOCATION_TAG, before.AllTags(), after.AllTags())
+	changes = diffMaps(changes, TRACE_LOCATION_META, before.AllMeta(), after.AllMeta())
+	changes = diffMaps(changes, TRACE_LOCATION_FIELD, before.AllFields(), after.AllFields())
+	return changes
+}
+
+// tracer records the trace of a message while it is processed. All methods
+// accept a nil tracer, which records nothing.
+type tracer struct {
+	trace   Trace
+	message lp.CCMessage // Message being processed
+	stage   string       // Current stage
+	before  lp.CCMessage // Copy of the message before the current rule
+}
+
+// begin stores a copy of the message before a rule is applied
+func (t *tracer) begin() {
+	if t == nil {
+		return
+	}
+	t.before = lp.FromMessage(t.message)
+}
+
+// end records the evaluated rule of the current stage with the changes of
+// the message since begin
+func (t *tracer) end(rule string, matched bool) {
+	if t == nil {
+		return
+	}
+	step := TraceStep{Stage: t.stage, Rule: rule, Matched: matched}
+	if t.before != nil {
+		step.Changes = diffMessages(t.before, t.message)
+		lp.Release(t.before)
+		t.before = nil
+	}
+	t.trace.Steps = append(t.trace.Steps, step)
+}
+
+// drop marks the message as dropped by the last rule
+func (t *tracer) drop() {
+	if t == nil {
+		return
+	}
+	t.trace.Dropped = true
+	if n := len(t.trace.Steps); n > 0 && t.trace.Steps[n-1].Stage == t.stage {
+		t.trace.Steps[n-1].Dropped = true
+	}
+}
+
+// finish records the result of the processing and passes the trace to the
+// hook, if it is not nil
+func (t *tracer) finish(out lp.CCMessage, err error, hook func(trace *Trace)) {
+	if t == nil {
+		return
+	}
+	if err != nil {
+		t.trace.Error = err.Error()
+	} else if out != nil {
+		t.trace.Output = out.String()
+	}
+	if hook != nil {
+		hook(&t.trace)
+	}
+}
+
+// traceHook calls a function with the traces of messages matching a selector
+type traceHook struct {
+	selector string
+	program  *vm.Program
+	hook     func(trace *Trace)
+	logged   bool // Whether hook is the default logTrace
+}
+
+// logTrace is the default trace hook
+func logTrace(trace *Trace) {
+	cclog.ComponentPrint("MessageProcessor", trace.String())
+}
+
+// SetTraceHook traces all messages matching the selector and calls hook with
+// the trace after processing. If hook is nil, the traces are logged. An empty
+// selector disables the tracing.
+func (mp *messageProcessor) SetTraceHook(selector string, hook func(trace *Trace)) error {
+	if len(selector) == 0 {
+		mp.mutex.Lock()
+		mp.traceHook = nil
+		mp.mutex.Unlock()
+		return nil
+	}
+	program, err := expr.Compile(sanitizeExprString(selector), expr.Env(baseenv), expr.AsBool())
+	if err != nil {
+		return fmt.Errorf("failed to create selector evaluable of '%s': %v", selector, err.Error())
+	}
+	logged := hook == nil
+	if logged {
+		hook = logTrace
+	}
+	mp.mutex.Lock()
+	mp.traceHook = &traceHook{selector: selector, program: program, hook: hook, logged: logged}
+	mp.mutex.Unlock()
+	return nil
+}
+
+// ProcessMessageTrace works like ProcessMessage and additionally returns how
+// each stage and rule processed the message
+func (mp *messageProcessor) ProcessMessageTrace(m lp.CCMessageView) (lp.CCMessage, *Trace, error) {
+	t := new(tracer)
+	out, err := mp.process(m, t)
+	return out, &t.trace, err
+}
@@ -8,6 +8,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -356,8 +359,1272 @@ func TestConfigList(t *testing.T) {
 	}
 }
 
+func TestDropLogBySeverity(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = mp.FromConfigJSON(json.RawMessage(`{"drop_messages_if": ["messagetype == 'log' && severity > 4", "facility == 'noisy'"]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tags := map[string]string{"type": "node", "hostname": "myhost"}
+	for _, c := range []struct {
+		severity lp.LogSeverity
+		facility string
+		drop     bool
+	}{
+		{lp.LOG_ERROR, "kernel", false},
+		{lp.LOG_WARNING, "kernel", false},
+		{lp.LOG_INFO, "kernel", true},
+		{lp.LOG_DEBUG, "kernel", true},
+		{lp.LOG_ERROR, "noisy", true},
+	} {
+		m, err := lp.NewStructuredLog("syslog", tags, map[string]string{}, c.severity, c.facility, "message", map[string]interface{}{"pid": 1}, time.Now())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		out, err := mp.ProcessMessage(m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if (out == nil) != c.drop {
+			t.Errorf("severity %s, facility %s: expected drop %v", c.severity, c.facility, c.drop)
+		}
+	}
+
+	// Messages without severity are not dropped
+	for _, f := range []func() (lp.CCMessage, error){
+		func() (lp.CCMessage, error) {
+			return lp.NewLog("mylog", tags, map[string]string{}, "message", time.Now())
+		},
+		func() (lp.CCMessage, error) {
+			return lp.NewMetric("mymetric", tags, map[string]string{}, 1.0, time.Now())
+		},
+	} {
+		m, _ := f()
+		if out, err := mp.ProcessMessage(m); err != nil || out == nil {
+			t.Errorf("message %s dropped: %v", m.Name(), err)
+		}
+	}
+}
+
+func TestRuleOrder(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		config  string
+		newname string
+		tag     string
+	}{
+		{
+			name:    "chained renames",
+			config:  `{"rename_messages_if": {"name == 'net_bytes_in'": "net_in", "name == 'net_in'": "net_recv", "name == 'net_recv'": "network_recv"}, "add_tags_if": [{"if": "true", "key": "rule", "value": "first"}, {"if": "true", "key": "rule", "value": "second"}]}`,
+			newname: "network_recv",
+			tag:     "second",
+		},
+		{
+			name:    "stop after first match",
+			config:  `{"rename_messages_if": {"name == 'net_bytes_in'": "net_in", "name == 'net_in'": "net_recv"}, "add_tags_if": [{"if": "true", "key": "rule", "value": "first"}, {"if": "true", "key": "rule", "value": "second"}], "stop_after_first_match": ["rename_if", "add_tag"]}`,
+			newname: "net_in",
+			tag:     "first",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// Map iteration order differs between runs, so repeat it
+			for i := 0; i < 20; i++ {
+				mp, err := NewMessageProcessor()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err := mp.FromConfigJSON(json.RawMessage(c.config)); err != nil {
+					t.Fatal(err.Error())
+				}
+				m, _ := lp.NewMetric("net_bytes_in", map[string]string{"type": "node"}, nil, 1.0, time.Now())
+				out, err := mp.ProcessMessage(m)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if out.Name() != c.newname {
+					t.Fatalf("expected name %s, got %s", c.newname, out.Name())
+				}
+				if v, _ := out.GetTag("rule"); v != c.tag {
+					t.Fatalf("expected tag rule=%s, got %s", c.tag, v)
+				}
+			}
+		})
+	}
+
+	// Following rules see the tags, meta information and fields added,
+	// moved or deleted by previous rules
+	mp, _ := NewMessageProcessor()
+	err := mp.FromConfigJSON(json.RawMessage(`{
+		"add_tags_if": [
+			{"if": "true", "key": "cluster", "value": "testcluster"},
+			{"if": "tag.cluster == 'testcluster'", "key": "partition", "value": "main"}
+		],
+		"delete_tags_if": [
+			{"if": "true", "key": "hostname"},
+			{"if": "!('hostname' in tag)", "key": "type"}
+		],
+		"move_tag_to_meta_if": [
+			{"if": "true", "key": "cluster", "value": "cluster"},
+			{"if": "meta.cluster == 'testcluster'", "key": "type-id", "value": "id"}
+		],
+		"add_field_if": [
+			{"if": "meta.id == '3'", "key": "note", "value": "moved"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	m, _ := lp.NewMetric("test", map[string]string{"type": "core", "type-id": "3", "hostname": "h1"}, nil, 1.0, time.Now())
+	out, err := mp.ProcessMessage(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v, _ := out.GetTag("partition"); v != "main" || out.HasTag("type") || out.HasTag("type-id") {
+		t.Errorf("rules did not see the changes of previous rules: %s", out.String())
+	}
+	if v, _ := out.GetField("note"); v != "moved" {
+		t.Errorf("rule did not see the moved meta information: %s", out.String())
+	}
+
+	mp, _ = NewMessageProcessor()
+	if err := mp.SetStopAfterFirstMatch("drop_by_name", true); err == nil {
+		t.Error("expected error for stage without rules")
+	}
+	mp.AddAddTagsByCondition("true", "a", "1")
+	mp.AddAddTagsByCondition("true", "b", "2")
+	mp.RemoveAddTagsByCondition("true")
+	m, _ = lp.NewMetric("test", map[string]string{"type": "node"}, nil, 1.0, time.Now())
+	if out, _ := mp.ProcessMessage(m); out.HasTag("a") || out.HasTag("b") {
+		t.Errorf("rules not removed: %s", out.String())
+	}
+}
+
+func TestSetByExpression(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{
+		"set_field_if": [
+			{"if": "name == 'load'", "key": "value", "expression": "value / 4"},
+			{"if": "name == 'load'", "key": "value", "expression": "value > 2 ? 2.0 : value"},
+			{"if": "name == 'load'", "key": "cores", "expression": "int(field.ncores)"},
+			{"if": "name == 'load'", "key": "total", "expression": "field.a + field.b"}
+		],
+		"set_tag_if": [
+			{"if": "tag.type == 'socket'", "key": "node", "expression": "tag.hostname + '-' + tag.typeid"}
+		],
+		"set_meta_if": [
+			{"if": "name == 'load'", "key": "scaled", "expression": "value < 2 ? 'yes' : 'no'"}
+		]
+	}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, c := range []struct {
+		value  float64
+		scaled float64
+		meta   string
+	}{
+		{4, 1, "yes"},
+		{20, 2, "no"},
+	} {
+		m, _ := lp.NewMessage("load",
+			map[string]string{"hostname": "h1", "type": "socket", "type-id": "1"},
+			nil,
+			map[string]interface{}{"value": c.value, "ncores": "8", "a": int64(1), "b": int64(2)},
+			time.Now())
+		out, err := mp.ProcessMessage(m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if v, _ := out.GetField("value"); v != c.scaled {
+			t.Errorf("expected value %v, got %v", c.scaled, v)
+		}
+		if v, _ := out.GetField("cores"); v != int64(8) {
+			t.Errorf("expected cores 8, got %v (%T)", v, v)
+		}
+		if v, _ := out.GetField("total"); v != int64(3) {
+			t.Errorf("expected total 3, got %v (%T)", v, v)
+		}
+		if v, _ := out.GetTag("node"); v != "h1-1" {
+			t.Errorf("expected tag node=h1-1, got %s", v)
+		}
+		if v, _ := out.GetMeta("scaled"); v != c.meta {
+			t.Errorf("expected meta scaled=%s, got %s", c.meta, v)
+		}
+	}
+
+	// Expressions returning the wrong type are rejected at runtime
+	mp, _ = NewMessageProcessor()
+	mp.AddSetFieldByCondition("true", "value", "field.unit")
+	m, _ := lp.NewMessage("load", map[string]string{"type": "node"}, nil, map[string]interface{}{"value": 1.0, "unit": "B"}, time.Now())
+	if _, err := mp.ProcessMessage(m); err == nil {
+		t.Error("expected error for string value")
+	}
+
+	// Type errors are detected when the rules are added
+	for _, c := range []struct {
+		config string
+	}{
+		{`{"set_tag_if": [{"if": "true", "key": "x", "expression": "value * 2"}]}`},
+		{`{"set_meta_if": [{"if": "true", "key": "x", "expression": "1 > 0"}]}`},
+		{`{"set_field_if": [{"if": "true", "key": "value", "expression": "'abc'"}]}`},
+		{`{"set_field_if": [{"if": "true", "key": "event", "expression": "42"}]}`},
+		{`{"set_field_if": [{"if": "true", "key": "x", "expression": "tags"}]}`},
+		{`{"set_field_if": [{"if": "true", "key": "x", "expression": "unknown + 1"}]}`},
+	} {
+		mp, _ := NewMessageProcessor()
+		if err := mp.FromConfigJSON(json.RawMessage(c.config)); err == nil {
+			t.Errorf("expected error for %s", c.config)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{"aggregate": [{
+		"if": "name == 'flops_any'",
+		"group_by": ["hostname"],
+		"scope": "socket",
+		"topology": {"node": [0, 1, 2, 3], "socket": [[0, 2], [1, 3]], "memoryDomain": [[0, 1, 2, 3]], "core": [[0, 2], [1, 3]]},
+		"functions": ["sum", "max", "count"],
+		"drop_input": true
+	}]}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t1 := time.Unix(1699999980, 0)
+	for i, v := range []float64{1, 2, 3, 4} {
+		m, _ := lp.NewMetric("flops_any", map[string]string{"hostname": "h1", "type": "hwthread", "type-id": strconv.Itoa(i)}, map[string]string{"unit": "F/s"}, v, t1)
+		if out, err := mp.ProcessMessage(m); err != nil || out != nil {
+			t.Fatalf("expected aggregated input to be dropped, got %v, %v", out, err)
+		}
+	}
+	other, _ := lp.NewMetric("mem_bw", map[string]string{"hostname": "h1", "type": "hwthread", "type-id": "0"}, nil, 1.0, t1)
+	if out, _ := mp.ProcessMessage(other); out == nil {
+		t.Fatal("message not matching the condition was dropped")
+	}
+	if p := mp.PendingMessages(); len(p) != 0 {
+		t.Fatalf("expected no messages before the window is closed, got %d", len(p))
+	}
+
+	// The next timestamp closes the window of socket 0
+	m, _ := lp.NewMetric("flops_any", map[string]string{"hostname": "h1", "type": "core", "type-id": "0"}, nil, 5.0, t1.Add(time.Minute))
+	mp.ProcessMessage(m)
+	// Tick closes the remaining windows after the delay
+	mp.Tick(t1.Add(AGGREGATE_DEFAULT_DELAY))
+
+	expected := map[string]interface{}{
+		"flops_any_sum/0":   4.0,
+		"flops_any_max/0":   3.0,
+		"flops_any_count/0": int64(2),
+		"flops_any_sum/1":   6.0,
+		"flops_any_max/1":   4.0,
+		"flops_any_count/1": int64(2),
+	}
+	pending := mp.PendingMessages()
+	if len(pending) != len(expected) {
+		t.Fatalf("expected %d aggregated messages, got %d", len(expected), len(pending))
+	}
+	for _, p := range pending {
+		id, _ := p.GetTag("type-id")
+		key := p.Name() + "/" + id
+		v, _ := p.GetField("value")
+		if v != expected[key] {
+			t.Errorf("expected %s = %v, got %v", key, expected[key], v)
+		}
+		if typ, _ := p.GetTag("type"); typ != "socket" || !p.Time().Equal(t1) {
+			t.Errorf("unexpected aggregated message %s", p.String())
+		}
+		if _, ok := p.GetMeta("unit"); ok == (p.Name() == "flops_any_count") {
+			t.Errorf("unexpected unit in %s", p.String())
+		}
+	}
+
+	// Time windows are aligned to multiples of the window
+	mp, _ = NewMessageProcessor()
+	err = mp.AddAggregation(AggregationConfig{Condition: "true", Scope: "node", Window: "60s", Functions: []string{"avg"}, Name: "{name}"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, v := range []float64{1, 2, 6} {
+		m, _ := lp.NewMetric("load", map[string]string{"hostname": "h1", "type": "core", "type-id": strconv.Itoa(i)}, nil, v, t1.Add(time.Duration(i)*10*time.Second))
+		if out, _ := mp.ProcessMessage(m); out == nil {
+			t.Fatal("input dropped without drop_input")
+		}
+	}
+	mp.Tick(t1.Add(time.Minute + AGGREGATE_DEFAULT_DELAY - time.Second))
+	if p := mp.PendingMessages(); len(p) != 0 {
+		t.Fatalf("window closed before its end and the delay, got %d messages", len(p))
+	}
+	mp.Tick(t1.Add(time.Minute + AGGREGATE_DEFAULT_DELAY))
+	pending = mp.PendingMessages()
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 aggregated message, got %d", len(pending))
+	}
+	if v, _ := pending[0].GetField("value"); v != 3.0 || pending[0].Name() != "load" || pending[0].HasTag("type-id") {
+		t.Errorf("unexpected aggregated message %s", pending[0].String())
+	}
+
+	// Without window, a tick during the arrival of the inputs with the same
+	// timestamp does not close the group before the delay
+	mp, _ = NewMessageProcessor()
+	err = mp.AddAggregation(AggregationConfig{Condition: "true", Scope: "node", Functions: []string{"sum"}, Name: "{name}", Delay: "5s"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	add := func(id int, tm time.Time) {
+		m, _ := lp.NewMetric("load", map[string]string{"hostname": "h1", "type": "hwthread", "type-id": strconv.Itoa(id)}, nil, 1.0, tm)
+		mp.ProcessMessage(m)
+	}
+	add(0, t1)
+	add(1, t1)
+	mp.Tick(t1.Add(time.Second))
+	if p := mp.PendingMessages(); len(p) != 0 {
+		t.Fatalf("group closed before the delay, got %d messages", len(p))
+	}
+	add(2, t1)
+	add(3, t1)
+	mp.Tick(t1.Add(5 * time.Second))
+	pending = mp.PendingMessages()
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 aggregated message after the delay, got %d", len(pending))
+	}
+	if v, _ := pending[0].GetField("value"); v != 4.0 {
+		t.Errorf("expected sum of all inputs, got %s", pending[0].String())
+	}
+	// Late inputs do not open the closed group again
+	add(4, t1)
+	mp.Tick(t1.Add(time.Minute))
+	if p := mp.PendingMessages(); len(p) != 0 {
+		t.Errorf("late input created %d duplicate messages", len(p))
+	}
+
+	for _, c := range []AggregationConfig{
+		{Condition: "true"},
+		{Condition: "true", Functions: []string{"sum"}, Delay: "-1s"},
+		{Condition: "true", Functions: []string{"median"}},
+		{Condition: "true", Functions: []string{"sum", "avg"}, Name: "{name}"},
+		{Condition: "true", Functions: []string{"sum"}, Scope: "socket"},
+		{Condition: "true", Functions: []string{"sum"}, Window: "often"},
+	} {
+		if err := mp.AddAggregation(c); err == nil {
+			t.Errorf("expected error for invalid aggregation %v", c)
+		}
+	}
+}
+
+func TestAggregateExpire(t *testing.T) {
+	a, err := newAggregation(AggregationConfig{Condition: "true", Functions: []string{"sum"}, Window: "60s"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var emitted int
+	emit := func(m lp.CCMessage) { emitted++ }
+
+	// Series reporting once and then stopping
+	t1 := time.Unix(1699999980, 0)
+	const numSeries = 100
+	for i := 0; i < numSeries; i++ {
+		m, _ := lp.NewMetric("load", map[string]string{"hostname": "h" + strconv.Itoa(i), "type": "node"}, nil, 1.0, t1)
+		a.add(m, emit)
+	}
+	a.flush(t1.Add(time.Minute+AGGREGATE_DEFAULT_DELAY), emit)
+	if emitted != numSeries || len(a.groups) != 0 || len(a.closed) != numSeries {
+		t.Fatalf("expected %d closed windows, got %d emitted, %d groups, %d closed", numSeries, emitted, len(a.groups), len(a.closed))
+	}
+	a.flush(t1.Add(time.Minute+AGGREGATE_DEFAULT_TTL-time.Second), emit)
+	if len(a.closed) != numSeries {
+		t.Fatalf("closed windows forgotten before the TTL, %d left", len(a.closed))
+	}
+	for h := 1; h <= 4; h++ {
+		a.flush(t1.Add(time.Duration(h)*time.Hour), emit)
+	}
+	if len(a.closed) != 0 {
+		t.Errorf("expected all closed windows to be forgotten, %d left", len(a.closed))
+	}
+
+	if _, err := newAggregation(AggregationConfig{Condition: "true", Functions: []string{"sum"}, TTL: "0s"}); err == nil {
+		t.Error("expected error for invalid TTL")
+	}
+}
+
+func TestRate(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{"rate": [
+		{"if": "name == 'net_bytes'", "counter_bits": 32, "ttl": "1m"},
+		{"if": "name == 'energy'", "name": "power", "unit": "W", "keep_input": true}
+	]}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t1 := time.Unix(1700000000, 0)
+	tags := map[string]string{"hostname": "h1", "type": "node"}
+	for i, c := range []struct {
+		value    interface{}
+		offset   time.Duration
+		expected interface{} // nil if the sample is dropped
+	}{
+		{uint64(100), 0, nil},                               // first sample
+		{uint64(1100), 10 * time.Second, 100.0},             // 1000 bytes in 10s
+		{uint64(1100), 10 * time.Second, nil},               // no newer sample
+		{uint64(4294967000), 20 * time.Second, 429496590.0}, // large increase
+		{uint64(200), 30 * time.Second, 49.6},               // 32 bit wraparound
+		{uint64(100), 40 * time.Second, nil},                // counter reset
+		{uint64(150), 50 * time.Second, 5.0},                // after reset
+		{uint64(1000), 200 * time.Second, nil},              // state expired
+		{int64(1200), 210 * time.Second, 20.0},              // integer types
+	} {
+		m, _ := lp.NewMetric("net_bytes", tags, map[string]string{"unit": "B"}, c.value, t1.Add(c.offset))
+		out, err := mp.ProcessMessage(m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if c.expected == nil {
+			if out != nil {
+				t.Errorf("sample %d: expected drop, got %s", i, out.String())
+			}
+			continue
+		}
+		if out == nil {
+			t.Fatalf("sample %d: dropped, expected %v", i, c.expected)
+		}
+		v, _ := out.GetField("value")
+		if math.Abs(v.(float64)-c.expected.(float64)) > 1e-9 {
+			t.Errorf("sample %d: expected rate %v, got %v", i, c.expected, v)
+		}
+		if u, _ := out.GetMeta("unit"); out.Name() != "net_bytes_rate" || u != "B/s" {
+			t.Errorf("sample %d: unexpected rate message %s", i, out.String())
+		}
+	}
+
+	// With keep_input, the counter is kept and the rate is emitted additionally
+	for i, v := range []float64{1000, 1500} {
+		m, _ := lp.NewMetric("energy", tags, map[string]string{"unit": "J"}, v, t1.Add(time.Duration(i)*5*time.Second))
+		if out, _ := mp.ProcessMessage(m); out == nil || out.Name() != "energy" {
+			t.Fatalf("counter not kept: %v", out)
+		}
+	}
+	pending := mp.PendingMessages()
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 rate message, got %d", len(pending))
+	}
+	v, _ := pending[0].GetField("value")
+	u, _ := pending[0].GetMeta("unit")
+	if pending[0].Name() != "power" || v != 100.0 || u != "W" {
+		t.Errorf("unexpected rate message %s", pending[0].String())
+	}
+
+	for _, c := range []RateConfig{
+		{Condition: "true", CounterBits: 16},
+		{Condition: "true", TTL: "-1m"},
+	} {
+		if err := mp.AddRate(c); err == nil {
+			t.Errorf("expected error for invalid rate %v", c)
+		}
+	}
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{"derived_metrics": [
+		{"name": "flops_any", "inputs": ["flops_dp", "flops_sp"], "expression": "flops_dp*2 + flops_sp", "unit": "F/s", "tolerance": "1s", "timeout": "30s"},
+		{"name": "mem_bw", "if": "tag.type == 'socket'", "inputs": ["read_bw", "write_bw"], "expression": "read_bw + write_bw", "drop_input": true}
+	]}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t1 := time.Unix(1700000000, 0)
+	send := func(name string, typeid string, value float64, tm time.Time) lp.CCMessage {
+		m, _ := lp.NewMetric(name, map[string]string{"hostname": "h1", "type": "socket", "type-id": typeid}, map[string]string{"unit": "MF/s"}, value, tm)
+		out, err := mp.ProcessMessage(m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return out
+	}
+
+	// Inputs within the tolerance with the same tags belong together
+	send("flops_dp", "0", 1, t1)
+	send("flops_dp", "1", 10, t1)
+	send("flops_sp", "0", 2, t1.Add(500*time.Millisecond))
+	// Incomplete set of socket 1 times out
+	send("flops_sp", "1", 20, t1.Add(time.Minute))
+	send("flops_dp", "1", 30, t1.Add(time.Minute))
+
+	pending := mp.PendingMessages()
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 derived metrics, got %d", len(pending))
+	}
+	for i, expected := range []float64{4, 80} {
+		v, _ := pending[i].GetField("value")
+		u, _ := pending[i].GetMeta("unit")
+		if pending[i].Name() != "flops_any" || v != expected || u != "F/s" {
+			t.Errorf("unexpected derived metric %s", pending[i].String())
+		}
+	}
+	if !pending[0].Time().Equal(t1) {
+		t.Errorf("expected timestamp of the first input, got %v", pending[0].Time())
+	}
+
+	// Tick discards incomplete sets which timed out
+	send("flops_sp", "0", 2, t1.Add(2*time.Minute))
+	mp.Tick(t1.Add(3 * time.Minute))
+	send("flops_dp", "0", 1, t1.Add(2*time.Minute))
+	if pending := mp.PendingMessages(); len(pending) != 0 {
+		t.Errorf("expected no derived metric from timed out inputs, got %d", len(pending))
+	}
+
+	// drop_input drops the inputs
+	if out := send("read_bw", "0", 5, t1); out != nil {
+		t.Errorf("input not dropped: %s", out.String())
+	}
+	send("write_bw", "0", 3, t1)
+	pending = mp.PendingMessages()
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 derived metric, got %d", len(pending))
+	}
+	if v, _ := pending[0].GetField("value"); pending[0].Name() != "mem_bw" || v != 8.0 || pending[0].HasMeta("unit") {
+		t.Errorf("unexpected derived metric %s", pending[0].String())
+	}
+
+	mp.RemoveDerivedMetric("mem_bw")
+	if out := send("read_bw", "0", 5, t1); out == nil {
+		t.Error("derived metric not removed")
+	}
+
+	for _, c := range []DerivedMetricConfig{
+		{Name: "x", Expression: "a"},
+		{Name: "x", Inputs: []string{"a"}, Expression: "b"},
+		{Name: "x", Inputs: []string{"a"}, Expression: "a", Timeout: "0s"},
+	} {
+		if err := mp.AddDerivedMetric(c); err == nil {
+			t.Errorf("expected error for invalid derived metric %v", c)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{
+		"add_tags_if": [
+			{"if": "name == 'other'", "key": "a", "value": "1"},
+			{"if": "name == 'cpu_load'", "key": "cluster", "value": "testcluster"}
+		],
+		"rename_messages": {"cpu_load": "load"},
+		"drop_messages_if": ["name == 'load' && value < 0"]
+	}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	m, _ := lp.NewMetric("cpu_load", map[string]string{"hostname": "h1", "type": "node"}, nil, 1.0, time.Now())
+	out, trace, err := mp.ProcessMessageTrace(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if out == nil || trace.Dropped || trace.Output != out.String() {
+		t.Fatalf("unexpected output of trace:\n%s", trace.String())
+	}
+	expected := []TraceStep{
+		{Stage: STAGENAME_DROP_IF, Rule: "name == 'load' && value < 0"},
+		{Stage: STAGENAME_ADD_TAG, Rule: "name == 'other'"},
+		{Stage: STAGENAME_ADD_TAG, Rule: "name == 'cpu_load'", Matched: true,
+			Changes: []TraceChange{{Location: TRACE_LOCATION_TAG, Key: "cluster", After: "testcluster"}}},
+		{Stage: STAGENAME_RENAME_BY_NAME, Rule: "cpu_load", Matched: true,
+			Changes: []TraceChange{
+				{Location: TRACE_LOCATION_NAME, Before: "cpu_load", After: "load"},
+				{Location: TRACE_LOCATION_META, Key: "oldname", After: "cpu_load"},
+			}},
+	}
+	if !reflect.DeepEqual(trace.Steps, expected) {
+		t.Errorf("unexpected trace:\n%s", trace.String())
+	}
+
+	// Dropped messages are marked in the trace
+	m, _ = lp.NewMetric("load", map[string]string{"hostname": "h1", "type": "node"}, nil, -1.0, time.Now())
+	out, trace, err = mp.ProcessMessageTrace(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if out != nil || !trace.Dropped || !trace.Steps[0].Matched || !trace.Steps[0].Dropped {
+		t.Errorf("expected message dropped by first rule:\n%s", trace.String())
+	}
+
+	// Rules failing to evaluate are recorded with the error
+	failing, _ := NewMessageProcessor()
+	if err := failing.AddDropMessagesByCondition("name matches tag.hostname"); err != nil {
+		t.Fatal(err.Error())
+	}
+	m, _ = lp.NewMetric("load", map[string]string{"hostname": "[", "type": "node"}, nil, 1.0, time.Now())
+	_, trace, err = failing.ProcessMessageTrace(m)
+	if err == nil || len(trace.Error) == 0 {
+		t.Fatalf("expected evaluation error:\n%s", trace.String())
+	}
+	if len(trace.Steps) != 1 || trace.Steps[0].Rule != "name matches tag.hostname" || trace.Steps[0].Matched {
+		t.Errorf("expected failed rule in trace:\n%s", trace.String())
+	}
+
+	// The hook is only called for messages matching the selector
+	var traces []*Trace
+	if err := mp.SetTraceHook("tag.hostname == 'h2'", func(trace *Trace) { traces = append(traces, trace) }); err != nil {
+		t.Fatal(err.Error())
+	}
+	selected := ""
+	for _, host := range []string{"h1", "h2", "h3"} {
+		m, _ := lp.NewMetric("cpu_load", map[string]string{"hostname": host, "type": "node"}, nil, 1.0, time.Now())
+		if host == "h2" {
+			selected = m.String()
+		}
+		if _, err := mp.ProcessMessage(m); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(traces) != 1 || traces[0].Input != selected {
+		t.Errorf("expected one trace of host h2, got %d", len(traces))
+	}
+	if err := mp.SetTraceHook("", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	mp.ProcessMessage(m)
+	if len(traces) != 1 {
+		t.Error("trace hook called after disabling it")
+	}
+}
+
+func TestConfigExport(t *testing.T) {
+	config := `{
+		"stage_order": ["rename_if", "add_tag", "drop_if"],
+		"drop_messages": ["b", "a"],
+		"drop_messages_if": ["value < 0"],
+		"rename_messages": {"cpu_load": "load"},
+		"rename_messages_if": {"name == 'z'": "y", "name == 'y'": "x"},
+		"add_tags_if": [{"if": "true", "key": "cluster", "value": "test"}],
+		"set_field_if": [{"if": "name == 'load'", "key": "value", "expression": "value / 4"}],
+		"rate": [{"if": "name == 'bytes'", "counter_bits": 64}],
+		"stop_after_first_match": ["add_tag"]
+	}`
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+	mp.AddAddMetaByCondition("name == 'load'", "unit", "load")
+
+	out, err := mp.ToConfigJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var c messageProcessorConfig
+	if err := json.Unmarshal(out, &c); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(c.DropMessages, []string{"a", "b"}) {
+		t.Errorf("unexpected drop_messages %v", c.DropMessages)
+	}
+	if !reflect.DeepEqual(c.RenameMessagesIf, orderedConfigMap{{"name == 'z'", "y"}, {"name == 'y'", "x"}}) {
+		t.Errorf("rename_messages_if not in configured order: %v", c.RenameMessagesIf)
+	}
+	if len(c.AddMetaIf) != 1 || c.AddMetaIf[0].Key != "unit" {
+		t.Errorf("rule added at runtime not exported: %v", c.AddMetaIf)
+	}
+	if len(c.SetFieldIf) != 1 || c.SetFieldIf[0].Expression != "value / 4" {
+		t.Errorf("unexpected set_field_if %v", c.SetFieldIf)
+	}
+	if len(c.Rate) != 1 || c.Rate[0].Name != RATE_DEFAULT_NAME {
+		t.Errorf("unexpected rate %v", c.Rate)
+	}
+
+	// A message processor created from the exported configuration is equal
+	mp2, _ := NewMessageProcessor()
+	if err := mp2.FromConfigJSON(out); err != nil {
+		t.Fatal(err.Error())
+	}
+	changes, err := mp.Diff(mp2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(changes) > 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+
+	mp2.RemoveAddMetaByCondition("name == 'load'")
+	mp2.AddDropMessagesByName("c")
+	mp2.SetStopAfterFirstMatch(STAGENAME_ADD_TAG, false)
+	mp2.SetStopAfterFirstMatch(STAGENAME_RATE, false)
+	changes, err = mp.Diff(mp2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []ConfigChange{
+		{Option: "drop_messages", After: "c"},
+		{Option: "add_meta_if", Before: messageProcessorTagConfig{Key: "unit", Value: "load", Condition: "name == 'load'"}},
+		{Option: "stop_after_first_match", Before: STAGENAME_ADD_TAG},
+		{Option: "apply_all_matches", After: STAGENAME_RATE},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+
+	// Disabled defaults of stop after first match are exported
+	out, err = mp2.ToConfigJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mp5, _ := NewMessageProcessor()
+	if err := mp5.FromConfigJSON(out); err != nil {
+		t.Fatal(err.Error())
+	}
+	if changes, _ := mp2.Diff(mp5); len(changes) > 0 {
+		t.Errorf("expected no changes after round trip, got %v", changes)
+	}
+
+	// Changes of the rule order are reported with the whole list
+	mp3, _ := NewMessageProcessor()
+	mp3.AddRenameMetricByCondition("name == 'y'", "x")
+	mp3.AddRenameMetricByCondition("name == 'z'", "y")
+	mp4, _ := NewMessageProcessor()
+	mp4.AddRenameMetricByCondition("name == 'z'", "y")
+	mp4.AddRenameMetricByCondition("name == 'y'", "x")
+	changes, _ = mp3.Diff(mp4)
+	if len(changes) != 1 || changes[0].Option != "rename_messages_if" || changes[0].Before == nil || changes[0].After == nil {
+		t.Errorf("expected order change of rename_messages_if, got %v", changes)
+	}
+}
+
+func TestProcessMessages(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mp.AddDropMessagesByName("drop")
+	mp.AddAddTagsByCondition("true", "cluster", "test")
+	// Fails for messages with a string unit field
+	mp.AddSetFieldByCondition("name == 'bad'", "value", "field.unit")
+
+	var in []lp.CCMessage
+	for _, name := range []string{"a", "drop", "bad", "b"} {
+		m, _ := lp.NewMessage(name, map[string]string{"type": "node"}, nil, map[string]interface{}{"value": 1.0, "unit": "B"}, time.Now())
+		in = append(in, m)
+	}
+	out, err := mp.ProcessMessages(in)
+	if err == nil {
+		t.Error("expected error for message bad")
+	}
+	if len(out) != 2 || out[0].Name() != "a" || out[1].Name() != "b" {
+		t.Fatalf("expected messages a and b, got %v", out)
+	}
+	for _, m := range out {
+		if !m.HasTag("cluster") {
+			t.Errorf("message %s not processed", m.Name())
+		}
+	}
+	if in[0].HasTag("cluster") {
+		t.Error("input message modified")
+	}
+}
+
+func TestProcessChannel(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The rate stage drops decreasing counters, so all rates are only
+	// created if the samples of each series are processed in order
+	if err := mp.AddRate(RateConfig{Condition: "name == 'bytes'"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	const hosts, samples = 8, 100
+	in := make(chan lp.CCMessage)
+	out := make(chan lp.CCMessage, hosts*samples)
+	go func() {
+		t0 := time.Unix(1700000000, 0)
+		for i := 0; i < samples; i++ {
+			for h := 0; h < hosts; h++ {
+				m, _ := lp.NewMetric("bytes", map[string]string{"type": "node", "hostname": fmt.Sprintf("h%d", h)}, nil, float64(10*i), t0.Add(time.Duration(i)*time.Second))
+				in <- m
+			}
+		}
+		close(in)
+	}()
+	mp.ProcessChannel(in, out, 4)
+	close(out)
+
+	count := 0
+	for m := range out {
+		if v, _ := m.GetField("value"); v != 10.0 {
+			t.Errorf("expected rate 10, got %v", v)
+		}
+		count++
+	}
+	if count != hosts*(samples-1) {
+		t.Errorf("expected %d rates, got %d", hosts*(samples-1), count)
+	}
+
+	// Deleting the tag src before the rate stage joins the input series of
+	// all sources, so the rate stage has to see them in input order
+	mp, _ = NewMessageProcessor()
+	if err := mp.AddDeleteTagsByCondition("name == 'bytes'", "src", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mp.AddRate(RateConfig{Condition: "name == 'bytes'"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	in = make(chan lp.CCMessage)
+	out = make(chan lp.CCMessage, samples)
+	go func() {
+		t0 := time.Unix(1700000000, 0)
+		for i := 0; i < samples; i++ {
+			m, _ := lp.NewMetric("bytes", map[string]string{"type": "node", "hostname": "h1", "src": strconv.Itoa(i % hosts)}, nil, float64(10*i), t0.Add(time.Duration(i)*time.Second))
+			in <- m
+		}
+		close(in)
+	}()
+	mp.ProcessChannel(in, out, 4)
+	close(out)
+
+	count = 0
+	for m := range out {
+		if v, _ := m.GetField("value"); v != 10.0 || m.HasTag("src") {
+			t.Errorf("expected rate 10 without src, got %s", m.String())
+		}
+		count++
+	}
+	if count != samples-1 {
+		t.Errorf("expected %d rates of joined series, got %d", samples-1, count)
+	}
+
+	// The aggregate stage combines the series of all hwthreads, so it has to
+	// see them in input order to not skip metrics of closed windows
+	mp, _ = NewMessageProcessor()
+	err = mp.AddAggregation(AggregationConfig{Condition: "name == 'load'", Scope: "node", Window: "10s", Functions: []string{"sum"}, Name: "{name}", DropInput: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	const hwthreads, windows = 16, 5
+	in = make(chan lp.CCMessage)
+	out = make(chan lp.CCMessage, hwthreads*windows*10)
+	t0 := time.Unix(1700000000, 0)
+	go func() {
+		for i := 0; i < windows*10; i++ {
+			for h := 0; h < hwthreads; h++ {
+				m, _ := lp.NewMetric("load", map[string]string{"type": "hwthread", "type-id": strconv.Itoa(h), "hostname": "h1"}, nil, 1.0, t0.Add(time.Duration(i)*time.Second))
+				in <- m
+			}
+		}
+		close(in)
+	}()
+	mp.ProcessChannel(in, out, 4)
+	mp.Tick(t0.Add(time.Hour))
+	for _, m := range mp.PendingMessages() {
+		out <- m
+	}
+	close(out)
+
+	count = 0
+	for m := range out {
+		if v, _ := m.GetField("value"); v != float64(hwthreads*10) {
+			t.Errorf("expected sum %d, got %s", hwthreads*10, m.String())
+		}
+		count++
+	}
+	if count != windows {
+		t.Errorf("expected %d aggregated messages, got %d", windows, count)
+	}
+
+	// Messages generated by Tick stay pending while ProcessChannel runs
+	m, _ := lp.NewMetric("load", map[string]string{"type": "hwthread", "type-id": "0", "hostname": "h2"}, nil, 1.0, t0)
+	if _, err := mp.ProcessMessage(m); err != nil {
+		t.Fatal(err.Error())
+	}
+	mp.Tick(t0.Add(time.Hour))
+	in = make(chan lp.CCMessage, 1)
+	out = make(chan lp.CCMessage, 1)
+	m, _ = lp.NewMetric("other", map[string]string{"type": "node", "hostname": "h1"}, nil, 1.0, t0)
+	in <- m
+	close(in)
+	mp.ProcessChannel(in, out, 2)
+	close(out)
+	if m := <-out; m == nil || m.Name() != "other" || len(out) != 0 {
+		t.Errorf("unexpected output of ProcessChannel")
+	}
+	if p := mp.PendingMessages(); len(p) != 1 || p[0].Name() != "load" {
+		t.Errorf("expected the message generated by Tick to stay pending, got %d messages", len(p))
+	}
+}
+
+func TestStats(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{
+		"drop_messages": ["unused"],
+		"drop_messages_if": ["value < 0"],
+		"add_tags_if": [
+			{"if": "name == 'a'", "key": "x", "value": "1"},
+			{"if": "tag.hostname == 'h1'", "key": "y", "value": "2"}
+		],
+		"stats_interval": "1m"
+	}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, c := range []struct {
+		name  string
+		host  string
+		value float64
+	}{
+		{"a", "h1", 1},
+		{"a", "h2", -1},
+		{"b", "h1", 1},
+		{"b", "h2", 1},
+	} {
+		m, _ := lp.NewMetric(c.name, map[string]string{"type": "node", "hostname": c.host}, nil, c.value, time.Now())
+		if _, err := mp.ProcessMessage(m); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	stats := make(map[string]StageStats)
+	for _, s := range mp.Stats() {
+		stats[s.Stage] = s
+	}
+	if s := stats[STAGENAME_DROP_BY_NAME]; s.Evaluated != 4 || s.Matched != 0 || s.Dropped != 0 {
+		t.Errorf("unexpected statistics of %s: %+v", s.Stage, s.StatCounters)
+	}
+	if s := stats[STAGENAME_DROP_IF]; s.Evaluated != 4 || s.Matched != 1 || s.Dropped != 1 || len(s.Rules) != 1 {
+		t.Errorf("unexpected statistics of %s: %+v", s.Stage, s)
+	} else if r := s.Rules[0]; r.Rule != "value < 0" || r.Evaluated != 4 || r.Matched != 1 || r.Dropped != 1 {
+		t.Errorf("unexpected statistics of rule %s: %+v", r.Rule, r.StatCounters)
+	}
+	if s := stats[STAGENAME_ADD_TAG]; s.Evaluated != 3 || s.Matched != 2 || s.Dropped != 0 || len(s.Rules) != 2 {
+		t.Errorf("unexpected statistics of %s: %+v", s.Stage, s)
+	} else if s.Rules[0].Matched != 1 || s.Rules[1].Matched != 2 || s.Rules[1].Evaluated != 3 {
+		t.Errorf("unexpected statistics of rules of %s: %+v", s.Stage, s.Rules)
+	}
+	if s := stats[STAGENAME_RENAME_IF]; s.Evaluated != 0 {
+		t.Errorf("stage %s without rules evaluated", s.Stage)
+	}
+
+	// The statistics are emitted as metrics of the active stages and their rules
+	mp.Tick(time.Now())
+	count := 0
+	for _, m := range mp.PendingMessages() {
+		if stage, _ := m.GetTag("stage"); m.Name() == STATS_METRIC_PREFIX+"dropped" && stage == STAGENAME_DROP_IF && m.HasTag("rule") {
+			if v, _ := m.GetTag("rule"); v != "0" {
+				t.Errorf("unexpected rule %s", v)
+			}
+			if v, _ := m.GetMeta("rule"); v != "value < 0" {
+				t.Errorf("unexpected condition %s", v)
+			}
+			if v, _ := m.GetField("value"); v != int64(1) {
+				t.Errorf("expected 1 dropped message, got %v", v)
+			}
+		}
+		count++
+	}
+	// 3 stages with 3 rules with 5 metrics each
+	if count != 30 {
+		t.Errorf("expected 30 metrics, got %d", count)
+	}
+	mp.Tick(time.Now())
+	if len(mp.PendingMessages()) != 0 {
+		t.Error("statistics emitted before the interval passed")
+	}
+}
+
+func TestRegexRules(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{
+		"rename_messages_regex": {"^likwid_(.*)_dp$": "$1", "^cpu_(.*)$": "core_${1}"},
+		"rewrite_tags_if": [
+			{"if": "true", "key": "hostname", "regex": "^(\\w+)\\.cluster\\.local$", "replacement": "$1"}
+		],
+		"rewrite_meta_if": [
+			{"if": "meta.unit == 'MBytes/s'", "key": "unit", "regex": "^MBytes/s$", "replacement": "MB/s"}
+		],
+		"rewrite_field_if": [
+			{"if": "msgtype == 'event'", "key": "event", "regex": "node(\\d+)", "replacement": "n$1"}
+		]
+	}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	m, _ := lp.NewMetric("likwid_cpu_flops_dp", map[string]string{"type": "node", "hostname": "n01.cluster.local"}, map[string]string{"unit": "MBytes/s"}, 1.0, time.Now())
+	out, err := mp.ProcessMessage(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Renames are applied in order and see the new name
+	if out.Name() != "core_flops" {
+		t.Errorf("expected name core_flops, got %s", out.Name())
+	}
+	if v, _ := out.GetTag("hostname"); v != "n01" {
+		t.Errorf("expected hostname n01, got %s", v)
+	}
+	if v, _ := out.GetMeta("unit"); v != "MB/s" {
+		t.Errorf("expected unit MB/s, got %s", v)
+	}
+
+	m, _ = lp.NewEvent("job", map[string]string{"type": "node", "hostname": "other.example.com"}, nil, "start on node1,node2", time.Now())
+	out, err = mp.ProcessMessage(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v, _ := out.GetField("event"); v != "start on n1,n2" {
+		t.Errorf("expected event 'start on n1,n2', got %v", v)
+	}
+	if v, _ := out.GetTag("hostname"); v != "other.example.com" {
+		t.Errorf("hostname not matching the regular expression changed to %s", v)
+	}
+	if out.Name() != "job" {
+		t.Errorf("name not matching the regular expressions changed to %s", out.Name())
+	}
+
+	// Invalid regular expressions are rejected when they are added
+	if err := mp.AddRenameMetricByRegex("^(", "x"); err == nil {
+		t.Error("expected error for invalid regular expression")
+	}
+	if err := mp.AddRewriteTagsByCondition("true", "hostname", "[", "x"); err == nil {
+		t.Error("expected error for invalid regular expression")
+	}
+	mp.RemoveRenameMetricByRegex("^cpu_(.*)$")
+	m, _ = lp.NewMetric("likwid_cpu_flops_dp", map[string]string{"type": "node"}, nil, 1.0, time.Now())
+	if out, _ := mp.ProcessMessage(m); out.Name() != "cpu_flops" {
+		t.Errorf("expected name cpu_flops after removing rename, got %s", out.Name())
+	}
+
+	// The renames are counted per regular expression
+	for _, s := range mp.Stats() {
+		if s.Stage != STAGENAME_RENAME_REGEX {
+			continue
+		}
+		if s.Evaluated != 3 || s.Matched != 2 {
+			t.Errorf("unexpected statistics of stage %s: %+v", s.Stage, s.StatCounters)
+		}
+		if len(s.Rules) != 1 || s.Rules[0].Rule != "^likwid_(.*)_dp$" || s.Rules[0].Evaluated != 3 || s.Rules[0].Matched != 2 {
+			t.Errorf("unexpected rule statistics %+v", s.Rules)
+		}
+	}
+
+	// Chained renames can be stopped after the first match
+	mp, _ = NewMessageProcessor()
+	if err := mp.FromConfigJSON(json.RawMessage(`{
+		"rename_messages_regex": {"^a_(.*)$": "b_$1", "^b_(.*)$": "c_$1"},
+		"stop_after_first_match": ["rename_regex"]
+	}`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	m, _ = lp.NewMetric("a_x", map[string]string{"type": "node"}, nil, 1.0, time.Now())
+	if out, _ := mp.ProcessMessage(m); out.Name() != "b_x" {
+		t.Errorf("expected name b_x with stop after first match, got %s", out.Name())
+	}
+}
+
+func TestSplitMerge(t *testing.T) {
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := `{
+		"split_fields": [{"if": "name == 'cpu'"}],
+		"add_tags_if": [{"if": "true", "key": "cluster", "value": "testcluster"}]
+	}`
+	if err := mp.FromConfigJSON(json.RawMessage(config)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tm := time.Now()
+	fields := map[string]interface{}{"usage_user": 1.5, "usage_system": int64(2), "state": "idle"}
+	m, _ := lp.NewMessage("cpu", map[string]string{"type": "node", "hostname": "n01"}, nil, fields, tm)
+	out, err := mp.ProcessMessage(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if out != nil {
+		t.Errorf("expected split message to be dropped, got %s", out.String())
+	}
+	// The metrics pass the stages after split_fields, the string field is skipped
+	split := mp.PendingMessages()
+	if len(split) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(split))
+	}
+	for i, name := range []string{"cpu_usage_system", "cpu_usage_user"} {
+		if split[i].Name() != name || !split[i].IsMetric() {
+			t.Errorf("expected metric %s, got %s", name, split[i].String())
+		}
+		if v, _ := split[i].GetTag("cluster"); v != "testcluster" {
+			t.Errorf("expected tag cluster=testcluster on %s, got %s", name, v)
+		}
+	}
+
+	// Metrics with only the value field are not split unless value is listed
+	// in fields
+	m, _ = lp.NewMetric("cpu", map[string]string{"type": "node", "hostname": "n01"}, nil, 1.0, tm)
+	if out, err := mp.ProcessMessage(m); err != nil || out == nil || out.Name() != "cpu" {
+		t.Errorf("expected unchanged metric cpu, got %v, %v", out, err)
+	}
+	if pending := mp.PendingMessages(); len(pending) != 0 {
+		t.Errorf("expected no split metrics, got %v", pending)
+	}
+	mpValue, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mpValue.AddSplitFields(SplitConfig{Condition: "true", Fields: []string{"value"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	m, _ = lp.NewMetric("cpu", map[string]string{"type": "node"}, nil, 1.0, tm)
+	if out, _ := mpValue.ProcessMessage(m); out != nil {
+		t.Errorf("expected split metric to be dropped, got %s", out.String())
+	}
+	if pending := mpValue.PendingMessages(); len(pending) != 1 || pending[0].Name() != "cpu_value" {
+		t.Errorf("expected split metric cpu_value, got %v", pending)
+	}
+
+	// Merging the metrics restores the multi-field message
+	mp2, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mp2.AddMergeFields(MergeConfig{Condition: "true", Fields: []string{"usage_user", "usage_system"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, m := range split {
+		if out, err := mp2.ProcessMessage(m); err != nil || out != nil {
+			t.Errorf("expected merged input to be dropped, got %v, %v", out, err)
+		}
+	}
+	merged := mp2.PendingMessages()
+	if len(merged) != 1 {
+		t.Fatalf("expected 1 merged message, got %d", len(merged))
+	}
+	if merged[0].Name() != "cpu" || !merged[0].Time().Equal(tm) {
+		t.Errorf("expected message cpu at %v, got %s", tm, merged[0].String())
+	}
+	for key, value := range map[string]interface{}{"usage_user": 1.5, "usage_system": int64(2)} {
+		if v, ok := merged[0].GetField(key); !ok || v != value {
+			t.Errorf("expected field %s=%v, got %v", key, value, v)
+		}
+	}
+
+	// Without expected fields, the merged message is emitted when the next
+	// timestamp arrives or after the timeout
+	mp3, err := NewMessageProcessor()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mp3.AddMergeFields(MergeConfig{Condition: "true", Template: "likwid_{field}", Name: "likwid", Timeout: "5s"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	tags := map[string]string{"type": "hwthread", "type-id": "0"}
+	for i, name := range []string{"likwid_flops_dp", "likwid_mem_bw", "likwid_flops_dp"} {
+		m, _ := lp.NewMetric(name, tags, nil, float64(i), tm.Add(time.Duration(i/2)*time.Second))
+		mp3.ProcessMessage(m)
+	}
+	merged = mp3.PendingMessages()
+	if len(merged) != 1 || len(merged[0].Fields()) != 2 {
+		t.Fatalf("expected 1 merged message with 2 fields, got %v", merged)
+	}
+	mp3.Tick(tm.Add(3 * time.Second))
+	if len(mp3.PendingMessages()) != 0 {
+		t.Error("merged message emitted before the timeout")
+	}
+	mp3.Tick(tm.Add(6 * time.Second))
+	merged = mp3.PendingMessages()
+	if len(merged) != 1 || merged[0].Name() != "likwid" {
+		t.Fatalf("expected merged message likwid after the timeout, got %v", merged)
+	}
+	if v, _ := merged[0].GetField("flops_dp"); v != 2.0 {
+		t.Errorf("expected field flops_dp=2, got %v", v)
+	}
+
+	// Templates need a field and a name
+	if err := mp3.AddMergeFields(MergeConfig{Condition: "true", Template: "likwid_{field}"}); err == nil {
+		t.Error("expected error for template without name")
+	}
+	if err := mp3.AddSplitFields(SplitConfig{Condition: "true", Name: "{name}_split"}); err == nil {
+		t.Error("expected error for name template without field")
+	}
+
+	// The rules are exported and removed by condition
+	exported, err := mp.ToConfigJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var c messageProcessorConfig
+	if err := json.Unmarshal(exported, &c); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(c.SplitFields) != 1 || c.SplitFields[0].Name != SPLIT_DEFAULT_NAME || len(c.FirstMatch) != 0 {
+		t.Errorf("unexpected exported configuration %s", exported)
+	}
+	mp.RemoveSplitFields("name == 'cpu'")
+	m, _ = lp.NewMessage("cpu", map[string]string{"type": "node"}, nil, fields, tm)
+	if out, _ := mp.ProcessMessage(m); out == nil || len(out.Fields()) != 3 {
+		t.Errorf("expected unchanged message after removing the split rule, got %v", out)
+	}
+}
+
+func TestMergeLimit(t *testing.T) {
+	m, err := newMerge(MergeConfig{Condition: "true", Fields: []string{"user", "system"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var emitted int
+	emit := func(m lp.CCMessage) { emitted++ }
+
+	// Series which never send all fields
+	tm := time.Unix(1700000000, 0)
+	for i := 0; i < maxMergeGroups; i++ {
+		x, _ := lp.NewMetric("cpu_user", map[string]string{"hostname": "h" + strconv.Itoa(i), "type": "node"}, nil, 1.0, tm)
+		m.add(x, emit)
+	}
+	if emitted != 0 || len(m.groups) != maxMergeGroups {
+		t.Fatalf("expected %d incomplete merged messages, got %d emitted, %d groups", maxMergeGroups, emitted, len(m.groups))
+	}
+	// A new series emits the incomplete merged messages
+	x, _ := lp.NewMetric("cpu_user", map[string]string{"hostname": "new", "type": "node"}, nil, 1.0, tm)
+	m.add(x, emit)
+	if emitted != maxMergeGroups || len(m.groups) != 1 {
+		t.Errorf("expected %d emitted merged messages and 1 group, got %d emitted, %d groups", maxMergeGroups, emitted, len(m.groups))
+	}
+}
+
+// Number of messages processed in each iteration of the benchmarks. Only
+// the processing is timed, not the generation of the messages.
+const benchmarkMessages = 1000
+
 func BenchmarkProcessing(b *testing.B) {
-	mlist, err := generate_message_lists(b.N, 1000)
+	mlist, err := generate_message_lists(b.N, benchmarkMessages)
 	if err != nil {
 		b.Error(err.Error())
 		return
@@ -374,7 +1641,8 @@ func BenchmarkProcessing(b *testing.B) {
 		return
 	}
 
-	b.StartTimer()
+	b.ReportAllocs()
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		for _, m := range mlist[i] {
 			if _, err := mp.ProcessMessage(m); err != nil {
@@ -384,5 +1652,124 @@ func BenchmarkProcessing(b *testing.B) {
 		}
 	}
 	b.StopTimer()
-	b.ReportMetric(float64(b.Elapsed())/float64(len(mlist)*b.N), "ns/message")
+	b.ReportMetric(float64(b.Elapsed())/float64(b.N*benchmarkMessages), "ns/message")
+}
+
+// Same as BenchmarkProcessing but the processed messages are returned to
+// the message pool
+func BenchmarkProcessingPooled(b *testing.B) {
+	mlist, err := generate_message_lists(b.N, benchmarkMessages)
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+	err = mp.FromConfigJSON(json.RawMessage(`{"move_meta_to_tag_if": [{"if" : "name == 'mymetric'", "key":"unit", "value":"unit"}]}`))
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, m := range mlist[i] {
+			out, err := mp.ProcessMessage(m)
+			if err != nil {
+				b.Errorf("failed processing message '%s': %v", m.ToLineProtocol(nil), err.Error())
+				return
+			}
+			lp.Release(out)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.Elapsed())/float64(b.N*benchmarkMessages), "ns/message")
+}
+
+// Same as BenchmarkProcessingPooled but the messages of each list are
+// processed as batch
+func BenchmarkProcessingBatch(b *testing.B) {
+	mlist, err := generate_message_lists(b.N, benchmarkMessages)
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+	err = mp.FromConfigJSON(json.RawMessage(`{"move_meta_to_tag_if": [{"if" : "name == 'mymetric'", "key":"unit", "value":"unit"}]}`))
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out, err := mp.ProcessMessages(mlist[i])
+		if err != nil {
+			b.Errorf("failed processing messages: %v", err.Error())
+			return
+		}
+		for _, m := range out {
+			lp.Release(m)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.Elapsed())/float64(b.N*benchmarkMessages), "ns/message")
+}
+
+// Same as BenchmarkProcessingPooled but the messages are processed
+// concurrently by the worker pool
+func BenchmarkProcessingChannel(b *testing.B) {
+	mlist, err := generate_message_lists(b.N, benchmarkMessages)
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+
+	mp, err := NewMessageProcessor()
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+	err = mp.FromConfigJSON(json.RawMessage(`{"move_meta_to_tag_if": [{"if" : "name == 'mymetric'", "key":"unit", "value":"unit"}]}`))
+	if err != nil {
+		b.Error(err.Error())
+		return
+	}
+
+	in := make(chan lp.CCMessage, 1024)
+	out := make(chan lp.CCMessage, 1024)
+	done := make(chan struct{})
+	go func() {
+		for m := range out {
+			lp.Release(m)
+		}
+		close(done)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			for _, m := range mlist[i] {
+				in <- m
+			}
+		}
+		close(in)
+	}()
+	mp.ProcessChannel(in, out, 0)
+	close(out)
+	<-done
+	b.StopTimer()
+	b.ReportMetric(float64(b.Elapsed())/float64(b.N*benchmarkMessages), "ns/message")
 }
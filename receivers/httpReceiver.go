@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
@@ -16,7 +17,7 @@ import (
 
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
-	influx "github.com/influxdata/line-protocol/v2/lineprotocol"
+	mp "github.com/ClusterCockpit/cc-lib/messageProcessor"
 )
 
 const HTTP_RECEIVER_PORT = "8080"
@@ -39,14 +40,25 @@ type HttpReceiverConfig struct {
 	Username     string `json:"username"`
 	Password     string `json:"password"`
 	useBasicAuth bool
+
+	// Wire format: 'influx' line protocol (default) or 'msgpack' binary format
+	Format string `json:"format,omitempty"`
+
+	// Timestamp precision of the line protocol: 's', 'ms', 'us', 'ns' (default) or 'auto'.
+	// Can be overwritten per request with the query parameter 'precision'
+	Precision string `json:"precision,omitempty"`
+
+	// Stop decoding the line protocol of a request at the first bad line instead of skipping bad lines
+	Strict bool `json:"strict,omitempty"`
 }
 
 type HttpReceiver struct {
 	receiver
 	// meta   map[string]string
-	config HttpReceiverConfig
-	server *http.Server
-	wg     sync.WaitGroup
+	config    HttpReceiverConfig
+	precision lp.Precision
+	server    *http.Server
+	wg        sync.WaitGroup
 }
 
 func (r *HttpReceiver) Init(name string, config json.RawMessage) error {
@@ -89,20 +101,29 @@ func (r *HttpReceiver) Init(name string, config json.RawMessage) error {
 	if r.config.useBasicAuth && len(r.config.Password) == 0 {
 		return errors.New("basic authentication requires password")
 	}
-	// msgp, err := mp.NewMessageProcessor()
-	// if err != nil {
-	// 	return fmt.Errorf("initialization of message processor failed: %v", err.Error())
-	// }
-	// r.mp = msgp
-	// if len(r.config.MessageProcessor) > 0 {
-	// 	err = r.mp.FromConfigJSON(r.config.MessageProcessor)
-	// 	if err != nil {
-	// 		return fmt.Errorf("failed parsing JSON for message processor: %v", err.Error())
-	// 	}
-	// }
+	format, err := checkFormat(r.config.Format)
+	if err != nil {
+		return err
+	}
+	r.config.Format = format
+	r.precision, err = lp.ParsePrecision(r.config.Precision)
+	if err != nil {
+		return err
+	}
+	msgp, err := mp.NewMessageProcessor()
+	if err != nil {
+		return fmt.Errorf("initialization of message processor failed: %v", err.Error())
+	}
+	r.mp = msgp
+	if len(r.config.MessageProcessor) > 0 {
+		err = r.mp.FromConfigJSON(r.config.MessageProcessor)
+		if err != nil {
+			return fmt.Errorf("failed parsing JSON for message processor: %v", err.Error())
+		}
+	}
 	// r.mp.AddAddMetaByCondition("true", "source", r.name)
-	//
-	//r.meta = map[string]string{"source": r.name}
+	r.validator = r.config.Validate
+
 	p := r.config.Path
 	if !strings.HasPrefix(p, "/") {
 		p = "/" + p
@@ -127,6 +148,7 @@ func (r *HttpReceiver) Init(name string, config json.RawMessage) error {
 
 func (r *HttpReceiver) Start() {
 	cclog.ComponentDebug(r.name, "START")
+	r.startTicker()
 	r.wg.Add(1)
 	go func() {
 		err := r.server.ListenAndServe()
@@ -152,82 +174,74 @@ func (r *HttpReceiver) ServerHttp(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
-	if r.sink != nil {
-		d := influx.NewDecoder(req.Body)
-		for d.Next() {
-
-			// Decode measurement name
-			measurement, err := d.Measurement()
-			if err != nil {
-				msg := "ServerHttp: Failed to decode measurement: " + err.Error()
-				cclog.ComponentError(r.name, msg)
-				http.Error(w, msg, http.StatusInternalServerError)
-				return
-			}
-
-			// Decode tags
-			tags := make(map[string]string)
-			for {
-				key, value, err := d.NextTag()
-				if err != nil {
-					msg := "ServerHttp: Failed to decode tag: " + err.Error()
-					cclog.ComponentError(r.name, msg)
-					http.Error(w, msg, http.StatusInternalServerError)
-					return
-				}
-				if key == nil {
-					break
-				}
-				tags[string(key)] = string(value)
-			}
-
-			// Decode fields
-			fields := make(map[string]interface{})
-			for {
-				key, value, err := d.NextField()
-				if err != nil {
-					msg := "ServerHttp: Failed to decode field: " + err.Error()
-					cclog.ComponentError(r.name, msg)
-					http.Error(w, msg, http.StatusInternalServerError)
-					return
-				}
-				if key == nil {
-					break
-				}
-				fields[string(key)] = value.Interface()
+	if r.sink != nil && r.config.Format == RECEIVER_FORMAT_MSGPACK {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			msg := "ServerHttp: Failed to read body: " + err.Error()
+			cclog.ComponentError(r.name, msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		msgs, err := lp.FromBinary(data)
+		if err != nil {
+			msg := "ServerHttp: " + err.Error()
+			cclog.ComponentError(r.name, msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		for _, y := range msgs {
+			m, err := r.mp.ProcessMessage(y)
+			lp.Release(y)
+			if err == nil && m != nil {
+				r.send(m)
 			}
-
-			// Decode time stamp
-			t, err := d.Time(influx.Nanosecond, time.Time{})
+		}
+		r.sendPending()
+	} else if r.sink != nil {
+		// Influx-style precision parameter overwrites the configured precision
+		precision := r.precision
+		if p := req.URL.Query().Get("precision"); len(p) > 0 {
+			var err error
+			precision, err = lp.ParsePrecision(p)
 			if err != nil {
-				msg := "ServerHttp: Failed to decode time stamp: " + err.Error()
+				msg := "ServerHttp: " + err.Error()
 				cclog.ComponentError(r.name, msg)
-				http.Error(w, msg, http.StatusInternalServerError)
+				http.Error(w, msg, http.StatusBadRequest)
 				return
 			}
-
-			y, _ := lp.NewMessage(
-				string(measurement),
-				tags,
-				nil,
-				fields,
-				t,
-			)
-
+		}
+		d := lp.NewDecoder(req.Body)
+		d.SetPrecision(precision)
+		d.SetStrict(r.config.Strict)
+		for d.Next() {
+			y := d.Message()
 			m, err := r.mp.ProcessMessage(y)
+			lp.Release(y)
 			if err == nil && m != nil {
-				r.sink <- m
+				r.send(m)
 			}
-
 		}
-		// Check for IO errors
-		err := d.Err()
-		if err != nil {
+		r.sendPending()
+		// Check for IO errors, the bad line stopping the decoder in strict
+		// mode is reported below
+		var decodeErr *lp.DecodeError
+		if err := d.Err(); err != nil && !errors.As(err, &decodeErr) {
 			msg := "ServerHttp: Failed to decode: " + err.Error()
 			cclog.ComponentError(r.name, msg)
 			http.Error(w, msg, http.StatusInternalServerError)
 			return
 		}
+		// Report bad lines. All other lines are already forwarded, in strict
+		// mode only the lines before the first bad line.
+		if errs := d.Errors(); len(errs) > 0 {
+			msg := fmt.Sprintf("ServerHttp: Failed to decode %d line(s), first error: %s", d.ErrorCount(), errs[0].Error())
+			if r.config.Strict {
+				msg = fmt.Sprintf("ServerHttp: Failed to decode, following lines skipped: %s", errs[0].Error())
+			}
+			cclog.ComponentError(r.name, msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -235,6 +249,7 @@ func (r *HttpReceiver) ServerHttp(w http.ResponseWriter, req *http.Request) {
 
 func (r *HttpReceiver) Close() {
 	r.server.Shutdown(context.Background())
+	r.stopTicker()
 }
 
 func NewHttpReceiver(name string, config json.RawMessage) (Receiver, error) {
@@ -0,0 +1,54 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package receivers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+)
+
+func TestHttpReceiverBadLines(t *testing.T) {
+	body := "first,type=node value=1 1700000000000000000\n" +
+		"bad line\n" +
+		"second,type=node value=2 1700000000000000000\n"
+
+	for _, test := range []struct {
+		strict   bool
+		path     string
+		expected []string
+	}{
+		{strict: false, path: "/skip", expected: []string{"first", "second"}},
+		{strict: true, path: "/strict", expected: []string{"first"}},
+	} {
+		config, _ := json.Marshal(map[string]interface{}{"type": "http", "path": test.path, "strict": test.strict})
+		r, err := NewHttpReceiver("test", config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sink := make(chan lp.CCMessage, 10)
+		r.SetSink(sink)
+
+		// The lines before the bad line are forwarded although the request
+		// fails
+		w := httptest.NewRecorder()
+		r.(*HttpReceiver).ServerHttp(w, httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("strict=%v: expected status %d, got %d", test.strict, http.StatusBadRequest, w.Code)
+		}
+		close(sink)
+		var names []string
+		for m := range sink {
+			names = append(names, m.Name())
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("strict=%v: expected messages %v, got %v", test.strict, test.expected, names)
+		}
+	}
+}
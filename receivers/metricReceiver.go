@@ -6,14 +6,40 @@ package receivers
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
 
+	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
 	mp "github.com/ClusterCockpit/cc-lib/messageProcessor"
 )
 
+// Wire formats for receivers decoding encoded messages
+const (
+	RECEIVER_FORMAT_INFLUX  = "influx"  // InfluxDB line protocol
+	RECEIVER_FORMAT_MSGPACK = "msgpack" // binary CCMessage format, see ccMessage.FromBinary
+)
+
+// checkFormat checks the configured wire format. An empty format selects the InfluxDB line protocol
+func checkFormat(format string) (string, error) {
+	switch format {
+	case "", RECEIVER_FORMAT_INFLUX:
+		return RECEIVER_FORMAT_INFLUX, nil
+	case RECEIVER_FORMAT_MSGPACK:
+		return RECEIVER_FORMAT_MSGPACK, nil
+	}
+	return "", fmt.Errorf("unknown format '%s'", format)
+}
+
+// Interval in which receivers pass the current time to the message processor,
+// see startTicker
+const RECEIVER_TICK_INTERVAL = time.Second
+
 type defaultReceiverConfig struct {
 	Type             string          `json:"type"`
 	MessageProcessor json.RawMessage `json:"process_messages,omitempty"`
+	Validate         *lp.Validator   `json:"validate,omitempty"`
 }
 
 // Receiver configuration: Listen address, port
@@ -26,9 +52,13 @@ type ReceiverConfig struct {
 }
 
 type receiver struct {
-	name string
-	sink chan lp.CCMessage
-	mp   mp.MessageProcessor
+	name      string
+	sink      chan lp.CCMessage
+	mp        mp.MessageProcessor
+	validator *lp.Validator
+
+	tickDone chan struct{}
+	tickWg   sync.WaitGroup
 }
 
 type Receiver interface {
@@ -36,6 +66,7 @@ type Receiver interface {
 	Close()                         // Close / finish metric receiver
 	Name() string                   // Name of the metric receiver
 	SetSink(sink chan lp.CCMessage) // Set sink channel
+	InvalidMessages() uint64        // Number of messages that failed validation
 }
 
 // Name returns the name of the metric receiver
@@ -47,3 +78,93 @@ func (r *receiver) Name() string {
 func (r *receiver) SetSink(sink chan lp.CCMessage) {
 	r.sink = sink
 }
+
+// InvalidMessages returns the number of messages that failed validation
+func (r *receiver) InvalidMessages() uint64 {
+	return r.validator.Invalid()
+}
+
+// send validates the message, if enabled, and forwards it to the sink.
+// Invalid messages are counted and dropped if the validation rejects them.
+// Without sink, the message is dropped.
+func (r *receiver) send(m lp.CCMessage) {
+	r.forward(m, nil)
+}
+
+// forward works like send but stops waiting for the sink when done is
+// closed. It releases the message and returns false in that case.
+func (r *receiver) forward(m lp.CCMessage, done <-chan struct{}) bool {
+	if err := r.validator.Check(m); err != nil {
+		cclog.ComponentDebug(r.name, "invalid message", m.String()+":", err.Error())
+		if r.validator.Reject {
+			lp.Release(m)
+			return true
+		}
+	}
+	if r.sink == nil {
+		lp.Release(m)
+		return true
+	}
+	select {
+	case r.sink <- m:
+		return true
+	case <-done:
+		lp.Release(m)
+		return false
+	}
+}
+
+// sendPending forwards the messages generated by stateful stages of the
+// message processor, like aggregations
+func (r *receiver) sendPending() {
+	r.forwardPending(nil)
+}
+
+// forwardPending works like sendPending but stops when done is closed and
+// releases the messages not forwarded
+func (r *receiver) forwardPending(done <-chan struct{}) {
+	pending := r.mp.PendingMessages()
+	for i, m := range pending {
+		if !r.forward(m, done) {
+			for _, x := range pending[i+1:] {
+				lp.Release(x)
+			}
+			return
+		}
+	}
+}
+
+// startTicker periodically passes the current time to the message processor
+// and forwards the generated messages. This closes the time windows of
+// aggregations and emits the messages of other stateful stages for series
+// which stopped reporting, and the statistics configured with stats_interval.
+// It runs until stopTicker is called, which also ends waiting for the sink.
+func (r *receiver) startTicker() {
+	done := make(chan struct{})
+	r.tickDone = done
+	r.tickWg.Add(1)
+	go func() {
+		defer r.tickWg.Done()
+		ticker := time.NewTicker(RECEIVER_TICK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				r.mp.Tick(now)
+				r.forwardPending(done)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stopTicker stops the ticker started by startTicker and waits until it
+// exited
+func (r *receiver) stopTicker() {
+	if r.tickDone != nil {
+		close(r.tickDone)
+		r.tickWg.Wait()
+		r.tickDone = nil
+	}
+}
@@ -9,12 +9,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"time"
 
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
 	mp "github.com/ClusterCockpit/cc-lib/messageProcessor"
-	influx "github.com/influxdata/line-protocol/v2/lineprotocol"
 	nats "github.com/nats-io/nats.go"
 )
 
@@ -26,13 +24,20 @@ type NatsReceiverConfig struct {
 	User     string `json:"user,omitempty"`
 	Password string `json:"password,omitempty"`
 	NkeyFile string `json:"nkey_file,omitempty"`
+	// Wire format: 'influx' line protocol (default) or 'msgpack' binary format
+	Format string `json:"format,omitempty"`
+	// Timestamp precision of the line protocol: 's', 'ms', 'us', 'ns' (default) or 'auto'
+	Precision string `json:"precision,omitempty"`
+	// Stop decoding the line protocol of a message at the first bad line instead of skipping bad lines
+	Strict bool `json:"strict,omitempty"`
 }
 
 type NatsReceiver struct {
 	receiver
 	nc *nats.Conn
 	// meta   map[string]string
-	config NatsReceiverConfig
+	config    NatsReceiverConfig
+	precision lp.Precision
 }
 
 // Start subscribes to the configured NATS subject
@@ -40,74 +45,43 @@ type NatsReceiver struct {
 func (r *NatsReceiver) Start() {
 	cclog.ComponentDebug(r.name, "START")
 	r.nc.Subscribe(r.config.Subject, r._NatsReceive)
+	r.startTicker()
 }
 
 // _NatsReceive receives subscribed messages from the NATS server
 func (r *NatsReceiver) _NatsReceive(m *nats.Msg) {
+	if r.sink != nil && r.config.Format == RECEIVER_FORMAT_MSGPACK {
+		msgs, err := lp.FromBinary(m.Data)
+		if err != nil {
+			cclog.ComponentError(r.name, "_NatsReceive:", err.Error())
+			return
+		}
+		for _, y := range msgs {
+			m, err := r.mp.ProcessMessage(y)
+			lp.Release(y)
+			if err == nil && m != nil {
+				r.send(m)
+			}
+		}
+		r.sendPending()
+		return
+	}
 	if r.sink != nil {
-		d := influx.NewDecoderWithBytes(m.Data)
+		d := lp.NewDecoderWithBytes(m.Data)
+		d.SetPrecision(r.precision)
+		d.SetStrict(r.config.Strict)
 		for d.Next() {
-
-			// Decode measurement name
-			measurement, err := d.Measurement()
-			if err != nil {
-				msg := "_NatsReceive: Failed to decode measurement: " + err.Error()
-				cclog.ComponentError(r.name, msg)
-				return
-			}
-
-			// Decode tags
-			tags := make(map[string]string)
-			for {
-				key, value, err := d.NextTag()
-				if err != nil {
-					msg := "_NatsReceive: Failed to decode tag: " + err.Error()
-					cclog.ComponentError(r.name, msg)
-					return
-				}
-				if key == nil {
-					break
-				}
-				tags[string(key)] = string(value)
-			}
-
-			// Decode fields
-			fields := make(map[string]interface{})
-			for {
-				key, value, err := d.NextField()
-				if err != nil {
-					msg := "_NatsReceive: Failed to decode field: " + err.Error()
-					cclog.ComponentError(r.name, msg)
-					return
-				}
-				if key == nil {
-					break
-				}
-				fields[string(key)] = value.Interface()
-			}
-
-			// Decode time stamp
-			t, err := d.Time(influx.Nanosecond, time.Time{})
-			if err != nil {
-				msg := "_NatsReceive: Failed to decode time: " + err.Error()
-				cclog.ComponentError(r.name, msg)
-				return
-			}
-
-			y, err := lp.NewMessage(
-				string(measurement),
-				tags,
-				nil,
-				fields,
-				t,
-			)
-			if err == nil {
-				m, err := r.mp.ProcessMessage(y)
-				if err == nil && m != nil && r.sink != nil {
-					r.sink <- m
-				}
+			y := d.Message()
+			m, err := r.mp.ProcessMessage(y)
+			lp.Release(y)
+			if err == nil && m != nil && r.sink != nil {
+				r.send(m)
 			}
 		}
+		r.sendPending()
+		if errs := d.Errors(); len(errs) > 0 {
+			cclog.ComponentError(r.name, "_NatsReceive: Failed to decode", d.ErrorCount(), "line(s), first error:", errs[0].Error())
+		}
 	}
 }
 
@@ -117,6 +91,7 @@ func (r *NatsReceiver) Close() {
 		cclog.ComponentDebug(r.name, "CLOSE")
 		r.nc.Close()
 	}
+	r.stopTicker()
 }
 
 // NewNatsReceiver creates a new Receiver which subscribes to messages from a NATS server
@@ -140,6 +115,15 @@ func NewNatsReceiver(name string, config json.RawMessage) (Receiver, error) {
 		len(r.config.Subject) == 0 {
 		return nil, errors.New("not all configuration variables set required by NatsReceiver")
 	}
+	format, err := checkFormat(r.config.Format)
+	if err != nil {
+		return nil, err
+	}
+	r.config.Format = format
+	r.precision, err = lp.ParsePrecision(r.config.Precision)
+	if err != nil {
+		return nil, err
+	}
 	p, err := mp.NewMessageProcessor()
 	if err != nil {
 		return nil, fmt.Errorf("initialization of message processor failed: %v", err.Error())
@@ -151,6 +135,7 @@ func NewNatsReceiver(name string, config json.RawMessage) (Receiver, error) {
 			return nil, fmt.Errorf("failed parsing JSON for message processor: %v", err.Error())
 		}
 	}
+	r.validator = r.config.Validate
 
 	// Set metadata
 	// r.meta = map[string]string{
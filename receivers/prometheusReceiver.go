@@ -29,6 +29,8 @@ type PrometheusReceiverConfig struct {
 	SSL      bool   `json:"ssl"`
 }
 
+// PrometheusReceiver scrapes a Prometheus endpoint. It has no message
+// processor, so it ignores process_messages and does not start the ticker.
 type PrometheusReceiver struct {
 	receiver
 	meta     map[string]string
@@ -80,7 +82,7 @@ func (r *PrometheusReceiver) Start() {
 					if err == nil {
 						y, err := lp.NewMessage(name, tags, r.meta, map[string]interface{}{"value": value}, t)
 						if err == nil {
-							r.sink <- y
+							r.send(y)
 						}
 					}
 				}
@@ -117,6 +119,7 @@ func NewPrometheusReceiver(name string, config json.RawMessage) (Receiver, error
 		}
 	}
 	r.meta = map[string]string{"source": r.name}
+	r.validator = r.config.Validate
 	proto := "http"
 	if r.config.SSL {
 		proto = "https"
@@ -39,6 +39,10 @@ func (r *SampleReceiver) Start() {
 
 	// Start server process like http.ListenAndServe()
 
+	// Receivers using the message processor drive its stateful stages
+	// (e.g. aggregate) and forward their messages with the ticker
+	r.startTicker()
+
 	// or use own go routine but always make sure it exits
 	// as soon as it gets the signal of the r.done channel
 	//
@@ -70,6 +74,9 @@ func (r *SampleReceiver) Close() {
 
 	// Close server like http.Shutdown()
 
+	// Stop the ticker of the message processor
+	r.stopTicker()
+
 	// in case of own go routine, send the signal and wait
 	// r.done <- true
 	// r.wg.Wait()
@@ -119,6 +126,9 @@ func NewSampleReceiver(name string, config json.RawMessage) (Receiver, error) {
 		}
 	}
 
+	// Validate messages before sending them with r.send(), if configured
+	r.validator = r.config.Validate
+
 	// Check that all required fields in the configuration are set
 	// Use 'if len(r.config.Option) > 0' for strings
 
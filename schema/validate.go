@@ -5,12 +5,14 @@
 package schema
 
 import (
+	"bytes"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"io"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/ClusterCockpit/cc-backend/pkg/log"
 	"github.com/santhosh-tekuri/jsonschema/v5"
@@ -28,11 +30,14 @@ const (
 //go:embed schemas/*
 var schemaFiles embed.FS
 
-func Validate(k Kind, r io.Reader) (err error) {
+func init() {
 	jsonschema.Loaders["embedfs"] = func(s string) (io.ReadCloser, error) {
 		f := filepath.Join("schemas", strings.Split(s, "//")[1])
 		return schemaFiles.Open(f)
 	}
+}
+
+func Validate(k Kind, r io.Reader) (err error) {
 	var s *jsonschema.Schema
 
 	switch k {
@@ -65,3 +70,68 @@ func Validate(k Kind, r io.Reader) (err error) {
 
 	return nil
 }
+
+// Compiled job meta schemas for ValidateJobMeta by list of required properties
+var jobMetaSchemas sync.Map
+
+// ValidateJobMeta validates job meta data like Validate(Meta, r), but only
+// the given properties are required and the job state may also be
+// "running". It is used for meta data of jobs that are not finished yet.
+func ValidateJobMeta(r io.Reader, required []string) error {
+	key := strings.Join(required, ",")
+	s, ok := jobMetaSchemas.Load(key)
+	if !ok {
+		compiled, err := compileJobMeta(required)
+		if err != nil {
+			log.Errorf("Error while compiling json schema for job meta data: %v", err)
+			return err
+		}
+		s, _ = jobMetaSchemas.LoadOrStore(key, compiled)
+	}
+
+	var v interface{}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		log.Warnf("Error while decoding raw json schema: %#v", err)
+		return err
+	}
+
+	if err := s.(*jsonschema.Schema).Validate(v); err != nil {
+		return fmt.Errorf("SCHEMA/VALIDATE > %#v", err)
+	}
+
+	return nil
+}
+
+// compileJobMeta compiles a variant of the job meta schema with the given
+// required properties
+func compileJobMeta(required []string) (*jsonschema.Schema, error) {
+	raw, err := schemaFiles.ReadFile("schemas/job-meta.schema.json")
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("embedfs://job-meta.schema.json?required=%s", strings.Join(required, ","))
+	doc["$id"] = url
+	doc["required"] = required
+	if props, ok := doc["properties"].(map[string]interface{}); ok {
+		if state, ok := props["jobState"].(map[string]interface{}); ok {
+			if enum, ok := state["enum"].([]interface{}); ok {
+				state["enum"] = append(enum, string(JobStateRunning))
+			}
+		}
+	}
+	raw, err = json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource(url, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return c.Compile(url)
+}
@@ -36,6 +36,26 @@ func TestValidateJobMeta(t *testing.T) {
 
 }
 
+func TestValidateJobMetaRunning(t *testing.T) {
+	json := []byte(`{
+		"jobId": 123,
+		"cluster": "testcluster",
+		"startTime": 1719057119,
+		"jobState": "running"
+	}`)
+
+	required := []string{"jobId", "cluster", "startTime"}
+	if err := ValidateJobMeta(bytes.NewReader(json), required); err != nil {
+		t.Errorf("Error is not nil! %v", err)
+	}
+	if err := ValidateJobMeta(bytes.NewReader(json), append(required, "duration")); err == nil {
+		t.Error("Expected error for missing duration")
+	}
+	if err := Validate(Meta, bytes.NewReader(json)); err == nil {
+		t.Error("Expected error for incomplete job meta data")
+	}
+}
+
 func TestValidateCluster(t *testing.T) {
 	json := []byte(`{
 		"name": "emmy",
@@ -10,8 +10,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
-	//	"time"
 	"os/exec"
 
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
@@ -42,56 +42,67 @@ type GangliaSink struct {
 	config         GangliaSinkConfig
 }
 
-func (s *GangliaSink) Write(msg lp.CCMessage) error {
-	var err error = nil
-	// var tagsstr []string
-	var argstr []string
-
+func (s *GangliaSink) Write(msg lp.CCMessageView) error {
 	point, err := s.mp.ProcessMessage(msg)
 	if err == nil && point != nil {
-		// Get metric config (type, value, ... in suitable format)
-		conf := GetCommonGangliaConfig(point)
-		if len(conf.Type) == 0 {
-			conf = GetGangliaConfig(point)
-		}
-		if len(conf.Type) == 0 {
-			return fmt.Errorf("metric %q (Ganglia name %q) has no 'value' field", point.Name(), conf.Name)
-		}
+		err = s.write(point)
+	}
+	return errors.Join(err, writeMessages(s.mp.PendingMessages(), s.write))
+}
 
-		if s.config.AddGangliaGroup {
-			argstr = append(argstr, fmt.Sprintf("--group=%s", conf.Group))
-		}
-		if s.config.AddUnits && len(conf.Unit) > 0 {
-			argstr = append(argstr, fmt.Sprintf("--units=%s", conf.Unit))
-		}
+// write submits the processed message with gmetric
+func (s *GangliaSink) write(point lp.CCMessage) error {
+	// var tagsstr []string
+	var argstr []string
 
-		if len(s.config.ClusterName) > 0 {
-			argstr = append(argstr, fmt.Sprintf("--cluster=%s", s.config.ClusterName))
-		}
-		// if s.config.AddTagsAsDesc && len(tagsstr) > 0 {
-		// 	argstr = append(argstr, fmt.Sprintf("--desc=%q", strings.Join(tagsstr, ",")))
-		// }
-		if len(s.gmetric_config) > 0 {
-			argstr = append(argstr, fmt.Sprintf("--conf=%s", s.gmetric_config))
-		}
-		if s.config.AddTypeToName {
-			argstr = append(argstr, fmt.Sprintf("--name=%s", GangliaMetricName(point)))
-		} else {
-			argstr = append(argstr, fmt.Sprintf("--name=%s", conf.Name))
-		}
-		argstr = append(argstr, fmt.Sprintf("--slope=%s", conf.Slope))
-		argstr = append(argstr, fmt.Sprintf("--value=%s", conf.Value))
-		argstr = append(argstr, fmt.Sprintf("--type=%s", conf.Type))
-		argstr = append(argstr, fmt.Sprintf("--tmax=%d", conf.Tmax))
+	// Get metric config (type, value, ... in suitable format)
+	conf := GetCommonGangliaConfig(point)
+	if len(conf.Type) == 0 {
+		conf = GetGangliaConfig(point)
+	}
+	if len(conf.Type) == 0 {
+		return fmt.Errorf("metric %q (Ganglia name %q) has no 'value' field", point.Name(), conf.Name)
+	}
 
-		cclog.ComponentDebug(s.name, s.gmetric_path, strings.Join(argstr, " "))
-		command := exec.Command(s.gmetric_path, argstr...)
-		command.Wait()
-		_, err = command.Output()
+	if s.config.AddGangliaGroup {
+		argstr = append(argstr, fmt.Sprintf("--group=%s", conf.Group))
+	}
+	if s.config.AddUnits && len(conf.Unit) > 0 {
+		argstr = append(argstr, fmt.Sprintf("--units=%s", conf.Unit))
 	}
+
+	if len(s.config.ClusterName) > 0 {
+		argstr = append(argstr, fmt.Sprintf("--cluster=%s", s.config.ClusterName))
+	}
+	// if s.config.AddTagsAsDesc && len(tagsstr) > 0 {
+	// 	argstr = append(argstr, fmt.Sprintf("--desc=%q", strings.Join(tagsstr, ",")))
+	// }
+	if len(s.gmetric_config) > 0 {
+		argstr = append(argstr, fmt.Sprintf("--conf=%s", s.gmetric_config))
+	}
+	if s.config.AddTypeToName {
+		argstr = append(argstr, fmt.Sprintf("--name=%s", GangliaMetricName(point)))
+	} else {
+		argstr = append(argstr, fmt.Sprintf("--name=%s", conf.Name))
+	}
+	argstr = append(argstr, fmt.Sprintf("--slope=%s", conf.Slope))
+	argstr = append(argstr, fmt.Sprintf("--value=%s", conf.Value))
+	argstr = append(argstr, fmt.Sprintf("--type=%s", conf.Type))
+	argstr = append(argstr, fmt.Sprintf("--tmax=%d", conf.Tmax))
+
+	cclog.ComponentDebug(s.name, s.gmetric_path, strings.Join(argstr, " "))
+	command := exec.Command(s.gmetric_path, argstr...)
+	command.Wait()
+	_, err := command.Output()
 	return err
 }
 
+// tick submits the messages generated by the message processor
+func (s *GangliaSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	return writeMessages(s.mp.PendingMessages(), s.write)
+}
+
 func (s *GangliaSink) Flush() error {
 	return nil
 }
@@ -53,13 +53,16 @@ type HttpSinkConfig struct {
 
 	// Timestamp precision
 	Precision string `json:"precision,omitempty"`
+
+	// Wire format: 'influx' line protocol (default) or 'msgpack' binary format
+	Format string `json:"format,omitempty"`
 }
 
 type HttpSink struct {
 	sink
 	client *http.Client
-	// influx line protocol encoder
-	encoder influx.Encoder
+	// influx line protocol or msgpack encoder
+	encoder messageEncoder
 
 	// Flush() runs in another goroutine and accesses the influx line protocol encoder,
 	// so this encoderLock has to protect the encoder
@@ -70,18 +73,21 @@ type HttpSink struct {
 	// Lock to assure that only one timer is running at a time
 	timerLock sync.Mutex
 
+	// processed messages in WriteBatch()
+	batch lp.Batch
+
 	config HttpSinkConfig
 }
 
 // Write sends metric m as http message
-func (s *HttpSink) Write(msg lp.CCMessage) error {
+func (s *HttpSink) Write(msg lp.CCMessageView) error {
 	// submit m only after applying processing/dropping rules
 	m, err := s.mp.ProcessMessage(msg)
 	if err == nil && m != nil {
 		// Lock for encoder usage
 		s.encoderLock.Lock()
 
-		err = EncoderAdd(&s.encoder, m)
+		err = s.encoder.Add(m)
 
 		// Unlock encoder usage
 		s.encoderLock.Unlock()
@@ -92,6 +98,79 @@ func (s *HttpSink) Write(msg lp.CCMessage) error {
 		}
 	}
 
+	// Add the messages generated by the message processor
+	if _, err := s.addPending(); err != nil {
+		return err
+	}
+
+	return s.flushOrStartTimer()
+}
+
+// addPending adds the messages generated by stateful stages of the message
+// processor, like aggregations, to the encoder and returns their number
+func (s *HttpSink) addPending() (int, error) {
+	pending := s.mp.PendingMessages()
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	// Lock for encoder usage
+	s.encoderLock.Lock()
+	err := writeMessages(pending, s.encoder.Add)
+	// Unlock encoder usage
+	s.encoderLock.Unlock()
+
+	// Check that encoding worked
+	if err != nil {
+		return len(pending), fmt.Errorf("encoding failed: %v", err)
+	}
+	return len(pending), nil
+}
+
+// tick sends the messages generated by the message processor
+func (s *HttpSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	n, err := s.addPending()
+	if n == 0 || err != nil {
+		return err
+	}
+	return s.flushOrStartTimer()
+}
+
+// WriteBatch sends all messages of the batch as http message
+func (s *HttpSink) WriteBatch(batch *lp.Batch) error {
+	// submit only messages after applying processing/dropping rules
+	s.batch.Reset()
+	for _, msg := range batch.All() {
+		m, err := s.mp.ProcessMessage(msg)
+		if err == nil && m != nil {
+			s.batch.Add(m)
+			lp.Release(m)
+		}
+	}
+	// Add the messages generated by the message processor
+	for _, m := range s.mp.PendingMessages() {
+		s.batch.Add(m)
+		lp.Release(m)
+	}
+
+	// Lock for encoder usage
+	s.encoderLock.Lock()
+	err := s.encoder.AddBatch(&s.batch)
+	// Unlock encoder usage
+	s.encoderLock.Unlock()
+
+	// Check that encoding worked
+	if err != nil {
+		return fmt.Errorf("encoding failed: %v", err)
+	}
+
+	return s.flushOrStartTimer()
+}
+
+// flushOrStartTimer flushes directly if no flush delay is configured,
+// otherwise it starts the flush timer
+func (s *HttpSink) flushOrStartTimer() error {
 	if s.config.flushDelay == 0 {
 		// Directly flush if no flush delay is configured
 		return s.Flush()
@@ -149,6 +228,8 @@ func (s *HttpSink) Flush() error {
 			return err
 		}
 
+		req.Header.Set("Content-Type", s.encoder.ContentType())
+
 		// Set authorization header
 		if len(s.config.JWT) != 0 {
 			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.config.JWT))
@@ -299,8 +380,11 @@ func NewHttpSink(name string, config json.RawMessage) (Sink, error) {
 		Timeout: s.config.timeout,
 	}
 
-	// Configure influx line protocol encoder
+	// Configure influx line protocol or msgpack encoder
 	s.encoder.SetPrecision(precision)
+	if err := s.encoder.SetFormat(s.config.Format); err != nil {
+		return nil, err
+	}
 
 	return s, nil
 }
@@ -134,7 +134,7 @@ func (s *InfluxAsyncSink) connect() error {
 	return nil
 }
 
-func (s *InfluxAsyncSink) Write(m lp.CCMessage) error {
+func (s *InfluxAsyncSink) Write(m lp.CCMessageView) error {
 	if s.customFlushInterval != 0 && s.flushTimer == nil {
 		// Run a batched flush for all lines that have arrived in the defined interval
 		s.flushTimer = time.AfterFunc(s.customFlushInterval, func() {
@@ -145,11 +145,23 @@ func (s *InfluxAsyncSink) Write(m lp.CCMessage) error {
 	}
 	msg, err := s.mp.ProcessMessage(m)
 	if err == nil && msg != nil {
-		s.writeApi.WritePoint(msg.ToPoint(nil))
+		s.write(msg)
 	}
+	return writeMessages(s.mp.PendingMessages(), s.write)
+}
+
+// write passes the processed message to the asynchronous write API
+func (s *InfluxAsyncSink) write(msg lp.CCMessage) error {
+	s.writeApi.WritePoint(msg.ToPoint(nil))
 	return nil
 }
 
+// tick writes the messages generated by the message processor
+func (s *InfluxAsyncSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	return writeMessages(s.mp.PendingMessages(), s.write)
+}
+
 func (s *InfluxAsyncSink) Flush() error {
 	cclog.ComponentDebug(s.name, "Flushing")
 	s.writeApi.Flush()
@@ -243,84 +243,127 @@ func (s *InfluxSink) connect() error {
 }
 
 // Write sends metric m in influxDB line protocol
-func (s *InfluxSink) Write(msg lp.CCMessage) error {
+func (s *InfluxSink) Write(msg lp.CCMessageView) error {
 	m, err := s.mp.ProcessMessage(msg)
+
+	// Lock for encoder usage
+	s.encoderLock.Lock()
+
 	if err == nil && m != nil {
-		// Lock for encoder usage
-		s.encoderLock.Lock()
-
-		// Encode measurement name
-		s.encoder.StartLine(m.Name())
-
-		// copy tags and meta data which should be used as tags
-		s.extended_tag_list = s.extended_tag_list[:0]
-		for key, value := range m.Tags() {
-			s.extended_tag_list = append(
-				s.extended_tag_list,
-				key_value_pair{
-					key:   key,
-					value: value,
-				},
-			)
+		if err := s.encode(m); err != nil {
+			// Unlock encoder usage
+			s.encoderLock.Unlock()
+			return err
 		}
-		// for _, key := range s.config.MetaAsTags {
-		// 	if value, ok := m.GetMeta(key); ok {
-		// 		s.extended_tag_list =
-		// 			append(
-		// 				s.extended_tag_list,
-		// 				key_value_pair{
-		// 					key:   key,
-		// 					value: value,
-		// 				},
-		// 			)
-		// 	}
-		// }
-
-		// Encode tags (they musts be in lexical order)
-		slices.SortFunc(
+	}
+
+	// Encode the messages generated by the message processor
+	if err := writeMessages(s.mp.PendingMessages(), s.encode); err != nil {
+		// Unlock encoder usage
+		s.encoderLock.Unlock()
+		return err
+	}
+
+	return s.flushOrStartTimer()
+}
+
+// tick sends the messages generated by the message processor
+func (s *InfluxSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	pending := s.mp.PendingMessages()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Lock for encoder usage
+	s.encoderLock.Lock()
+
+	if err := writeMessages(pending, s.encode); err != nil {
+		// Unlock encoder usage
+		s.encoderLock.Unlock()
+		return err
+	}
+
+	return s.flushOrStartTimer()
+}
+
+// encode adds the processed message m to the encoder.
+// The caller has to hold the encoder lock.
+func (s *InfluxSink) encode(m lp.CCMessage) error {
+	// Encode measurement name
+	s.encoder.StartLine(m.Name())
+
+	// copy tags and meta data which should be used as tags
+	s.extended_tag_list = s.extended_tag_list[:0]
+	for key, value := range m.AllTags() {
+		s.extended_tag_list = append(
 			s.extended_tag_list,
-			func(a key_value_pair, b key_value_pair) int {
-				if a.key < b.key {
-					return -1
-				}
-				if a.key > b.key {
-					return +1
-				}
-				return 0
+			key_value_pair{
+				key:   key,
+				value: value,
 			},
 		)
-		for i := range s.extended_tag_list {
-			s.encoder.AddTag(
-				s.extended_tag_list[i].key,
-				s.extended_tag_list[i].value,
-			)
-		}
-
-		// Encode fields
-		for key, value := range m.Fields() {
-			s.encoder.AddField(key, influx.MustNewValue(value))
-		}
+	}
+	// for _, key := range s.config.MetaAsTags {
+	// 	if value, ok := m.GetMeta(key); ok {
+	// 		s.extended_tag_list =
+	// 			append(
+	// 				s.extended_tag_list,
+	// 				key_value_pair{
+	// 					key:   key,
+	// 					value: value,
+	// 				},
+	// 			)
+	// 	}
+	// }
+
+	// Encode tags (they musts be in lexical order)
+	slices.SortFunc(
+		s.extended_tag_list,
+		func(a key_value_pair, b key_value_pair) int {
+			if a.key < b.key {
+				return -1
+			}
+			if a.key > b.key {
+				return +1
+			}
+			return 0
+		},
+	)
+	for i := range s.extended_tag_list {
+		s.encoder.AddTag(
+			s.extended_tag_list[i].key,
+			s.extended_tag_list[i].value,
+		)
+	}
 
-		// Encode time stamp
-		s.encoder.EndLine(m.Time())
+	// Encode fields
+	for key, value := range m.AllFields() {
+		s.encoder.AddField(key, influx.MustNewValue(value))
+	}
 
-		// Check for encoder errors
-		if err := s.encoder.Err(); err != nil {
-			// Unlock encoder usage
-			s.encoderLock.Unlock()
+	// Encode time stamp
+	s.encoder.EndLine(m.Time())
 
-			return fmt.Errorf("encoding failed: %v", err)
-		}
-		s.numRecordsInEncoder++
+	// Check for encoder errors
+	if err := s.encoder.Err(); err != nil {
+		return fmt.Errorf("encoding failed: %v", err)
 	}
+	s.numRecordsInEncoder++
+	return nil
+}
 
+// flushOrStartTimer flushes directly if no flush delay is configured or the
+// batch size is reached, otherwise it starts the flush timer.
+// The caller has to hold the encoder lock, which is released.
+func (s *InfluxSink) flushOrStartTimer() error {
 	if s.config.flushDelay == 0 {
 		// Unlock encoder usage
 		s.encoderLock.Unlock()
 
 		// Directly flush if no flush delay is configured
 		return s.Flush()
-	} else if s.numRecordsInEncoder == s.config.BatchSize {
+	} else if s.numRecordsInEncoder >= s.config.BatchSize {
 		// Unlock encoder usage
 		s.encoderLock.Unlock()
 
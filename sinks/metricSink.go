@@ -6,6 +6,8 @@ package sinks
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
 	mp "github.com/ClusterCockpit/cc-lib/messageProcessor"
@@ -30,6 +32,105 @@ func (s *sink) Name() string {
 	return s.name
 }
 
+// writeMessages passes the messages to write, which writes a processed
+// message to the sink. It is used for the messages generated by the stateful
+// stages of the message processor, like aggregations, see PendingMessages.
+func writeMessages(messages []lp.CCMessage, write func(m lp.CCMessage) error) error {
+	var errs []error
+	for _, m := range messages {
+		if err := write(m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Wire formats for sinks sending encoded messages
+const (
+	SINK_FORMAT_INFLUX  = "influx"  // InfluxDB line protocol
+	SINK_FORMAT_MSGPACK = "msgpack" // binary CCMessage format, see ccMessage.ToBinary
+)
+
+// messageEncoder collects encoded messages in the configured wire format
+type messageEncoder struct {
+	format  string
+	influx  influx.Encoder
+	msgpack []byte
+}
+
+// SetFormat selects the wire format. An empty format selects the InfluxDB line protocol
+func (e *messageEncoder) SetFormat(format string) error {
+	switch format {
+	case "", SINK_FORMAT_INFLUX:
+		e.format = SINK_FORMAT_INFLUX
+	case SINK_FORMAT_MSGPACK:
+		e.format = SINK_FORMAT_MSGPACK
+	default:
+		return fmt.Errorf("unknown format '%s'", format)
+	}
+	return nil
+}
+
+// SetPrecision sets the timestamp precision of the InfluxDB line protocol
+func (e *messageEncoder) SetPrecision(precision influx.Precision) {
+	e.influx.SetPrecision(precision)
+}
+
+// Add encodes the message and appends it to the buffer
+func (e *messageEncoder) Add(msg lp.CCMessage) error {
+	if e.format == SINK_FORMAT_MSGPACK {
+		buf, err := lp.AppendBinary(e.msgpack, msg)
+		if err != nil {
+			return err
+		}
+		e.msgpack = buf
+		return nil
+	}
+	return EncoderAdd(&e.influx, msg)
+}
+
+// AddBatch encodes all messages of the batch and appends them to the buffer
+func (e *messageEncoder) AddBatch(batch *lp.Batch) error {
+	if e.format == SINK_FORMAT_MSGPACK {
+		for _, msg := range batch.All() {
+			buf, err := lp.AppendBinary(e.msgpack, msg)
+			if err != nil {
+				return err
+			}
+			e.msgpack = buf
+		}
+		return nil
+	}
+	err := batch.EncodeLineProtocol(&e.influx)
+	if err != nil {
+		// The encoder skipped the bad lines, continue with the next batch
+		e.influx.ClearErr()
+	}
+	return err
+}
+
+// Bytes returns the encoded messages
+func (e *messageEncoder) Bytes() []byte {
+	if e.format == SINK_FORMAT_MSGPACK {
+		return e.msgpack
+	}
+	return e.influx.Bytes()
+}
+
+// Reset clears the buffer
+func (e *messageEncoder) Reset() {
+	e.msgpack = e.msgpack[:0]
+	e.influx.Reset()
+}
+
+// ContentType returns the MIME type of the wire format
+func (e *messageEncoder) ContentType() string {
+	if e.format == SINK_FORMAT_MSGPACK {
+		return "application/msgpack"
+	}
+	return "text/plain; charset=utf-8"
+}
+
 type key_value_pair struct {
 	key   string
 	value string
@@ -42,7 +143,7 @@ func EncoderAdd(encoder *influx.Encoder, msg lp.CCMessage) error {
 	tag_list := make([]key_value_pair, 0, 10)
 
 	// copy tags and meta data which should be used as tags
-	for key, value := range msg.Tags() {
+	for key, value := range msg.AllTags() {
 		tag_list = append(
 			tag_list,
 			key_value_pair{
@@ -72,7 +173,7 @@ func EncoderAdd(encoder *influx.Encoder, msg lp.CCMessage) error {
 	}
 
 	// Encode fields
-	for key, value := range msg.Fields() {
+	for key, value := range msg.AllFields() {
 		encoder.AddField(key, influx.MustNewValue(value))
 	}
 
@@ -33,17 +33,22 @@ type NatsSinkConfig struct {
 	NkeyFile   string `json:"nkey_file,omitempty"`
 	// Timestamp precision
 	Precision string `json:"precision,omitempty"`
+
+	// Wire format: 'influx' line protocol (default) or 'msgpack' binary format
+	Format string `json:"format,omitempty"`
 }
 
 type NatsSink struct {
 	sink
 	client      *nats.Conn
-	encoder     influx.Encoder
+	encoder     messageEncoder
 	encoderLock sync.Mutex
 	config      NatsSinkConfig
 
 	flushTimer *time.Timer
 	timerLock  sync.Mutex
+
+	batch lp.Batch // processed messages in WriteBatch()
 }
 
 func (s *NatsSink) connect() error {
@@ -76,14 +81,14 @@ func (s *NatsSink) connect() error {
 	return nil
 }
 
-func (s *NatsSink) Write(m lp.CCMessage) error {
+func (s *NatsSink) Write(m lp.CCMessageView) error {
 	msg, err := s.mp.ProcessMessage(m)
 	if err == nil && msg != nil {
 		// Lock for encoder usage
 		s.encoderLock.Lock()
 
 		// Add message to encoder
-		err = EncoderAdd(&s.encoder, m)
+		err = s.encoder.Add(msg)
 
 		// Unlock encoder usage
 		s.encoderLock.Unlock()
@@ -95,6 +100,77 @@ func (s *NatsSink) Write(m lp.CCMessage) error {
 		}
 	}
 
+	// Add the messages generated by the message processor
+	if _, err := s.addPending(); err != nil {
+		cclog.ComponentError(s.name, "Write:", err.Error())
+		return err
+	}
+
+	return s.flushOrStartTimer()
+}
+
+// addPending adds the messages generated by stateful stages of the message
+// processor, like aggregations, to the encoder and returns their number
+func (s *NatsSink) addPending() (int, error) {
+	pending := s.mp.PendingMessages()
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	// Lock for encoder usage
+	s.encoderLock.Lock()
+	err := writeMessages(pending, s.encoder.Add)
+	// Unlock encoder usage
+	s.encoderLock.Unlock()
+
+	return len(pending), err
+}
+
+// tick publishes the messages generated by the message processor
+func (s *NatsSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	n, err := s.addPending()
+	if n == 0 || err != nil {
+		return err
+	}
+	return s.flushOrStartTimer()
+}
+
+// WriteBatch publishes all messages of the batch to the NATS server
+func (s *NatsSink) WriteBatch(batch *lp.Batch) error {
+	// submit only messages after applying processing/dropping rules
+	s.batch.Reset()
+	for _, msg := range batch.All() {
+		m, err := s.mp.ProcessMessage(msg)
+		if err == nil && m != nil {
+			s.batch.Add(m)
+			lp.Release(m)
+		}
+	}
+	// Add the messages generated by the message processor
+	for _, m := range s.mp.PendingMessages() {
+		s.batch.Add(m)
+		lp.Release(m)
+	}
+
+	// Lock for encoder usage
+	s.encoderLock.Lock()
+	err := s.encoder.AddBatch(&s.batch)
+	// Unlock encoder usage
+	s.encoderLock.Unlock()
+
+	// Check that encoding worked
+	if err != nil {
+		cclog.ComponentError(s.name, "WriteBatch:", err.Error())
+		return err
+	}
+
+	return s.flushOrStartTimer()
+}
+
+// flushOrStartTimer flushes directly if no flush delay is configured,
+// otherwise it starts the flush timer
+func (s *NatsSink) flushOrStartTimer() error {
 	if s.config.flushDelay == 0 {
 		// Directly flush if no flush delay is configured
 		return s.Flush()
@@ -212,6 +288,9 @@ func NewNatsSink(name string, config json.RawMessage) (Sink, error) {
 	}
 
 	s.encoder.SetPrecision(precision)
+	if err := s.encoder.SetFormat(s.config.Format); err != nil {
+		return nil, err
+	}
 	// Setup infos for connection
 	if err := s.connect(); err != nil {
 		return nil, fmt.Errorf("unable to connect: %v", err)
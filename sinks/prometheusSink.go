@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
@@ -38,6 +39,7 @@ type PrometheusSink struct {
 	config       PrometheusSinkConfig
 	labelMetrics map[string]*prometheus.GaugeVec
 	nodeMetrics  map[string]prometheus.Gauge
+	histograms   map[string]*histogramCollector
 	promWg       sync.WaitGroup
 	promServer   *http.Server
 }
@@ -86,6 +88,75 @@ func getLabelNames(metric lp.CCMessage) []string {
 	return labelNames
 }
 
+// histogramCollector exports the latest histogram of each label combination
+// of a histogram metric as classic Prometheus histogram. Native histograms
+// need exponential buckets, which histogram messages do not have.
+type histogramCollector struct {
+	desc   *prometheus.Desc
+	lock   sync.Mutex
+	series map[string]histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	hist        lp.Histogram
+}
+
+func (c *histogramCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *histogramCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, h := range c.series {
+		buckets := make(map[float64]uint64, len(h.hist.Buckets))
+		for i, b := range h.hist.Buckets {
+			buckets[b] = h.hist.Counts[i]
+		}
+		m, err := prometheus.NewConstHistogram(c.desc, h.hist.Count, h.hist.Sum, buckets, h.labelValues...)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.desc, err)
+			continue
+		}
+		ch <- m
+	}
+}
+
+func (s *PrometheusSink) updateHistogram(metric lp.CCMessage) error {
+	name := metric.Name()
+	hist, err := metric.GetHistogram()
+	if err != nil {
+		return fmt.Errorf("histogram %s: %v", name, err.Error())
+	}
+	labels := getLabelNames(metric)
+	labelValues := getLabelValue(metric)
+	if len(labels) != len(labelValues) {
+		return fmt.Errorf("cannot detect metric labels for metric %s", name)
+	}
+
+	c, ok := s.histograms[name]
+	if !ok {
+		namespace := ""
+		if s.config.GroupAsNameSpace && metric.HasMeta("group") {
+			g, _ := metric.GetMeta("group")
+			namespace = strings.ToLower(g)
+		}
+		c = &histogramCollector{
+			desc:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), "", labels, nil),
+			series: make(map[string]histogramSeries),
+		}
+		if err := prometheus.Register(c); err != nil {
+			return fmt.Errorf("cannot register histogram %s: %v", name, err.Error())
+		}
+		s.histograms[name] = c
+	}
+	c.lock.Lock()
+	c.series[strings.Join(labelValues, ",")] = histogramSeries{labelValues: labelValues, hist: hist}
+	c.lock.Unlock()
+	return nil
+}
+
 func (s *PrometheusSink) newMetric(metric lp.CCMessage) error {
 	var value float64 = 0
 	name := metric.Name()
@@ -125,6 +196,9 @@ func (s *PrometheusSink) newMetric(metric lp.CCMessage) error {
 }
 
 func (s *PrometheusSink) updateMetric(metric lp.CCMessage) error {
+	if metric.IsHistogram() {
+		return s.updateHistogram(metric)
+	}
 	value := 0.0
 	name := metric.Name()
 	labelValues := getLabelValue(metric)
@@ -146,7 +220,7 @@ func (s *PrometheusSink) updateMetric(metric lp.CCMessage) error {
 		}
 		s.labelMetrics[name].WithLabelValues(labelValues...).Set(value)
 	} else {
-		if _, ok := s.labelMetrics[name]; !ok {
+		if _, ok := s.nodeMetrics[name]; !ok {
 			err := s.newMetric(metric)
 			if err != nil {
 				return err
@@ -157,12 +231,18 @@ func (s *PrometheusSink) updateMetric(metric lp.CCMessage) error {
 	return nil
 }
 
-func (s *PrometheusSink) Write(m lp.CCMessage) error {
+func (s *PrometheusSink) Write(m lp.CCMessageView) error {
 	msg, err := s.mp.ProcessMessage(m)
 	if err == nil && msg != nil {
-		err = s.updateMetric(m)
+		err = s.updateMetric(msg)
 	}
-	return err
+	return errors.Join(err, writeMessages(s.mp.PendingMessages(), s.updateMetric))
+}
+
+// tick updates the metrics with the messages generated by the message processor
+func (s *PrometheusSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	return writeMessages(s.mp.PendingMessages(), s.updateMetric)
 }
 
 func (s *PrometheusSink) Flush() error {
@@ -207,6 +287,7 @@ func NewPrometheusSink(name string, config json.RawMessage) (Sink, error) {
 	}
 	s.labelMetrics = make(map[string]*prometheus.GaugeVec)
 	s.nodeMetrics = make(map[string]prometheus.Gauge)
+	s.histograms = make(map[string]*histogramCollector)
 	s.promWg.Add(1)
 	go func() {
 		router := mux.NewRouter()
@@ -0,0 +1,48 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package sinks
+
+import (
+	"testing"
+	"time"
+
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrometheusSinkNodeMetric(t *testing.T) {
+	s := &PrometheusSink{
+		labelMetrics: make(map[string]*prometheus.GaugeVec),
+		nodeMetrics:  make(map[string]prometheus.Gauge),
+		histograms:   make(map[string]*histogramCollector),
+	}
+	// Metrics without labels are exported as gauge, which is updated by
+	// the following messages
+	const name = "test_prometheus_sink_node_metric"
+	for _, v := range []float64{1, 2} {
+		m, _ := lp.NewMetric(name, map[string]string{"hostname": "h1"}, nil, v, time.Now())
+		if err := s.updateMetric(m); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		if len(f.GetMetric()) != 1 {
+			t.Fatalf("expected 1 exported metric, got %d", len(f.GetMetric()))
+		}
+		if v := f.GetMetric()[0].GetGauge().GetValue(); v != 2 {
+			t.Errorf("expected exported value 2, got %v", v)
+		}
+		return
+	}
+	t.Errorf("metric %s not exported", name)
+}
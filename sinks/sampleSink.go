@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
@@ -33,17 +34,32 @@ type SampleSink struct {
 // See: metricSink.go
 
 // Code to submit a single CCMetric to the sink
-func (s *SampleSink) Write(point lp.CCMessage) error {
+func (s *SampleSink) Write(point lp.CCMessageView) error {
 	// based on s.meta_as_tags use meta infos as tags
 	// moreover, submit the point to the message processor
 	// to apply drop/modify rules
 	msg, err := s.mp.ProcessMessage(point)
 	if err == nil && msg != nil {
-		log.Print(msg)
+		s.write(msg)
 	}
+	// Write the messages generated by the message processor, like
+	// aggregations or split multi-field messages
+	return writeMessages(s.mp.PendingMessages(), s.write)
+}
+
+// Code to submit a single processed CCMetric to the sink
+func (s *SampleSink) write(msg lp.CCMessage) error {
+	log.Print(msg)
 	return nil
 }
 
+// Called periodically by the sink manager. The message processor closes
+// the time windows of aggregations etc. and the generated messages are written
+func (s *SampleSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	return writeMessages(s.mp.PendingMessages(), s.write)
+}
+
 // If the sink uses batched sends internally, you can tell to flush its buffers
 func (s *SampleSink) Flush() error {
 	return nil
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
@@ -15,11 +16,30 @@ import (
 
 const SINK_MAX_FORWARD = 50
 
+// Interval in which the sink manager passes the current time to the message
+// processors of the sinks, see tickSink
+const SINK_TICK_INTERVAL = time.Second
+
 type Sink interface {
-	Write(point lp.CCMessage) error // Write metric to the sink
-	Flush() error                   // Flush buffered metrics
-	Close()                         // Close / finish metric sink
-	Name() string                   // Name of the metric sink
+	Write(point lp.CCMessageView) error // Write metric to the sink
+	Flush() error                       // Flush buffered metrics
+	Close()                             // Close / finish metric sink
+	Name() string                       // Name of the metric sink
+}
+
+// BatchSink is implemented by sinks that can write many messages at once.
+// The sink manager uses WriteBatch() instead of Write() for such sinks.
+type BatchSink interface {
+	Sink
+	WriteBatch(batch *lp.Batch) error // Write all metrics of the batch to the sink
+}
+
+// tickSink is implemented by sinks with a message processor. The sink manager
+// calls tick periodically with the current time. The sink passes it to the
+// message processor, which closes the time windows of aggregations and emits
+// the statistics, and writes the generated messages.
+type tickSink interface {
+	tick(now time.Time) error
 }
 
 // Sink manager access functions
@@ -27,6 +47,7 @@ type SinkManager interface {
 	Init(wg *sync.WaitGroup, sinkConfig json.RawMessage) error
 	AddInput(input chan lp.CCMessage)
 	AddOutput(name string, config json.RawMessage) error
+	SetValidator(v *lp.Validator)
 	Start()
 	Close()
 }
@@ -49,6 +70,8 @@ type sinkManager struct {
 	wg         *sync.WaitGroup   // wait group for all goroutines in cc-metric-collector
 	sinks      map[string]Sink   // Mapping sink name to sink
 	maxForward int               // number of metrics to write maximally in one iteration
+	batch      *lp.Batch         // metrics of one iteration for batch sinks
+	validator  *lp.Validator     // validation of metrics before writing, nil if disabled
 }
 
 // Init initializes the sink manager by:
@@ -60,6 +83,7 @@ func (sm *sinkManager) Init(wg *sync.WaitGroup, sinkConfig json.RawMessage) erro
 	sm.wg = wg
 	sm.sinks = make(map[string]Sink, 0)
 	sm.maxForward = SINK_MAX_FORWARD
+	sm.batch = lp.NewBatch(SINK_MAX_FORWARD + 1)
 
 	// Parse config
 	var rawConfigs map[string]json.RawMessage
@@ -104,28 +128,80 @@ func (sm *sinkManager) Start() {
 			cclog.ComponentDebug("SinkManager", "DONE")
 		}
 
+		// Collect metrics in a batch only if there are batch sinks
+		batchSinks := 0
+		for _, s := range sm.sinks {
+			if _, ok := s.(BatchSink); ok {
+				batchSinks++
+			}
+		}
+
 		toTheSinks := func(p lp.CCMessage) {
-			// Send received metric to all outputs
+			if err := sm.validator.Check(p); err != nil {
+				cclog.ComponentDebug("SinkManager", "invalid message", p.String()+":", err.Error())
+				if sm.validator.Reject {
+					return
+				}
+			}
+			// Send received metric to all outputs. The sinks share the
+			// message, so they only get read access to it
 			cclog.ComponentDebug("SinkManager", "WRITE", p)
+			view := lp.ReadOnly(p)
 			for _, s := range sm.sinks {
-				if err := s.Write(p); err != nil {
+				if _, ok := s.(BatchSink); ok {
+					continue
+				}
+				if err := s.Write(view); err != nil {
 					cclog.ComponentError("SinkManager", "WRITE", s.Name(), "write failed:", err.Error())
 				}
 			}
+			if batchSinks > 0 {
+				sm.batch.Add(view)
+			}
+		}
+
+		batchToTheSinks := func() {
+			// Send all metrics received in this iteration to the batch sinks
+			if sm.batch.Len() == 0 {
+				return
+			}
+			for _, s := range sm.sinks {
+				if b, ok := s.(BatchSink); ok {
+					if err := b.WriteBatch(sm.batch); err != nil {
+						cclog.ComponentError("SinkManager", "WRITE", s.Name(), "batch write failed:", err.Error())
+					}
+				}
+			}
+			sm.batch.Reset()
 		}
 
+		// Pass the current time to the message processors of the sinks in
+		// this goroutine, so tick does not run concurrently with Write
+		ticker := time.NewTicker(SINK_TICK_INTERVAL)
+		defer ticker.Stop()
+
 		for {
 			select {
 			case <-sm.done:
 				done()
 				return
 
+			case now := <-ticker.C:
+				for _, s := range sm.sinks {
+					if t, ok := s.(tickSink); ok {
+						if err := t.tick(now); err != nil {
+							cclog.ComponentError("SinkManager", "TICK", s.Name(), "write failed:", err.Error())
+						}
+					}
+				}
+
 			case p := <-sm.input:
 				toTheSinks(p)
 				for i := 0; len(sm.input) > 0 && i < sm.maxForward; i++ {
 					p := <-sm.input
 					toTheSinks(p)
 				}
+				batchToTheSinks()
 			}
 		}
 	}()
@@ -134,6 +210,13 @@ func (sm *sinkManager) Start() {
 	cclog.ComponentDebug("SinkManager", "STARTED")
 }
 
+// SetValidator enables the validation of all messages before they are
+// written to the sinks. The validator counts the invalid messages and drops
+// them if it rejects them. Must be called before Start().
+func (sm *sinkManager) SetValidator(v *lp.Validator) {
+	sm.validator = v
+}
+
 // AddInput adds the input channel to the sink manager
 func (sm *sinkManager) AddInput(input chan lp.CCMessage) {
 	sm.input = input
@@ -0,0 +1,265 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+	mp "github.com/ClusterCockpit/cc-lib/messageProcessor"
+)
+
+// testSink processes the messages in the background, like sinks with
+// flush timers do, and records the results
+type testSink struct {
+	sink
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	written []lp.CCMessage
+	errors  []string
+}
+
+func (s *testSink) Write(point lp.CCMessageView) error {
+	if _, ok := point.(lp.CCMessage); ok {
+		return fmt.Errorf("sink got writable message")
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		msg, err := s.mp.ProcessMessage(point)
+		if err != nil {
+			s.addError(err.Error())
+			return
+		}
+		msg.AddTag("sink", s.name)
+		msg.AddField("value", 2.0)
+		for k := range point.AllTags() {
+			if k == "sink" {
+				s.addError("tag added by other sink")
+			}
+		}
+		s.lock.Lock()
+		s.written = append(s.written, msg)
+		s.lock.Unlock()
+	}()
+	return nil
+}
+
+func (s *testSink) addError(err string) {
+	s.lock.Lock()
+	s.errors = append(s.errors, err)
+	s.lock.Unlock()
+}
+
+func (s *testSink) Flush() error {
+	return nil
+}
+
+func (s *testSink) Close() {
+	s.wg.Wait()
+}
+
+func TestSinkManagerMultipleSinks(t *testing.T) {
+	testSinks := make(map[string]*testSink)
+	var lock sync.Mutex
+	AvailableSinks["test"] = func(name string, config json.RawMessage) (Sink, error) {
+		s := new(testSink)
+		s.name = name
+		p, err := mp.NewMessageProcessor()
+		if err != nil {
+			return nil, err
+		}
+		s.mp = p
+		s.mp.AddMoveMetaToTags("true", "unit", "unit")
+		lock.Lock()
+		testSinks[name] = s
+		lock.Unlock()
+		return s, nil
+	}
+	defer delete(AvailableSinks, "test")
+
+	var wg sync.WaitGroup
+	sm, err := New(&wg, json.RawMessage(`{"a": {"type": "test"}, "b": {"type": "test"}, "c": {"type": "test"}}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input := make(chan lp.CCMessage, 10)
+	sm.AddInput(input)
+	sm.Start()
+
+	const numMessages = 100
+	sent := make([]lp.CCMessage, 0, numMessages)
+	for i := 0; i < numMessages; i++ {
+		m, err := lp.NewMessage(
+			"test",
+			map[string]string{"type": "node", "hostname": "myhost"},
+			map[string]string{"unit": "B"},
+			map[string]interface{}{"value": float64(i)},
+			time.Now(),
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sent = append(sent, m)
+		input <- m
+		// Read the message while the sinks use it
+		_ = m.String()
+	}
+	// Wait until the sink manager processed all messages
+	for len(input) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sm.Close()
+	wg.Wait()
+
+	for i, m := range sent {
+		if m.HasTag("sink") || m.HasTag("unit") || !m.HasMeta("unit") {
+			t.Errorf("message %d was modified by a sink: %s", i, m.String())
+		}
+		if v, _ := m.GetField("value"); v != float64(i) {
+			t.Errorf("message %d: field changed from %v to %v", i, float64(i), v)
+		}
+	}
+	for name, s := range testSinks {
+		for _, err := range s.errors {
+			t.Errorf("sink %s: %s", name, err)
+		}
+		if len(s.written) != numMessages {
+			t.Errorf("sink %s: expected %d messages, got %d", name, numMessages, len(s.written))
+		}
+		for _, m := range s.written {
+			if v, _ := m.GetTag("sink"); v != name {
+				t.Errorf("sink %s: message has tag sink=%s", name, v)
+			}
+			if !m.HasTag("unit") {
+				t.Errorf("sink %s: message processor did not move meta to tag: %s", name, m.String())
+			}
+		}
+	}
+}
+
+// testBatchSink records the messages of all batches
+type testBatchSink struct {
+	sink
+	written []lp.CCMessage
+	writes  int
+}
+
+func (s *testBatchSink) Write(point lp.CCMessageView) error {
+	s.writes++
+	return nil
+}
+
+func (s *testBatchSink) WriteBatch(batch *lp.Batch) error {
+	for _, msg := range batch.All() {
+		s.written = append(s.written, msg.Mutable())
+	}
+	return nil
+}
+
+func (s *testBatchSink) Flush() error {
+	return nil
+}
+
+func (s *testBatchSink) Close() {}
+
+func TestSinkManagerBatchSink(t *testing.T) {
+	var bs *testBatchSink
+	AvailableSinks["testbatch"] = func(name string, config json.RawMessage) (Sink, error) {
+		bs = new(testBatchSink)
+		bs.name = name
+		return bs, nil
+	}
+	defer delete(AvailableSinks, "testbatch")
+
+	var wg sync.WaitGroup
+	sm, err := New(&wg, json.RawMessage(`{"a": {"type": "testbatch"}}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input := make(chan lp.CCMessage, 10)
+	sm.AddInput(input)
+	sm.Start()
+
+	const numMessages = 100
+	for i := 0; i < numMessages; i++ {
+		m, err := lp.NewMessage(
+			"test",
+			map[string]string{"type": "node", "hostname": "myhost"},
+			map[string]string{"unit": "B"},
+			map[string]interface{}{"value": float64(i)},
+			time.Unix(int64(i), 0),
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		input <- m
+	}
+	// Wait until the sink manager processed all messages
+	for len(input) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sm.Close()
+	wg.Wait()
+
+	if bs.writes > 0 {
+		t.Errorf("Write called %d times for batch sink", bs.writes)
+	}
+	if len(bs.written) != numMessages {
+		t.Fatalf("expected %d messages, got %d", numMessages, len(bs.written))
+	}
+	for i, m := range bs.written {
+		if v, _ := m.GetField("value"); v != float64(i) || m.Time().Unix() != int64(i) {
+			t.Errorf("message %d: unexpected message %s", i, m.String())
+		}
+	}
+}
+
+func TestSinkManagerValidation(t *testing.T) {
+	var bs *testBatchSink
+	AvailableSinks["testbatch"] = func(name string, config json.RawMessage) (Sink, error) {
+		bs = new(testBatchSink)
+		bs.name = name
+		return bs, nil
+	}
+	defer delete(AvailableSinks, "testbatch")
+
+	var wg sync.WaitGroup
+	sm, err := New(&wg, json.RawMessage(`{"a": {"type": "testbatch"}}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v := &lp.Validator{Reject: true}
+	sm.SetValidator(v)
+	input := make(chan lp.CCMessage, 10)
+	sm.AddInput(input)
+	sm.Start()
+
+	const numMessages = 10
+	for i := 0; i < numMessages; i++ {
+		tags := map[string]string{"type": "node", "hostname": "myhost"}
+		if i%2 == 1 {
+			delete(tags, "hostname")
+		}
+		m, err := lp.NewMetric("test", tags, nil, float64(i), time.Now())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		input <- m
+	}
+	for len(input) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sm.Close()
+	wg.Wait()
+
+	if len(bs.written) != numMessages/2 || v.Invalid() != numMessages/2 {
+		t.Errorf("expected %d valid and invalid messages, got %d and %d", numMessages/2, len(bs.written), v.Invalid())
+	}
+}
@@ -10,8 +10,8 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
-	//	"time"
 	cclog "github.com/ClusterCockpit/cc-lib/ccLogger"
 	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
 	mp "github.com/ClusterCockpit/cc-lib/messageProcessor"
@@ -26,17 +26,29 @@ type StdoutSink struct {
 	}
 }
 
-func (s *StdoutSink) Write(m lp.CCMessage) error {
+func (s *StdoutSink) Write(m lp.CCMessageView) error {
 	msg, err := s.mp.ProcessMessage(m)
 	if err == nil && msg != nil {
-		fmt.Fprint(
-			s.output,
-			msg.ToLineProtocol(s.meta_as_tags),
-		)
+		s.write(msg)
 	}
+	return writeMessages(s.mp.PendingMessages(), s.write)
+}
+
+// write prints the processed message
+func (s *StdoutSink) write(msg lp.CCMessage) error {
+	fmt.Fprint(
+		s.output,
+		msg.ToLineProtocol(s.meta_as_tags),
+	)
 	return nil
 }
 
+// tick prints the messages generated by the message processor
+func (s *StdoutSink) tick(now time.Time) error {
+	s.mp.Tick(now)
+	return writeMessages(s.mp.PendingMessages(), s.write)
+}
+
 func (s *StdoutSink) Flush() error {
 	s.output.Sync()
 	return nil
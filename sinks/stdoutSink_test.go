@@ -0,0 +1,103 @@
+// Copyright (C) NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved. This file is part of cc-lib.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lp "github.com/ClusterCockpit/cc-lib/ccMessage"
+)
+
+// newTestStdoutSink creates a stdout sink writing to a file with the message
+// processor configuration
+func newTestStdoutSink(t *testing.T, processMessages string) (*StdoutSink, string) {
+	output := filepath.Join(t.TempDir(), "out.txt")
+	config := fmt.Sprintf(`{"type": "stdout", "output_file": %q, "process_messages": %s}`, output, processMessages)
+	s, err := NewStdoutSink("test", json.RawMessage(config))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return s.(*StdoutSink), output
+}
+
+// readLines closes the sink and returns the lines it wrote
+func readLines(t *testing.T, s *StdoutSink, output string) []string {
+	s.Close()
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestStdoutSinkSplitFields(t *testing.T) {
+	s, output := newTestStdoutSink(t, `{"split_fields": [{"if": "name == 'mem'"}]}`)
+
+	m, err := lp.NewMessage(
+		"mem",
+		map[string]string{"type": "node", "hostname": "myhost"},
+		nil,
+		map[string]interface{}{"used": 1.0, "free": 2.0},
+		time.Unix(10, 0),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := s.Write(lp.ReadOnly(m)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lines := readLines(t, s, output)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 split metrics, got %d: %v", len(lines), lines)
+	}
+	for _, name := range []string{"mem_free", "mem_used"} {
+		found := false
+		for _, l := range lines {
+			if strings.HasPrefix(l, name+",") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("split metric %s not written: %v", name, lines)
+		}
+	}
+}
+
+func TestStdoutSinkTick(t *testing.T) {
+	s, output := newTestStdoutSink(t,
+		`{"aggregate": [{"if": "name == 'cpu_load'", "scope": "node", "window": "10s", "delay": "1s", "functions": ["sum"], "drop_input": true}]}`)
+
+	for i := 0; i < 2; i++ {
+		m, err := lp.NewMetric(
+			"cpu_load",
+			map[string]string{"type": "hwthread", "type-id": fmt.Sprint(i), "hostname": "myhost"},
+			nil,
+			1.0,
+			time.Unix(100, 0),
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := s.Write(lp.ReadOnly(m)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// The time window is closed by tick, which writes the aggregated metric
+	if err := s.tick(time.Unix(200, 0)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lines := readLines(t, s, output)
+	if len(lines) != 1 || !strings.Contains(lines[0], "value=2") {
+		t.Fatalf("expected the aggregated metric, got %v", lines)
+	}
+}